@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"go.uber.org/zap"
+)
+
+// archive-agent serves archive requests on a Unix socket, so that the archive module in
+// contrib/archive_module (or anything else speaking the protocol) doesn't have to fork a new process for
+// each WAL segment. The protocol is line based: for each request, a client sends
+//
+//	ARCHIVE <path to the WAL segment>\n
+//
+// and the agent replies, once the segment is safely archived (or it failed to), with one of
+//
+//	OK\n
+//	ERROR <message>\n
+//
+// Clients may send any number of requests over the same connection, one at a time. Relative paths are
+// relative to the data directory (i.e., the working directory of the archiver process).
+func (a *app) archiveAgent() int {
+	// a previous run may have been killed before it had a chance to clean up
+	if err := os.Remove(*a.agentSocket); err != nil && !os.IsNotExist(err) {
+		a.logger.Error("Failed to remove stale agent socket", zap.Error(err))
+		return exitFailure
+	}
+	listener, err := net.Listen("unix", *a.agentSocket)
+	if err != nil {
+		a.logger.Error("Failed to create the agent socket", zap.Error(err))
+		return exitFailure
+	}
+	defer listener.Close()
+	// anyone who can connect can make us upload any file we can read
+	if err := os.Chmod(*a.agentSocket, 0600); err != nil {
+		a.logger.Error("Failed to restrict access to the agent socket", zap.Error(err))
+		return exitFailure
+	}
+
+	// stop accepting requests once the command gives up (e.g., on SIGTERM)
+	go func() {
+		<-a.ctx.Done()
+		listener.Close()
+	}()
+
+	a.logger.Info("Serving archive requests", zap.String("socket", *a.agentSocket))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if a.ctx.Err() != nil {
+				a.logger.Info("Stopped serving archive requests")
+				return 0
+			}
+			a.logger.Error("Failed to accept connection", zap.Error(err))
+			return exitFailure
+		}
+		go a.serveArchiveRequests(conn)
+	}
+}
+
+func (a *app) serveArchiveRequests(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply := a.handleArchiveRequest(scanner.Text())
+		if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+			a.logger.Error("Failed to reply to archive request", zap.Error(err))
+			return
+		}
+	}
+}
+
+// return the reply to the request line
+func (a *app) handleArchiveRequest(line string) string {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 || fields[0] != "ARCHIVE" || fields[1] == "" {
+		return "ERROR malformed request"
+	}
+
+	walFullPath := fields[1]
+	if !filepath.IsAbs(walFullPath) {
+		walFullPath = filepath.Join(*a.pgDataDirectory, walFullPath)
+	}
+
+	begin := time.Now()
+	if err := a.archiveSegment(walFullPath); err != nil {
+		a.logger.Error("Failed to archive WAL segment", zap.String("WAL", walFullPath), zap.Error(err))
+		// the message ends up in the server log, it must fit in one line
+		return "ERROR " + strings.ReplaceAll(err.Error(), "\n", " ")
+	}
+	a.logger.Debug(
+		"Finished archiving WAL segment",
+		zap.String("WAL", walFullPath),
+		zap.Duration("duration", time.Now().Sub(begin)))
+
+	return "OK"
+}
+
+func parseArchiveAgentArgs(cfg *app, parser *argparse.Command) {
+	cfg.agentSocket = parser.String(
+		"",
+		"socket",
+		&argparse.Options{
+			Required: len(os.Args) > 1 && os.Args[1] == "archive-agent",
+			Help:     "Path to the Unix socket to serve archive requests on"})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// directory (in the WAL directory) where PostgreSQL keeps a .ready file for each segment waiting to be
+	// archived, renamed to .done once archive_command succeeds
+	archiveStatusDirectory = "archive_status"
+	// directory (in the WAL directory) with an empty file for each segment archived by --batch ahead of
+	// PostgreSQL asking for it, so that archive-wal can return right away when it does
+	archivedAheadDirectory = ".pgcarpenter-archived"
+)
+
+// return true iff the segment at walFullPath was archived ahead of time by a previous archive-wal --batch;
+// the record is removed, as PostgreSQL won't ask again once told the segment is archived
+func (a *app) archivedAhead(walFullPath string) bool {
+	marker := filepath.Join(filepath.Dir(walFullPath), archivedAheadDirectory, filepath.Base(walFullPath))
+	if _, err := os.Stat(marker); err != nil {
+		return false
+	}
+	if err := os.Remove(marker); err != nil {
+		a.logger.Warn("Failed to remove archived ahead record", zap.String("path", marker), zap.Error(err))
+	}
+
+	return true
+}
+
+// archive (concurrently) up to --batch - 1 segments waiting to be archived, other than the one at
+// walFullPath, the oldest first, and record each one archived so that archive-wal returns right away when
+// PostgreSQL asks for it; failures are left for PostgreSQL to retry
+func (a *app) archiveAhead(walFullPath string) {
+	walDir := filepath.Dir(walFullPath)
+	ready, err := readySegments(walDir)
+	if err != nil {
+		a.logger.Warn("Failed to list WAL segments waiting to be archived", zap.Error(err))
+		return
+	}
+	pending := make([]string, 0, *a.archiveBatch)
+	for _, name := range ready {
+		if len(pending) == *a.archiveBatch-1 {
+			break
+		}
+		if name == filepath.Base(walFullPath) {
+			continue
+		}
+		// already archived ahead, but PostgreSQL hasn't asked for it yet
+		if _, err := os.Stat(filepath.Join(walDir, archivedAheadDirectory, name)); err == nil {
+			continue
+		}
+		pending = append(pending, name)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(walDir, archivedAheadDirectory), 0700); err != nil {
+		a.logger.Warn("Failed to create the archived ahead directory", zap.Error(err))
+		return
+	}
+
+	a.logger.Debug("Archiving WAL segments ahead", zap.Strings("segments", pending))
+	wg := &sync.WaitGroup{}
+	for _, name := range pending {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := a.archiveSegment(filepath.Join(walDir, name)); err != nil {
+				a.logger.Warn("Failed to archive WAL segment ahead", zap.String("segment", name), zap.Error(err))
+				return
+			}
+			marker := filepath.Join(walDir, archivedAheadDirectory, name)
+			if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+				a.logger.Warn("Failed to record archived ahead segment", zap.String("segment", name), zap.Error(err))
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+// return the names of the files in the WAL directory waiting to be archived (as told by their .ready
+// files), sorted so that segments come in the order they were written
+func readySegments(walDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(walDir, archiveStatusDirectory))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".ready") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".ready"))
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
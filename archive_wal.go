@@ -1,12 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"syscall"
 	"time"
 
 	"github.com/akamensky/argparse"
 	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/storage"
 	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 )
@@ -22,25 +28,33 @@ func (a *app) archiveWAL() int {
 	walFullPath, err := a.getWALFullPath(*a.walPath)
 	if err != nil {
 		a.logger.Error("Failed to get the full path to the WAL segment", zap.Error(err))
-		return 1
+		return exitFailure
 	}
-	// object key (based on the file name, without the path, including the LZ4 extension)
-	key := a.getWALObjectKey(walFullPath)
-	// compress the WAL segment -- on a random sample of 256 WAL segments the file size was reduced to ~4.5MB, i.e.,
-	// ~27% the original size (16MB)
-	compressedWal, err := util.Compress(walFullPath, *a.tmpDirectory)
-	if err != nil {
-		a.logger.Error("Failed to compress WAL segment", zap.Error(err))
-		return 1
-	}
-	// upload the compressed file
-	err = a.storage.Put(key, compressedWal, 0)
-	// regardless of whether or not the upload operation was successful, remove the compressed file
-	util.MustRemoveFile(compressedWal, a.logger)
-	// return non-zero on error
-	if err != nil {
-		a.logger.Error("Failed to upload WAL segment", zap.Error(err))
-		return 1
+	// wal-uploader takes it from there
+	if *a.spoolDirectory != "" {
+		if err := a.spoolSegment(walFullPath); err != nil {
+			a.logger.Error("Failed to spool WAL segment", zap.Error(err))
+			return exitFailure
+		}
+		a.logger.Debug("Spooled WAL segment", zap.String("WAL", *a.walPath))
+		return 0
+	}
+	if *a.archiveBatch > 1 {
+		if a.archivedAhead(walFullPath) {
+			a.logger.Debug("WAL segment already archived ahead", zap.String("WAL", *a.walPath))
+			return 0
+		}
+		// the segments waiting to be archived are archived along with the one requested
+		done := make(chan struct{})
+		go func() {
+			a.archiveAhead(walFullPath)
+			close(done)
+		}()
+		defer func() { <-done }()
+	}
+	if err := a.archiveSegment(walFullPath); err != nil {
+		a.logger.Error("Failed to archive WAL segment", zap.Error(err))
+		return exitCode(err, exitStorage)
 	}
 
 	a.logger.Debug(
@@ -51,6 +65,123 @@ func (a *app) archiveWAL() int {
 	return 0
 }
 
+// compress and upload the WAL segment at walFullPath; timeline history files (e.g., 00000002.history) and
+// backup history files are archived the same way, as restore-wal needs them to follow timeline switches
+func (a *app) archiveSegment(walFullPath string) (err error) {
+	begin := time.Now()
+	defer func() { a.recordWALArchiveMetrics(err, time.Now().Sub(begin)) }()
+
+	// make sure we can read the WAL segment before doing anything else; a permission problem would otherwise
+	// only surface as a generic compression failure
+	if err := checkReadable(walFullPath); err != nil {
+		return fmt.Errorf("cannot read WAL segment: %w", err)
+	}
+	// object key (based on the file name, without the path, including the LZ4 extension)
+	key := a.getWALObjectKey(walFullPath)
+	// a truncated or corrupted segment would otherwise only be found out about during recovery
+	if err := validateWALFile(walFullPath, filepath.Base(walFullPath), *a.checkWALPages); err != nil {
+		return fmt.Errorf("invalid WAL segment: %w", err)
+	}
+	kind := walFileKind(filepath.Base(walFullPath))
+
+	// the checksum of the segment is stored with it, to tell whether a segment archived again is the same
+	checksum, err := util.Checksum(walFullPath, walChecksumAlgorithm)
+	if err != nil {
+		return fmt.Errorf("failed to checksum WAL segment: %w", err)
+	}
+	archived, err := a.checkArchivedSegment(key, checksum, kind == walPartialSegmentFile)
+	if err != nil {
+		return err
+	}
+	// e.g., the archiver was restarted after uploading the segment, but before it was told so
+	if archived {
+		a.logger.Info("WAL segment already archived with the same contents", zap.String("WAL", walFullPath))
+		return nil
+	}
+
+	// compress the WAL segment as it's uploaded -- on a random sample of 256 WAL segments the file size was
+	// reduced to ~4.5MB, i.e., ~27% the original size (16MB)
+	st, err := os.Stat(walFullPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL segment: %w", err)
+	}
+	metadata := storage.Metadata{Checksum: checksum, Size: st.Size()}
+	compression := a.walCompressOptions()
+	if _, err := a.putFile(key, walFullPath, metadata, &compression, util.ChecksumNone); err != nil {
+		return fmt.Errorf("failed to upload WAL segment: %w", err)
+	}
+
+	// the segment is safely archived at this point, a failure here is not worth failing archive_command over
+	if err := a.recordArchiveFingerprint(); err != nil {
+		a.logger.Warn("Failed to record archive settings fingerprint", zap.Error(err))
+	}
+	if err := a.recordLastArchived(walFullPath); err != nil {
+		a.logger.Warn("Failed to record the last archived WAL segment", zap.Error(err))
+	}
+
+	return nil
+}
+
+// return true iff the segment (with the given checksum) has already been archived as key; if a different
+// segment was archived under the same name, something is seriously wrong (e.g., two primaries archiving
+// to the same bucket, or a standby promoted without a new timeline) and it must not be overwritten, unless
+// it's a partial segment (e.g., by pg_receivewal), which keeps growing until it's complete
+func (a *app) checkArchivedSegment(key string, checksum string, partial bool) (bool, error) {
+	metadata, err := a.storage.GetMetadata(a.ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check whether the WAL segment was already archived: %w", err)
+	}
+
+	// segments archived by older versions of pgCarpenter have no checksum to compare with, the archived
+	// segment itself is checksummed instead
+	if metadata.Checksum == "" {
+		a.logger.Info("Checksumming archived WAL segment with no checksum", zap.String("key", key))
+		metadata.Checksum, err = a.archivedChecksum(key)
+		if err != nil {
+			return false, fmt.Errorf("failed to checksum the WAL segment already archived: %w", err)
+		}
+	}
+	if metadata.Checksum == checksum {
+		return true, nil
+	}
+	if partial {
+		a.logger.Info("Overwriting archived partial WAL segment", zap.String("key", key))
+		return false, nil
+	}
+
+	err = fmt.Errorf(
+		"a different WAL segment was already archived as %s (checksum %s, this one is %s); is another "+
+			"server archiving to the same bucket?",
+		key, metadata.Checksum, checksum)
+	a.notify(notify.Event{
+		Operation: "archive-wal",
+		Host:      notify.Hostname(),
+		Start:     time.Now(),
+		Error:     err.Error(),
+	})
+
+	return false, withExitCode(exitValidation, err)
+}
+
+// download and decompress the archived segment to compute its checksum
+func (a *app) archivedChecksum(key string) (string, error) {
+	compressed, err := a.downloadWAL(key)
+	if err != nil {
+		return "", err
+	}
+	defer util.MustRemoveFile(compressed, a.logger)
+	decompressed := util.TrimCompressionExtension(compressed)
+	if err := util.Decompress(compressed, decompressed); err != nil {
+		return "", err
+	}
+	defer util.MustRemoveFile(decompressed, a.logger)
+
+	return util.Checksum(decompressed, walChecksumAlgorithm)
+}
+
 func (a *app) getWALFullPath(wal string) (string, error) {
 	// the path name PG passes along for the WAL segment is relative to the current working directory
 	cwd, err := os.Getwd()
@@ -62,12 +193,88 @@ func (a *app) getWALFullPath(wal string) (string, error) {
 	return filepath.Join(cwd, wal), nil
 }
 
+// return an error if the file path can't be opened for reading; on permission errors, the
+// message includes everything needed to fix it: the file's mode and owner, and who we're running as
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err == nil {
+		return f.Close()
+	}
+	if !os.IsPermission(err) {
+		return err
+	}
+
+	msg := fmt.Sprintf("permission denied reading %s as euid=%d egid=%d", path, os.Geteuid(), os.Getegid())
+	st, statErr := os.Stat(path)
+	if statErr != nil {
+		// we may not even be allowed to traverse the parent directory
+		return fmt.Errorf("%s (failed to stat file: %v)", msg, statErr)
+	}
+	msg = fmt.Sprintf("%s; file mode is %s", msg, st.Mode())
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		msg = fmt.Sprintf("%s, owned by uid=%d gid=%d", msg, sys.Uid, sys.Gid)
+	}
+
+	return errors.New(msg)
+}
+
+// kinds of files archive-wal is given: archive_command is called with segments, and timeline and backup
+// history files; pg_receivewal (and promotion) leave partial segments behind
+const (
+	walSegmentFile         = iota // 000000010000000000000003
+	walPartialSegmentFile         // 000000010000000000000003.partial
+	walBackupHistoryFile          // 000000010000000000000003.00000028.backup
+	walTimelineHistoryFile        // 00000002.history
+	walUnknownFile
+)
+
+var (
+	walPartialSegmentRE      = regexp.MustCompile(`^[0-9A-F]{24}\.partial$`)
+	walBackupHistoryFileRE   = regexp.MustCompile(`^[0-9A-F]{24}\.[0-9A-F]{8}\.backup$`)
+	walTimelineHistoryFileRE = regexp.MustCompile(`^[0-9A-F]{8}\.history$`)
+)
+
+// return the kind of file (one of the wal*File constants above) by its name
+func walFileKind(name string) int {
+	switch {
+	case walSegmentRE.MatchString(name):
+		return walSegmentFile
+	case walPartialSegmentRE.MatchString(name):
+		return walPartialSegmentFile
+	case walBackupHistoryFileRE.MatchString(name):
+		return walBackupHistoryFile
+	case walTimelineHistoryFileRE.MatchString(name):
+		return walTimelineHistoryFile
+	}
+
+	return walUnknownFile
+}
+
+// WAL segments are always checksummed (regardless of --checksum-algorithm, which only applies to backups)
+// so that archiving a segment again can tell whether it's the same; they're small, so this is cheap
+const walChecksumAlgorithm = util.ChecksumXXH3
+
 // create the object's key from the filename + LZ4 extension
 func (a *app) getWALObjectKey(walPath string) string {
 	return filepath.Join(walFolder, filepath.Base(walPath)+lz4.Extension)
 }
 
 func parseArchiveWALArgs(cfg *app, parser *argparse.Command) {
-	// there are no options as of now, we just keep this around for consistency
-	// (and easy maintenance/future-proof?)
+	cfg.checkWALPages = boolFlag(
+		parser,
+		"",
+		"check-pages",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Check the page headers of WAL segments before archiving them, not just their names and sizes"})
+	cfg.archiveBatch = parser.Int(
+		"",
+		"batch",
+		&argparse.Options{
+			Required: false,
+			Default:  1,
+			Help: "Archive up to this many WAL segments concurrently: the one requested, and the oldest ones " +
+				"waiting to be archived (in " + archiveStatusDirectory + "), which archive-wal then returns " +
+				"right away for"})
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/storage"
+)
+
+// storage backends register themselves with the storage package, for a URL scheme, from a file behind
+// a build tag (e.g., storage_s3.go, left out with -tags nos3) so that binaries can be built without the
+// dependencies of the backends they don't need; third-party backends can be compiled in the same way
+
+// storage operations are retried (see --storage-retries) with a backoff that doubles up to this
+const maxStorageRetryBackoff = 30 * time.Second
+
+// return the URL of the storage: --storage-url, or the S3 bucket given by the --s3-* flags
+func (a *app) storageLocation() string {
+	if *a.storageURL != "" {
+		return *a.storageURL
+	}
+
+	query := url.Values{}
+	// otherwise, the bucket's region is looked up
+	if a.s3RegionGiven() {
+		query.Set("region", *a.s3Region)
+	}
+	if *a.s3RequestPayer != "" {
+		query.Set("request_payer", *a.s3RequestPayer)
+	}
+	query.Set("part_size_mb", strconv.Itoa(*a.s3PartSize))
+	query.Set("concurrency", strconv.Itoa(*a.s3Concurrency))
+	u := url.URL{Scheme: "s3", Host: *a.s3Bucket, RawQuery: query.Encode()}
+
+	return u.String()
+}
+
+// return true iff --s3-region was given (on the command line, or in the environment), rather than defaulted
+func (a *app) s3RegionGiven() bool {
+	_, inEnv := os.LookupEnv(flagEnvName("s3-region"))
+
+	return flagGiven("s3-region") || inEnv
+}
+
+// return the URL of folder in the storage (e.g., s3://bucket/backup_name/), without the backend settings
+func (a *app) folderLocation(folder string) string {
+	u, err := url.Parse(a.storageLocation())
+	if err != nil {
+		return folder
+	}
+	u.RawQuery = ""
+	u.Path = path.Join("/", u.Path, folder)
+	if u.Path != "/" {
+		u.Path += "/"
+	}
+
+	return u.String()
+}
+
+// set up the storage backend
+func (a *app) setupStorage() error {
+	backend, err := storage.Open(
+		a.storageLocation(),
+		storage.Options{
+			Logger:          a.logger,
+			UserAgent:       a.userAgent(),
+			MaxRetries:      *a.s3MaxRetries,
+			MaxUploadRate:   int64(*a.maxUploadRate),
+			MaxDownloadRate: int64(*a.maxDownloadRate),
+			SlowStart:       *a.slowStart,
+		})
+	if err != nil {
+		return err
+	}
+	a.storage = storage.WithRetries(
+		backend,
+		storage.RetryPolicy{
+			Retries:    *a.storageRetries,
+			Backoff:    time.Duration(*a.storageRetryBackoff) * time.Millisecond,
+			MaxBackoff: maxStorageRetryBackoff,
+			Timeout:    time.Duration(*a.storageOpTimeout) * time.Second,
+		},
+		a.logger)
+
+	return nil
+}
+
+func validateS3PartSize(args []string) error {
+	// S3 doesn't take smaller parts (but the last), nor larger ones
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 5 || n > 5*1024 {
+		return fmt.Errorf("part size ('%s') must be between 5 and 5120 (MB)", args[0])
+	}
+
+	return nil
+}
+
+func validateS3Concurrency(args []string) error {
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 1 {
+		return fmt.Errorf("concurrency ('%s') must be a positive integer", args[0])
+	}
+
+	return nil
+}
+
+func validateStorageRetries(args []string) error {
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 0 {
+		return fmt.Errorf("storage retries ('%s') must be a non-negative integer", args[0])
+	}
+
+	return nil
+}
+
+func validateStorageRetryBackoff(args []string) error {
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 1 {
+		return fmt.Errorf("storage retry backoff ('%s') must be a positive integer (milliseconds)", args[0])
+	}
+
+	return nil
+}
+
+func validateStorageOpTimeout(args []string) error {
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 0 {
+		return fmt.Errorf("storage operation timeout ('%s') must be a non-negative integer (seconds)", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"go.uber.org/zap"
+)
+
+// backupInfo is everything known about a backup, as printed by backup-info --json
+type backupInfo struct {
+	Name       string            `json:"name"`
+	Location   string            `json:"location"`
+	Successful bool              `json:"successful"`
+	Aborted    bool              `json:"aborted,omitempty"`
+	StartTime  time.Time         `json:"start_time"`
+	StopTime   time.Time         `json:"stop_time"`
+	Duration   time.Duration     `json:"duration_ns,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	StoredSize int64             `json:"stored_size,omitempty"`
+	Files      int64             `json:"files,omitempty"`
+	StartLSN   string            `json:"start_lsn,omitempty"`
+	StopLSN    string            `json:"stop_lsn,omitempty"`
+	StartWAL   string            `json:"start_wal_file,omitempty"`
+	StopWAL    string            `json:"stop_wal_file,omitempty"`
+	PGVersion  int               `json:"pg_version"`
+	Standby    bool              `json:"from_standby"`
+	Host       string            `json:"host,omitempty"`
+	Comment    string            `json:"comment,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Notes      []string          `json:"notes,omitempty"`
+}
+
+// show what the manifest of a backup says about it, including the WAL needed to make it consistent; backups
+// are always full backups, so there's no parent backup to show
+func (a *app) backupInfo() int {
+	if *a.backupName == latestKey {
+		latest, err := a.resolveLatest()
+		if err != nil {
+			a.logger.Error("Failed to resolve the reference to LATEST", zap.Error(err))
+			return exitCode(err, exitStorage)
+		}
+		*a.backupName = latest
+	}
+
+	m, err := a.getManifest(*a.backupName)
+	if err != nil {
+		a.logger.Error("Failed to get the manifest of the backup", zap.String("name", *a.backupName), zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+	successful, err := a.storage.Exists(a.ctx, a.getSuccessfulMarker(m.Name))
+	if err != nil {
+		a.logger.Error("Failed to check whether the backup was successful", zap.String("name", m.Name), zap.Error(err))
+		return exitStorage
+	}
+	info := backupInfo{
+		Name:       m.Name,
+		Location:   a.folderLocation(m.Name),
+		Successful: successful,
+		Aborted:    m.Aborted,
+		StartTime:  m.StartTime,
+		StopTime:   m.StopTime,
+		Duration:   m.Duration,
+		Size:       m.Size,
+		StoredSize: m.StoredSize,
+		Files:      m.Files,
+		StartLSN:   m.StartLSN,
+		StopLSN:    m.StopLSN,
+		StartWAL:   m.StartWALFile,
+		StopWAL:    m.StopWALFile,
+		PGVersion:  m.PGVersion,
+		Standby:    m.FromStandby,
+		Host:       m.Host,
+		Comment:    m.Comment,
+		Labels:     m.Labels,
+		Notes:      m.Notes,
+	}
+
+	if *a.infoJSON {
+		contents, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			a.logger.Error("Failed to encode the backup info", zap.Error(err))
+			return exitFailure
+		}
+		fmt.Println(string(contents))
+		return 0
+	}
+
+	fmt.Printf("Name:             %s %s\n", info.Name, formatStatus(info.Successful, info.Aborted))
+	fmt.Printf("Location:         %s\n", info.Location)
+	fmt.Printf("Started:          %s\n", info.StartTime.Format(time.RFC3339))
+	fmt.Printf("Stopped:          %s\n", info.StopTime.Format(time.RFC3339))
+	fmt.Printf("Duration:         %s\n", formatDuration(info.Duration))
+	fmt.Printf("Size:             %s (%d files)\n", formatSize(info.Size), info.Files)
+	fmt.Printf("Stored size:      %s\n", formatSize(info.StoredSize))
+	fmt.Printf("Host:             %s\n", info.Host)
+	if info.Standby {
+		fmt.Printf("PostgreSQL:       %d (taken from a standby)\n", info.PGVersion)
+	} else {
+		fmt.Printf("PostgreSQL:       %d\n", info.PGVersion)
+	}
+	fmt.Printf("Start LSN:        %s\n", info.StartLSN)
+	fmt.Printf("Stop LSN:         %s\n", info.StopLSN)
+	fmt.Printf("WAL needed:       %s\n", formatWALRange(m))
+	if info.Comment != "" || len(info.Labels) > 0 {
+		fmt.Printf("Description:      %s\n", formatDescription(info.Comment, info.Labels))
+	}
+	for _, note := range info.Notes {
+		fmt.Printf("Note:             %s\n", note)
+	}
+
+	return 0
+}
+
+func parseBackupInfoArgs(cfg *app, parser *argparse.Command) {
+	cfg.infoJSON = boolFlag(
+		parser,
+		"",
+		"json",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Print the details of the backup as JSON"})
+}
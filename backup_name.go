@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/notify"
+)
+
+// --backup-name auto is short for this template
+const (
+	backupNameAuto         = "auto"
+	backupNameAutoTemplate = "{{.Timestamp}}"
+)
+
+// e.g., 20240131T021500Z: sortable, unique (unless backups are started within the same second), and
+// made of characters backupNameRE allows
+const backupNameTimestampFormat = "20060102T150405Z"
+
+// characters in the host name that backupNameRE doesn't allow
+var notInBackupNameRE = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// what templates of backup names (e.g., nightly-{{.Timestamp}}) can refer to
+type backupNameFields struct {
+	// when the backup started, in UTC (see backupNameTimestampFormat)
+	Timestamp string
+	// e.g., 20240131
+	Date string
+	// the host taking the backup, with any characters not allowed in backup names replaced by -
+	Host string
+}
+
+// return true iff name is to be expanded into the name of the backup, rather than the name itself
+func isBackupNameTemplate(name string) bool {
+	return name == backupNameAuto || strings.Contains(name, "{{")
+}
+
+// return the name of the backup generated from the template (or auto) at time t
+func expandBackupName(name string, t time.Time) (string, error) {
+	if name == backupNameAuto {
+		name = backupNameAutoTemplate
+	}
+	tmpl, err := template.New("backup-name").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", err
+	}
+
+	t = t.UTC()
+	fields := backupNameFields{
+		Timestamp: t.Format(backupNameTimestampFormat),
+		Date:      t.Format("20060102"),
+		Host:      notInBackupNameRE.ReplaceAllString(notify.Hostname(), "-"),
+	}
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+
+	expanded := buf.String()
+	if !regexp.MustCompile(backupNameRE).MatchString(expanded) {
+		return "", fmt.Errorf("backup name ('%s', generated from '%s') does not match '%s'", expanded, name, backupNameRE)
+	}
+	if expanded == latestKey {
+		return "", errors.New("backup name can't be " + latestKey)
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// causes (see context.Cause) of the command giving up
+var (
+	errInterrupted = errors.New("interrupted")
+	errTimedOut    = errors.New("timed out (see --timeout)")
+)
+
+// commands run by PostgreSQL as restore_command and archive_command, which tells them being stopped (e.g.,
+// on shutdown) apart from failing by them dying of the signal, so they don't catch any
+var diesOfSignals = map[string]bool{"restore-wal": true, "archive-wal": true}
+
+// how long bookkeeping that must happen even once the command gave up (e.g., releasing its lock) may take
+const cleanupTimeout = 30 * time.Second
+
+// set up the context the command gives up with (see app.ctx): on --timeout, or when interrupted; a second
+// signal quits right away. The returned function releases its resources
+func (a *app) setupContext() context.CancelFunc {
+	ctx, interrupt := context.WithCancelCause(context.Background())
+	if !diesOfSignals[os.Args[1]] {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			a.logger.Warn("Interrupted, giving up (signal again to quit right away)", zap.String("signal", sig.String()))
+			interrupt(fmt.Errorf("%w by %s", errInterrupted, sig))
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+		}()
+	}
+
+	cancel := func() { interrupt(nil) }
+	// the daemon never gives up, the commands it runs do
+	if *a.timeout > 0 && os.Args[1] != "daemon" {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, time.Duration(*a.timeout)*time.Second, errTimedOut)
+		cancel = func() {
+			cancelTimeout()
+			interrupt(nil)
+		}
+	}
+	a.ctx = ctx
+
+	return cancel
+}
+
+// return why the command gave up (e.g., interrupted by a signal), or nil if it hasn't
+func (a *app) givenUp() error {
+	return context.Cause(a.ctx)
+}
+
+// return a context for bookkeeping that must happen even once the command gave up, and its cancel function
+func (a *app) cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(a.ctx), cleanupTimeout)
+}
+
+// wait for d, or until the command gives up; return false iff it gave up
+func (a *app) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-a.ctx.Done():
+		return false
+	}
+}
+
+// return a command that's sent SIGTERM (rather than killed) once the command running it gives up, so that
+// it can give up cleanly as well
+func (a *app) commandContext(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(a.ctx, name, args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+
+	return cmd
+}
+
+// put keys in keysC, in order, until the command gives up
+func (a *app) sendKeys(keys []string, keysC chan<- string) error {
+	for _, key := range keys {
+		select {
+		case keysC <- key:
+		case <-a.ctx.Done():
+			return a.ctx.Err()
+		}
+	}
+
+	return nil
+}
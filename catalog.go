@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/storage"
+	"go.uber.org/zap"
+)
+
+// the catalog of backups keeps what list-backups shows about every backup (and delete-backup picks the ones
+// to delete by) as one JSON object per backup (catalog/<name>.json), so that it takes listing the root of the
+// bucket and getting one object per backup, rather than looking up the marker and manifest of every backup.
+// Each entry is only ever written by the command creating (or deleting) that one backup, so that commands
+// running at the same time (e.g., create-backup and delete-backup) can't undo each other's updates, as they
+// would if the catalog were a single object that's read, modified, and written back. Which backups exist is
+// still told by the listing: entries of backups that no longer exist are ignored, and backups without one
+// (e.g., taken by older versions of pgCarpenter, or whose entry failed to be written) are looked up, and
+// their entry written for next time. LATEST is still the reference to the latest successful backup.
+const catalogFolder = "catalog"
+
+// the catalog used to be a single object, which repair-markers removes
+const legacyCatalogKey = "catalog.json"
+
+// catalogEntry is what list-backups shows about a backup
+type catalogEntry struct {
+	Name string `json:"name"`
+	// when the backup was started, as the modification time of its folder (in seconds since the epoch)
+	Created    int64 `json:"created"`
+	Successful bool  `json:"successful"`
+	Aborted    bool  `json:"aborted,omitempty"`
+	// the rest is taken from the manifest, if the backup has one
+	Comment      string            `json:"comment,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	Duration     time.Duration     `json:"duration_ns,omitempty"`
+	StartWALFile string            `json:"start_wal_file,omitempty"`
+	StopWALFile  string            `json:"stop_wal_file,omitempty"`
+}
+
+// return the key of the catalog entry of the backup
+func catalogEntryKey(name string) string {
+	return path.Join(catalogFolder, name+".json")
+}
+
+// return true iff the folder at the root of the bucket is a backup, rather than one of the folders used to
+// mark successful backups, keep manifests, WAL segments, archive settings, locks, and the catalog in
+func isBackupFolder(name string) bool {
+	switch name {
+	case successfullyCompletedFolder, manifestFolder, walFolder, archiversFolder, locksFolder, catalogFolder:
+		return false
+	}
+
+	return true
+}
+
+// return the names of all backups, as found by listing the root of the bucket
+func (a *app) listBackupNames() ([]string, error) {
+	keys, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if name := strings.TrimSuffix(k, "/"); isBackupFolder(name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// return the entries of all backups, from the catalog, looking up (and cataloging) the backups missing from it
+func (a *app) catalogEntries() ([]catalogEntry, error) {
+	names, err := a.listBackupNames()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]catalogEntry, 0, len(names))
+	for _, name := range names {
+		e, err := a.getCatalogEntry(name)
+		if err == nil {
+			entries = append(entries, e)
+			continue
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			a.logger.Warn("Failed to get the catalog entry, looking up the backup instead", zap.String("name", name), zap.Error(err))
+		}
+		if e, err = a.lookUpCatalogEntry(name); err != nil {
+			return nil, err
+		}
+		if err := a.putCatalogEntry(e); err != nil {
+			a.logger.Warn("Failed to catalog backup", zap.String("name", name), zap.Error(err))
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// return the entries of all backups, by looking up each backup (rather than trusting the catalog)
+func (a *app) listCatalogEntries() ([]catalogEntry, error) {
+	names, err := a.listBackupNames()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]catalogEntry, 0, len(names))
+	for _, name := range names {
+		e, err := a.lookUpCatalogEntry(name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// return the entry of the backup, as found in storage
+func (a *app) lookUpCatalogEntry(name string) (catalogEntry, error) {
+	e := catalogEntry{Name: name}
+	// unknown if it can't be told
+	if mtime, err := a.storage.GetLastModifiedTime(a.ctx, name+"/"); err == nil {
+		e.Created = mtime
+	}
+	successful, err := a.storage.Exists(a.ctx, a.getSuccessfulMarker(name))
+	if err != nil {
+		return e, err
+	}
+	e.Successful = successful
+	// backups taken by older versions of pgCarpenter don't have one
+	if m, err := a.getManifest(name); err == nil {
+		e.Aborted = !successful && m.Aborted
+		e.Comment = m.Comment
+		e.Labels = m.Labels
+		e.Size = m.Size
+		e.Duration = m.Duration
+		e.StartWALFile = m.StartWALFile
+		e.StopWALFile = m.StopWALFile
+	}
+
+	return e, nil
+}
+
+func (a *app) getCatalogEntry(name string) (catalogEntry, error) {
+	e := catalogEntry{}
+	contents, err := a.storage.GetString(a.ctx, catalogEntryKey(name))
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal([]byte(contents), &e); err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+func (a *app) putCatalogEntry(e catalogEntry) error {
+	contents, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return a.storage.PutString(a.ctx, catalogEntryKey(e.Name), string(contents))
+}
+
+// add (or refresh) the entry of the backup in the catalog; failing to is logged, but otherwise ignored
+func (a *app) catalogBackup(name string) {
+	e, err := a.lookUpCatalogEntry(name)
+	if err == nil {
+		err = a.putCatalogEntry(e)
+	}
+	if err != nil {
+		a.logger.Error("Failed to catalog backup", zap.String("name", name), zap.Error(err))
+		a.uncatalogBackup(name)
+	}
+}
+
+// remove the entries of the backups from the catalog; failing to is logged, but otherwise ignored
+func (a *app) uncatalogBackups(names []string) {
+	for _, name := range names {
+		a.uncatalogBackup(name)
+	}
+}
+
+// remove the entry of the backup from the catalog, so that the backup is looked up instead (if it still
+// exists) rather than an entry that's gone stale being trusted
+func (a *app) uncatalogBackup(name string) {
+	// even once the command gave up, as it's what keeps the catalog from going stale
+	ctx, cancel := a.cleanupContext()
+	defer cancel()
+	if err := a.storage.Delete(ctx, catalogEntryKey(name)); err != nil {
+		a.logger.Error("Failed to remove the catalog entry, it may be stale (see repair-markers)", zap.String("name", name), zap.Error(err))
+	}
+}
+
+// replace the catalog with the entries of all backups, as found in storage, removing the entries of the
+// backups that no longer exist (and the legacy catalog)
+func (a *app) rebuildCatalog() error {
+	entries, err := a.listCatalogEntries()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, e := range entries {
+		if err := a.putCatalogEntry(e); err != nil {
+			return err
+		}
+		exists[catalogEntryKey(e.Name)] = true
+	}
+
+	keys, err := a.listKeys(catalogFolder + "/")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if exists[k] {
+			continue
+		}
+		if err := a.storage.Delete(a.ctx, k); err != nil {
+			return err
+		}
+	}
+	if exists, err := a.storage.Exists(a.ctx, legacyCatalogKey); err != nil || !exists {
+		return err
+	}
+
+	return a.storage.Delete(a.ctx, legacyCatalogKey)
+}
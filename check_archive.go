@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// exit statuses of check-archive, as expected by Nagios (and compatible monitoring systems, e.g., Sensu)
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+// archiveLag is how far behind archiving is: the files waiting to be archived (i.e., with a .ready file in
+// archive_status), and how long the oldest one has been waiting
+type archiveLag struct {
+	segments int
+	oldest   string
+	age      time.Duration
+}
+
+// report how far behind archiving is, in a single line, with an exit status depending on the thresholds
+// given; the last segment in storage is reported too, for context
+func (a *app) checkArchive() int {
+	lag, err := a.getArchiveLag()
+	if err != nil {
+		fmt.Printf("ARCHIVE UNKNOWN - failed to inspect archive_status: %s\n", err)
+		return checkUnknown
+	}
+
+	status, label := checkOK, "OK"
+	switch {
+	case exceeds(lag.segments, *a.criticalSegments) || exceeds(int(lag.age.Seconds()), *a.criticalSeconds):
+		status, label = checkCritical, "CRITICAL"
+	case exceeds(lag.segments, *a.warningSegments) || exceeds(int(lag.age.Seconds()), *a.warningSeconds):
+		status, label = checkWarning, "WARNING"
+	}
+
+	msg := fmt.Sprintf("ARCHIVE %s - %d files waiting to be archived", label, lag.segments)
+	if lag.segments > 0 {
+		msg += fmt.Sprintf(", oldest %s for %s", lag.oldest, lag.age.Round(time.Second))
+	}
+	if last, err := a.getLastArchived(); err == nil {
+		msg += fmt.Sprintf("; last archived %s %s ago", last.Segment, time.Now().Sub(last.Time).Round(time.Second))
+	} else {
+		msg += "; last archived segment unknown"
+	}
+	// performance data
+	fmt.Printf("%s | segments=%d;%d;%d seconds=%d;%d;%d\n", msg, lag.segments, *a.warningSegments,
+		*a.criticalSegments, int(lag.age.Seconds()), *a.warningSeconds, *a.criticalSeconds)
+
+	return status
+}
+
+// true iff the threshold is enabled (i.e., positive) and value is above it
+func exceeds(value int, threshold int) bool {
+	return threshold > 0 && value > threshold
+}
+
+// return how far behind archiving is, by looking at the .ready files PostgreSQL keeps in archive_status
+// for each file waiting to be archived
+func (a *app) getArchiveLag() (archiveLag, error) {
+	lag := archiveLag{}
+	version, err := pgMajorVersion(*a.pgDataDirectory)
+	if err != nil {
+		return lag, err
+	}
+	walDir := filepath.Join(*a.pgDataDirectory, walDirectory(version))
+	ready, err := readySegments(walDir)
+	if err != nil {
+		return lag, err
+	}
+	lag.segments = len(ready)
+	if len(ready) == 0 {
+		return lag, nil
+	}
+
+	// segments are sorted in the order they were written, so the first one has been waiting the longest
+	lag.oldest = ready[0]
+	st, err := os.Stat(filepath.Join(walDir, archiveStatusDirectory, ready[0]+".ready"))
+	if err != nil {
+		return lag, err
+	}
+	lag.age = time.Now().Sub(st.ModTime())
+
+	return lag, nil
+}
+
+func parseCheckArchiveArgs(cfg *app, parser *argparse.Command) {
+	cfg.warningSegments = parser.Int(
+		"",
+		"warning-segments",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Warn if more than this many files are waiting to be archived (0 disables it)"})
+	cfg.criticalSegments = parser.Int(
+		"",
+		"critical-segments",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Critical if more than this many files are waiting to be archived (0 disables it)"})
+	cfg.warningSeconds = parser.Int(
+		"",
+		"warning-seconds",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Warn if a file has been waiting to be archived for more than this many seconds (0 disables it)"})
+	cfg.criticalSeconds = parser.Int(
+		"",
+		"critical-seconds",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help: "Critical if a file has been waiting to be archived for more than this many seconds " +
+				"(0 disables it)"})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"go.uber.org/zap"
+)
+
+// files a restored data directory can't do without
+var filesThatMustBeRestored = []string{"PG_VERSION", "global/pg_control"}
+
+// backups are only as good as the last restore test: restore the backup (LATEST by default) to a scratch
+// directory, check the result, and record it in the backup's verification history; with --every, keep
+// doing it periodically (e.g., on a sidecar host)
+func (a *app) checkRestore() int {
+	backupName := *a.backupName
+	if backupName == "" {
+		backupName = latestKey
+	}
+
+	for {
+		rc := a.checkRestoreOnce(backupName)
+		if *a.checkEvery <= 0 {
+			return rc
+		}
+		a.logger.Info("Waiting for the next restore test", zap.Int("seconds", *a.checkEvery))
+		if !a.sleep(time.Duration(*a.checkEvery) * time.Second) {
+			return rc
+		}
+	}
+}
+
+func (a *app) checkRestoreOnce(backupName string) int {
+	// LATEST is resolved by the restore, and may point to a different backup next time
+	*a.backupName = backupName
+	begin := time.Now()
+
+	scratch, err := ioutil.TempDir(*a.tmpDirectory, "pgCarpenter.check-restore.")
+	if err != nil {
+		a.logger.Error("Failed to create scratch directory", zap.Error(err))
+		return exitFailure
+	}
+	if !*a.keepRestore {
+		defer func() {
+			if err := os.RemoveAll(scratch); err != nil {
+				a.logger.Error("Failed to remove scratch directory", zap.Error(err))
+			}
+		}()
+	}
+
+	// everything is restored inside the scratch directory, nothing must leak to wherever the backed up
+	// cluster kept its tablespaces or the targets of its symlinks
+	*a.pgDataDirectory = filepath.Join(scratch, "data") + "/"
+	a.tablespaceRoot = filepath.Join(scratch, "tablespaces")
+	*a.materializeSymlinks = true
+
+	a.logger.Info("Starting restore test", zap.String("name", backupName), zap.String("path", scratch))
+	var restoreErr error
+	rc := a.restoreBackup()
+	if rc != 0 {
+		restoreErr = fmt.Errorf("restore-backup exited with %d", rc)
+	} else if restoreErr = checkRestoredFiles(*a.pgDataDirectory); restoreErr != nil {
+		rc = exitValidation
+	}
+	v := verification{
+		Time:     begin,
+		Host:     notify.Hostname(),
+		Method:   "check-restore",
+		Success:  restoreErr == nil,
+		Duration: time.Now().Sub(begin),
+	}
+	if restoreErr != nil {
+		v.Error = restoreErr.Error()
+	}
+
+	// by now, LATEST has been resolved to the name of the backup that was actually restored
+	if err := a.recordVerification(*a.backupName, v); err != nil {
+		a.logger.Error("Failed to record the result of the restore test", zap.Error(err))
+	}
+
+	if restoreErr != nil {
+		a.logger.Error("Restore test failed", zap.String("name", *a.backupName), zap.Error(restoreErr))
+		return rc
+	}
+	a.logger.Info(
+		"Restore test passed",
+		zap.String("name", *a.backupName),
+		zap.Duration("seconds", v.Duration))
+
+	return 0
+}
+
+// return an error if any of the files a data directory can't do without is missing
+func checkRestoredFiles(dataDirectory string) error {
+	for _, f := range filesThatMustBeRestored {
+		if _, err := os.Stat(filepath.Join(dataDirectory, f)); err != nil {
+			return fmt.Errorf("missing %s in the restored data directory: %w", f, err)
+		}
+	}
+
+	return nil
+}
+
+// append v to the verification history in the backup's manifest, and log how long it's been since the
+// backup was last verified successfully
+func (a *app) recordVerification(backupName string, v verification) error {
+	manifest, err := a.getManifest(backupName)
+	if err != nil {
+		return errors.New("backups taken by older versions of pgCarpenter don't have a manifest to record it in")
+	}
+	manifest.Verifications = append(manifest.Verifications, v)
+	if err := a.putManifest(manifest); err != nil {
+		return err
+	}
+
+	if last := lastSuccessfulVerification(manifest); last != nil {
+		a.logger.Info(
+			"Last successful restore test",
+			zap.String("name", backupName),
+			zap.Time("time", last.Time),
+			zap.Duration("age", time.Now().Sub(last.Time)))
+	} else {
+		a.logger.Warn("Backup has never been successfully restored", zap.String("name", backupName))
+	}
+
+	return nil
+}
+
+// return the most recent successful verification of the backup, or nil if there's none
+func lastSuccessfulVerification(manifest *backupManifest) *verification {
+	for i := len(manifest.Verifications) - 1; i >= 0; i-- {
+		if manifest.Verifications[i].Success {
+			return &manifest.Verifications[i]
+		}
+	}
+
+	return nil
+}
+
+func parseCheckRestoreArgs(cfg *app, parser *argparse.Command) {
+	cfg.checkEvery = parser.Int(
+		"",
+		"every",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Repeat the restore test every this many seconds (0 means run it once)"})
+	cfg.keepRestore = boolFlag(
+		parser,
+		"",
+		"keep",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Keep the restored data directory (in --tmp) for inspection"})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"go.uber.org/zap"
+)
+
+// settings read from the (optional) JSON configuration file passed with --config; these
+// are meant for site-specific tweaks that would be cumbersome to pass on the command line
+type config struct {
+	// prefixes (relative to the data directory) of files not to backup, on top of prefixesNotToBackup
+	ExcludePrefixes []string `json:"exclude_prefixes"`
+	// directories (relative to the data directory) that must exist after a restore, on top
+	// of directoriesThatMustExist
+	RequiredDirectories []string `json:"required_directories"`
+	// commands run by daemon, on cron-style schedules
+	Schedules []scheduledJob `json:"schedules"`
+}
+
+// scheduledJob is a pgCarpenter command (e.g., create-backup) run by daemon
+type scheduledJob struct {
+	Name string `json:"name"`
+	// e.g., 0 2 * * * for every day at 2am (see schedule.Parse)
+	Cron string `json:"cron"`
+	// the command and its flags, e.g., ["create-backup", "--backup-name", "auto"]; flags common to all
+	// commands (e.g., --s3-bucket) given to daemon are passed on
+	Args []string `json:"args"`
+	// wait up to this many seconds (at random) before running the command, so that hosts sharing a
+	// schedule don't all hit storage at once
+	JitterSeconds int `json:"jitter_seconds,omitempty"`
+	// run the command again (after RetryDelaySeconds) up to this many times if it fails
+	Retries           int `json:"retries,omitempty"`
+	RetryDelaySeconds int `json:"retry_delay_seconds,omitempty"`
+}
+
+// read the configuration file, if one was provided, into the app struct
+func (a *app) loadConfig() error {
+	a.config = &config{}
+	if *a.configFile == "" {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(*a.configFile)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(contents, a.config); err != nil {
+		return err
+	}
+	a.logger.Debug("Loaded configuration file", zap.String("path", *a.configFile))
+
+	return nil
+}
@@ -0,0 +1,249 @@
+/*
+ * pgcarpenter_archive: a PostgreSQL (15+) archive module that hands WAL segments over to a running
+ * `pgCarpenter archive-agent`, instead of forking `pgCarpenter archive-wal` for each one.
+ *
+ * See README.md for the protocol spoken with the agent.
+ */
+#include "postgres.h"
+
+#include <sys/socket.h>
+#include <sys/time.h>
+#include <sys/un.h>
+#include <unistd.h>
+
+#include "fmgr.h"
+#include "utils/guc.h"
+
+#if PG_VERSION_NUM >= 160000
+#include "archive/archive_module.h"
+#else
+#include "postmaster/pgarch.h"
+#endif
+
+PG_MODULE_MAGIC;
+
+/* longest reply we expect from the agent, including the error message */
+#define REPLY_MAX 1024
+
+static char *agent_socket = NULL;
+static int	agent_timeout = 300;
+
+/* connection to the agent, kept open across segments */
+static int	agent_fd = -1;
+
+static void
+disconnect_agent(void)
+{
+	if (agent_fd >= 0)
+		close(agent_fd);
+	agent_fd = -1;
+}
+
+static bool
+connect_agent(void)
+{
+	struct sockaddr_un addr;
+	struct timeval timeout;
+
+	if (agent_fd >= 0)
+		return true;
+
+	if (strlen(agent_socket) >= sizeof(addr.sun_path))
+	{
+		ereport(WARNING,
+				(errmsg("pgcarpenter_archive.socket is too long: \"%s\"", agent_socket)));
+		return false;
+	}
+
+	agent_fd = socket(AF_UNIX, SOCK_STREAM, 0);
+	if (agent_fd < 0)
+	{
+		ereport(WARNING, (errcode_for_socket_access(), errmsg("could not create socket: %m")));
+		return false;
+	}
+
+	/* uploading a segment may take a while, but not forever */
+	timeout.tv_sec = agent_timeout;
+	timeout.tv_usec = 0;
+	setsockopt(agent_fd, SOL_SOCKET, SO_RCVTIMEO, &timeout, sizeof(timeout));
+	setsockopt(agent_fd, SOL_SOCKET, SO_SNDTIMEO, &timeout, sizeof(timeout));
+
+	memset(&addr, 0, sizeof(addr));
+	addr.sun_family = AF_UNIX;
+	strlcpy(addr.sun_path, agent_socket, sizeof(addr.sun_path));
+	if (connect(agent_fd, (struct sockaddr *) &addr, sizeof(addr)) < 0)
+	{
+		ereport(WARNING,
+				(errcode_for_socket_access(),
+				 errmsg("could not connect to pgCarpenter agent at \"%s\": %m", agent_socket)));
+		disconnect_agent();
+		return false;
+	}
+
+	return true;
+}
+
+static bool
+send_all(const char *buf, size_t len)
+{
+	while (len > 0)
+	{
+		ssize_t		n = send(agent_fd, buf, len, 0);
+
+		if (n < 0)
+		{
+			if (errno == EINTR)
+				continue;
+			return false;
+		}
+		buf += n;
+		len -= n;
+	}
+
+	return true;
+}
+
+/* read a line (without the trailing newline) into reply */
+static bool
+receive_line(char *reply, size_t size)
+{
+	size_t		len = 0;
+
+	while (len < size - 1)
+	{
+		ssize_t		n = recv(agent_fd, reply + len, 1, 0);
+
+		if (n < 0 && errno == EINTR)
+			continue;
+		if (n <= 0)
+			return false;
+		if (reply[len] == '\n')
+		{
+			reply[len] = '\0';
+			return true;
+		}
+		len++;
+	}
+
+	return false;
+}
+
+static bool
+archive_segment(const char *file, const char *path)
+{
+	char	   *absolute;
+	char	   *request;
+	char		reply[REPLY_MAX];
+	bool		ok;
+
+	if (!connect_agent())
+		return false;
+
+	/* the archiver runs in the data directory, the agent may not */
+	absolute = make_absolute_path(path);
+	request = psprintf("ARCHIVE %s\n", absolute);
+	free(absolute);
+
+	ok = send_all(request, strlen(request)) && receive_line(reply, sizeof(reply));
+	pfree(request);
+	if (!ok)
+	{
+		ereport(WARNING,
+				(errcode_for_socket_access(),
+				 errmsg("lost connection to pgCarpenter agent while archiving \"%s\": %m", file)));
+		/* start over with a new connection on the next attempt */
+		disconnect_agent();
+		return false;
+	}
+
+	if (strcmp(reply, "OK") == 0)
+		return true;
+
+	ereport(WARNING,
+			(errmsg("pgCarpenter agent failed to archive \"%s\"", file),
+			 errdetail("%s", strncmp(reply, "ERROR ", 6) == 0 ? reply + 6 : reply)));
+
+	return false;
+}
+
+#if PG_VERSION_NUM >= 160000
+
+static bool
+pgcarpenter_check_configured(ArchiveModuleState *state)
+{
+	return agent_socket != NULL && agent_socket[0] != '\0';
+}
+
+static bool
+pgcarpenter_archive_file(ArchiveModuleState *state, const char *file, const char *path)
+{
+	return archive_segment(file, path);
+}
+
+static void
+pgcarpenter_shutdown(ArchiveModuleState *state)
+{
+	disconnect_agent();
+}
+
+static const ArchiveModuleCallbacks callbacks = {
+	.startup_cb = NULL,
+	.check_configured_cb = pgcarpenter_check_configured,
+	.archive_file_cb = pgcarpenter_archive_file,
+	.shutdown_cb = pgcarpenter_shutdown
+};
+
+const ArchiveModuleCallbacks *
+_PG_archive_module_init(void)
+{
+	return &callbacks;
+}
+
+#else
+
+static bool
+pgcarpenter_check_configured(void)
+{
+	return agent_socket != NULL && agent_socket[0] != '\0';
+}
+
+static void
+pgcarpenter_shutdown(void)
+{
+	disconnect_agent();
+}
+
+void
+_PG_archive_module_init(ArchiveModuleCallbacks *cb)
+{
+	cb->check_configured_cb = pgcarpenter_check_configured;
+	cb->archive_file_cb = archive_segment;
+	cb->shutdown_cb = pgcarpenter_shutdown;
+}
+
+#endif
+
+void
+_PG_init(void)
+{
+	DefineCustomStringVariable("pgcarpenter_archive.socket",
+							   "Path to the Unix socket of pgCarpenter archive-agent.",
+							   NULL,
+							   &agent_socket,
+							   "",
+							   PGC_SIGHUP,
+							   0,
+							   NULL, NULL, NULL);
+	DefineCustomIntVariable("pgcarpenter_archive.timeout",
+							"Seconds to wait for the agent to archive a segment.",
+							NULL,
+							&agent_timeout,
+							300,
+							1,
+							INT_MAX,
+							PGC_SIGHUP,
+							GUC_UNIT_S,
+							NULL, NULL, NULL);
+
+	MarkGUCPrefixReserved("pgcarpenter_archive");
+}
@@ -1,59 +1,320 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/akamensky/argparse"
 	_ "github.com/lib/pq"
 	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/storage"
 	"github.com/thumbtack/pgCarpenter/util"
+	"github.com/thumbtack/pgCarpenter/walker"
 	"go.uber.org/zap"
 )
 
-// there's no point on taking backups of directories like log or pg_xlog
-var prefixesNotToBackup = []string{"log", "pg_xlog", "postmaster.pid", "pg_replslot"}
+// there's no point on taking backups of directories like log or pg_xlog (pg_wal as of PG 10)
+var prefixesNotToBackup = []string{"log", "pg_xlog", "pg_wal", "postmaster.pid", "pg_replslot"}
+
+// files and directories that PostgreSQL either recreates on startup or that are of no use to (or would
+// even confuse) a restored cluster; same as pg_basebackup (see excludeDirContents and excludeFiles in basebackup.c)
+var (
+	// the directories themselves are kept, but not their contents
+	transientDirectories = []string{"pg_dynshmem", "pg_notify", "pg_serial", "pg_snapshots", "pg_stat_tmp", "pg_subtrans"}
+	// relative to the root of the data directory
+	transientFiles = []string{"postmaster.opts", "current_logfiles", "postgresql.auto.conf.tmp"}
+	// anywhere in the data directory
+	transientFileNames = []string{"pg_internal.init"}
+	// temporary files and directories (e.g., base/pgsql_tmp) are named with this prefix
+	transientPrefix = "pgsql_tmp"
+)
+
+// uploaded last (see uploadFiles)
+const pgControlFile = "global/pg_control"
+
+// files (relative to the data directory) whose contents are returned by pg_stop_backup, and never
+// uploaded from the data directory
+var stopBackupFiles = []string{"backup_label", "tablespace_map"}
+
+// returned by uploadFiles when the backup took longer than --max-duration
+var errMaxDurationExceeded = errors.New("backup exceeded the maximum duration")
+
+// values of --unreadable-files
+const (
+	unreadableFilesFail = "fail"
+	unreadableFilesSkip = "skip-with-warning"
+)
+
+// values of --on-error
+const (
+	onErrorAbort    = "abort"
+	onErrorRetry    = "retry"
+	onErrorContinue = "continue"
+)
+
+// how many files may be waiting between the walk and the filter (see uploadFiles); just paths, and their stat
+const uploadQueueSize = 1024
+
+// a file (relative to the data directory) on its way to be uploaded
+type backupFile struct {
+	path string
+	info os.FileInfo
+}
+
+// number of files that made it through each stage of uploadFiles (updated atomically)
+type uploadCounts struct {
+	found      int64 // by the walk, and not ignored
+	vanished   int64 // removed before they could be uploaded
+	unreadable int64 // see --unreadable-files
+	reused     int64 // already uploaded by the interrupted run of the backup being resumed
+	uploaded   int64
+}
+
+// with --on-error=retry, how many more times uploading a file is attempted (backing off exponentially
+// between attempts) before aborting the backup
+const uploadRetries = 5
+
+// returned by stopBackup when the connection that started the (non-exclusive) backup is gone, in
+// which case PostgreSQL has already aborted the backup
+var errBackupAborted = errors.New("connection that started the backup was lost, PostgreSQL aborted the backup")
 
 func (a *app) createBackup() int {
-	a.logger.Info("Preparing to start backup", zap.String("name", *a.backupName))
 	begin := time.Now()
+	if isBackupNameTemplate(*a.backupName) {
+		name, err := expandBackupName(*a.backupName, begin)
+		if err != nil {
+			a.logger.Error("Failed to generate the name of the backup", zap.Error(err))
+			return exitUsage
+		}
+		*a.backupName = name
+	}
+	a.logger.Info("Preparing to start backup", zap.String("name", *a.backupName))
+
+	stopProgress := a.startProgress("create-backup")
+	// e.g., to quiesce applications or snapshot a volume; the backup isn't taken if it fails
+	items := 0
+	err := a.runHook("pre-backup", *a.preBackupCmd, hookEnv{name: *a.backupName, status: "started"})
+	if err == nil {
+		items, err = a.runBackup()
+	}
+	stopProgress()
+	a.progress.Finished(err)
+
+	env := hookEnv{
+		name:     *a.backupName,
+		status:   hookStatus(err),
+		err:      err,
+		files:    a.progress.Files(),
+		bytes:    a.progress.Bytes(),
+		duration: time.Now().Sub(begin),
+	}
+	if err := a.runHook("post-backup", *a.postBackupCmd, env); err != nil {
+		a.logger.Error("Failed to run post-backup hook", zap.Error(err))
+	}
+	a.recordBackupMetrics(err, time.Now().Sub(begin))
+	event := notify.Event{
+		Operation:  "create-backup",
+		BackupName: *a.backupName,
+		Host:       notify.Hostname(),
+		Success:    err == nil,
+		Start:      begin,
+		Duration:   time.Now().Sub(begin),
+		Files:      items,
+		Bytes:      a.progress.Bytes(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	a.notify(event)
+
+	if err != nil {
+		if errors.Is(err, errBackupAborted) {
+			a.logger.Error("Backup was aborted by PostgreSQL (was the server restarted?)", zap.Error(err))
+		} else {
+			a.logger.Error("Backup failed", zap.String("name", *a.backupName), zap.Error(err))
+		}
+		return exitCode(err, exitFailure)
+	}
+
+	a.logger.Info(
+		"Backup successfully completed",
+		zap.String("name", *a.backupName),
+		zap.Int("files", items),
+		zap.Int64("bytes", a.manifest.Size),
+		zap.Int64("stored_bytes", a.manifest.StoredSize),
+		zap.Float64("compression_ratio", compressionRatio(a.manifest.Size, a.manifest.StoredSize)),
+		zap.Float64("bytes_per_second", a.manifest.throughput()),
+		zap.Int("workers", a.manifest.Workers),
+		zap.Duration("seconds", time.Now().Sub(begin)),
+	)
+
+	return 0
+}
 
+// take the backup; return the number of files uploaded
+func (a *app) runBackup() (int, error) {
 	backupKey := *a.backupName + "/"
 
-	// don't allow existing backups to be overwritten
-	_, err := a.storage.GetString(backupKey)
-	if err == nil {
-		a.logger.Error("A backup with the same name already exists", zap.String("backup_name", *a.backupName))
-		return 1
+	if err := a.loadExcludePatterns(); err != nil {
+		return 0, fmt.Errorf("failed to load exclude patterns: %w", err)
+	}
+
+	// two backups of the same cluster at the same time would step on each other's toes
+	unlock, err := a.lockBackup()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	// don't allow existing backups to be overwritten, unless we've been asked to resume one
+	exists, err := a.storage.Exists(a.ctx, backupKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check whether the backup already exists: %w", err)
+	}
+	if exists && !*a.resume {
+		return 0, fmt.Errorf("a backup with the same name already exists: %s", *a.backupName)
+	}
+
+	if exists {
+		// there's nothing to resume if the backup was successfully completed
+		completed, err := a.storage.Exists(a.ctx, a.getSuccessfulMarker(*a.backupName))
+		if err != nil {
+			return 0, fmt.Errorf("failed to check whether the backup was already completed: %w", err)
+		}
+		if completed {
+			return 0, fmt.Errorf("backup already successfully completed: %s", *a.backupName)
+		}
+		a.logger.Info("Resuming backup", zap.String("name", *a.backupName))
+		a.uploadedKeys, err = a.listUploadedKeys()
+		if err != nil {
+			return 0, fmt.Errorf("failed to list the files uploaded by the interrupted backup: %w", err)
+		}
+		a.logger.Info("Found files uploaded by the interrupted backup", zap.Int("files", len(a.uploadedKeys)))
+		// the checksums of the files it uploaded are in its manifest (if it got to write one)
+		if m, err := a.getManifest(*a.backupName); err == nil {
+			a.resumedChecksums = m.Checksums
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			a.logger.Warn("Failed to get the manifest of the interrupted backup", zap.Error(err))
+		}
+	} else {
+		// create the top level "folder" so that the object actually exists and
+		// has all the relevant metadata like timestamps
+		if err := a.storage.PutString(a.ctx, backupKey, ""); err != nil {
+			return 0, fmt.Errorf("failed to create top-level backup folder: %w", err)
+		}
+		// so that it's listed (and can be deleted) even if it never completes
+		a.catalogBackup(*a.backupName)
+	}
+	// once it's completed (or has failed)
+	defer a.catalogBackup(*a.backupName)
+
+	a.manifest = &backupManifest{
+		Name:               *a.backupName,
+		StartTime:          time.Now(),
+		Host:               notify.Hostname(),
+		PGUser:             *a.pgUser,
+		PGCarpenterVersion: version,
+		Comment:            *a.comment,
+		Labels:             parseLabels(*a.labels),
+	}
+	if u, err := user.Current(); err == nil {
+		a.manifest.OSUser = u.Username
+	}
+	if identifier, ok := a.storage.(storage.Identifier); ok {
+		if identity, err := identifier.Identity(a.ctx); err == nil {
+			a.manifest.Identity = identity
+		}
+	}
+	if *a.maxDuration > 0 {
+		a.deadline = a.manifest.StartTime.Add(time.Duration(*a.maxDuration) * time.Second)
+	}
+
+	a.manifest.DataDirectory, err = a.logicalDataDirectory()
+	if err != nil {
+		return 0, err
+	}
+	a.manifest.Tablespaces, err = findTablespaces(*a.pgDataDirectory)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find tablespaces: %w", err)
 	}
 
-	// create the top level "folder" so that the object actually exists and
-	// has all the relevant metadata like timestamps
-	if err := a.storage.PutString(backupKey, ""); err != nil {
-		a.logger.Error("Failed to create top-level backup folder", zap.Error(err))
-		return 1
+	w, err := a.newWalker()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the list of files to backup: %w", err)
 	}
 
 	// tell PG we're starting a base backup, copy all the file, tell PG we're done
 	db, err := a.startBackup()
 	if err != nil {
-		a.logger.Error("Failed to start backup", zap.Error(err))
-		return 1
+		return 0, withExitCode(exitPostgreSQL, fmt.Errorf("failed to start backup: %w", err))
 	}
 
 	// copy all files to remote storage
-	items := a.uploadFiles()
+	items, uploadErr := a.uploadFiles(w)
 
 	// tell PG we're done copying the data directory, save the tablespace map and backup label files
+	// (even if uploading failed, so that PG doesn't have to wait for the connection to be closed)
 	if err := a.stopBackup(db); err != nil {
-		a.logger.Error("Failed to stop backup", zap.Error(err))
-		return 1
+		return items, withExitCode(exitPostgreSQL, fmt.Errorf("failed to stop backup: %w", err))
+	}
+
+	a.manifest.StopTime = time.Now()
+	a.manifest.Size = a.progress.Bytes()
+	a.manifest.Files = a.progress.Files()
+	a.manifest.StoredSize = atomic.LoadInt64(&a.storedBytes)
+	a.manifest.Duration = a.manifest.StopTime.Sub(a.manifest.StartTime)
+	a.manifest.Workers = *a.nWorkers
+	if len(a.manifest.SkippedFiles) > 0 {
+		a.manifest.Notes = append(
+			a.manifest.Notes,
+			fmt.Sprintf("%d files were not backed up because they couldn't be read (see skipped_files in the manifest)",
+				len(a.manifest.SkippedFiles)))
+	}
+	if a.failedUploads > 0 {
+		a.manifest.Notes = append(
+			a.manifest.Notes,
+			fmt.Sprintf("%d files failed to upload, the backup is incomplete (see skipped_files in the manifest)",
+				a.failedUploads))
+	}
+	if uploadErr != nil {
+		a.manifest.Aborted = true
+		a.manifest.AbortReason = uploadErr.Error()
+	}
+	if a.givenUp() != nil {
+		a.manifest.Notes = append(
+			a.manifest.Notes,
+			"the backup was interrupted, it's incomplete (create-backup --resume picks up where it left off, "+
+				"delete-backup removes it)")
+	}
+	if err := a.putManifest(a.manifest); err != nil {
+		return items, withExitCode(exitStorage, fmt.Errorf("failed to upload the manifest: %w", err))
+	}
+	if uploadErr != nil {
+		return items, withExitCode(
+			exitPartial, fmt.Errorf("backup aborted, only %d files were uploaded: %w", items, uploadErr))
+	}
+	// with --on-error=continue, everything else is in the backup but it can't be trusted to restore
+	if a.failedUploads > 0 {
+		for _, f := range a.manifest.SkippedFiles {
+			a.logger.Error("File not backed up", zap.String("path", f.Path), zap.String("reason", f.Reason))
+		}
+		return items, withExitCode(
+			exitPartial, fmt.Errorf("%d files failed to upload, not marking the backup as successful", a.failedUploads))
 	}
 
 	// mark the backup as successful
@@ -63,18 +324,31 @@ func (a *app) createBackup() int {
 
 	// update the LATEST marker
 	if err := a.updateLatest(*a.backupName); err != nil {
-		a.logger.Error("Failed to update the LATEST marker", zap.Error(err))
-		return 1
+		return items, withExitCode(exitStorage, fmt.Errorf("failed to update the LATEST marker: %w", err))
 	}
 
-	a.logger.Info(
-		"Backup successfully completed",
-		zap.String("name", *a.backupName),
-		zap.Int("files", items),
-		zap.Duration("seconds", time.Now().Sub(begin)),
-	)
+	return items, nil
+}
 
-	return 0
+// return the oid of every database, by name
+func listDatabases(ctx context.Context, conn *sql.Conn) (map[string]uint32, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT datname, oid FROM pg_database")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	databases := make(map[string]uint32)
+	for rows.Next() {
+		var name string
+		var oid uint32
+		if err := rows.Scan(&name, &oid); err != nil {
+			return nil, err
+		}
+		databases[name] = oid
+	}
+
+	return databases, rows.Err()
 }
 
 func (a *app) startBackup() (*sql.Conn, error) {
@@ -95,16 +369,57 @@ func (a *app) startBackup() (*sql.Conn, error) {
 		return nil, err
 	}
 
-	_, err = conn.QueryContext(
+	// pg_start_backup and pg_stop_backup were renamed in PG 15 (along with the removal of exclusive backups)
+	if err := conn.QueryRowContext(ctx, "SHOW server_version_num").Scan(&a.manifest.PGVersion); err != nil {
+		return nil, err
+	}
+	// backups can also be taken from a standby (as of 9.6, which introduced non-exclusive backups)
+	err = conn.QueryRowContext(
 		ctx,
-		"SELECT pg_start_backup($1, $2, $3)",
-		*a.backupName,
-		*a.backupCheckpoint,
-		"false",
-	)
+		"SELECT pg_is_in_recovery(), current_setting('full_page_writes')",
+	).Scan(&a.manifest.FromStandby, &a.manifest.FullPageWrites)
+	if err != nil {
+		return nil, err
+	}
+	// to tell the segment the backup stops in (its unit changed from 8kB pages to bytes in PG 11)
+	err = conn.QueryRowContext(
+		ctx,
+		"SELECT setting::bigint * CASE unit WHEN '8kB' THEN 8192 WHEN 'MB' THEN 1048576 ELSE 1 END "+
+			"FROM pg_settings WHERE name = 'wal_segment_size'",
+	).Scan(&a.manifest.WALSegmentSize)
 	if err != nil {
 		return nil, err
 	}
+	// so that restores can tell which files belong to which database (see --priority-database)
+	if a.manifest.Databases, err = listDatabases(ctx, conn); err != nil {
+		return nil, err
+	}
+	a.logger.Debug(
+		"Connected to PostgreSQL",
+		zap.Int("server_version_num", a.manifest.PGVersion),
+		zap.Bool("standby", a.manifest.FromStandby))
+	if a.manifest.FromStandby {
+		if a.manifest.PGVersion < 90600 {
+			return nil, errors.New("backups from a standby require PostgreSQL 9.6 or later")
+		}
+		a.logger.Info("Taking backup from a standby")
+		a.manifest.Notes = append(
+			a.manifest.Notes,
+			"Taken from a standby: full_page_writes must be enabled on the primary, and the backup can "+
+				"only be restored once all WAL up to the stop LSN has been archived (by the primary, "+
+				"or by the standby if archive_mode = always)")
+	}
+
+	query := "SELECT pg_start_backup($1, $2, false)"
+	if a.manifest.PGVersion >= 150000 {
+		query = "SELECT pg_backup_start($1, $2)"
+	}
+	var lsn string
+	if err := conn.QueryRowContext(ctx, query, *a.backupName, *a.backupCheckpoint).Scan(&lsn); err != nil {
+		return nil, err
+	}
+	a.logger.Info("Backup started", zap.String("lsn", lsn))
+	a.manifest.StartLSN = lsn
 
 	// when doing a non-exclusive backup connection calling pg_start_backup must be maintained until the end of the
 	// backup, or the backup will be automatically aborted
@@ -114,10 +429,17 @@ func (a *app) startBackup() (*sql.Conn, error) {
 func (a *app) stopBackup(conn *sql.Conn) error {
 	a.logger.Info("Stopping backup", zap.String("name", *a.backupName))
 	var lsn, labelFile, mapFile string
+
+	// the backup is tied to the connection that started it; if that connection is gone pg_stop_backup
+	// would fail with a confusing error, so check it first and report what actually happened
+	if err := a.pingBackupConnection(conn); err != nil {
+		return fmt.Errorf("%w: %v", errBackupAborted, err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// print a short message to indicate we're just waiting for pg_stop_backup to complete
+	// print a short message to indicate we're just waiting for pg_stop_backup (or pg_backup_stop) to complete
 	//
 	// pg_stop_backup will only succeed after all the necessary WAL has been
 	// archived, which may take a while
@@ -134,11 +456,41 @@ func (a *app) stopBackup(conn *sql.Conn) error {
 
 	}()
 
-	row := conn.QueryRowContext(ctx, "SELECT * FROM pg_stop_backup(false)")
-	err := row.Scan(&lsn, &labelFile, &mapFile)
+	// a standby only archives WAL with archive_mode = always, otherwise waiting for the WAL to be archived
+	// would block forever; it's up to the primary to archive it
+	wait, err := a.waitForArchive(ctx, conn)
+	if err != nil {
+		return err
+	}
+	// once we gave up (e.g., on SIGTERM), the backup is only stopped so that PostgreSQL isn't left in
+	// backup mode; it's incomplete anyway, so there's no point in waiting for its WAL to be archived
+	if a.givenUp() != nil {
+		wait = false
+	}
+
+	var row *sql.Row
+	switch {
+	case a.manifest.PGVersion >= 150000:
+		row = conn.QueryRowContext(ctx, "SELECT * FROM pg_backup_stop($1)", wait)
+	case a.manifest.PGVersion >= 100000:
+		row = conn.QueryRowContext(ctx, "SELECT * FROM pg_stop_backup(false, $1)", wait)
+	default:
+		// there's no way to not wait, but 9.6 doesn't wait on a standby to begin with
+		row = conn.QueryRowContext(ctx, "SELECT * FROM pg_stop_backup(false)")
+	}
+	err = row.Scan(&lsn, &labelFile, &mapFile)
 	if err != nil {
 		return err
 	}
+	if !wait {
+		a.logger.Warn("Not waiting for WAL to be archived, make sure it is before restoring", zap.String("lsn", lsn))
+	}
+	a.manifest.StopLSN = lsn
+	a.manifest.StartWALFile = parseStartWALFile(labelFile)
+	a.manifest.StopWALFile, err = stopWALFile(a.manifest.StartWALFile, lsn, a.manifest.WALSegmentSize)
+	if err != nil {
+		a.logger.Warn("Failed to tell the WAL segment the backup stops in", zap.String("lsn", lsn), zap.Error(err))
+	}
 
 	// explicitly close the connection we kept open throughout the backup
 	err = conn.Close()
@@ -146,17 +498,23 @@ func (a *app) stopBackup(conn *sql.Conn) error {
 		a.logger.Error("Failed to close connection", zap.Error(err))
 	}
 
+	// ditto for the backup label and tablespace map, which are uploaded when (if) the backup is resumed
+	if err := a.givenUp(); err != nil {
+		a.logger.Warn("Not uploading backup_label and tablespace_map", zap.Error(err))
+		return nil
+	}
+
 	// upload the second field to a file named backup_label in the root directory of the backup and
 	// the third field to a file named tablespace_map, unless the field is empty
 	key := *a.backupName + "/backup_label"
-	err = a.storage.PutString(key, labelFile)
+	err = a.storage.PutString(a.ctx, key, labelFile)
 	if err != nil {
 		return err
 	}
 
 	if mapFile != "" {
 		key = *a.backupName + "/tablespace_map"
-		err = a.storage.PutString(key, mapFile)
+		err = a.storage.PutString(a.ctx, key, mapFile)
 		if err != nil {
 			return err
 		}
@@ -165,19 +523,60 @@ func (a *app) stopBackup(conn *sql.Conn) error {
 	return nil
 }
 
+// return the name of the WAL segment the backup starts in, from the backup label, i.e., the line
+// START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+func parseStartWALFile(labelFile string) string {
+	for _, line := range strings.Split(labelFile, "\n") {
+		if !strings.HasPrefix(line, "START WAL LOCATION:") {
+			continue
+		}
+		if i := strings.Index(line, "(file "); i >= 0 {
+			return strings.TrimSuffix(line[i+len("(file "):], ")")
+		}
+	}
+
+	return ""
+}
+
+// return whether pg_stop_backup should wait for all the WAL the backup needs to be archived
+func (a *app) waitForArchive(ctx context.Context, conn *sql.Conn) (bool, error) {
+	if !a.manifest.FromStandby {
+		return true, nil
+	}
+
+	var archiveMode string
+	if err := conn.QueryRowContext(ctx, "SHOW archive_mode").Scan(&archiveMode); err != nil {
+		return false, err
+	}
+
+	return archiveMode == "always", nil
+}
+
+// make sure the connection we've kept open throughout the backup is still alive
+func (a *app) pingBackupConnection(conn *sql.Conn) error {
+	d := time.Now().Add(time.Duration(*a.statementTimeout) * time.Second)
+	ctx, cancel := context.WithDeadline(context.Background(), d)
+	defer cancel()
+
+	return conn.PingContext(ctx)
+}
+
 func (a *app) getSuccessfulMarker(backupName string) string {
 	return filepath.Join(successfullyCompletedFolder, backupName)
 }
 
 func (a *app) putSuccessfulMarker(backupName string) error {
-	return a.storage.PutString(a.getSuccessfulMarker(backupName), "")
+	return a.storage.PutString(a.ctx, a.getSuccessfulMarker(backupName), "")
 }
 
 func (a *app) deleteSuccessfulMarker(backupName string) error {
 	key := a.getSuccessfulMarker(backupName)
-	_, err := a.storage.GetString(key)
-	if err == nil {
-		if err := a.storage.Delete(key); err != nil {
+	exists, err := a.storage.Exists(a.ctx, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := a.storage.Delete(a.ctx, key); err != nil {
 			return err
 		}
 	}
@@ -186,67 +585,444 @@ func (a *app) deleteSuccessfulMarker(backupName string) error {
 }
 
 func (a *app) updateLatest(backupName string) error {
-	return a.storage.PutString(latestKey, backupName)
+	return a.storage.PutString(a.ctx, latestKey, backupName)
+}
+
+// return the set of keys of all objects that were already uploaded to the backup folder (by a previous run)
+func (a *app) listUploadedKeys() (map[string]bool, error) {
+	keys := make(map[string]bool)
+	keysC := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		for key := range keysC {
+			keys[key] = true
+		}
+		close(done)
+	}()
+
+	err := a.storage.WalkFolder(a.ctx, *a.backupName+"/", keysC)
+	close(keysC)
+	<-done
+
+	return keys, err
+}
+
+// return true iff a previous run of the backup already uploaded the file with the same size and mtime
+func (a *app) alreadyUploaded(key string, st os.FileInfo) bool {
+	// the file may have been compressed (or not) depending on the size it had at the time
+	for _, k := range []string{key, key + lz4.Extension, key + util.ZstdExtension} {
+		if !a.uploadedKeys[k] {
+			continue
+		}
+		metadata, err := a.storage.GetMetadata(a.ctx, k)
+		if err != nil {
+			a.logger.Error("Failed to get metadata", zap.String("key", k), zap.Error(err))
+			return false
+		}
+		return metadata.Size == st.Size() && metadata.ModifiedTime == st.ModTime().Unix()
+	}
+
+	return false
 }
 
-// upload the data directory to remote storage; return the number of files uploaded
-func (a *app) uploadFiles() int {
+// remove the objects uploaded by a previous run of the backup whose files no longer exist
+// in the data directory (keys is the set of keys of all files that do exist)
+func (a *app) deleteVanishedFiles(keys map[string]bool) {
+	for k := range a.uploadedKeys {
+		key := strings.TrimSuffix(util.TrimCompressionExtension(k), util.DirectoryExtension)
+		if keys[key] {
+			continue
+		}
+		a.logger.Debug("Deleting file that no longer exists", zap.String("key", k))
+		if err := a.storage.Delete(a.ctx, k); err != nil {
+			a.logger.Error("Failed to delete file", zap.String("key", k), zap.Error(err))
+		}
+	}
+}
+
+// return the Walker that enumerates the files to backup: all files in the data directory, unless
+// a list of files was provided
+func (a *app) newWalker() (walker.Walker, error) {
+	if *a.fileList == "" {
+		// filepath.Walk doesn't follow symlinks, so each tablespace is walked on its own
+		walkers := []walker.Walker{walker.NewDirectory(*a.pgDataDirectory, a.unreadableFile)}
+		for _, ts := range a.manifest.Tablespaces {
+			a.logger.Info("Found tablespace", zap.String("oid", ts.OID), zap.String("location", ts.Location))
+			link := filepath.Join(tablespaceDirectory, ts.OID)
+			// the trailing slash makes sure the symlink is followed
+			root := filepath.Join(*a.pgDataDirectory, link) + "/"
+			if *a.logicalRoot != "" && filepath.IsAbs(ts.Location) {
+				root = a.snapshotPath(ts.Location) + "/"
+			}
+			walkers = append(
+				walkers,
+				walker.NewPrefix(link, walker.NewDirectory(
+					root,
+					func(path string, err error) error { return a.unreadableFile(filepath.Join(link, path), err) })))
+		}
+		return walker.NewMulti(walkers...), nil
+	}
+
+	var list io.Reader = os.Stdin
+	if *a.fileList != "-" {
+		contents, err := ioutil.ReadFile(*a.fileList)
+		if err != nil {
+			return nil, err
+		}
+		list = bytes.NewReader(contents)
+	}
+
+	return walker.NewFileList(*a.pgDataDirectory, list, a.unreadableFile), nil
+}
+
+// upload the data directory to remote storage; return the number of files (and directories) in the backup
+//
+// the walk, the filter (see filterFiles), and the workers run concurrently, with plenty of room in between,
+// so that neither a slow upload stalls the walk nor the other way around; the workers take the largest
+// files queued first (see uploadQueue)
+func (a *app) uploadFiles(w walker.Walker) (int, error) {
 	a.logger.Info("Preparing to upload files", zap.String("name", *a.backupName))
-	// channel to keep the path of all files that need to compressed and uploaded
-	filesC := make(chan string)
+	foundC := make(chan backupFile, uploadQueueSize)
+	queue := newUploadQueue()
 
 	// spawn a pool of workers
 	a.logger.Info("Spawning workers", zap.Int("number", *a.nWorkers))
 	wg := &sync.WaitGroup{}
 	wg.Add(*a.nWorkers)
 	for i := 0; i < *a.nWorkers; i++ {
-		go a.backupWorker(filesC, wg)
+		go a.backupWorker(queue, wg)
 	}
 
-	// traverse the data directory and put each file (relative path) in the channel for a worker to process
+	// the copy of pg_control must be at least as recent as any other file in the backup, so it's only
+	// uploaded once all of them are
+	var pgControl *backupFile
+	filtered := make(chan struct{})
+	go func() {
+		defer close(filtered)
+		pgControl = a.filterFiles(foundC, queue)
+	}()
+
+	// traverse the data directory (or whatever the source of files is) and put each file (relative path)
+	// in the channel for the filter, and then a worker, to process
 	a.logger.Info("Traversing the data directory", zap.String("path", *a.pgDataDirectory))
-	items := 0
-	err := filepath.Walk(
-		*a.pgDataDirectory,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				// files might change during the copy process; it's normal during an online backup
-				if os.IsNotExist(err) {
-					a.logger.Debug("Source file vanished", zap.String("path", path), zap.Error(err))
+	// keys of all files found in the data directory; only used when resuming a backup
+	keys := make(map[string]bool)
+	err := w.Walk(
+		func(file string, info os.FileInfo) error {
+			// stop queuing files once a worker failed to upload one (unless --on-error=continue), or the
+			// command gives up
+			if err := a.uploadError(); err != nil {
+				return err
+			}
+			if err := a.givenUp(); err != nil {
+				return err
+			}
+			// stop queuing files once we're out of time; the ones already queued are still uploaded
+			if !a.deadline.IsZero() && time.Now().After(a.deadline) {
+				return errMaxDurationExceeded
+			}
+			// tablespaces are walked separately
+			if isTablespaceLink(file, info) {
+				return nil
+			}
+			// other symlinks are recorded in the manifest, even if what they point to isn't backed up
+			// (e.g., pg_wal on a different filesystem), unless explicitly excluded by the user
+			if info.Mode()&os.ModeSymlink != 0 && !a.isExcluded(file) {
+				link, err := readSymlink(*a.pgDataDirectory, file, a.snapshotPath)
+				if err != nil {
+					return err
+				}
+				a.logger.Debug("Recording symlink", zap.String("path", file), zap.String("target", link.Target))
+				a.manifest.Symlinks = append(a.manifest.Symlinks, link)
+				// the contents of symlinked directories are not backed up (they're not traversed either)
+				if link.IsDir {
 					return nil
 				}
-				// anything other than the file not existing, on the other hand, is a problem
-				return err
 			}
-			// grab just the path relative to the data directory
-			file := strings.TrimPrefix(path, *a.pgDataDirectory)
+			// backup_label and tablespace_map are taken from pg_stop_backup, anything in the data directory
+			// by those names (e.g., left behind by an exclusive backup that was never stopped) is stale
+			if isStopBackupFile(file) {
+				a.logger.Warn("Ignoring file in the data directory in favor of pg_stop_backup's", zap.String("path", file))
+				return nil
+			}
 			if a.ignoreFile(file) {
-				a.logger.Debug("Ignoring file", zap.String("path", path))
+				a.logger.Debug("Ignoring file", zap.String("path", file))
+				// no need to look inside ignored directories, everything in there is ignored as well
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			a.logger.Debug("Adding file", zap.String("path", file))
-			filesC <- file
-			items++
+			foundC <- backupFile{path: file, info: info}
+			atomic.AddInt64(&a.uploadCounts.found, 1)
+			if a.uploadedKeys != nil {
+				keys[filepath.Join(*a.backupName, file)] = true
+			}
 			return nil
 		},
 	)
 
+	// regardless of how the traversal ended, let the workers finish what's already been queued
+	a.logger.Info("Waiting for all workers to finish")
+	close(foundC)
+	<-filtered
+	a.progress.TotalsFinal()
+	wg.Wait()
+
+	// unless the backup is being aborted, in which case it's uploaded when (if) it's resumed
+	if pgControl != nil && err == nil && a.uploadError() == nil {
+		a.logger.Info("Uploading pg_control")
+		// as of now, rather than when it was found
+		if st, err := os.Stat(a.localPath(pgControl.path)); err == nil {
+			pgControl.info = st
+		}
+		last := newUploadQueue()
+		last.push(*pgControl)
+		last.close()
+		wg.Add(1)
+		a.backupWorker(last, wg)
+	}
+
+	c := &a.uploadCounts
+	items := int(atomic.LoadInt64(&c.uploaded) + atomic.LoadInt64(&c.reused))
+	a.logger.Info(
+		"Done uploading files",
+		zap.Int64("found", atomic.LoadInt64(&c.found)),
+		zap.Int64("vanished", atomic.LoadInt64(&c.vanished)),
+		zap.Int64("unreadable", atomic.LoadInt64(&c.unreadable)),
+		zap.Int64("already_uploaded", atomic.LoadInt64(&c.reused)),
+		zap.Int64("uploaded", atomic.LoadInt64(&c.uploaded)),
+		zap.Int("failed", a.failedUploads))
+
+	// the last files may have failed to upload after the walk was over, or been left alone once the
+	// command gave up
+	if err == nil {
+		err = a.uploadError()
+	}
+	if err == nil {
+		err = a.givenUp()
+	}
 	if err != nil {
 		a.logger.Error("Failed to walk data directory", zap.Error(err))
-		return 1
+		return items, err
 	}
 
-	a.logger.Info("Waiting for all workers to finish")
-	close(filesC)
-	wg.Wait()
+	if a.uploadedKeys != nil {
+		a.deleteVanishedFiles(keys)
+	}
+
+	return items, nil
+}
+
+// the stage between the walk and the workers: stat each file found (it may be gone by now), find out about
+// the ones we can't read before the workers do (while the backup can still be stopped, see
+// --unreadable-files), and add the rest to the work to do; pg_control is returned, rather than queued, as
+// it's uploaded last
+func (a *app) filterFiles(foundC <-chan backupFile, queue *uploadQueue) *backupFile {
+	defer queue.close()
+
+	var pgControl *backupFile
+	for f := range foundC {
+		// once the backup is being aborted (or the command gives up), the files still found are left alone
+		if a.uploadError() != nil || a.ctx.Err() != nil {
+			continue
+		}
+
+		st, err := os.Stat(a.localPath(f.path))
+		if err != nil {
+			// this can happen for very legitimate reasons, as PG is not stopped and we're taking an online backup
+			a.logger.Info("Failed to stat file. Might have been removed", zap.String("path", f.path), zap.Error(err))
+			atomic.AddInt64(&a.uploadCounts.vanished, 1)
+			continue
+		}
+		if st.Mode().IsRegular() {
+			if file, err := os.Open(a.localPath(f.path)); err == nil {
+				file.Close()
+			} else if os.IsPermission(err) {
+				if err := a.unreadableFile(f.path, err); err != nil {
+					a.abortBackup(err)
+				}
+				atomic.AddInt64(&a.uploadCounts.unreadable, 1)
+				continue
+			}
+		}
+
+		if !st.IsDir() {
+			a.progress.AddTotal(1, st.Size())
+		}
+		if f.path == pgControlFile {
+			pgControl = &backupFile{path: f.path, info: st}
+			continue
+		}
+		queue.push(backupFile{path: f.path, info: st})
+	}
+
+	return pgControl
+}
+
+// upload (e.g., with a call to Put) a file (relative to the data directory), trying again with
+// --on-error=retry
+func (a *app) retryUpload(path string, upload func() error) error {
+	err := upload()
+	if *a.onError != onErrorRetry {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 1; err != nil && attempt <= uploadRetries; attempt++ {
+		a.logger.Warn(
+			"Failed to upload file, retrying",
+			zap.String("path", path),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		if !a.sleep(backoff) {
+			return err
+		}
+		backoff *= 2
+		err = upload()
+	}
+
+	return err
+}
+
+// decide, according to --on-error, what to do about a file (relative to the data directory) that couldn't
+// be uploaded: either abort the backup (once the workers are done with the files they're working on, it's
+// stopped cleanly), or skip the file (recording it in the manifest) and carry on, in which case the backup
+// won't be marked successful
+func (a *app) uploadFailed(path string, err error) {
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+
+	if *a.onError == onErrorContinue {
+		a.logger.Error("Failed to upload file, skipping it", zap.String("path", path), zap.Error(err))
+		a.manifest.SkippedFiles = append(
+			a.manifest.SkippedFiles,
+			skippedFile{Path: path, Reason: "failed to upload: " + err.Error()})
+		a.failedUploads++
+		return
+	}
+
+	a.logger.Error("Failed to upload file, aborting the backup", zap.String("path", path), zap.Error(err))
+	if a.uploadErr == nil {
+		a.uploadErr = fmt.Errorf("failed to upload %s: %w", path, err)
+	}
+}
+
+// abort the backup with err, unless it's already being aborted
+func (a *app) abortBackup(err error) {
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+
+	if a.uploadErr == nil {
+		a.uploadErr = err
+	}
+}
+
+// return the error that's aborting the backup, if any (see uploadFailed)
+func (a *app) uploadError() error {
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+
+	return a.uploadErr
+}
+
+// decide, according to --unreadable-files, what to do about a file (or directory) that can't be read
+// (path is relative to the data directory): either stop the backup, or skip the file (recording it in
+// the manifest) and carry on
+func (a *app) unreadableFile(path string, err error) error {
+	if !os.IsPermission(err) || *a.unreadableFiles == unreadableFilesFail {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	a.logger.Warn("Skipping unreadable file", zap.String("path", path), zap.Error(err))
+	a.recordSkippedFile(path, err)
+
+	return nil
+}
 
-	return items
+func (a *app) recordSkippedFile(path string, err error) {
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+	a.manifest.SkippedFiles = append(a.manifest.SkippedFiles, skippedFile{Path: path, Reason: err.Error()})
 }
 
-// return true iff it's in one of the directories we do not need to backup
+// record the checksum of the contents of the file (relative to the data directory) as it was uploaded
+func (a *app) recordChecksum(path string, checksum string) {
+	if checksum == "" {
+		return
+	}
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+	if a.manifest.Checksums == nil {
+		a.manifest.Checksums = make(map[string]string)
+	}
+	a.manifest.Checksums[path] = checksum
+}
+
+func (a *app) recordFileSize(path string, size int64) {
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+	if a.manifest.FileSizes == nil {
+		a.manifest.FileSizes = make(map[string]int64)
+	}
+	a.manifest.FileSizes[path] = size
+}
+
+// return true iff it's in one of the directories we do not need to backup or was excluded by the user
 func (a *app) ignoreFile(path string) bool {
-	for _, d := range prefixesNotToBackup {
-		if strings.HasPrefix(path, d) {
+	for _, prefixes := range [][]string{prefixesNotToBackup, a.config.ExcludePrefixes} {
+		for _, d := range prefixes {
+			if strings.HasPrefix(path, d) {
+				return true
+			}
+		}
+	}
+
+	if !*a.includeTransient && isTransient(path) {
+		return true
+	}
+	// left over by restore-wal --prefetch (in pg_wal, which isn't backed up anyway, unless --wal-path was
+	// elsewhere in the data directory)
+	for _, part := range strings.Split(path, "/") {
+		if part == prefetchDirectory {
+			return true
+		}
+	}
+
+	return a.isExcluded(path)
+}
+
+// return true iff path (relative to the data directory) is one of the files whose contents are returned
+// by pg_stop_backup (and uploaded by stopBackup)
+func isStopBackupFile(path string) bool {
+	for _, f := range stopBackupFiles {
+		if path == f {
+			return true
+		}
+	}
+
+	return false
+}
+
+// return true iff path (relative to the data directory) is a transient file, or is inside a transient directory
+func isTransient(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, transientPrefix) {
+		return true
+	}
+	for _, f := range transientFileNames {
+		if name == f {
+			return true
+		}
+	}
+	for _, f := range transientFiles {
+		if path == f {
+			return true
+		}
+	}
+	for _, d := range transientDirectories {
+		if strings.HasPrefix(path, d+"/") {
 			return true
 		}
 	}
@@ -254,26 +1030,73 @@ func (a *app) ignoreFile(path string) bool {
 	return false
 }
 
-// continuously receive file paths (relative to the data directory) from the filesC channel
+// return true iff path (relative to the data directory), or any of its parent directories,
+// matches one of the user provided exclude patterns
+func (a *app) isExcluded(path string) bool {
+	for _, pattern := range a.excludePatterns {
+		for p := path; p != "." && p != "/" && p != ""; p = filepath.Dir(p) {
+			// patterns have been validated by loadExcludePatterns
+			if match, _ := filepath.Match(pattern, p); match {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// collect the exclude patterns from the command line and the exclude file (one pattern per line,
+// ignoring empty lines and comments starting with #), making sure they're all valid
+func (a *app) loadExcludePatterns() error {
+	patterns := append([]string{}, *a.excludes...)
+
+	if *a.excludeFile != "" {
+		contents, err := ioutil.ReadFile(*a.excludeFile)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			patterns = append(patterns, line)
+		}
+	}
+
+	for _, pattern := range patterns {
+		// allow directories to be written as log/
+		pattern = strings.TrimSuffix(pattern, "/")
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+		}
+		a.excludePatterns = append(a.excludePatterns, pattern)
+	}
+	a.logger.Debug("Loaded exclude patterns", zap.Strings("patterns", a.excludePatterns))
+
+	return nil
+}
+
+// continuously take files (relative to the data directory) from the queue, largest first,
 // compress the ones larger than compress-threshold, and upload them to remote storage along with some relevant metadata
-func (a *app) backupWorker(filesC <-chan string, wg *sync.WaitGroup) {
+func (a *app) backupWorker(queue *uploadQueue, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for {
-		pgFile, more := <-filesC
+		f, more := queue.pop()
 		if !more {
 			a.logger.Debug("No more files to process")
 			return
 		}
 
-		pgFilePath := filepath.Join(*a.pgDataDirectory, pgFile)
-		st, err := os.Stat(pgFilePath)
-		if err != nil {
-			// this can happen for very legitimate reasons, as PG is not stopped and we're taking an online backup
-			a.logger.Info("Failed to stat file. Might have been removed", zap.Error(err))
+		// once the backup is being aborted (or the command gives up), the files still queued are left alone
+		if a.uploadError() != nil || a.ctx.Err() != nil {
 			continue
 		}
 
+		pgFile, st := f.path, f.info
+		pgFilePath := a.localPath(pgFile)
+
 		// name the object after the file path relative to the data directory
 		key := filepath.Join(*a.backupName, pgFile)
 		// create directories
@@ -286,39 +1109,211 @@ func (a *app) backupWorker(filesC <-chan string, wg *sync.WaitGroup) {
 				"Creating object for directory directory",
 				zap.String("path", pgFile),
 				zap.String("key", key))
-			if err := a.storage.PutString(key, ""); err != nil {
-				a.logger.Fatal("Failed to create object for directory on remote storage", zap.Error(err))
+			if a.uploadedKeys[key] {
+				atomic.AddInt64(&a.uploadCounts.reused, 1)
+				continue
 			}
-			continue
-		}
-		// compress files larger than a given threshold
-		compressed := ""
-		if st.Size() > int64(*a.compressThreshold) {
-			a.logger.Debug("Compressing file", zap.String("path", pgFile), zap.Int64("size", st.Size()))
-			compressed, err = util.Compress(pgFilePath, *a.tmpDirectory)
+			err := a.retryUpload(pgFile, func() error {
+				return a.storage.PutStringWithMetadata(a.ctx, key, "", fileMetadata(st))
+			})
 			if err != nil {
-				a.logger.Error("Failed to compress file", zap.Error(err))
-				// we use compressed == "" to decide whether to upload and remove a compressed file
-				// let's try to proceed with the backup by uploading the uncompressed file
-				compressed = ""
+				a.uploadFailed(pgFile, err)
 				continue
 			}
-			// mark the object as a compressed file
-			key += lz4.Extension
+			atomic.AddInt64(&a.uploadCounts.uploaded, 1)
+			continue
+		}
+		// skip files left untouched since they were uploaded by an interrupted run of this backup
+		if a.uploadedKeys != nil && a.alreadyUploaded(key, st) {
+			a.logger.Debug("Skipping file already uploaded", zap.String("path", pgFile))
+			atomic.AddInt64(&a.uploadCounts.reused, 1)
+			a.recordFileSize(pgFile, st.Size())
+			a.recordChecksum(pgFile, a.resumedChecksums[pgFile])
+			a.progress.FileDone(pgFile, st.Size())
+			continue
 		}
 
-		if compressed != "" {
-			err = a.storage.Put(key, compressed, st.ModTime().Unix())
-			// cleanup the temporary compressed file
-			util.MustRemoveFile(compressed, a.logger)
-		} else {
-			err = a.storage.Put(key, pgFilePath, st.ModTime().Unix())
+		// compress files worth compressing, as they're uploaded
+		var compression *util.CompressOptions
+		if a.shouldCompress(pgFilePath, st) {
+			options := a.compressOptions()
+			compression = &options
+			// mark the object as a compressed file (and how it was compressed)
+			key += options.Extension(st.Size())
+		}
+		var checksum string
+		err := a.retryUpload(pgFile, func() error {
+			var err error
+			checksum, err = a.putFile(key, pgFilePath, fileMetadata(st), compression, *a.checksumAlgorithm)
+			return err
+		})
+		// the file was readable when it was found, but that may have changed since; it's too late to stop
+		// the backup at this point, so it's skipped regardless of --unreadable-files
+		if os.IsPermission(err) {
+			a.logger.Warn("Skipping file that became unreadable", zap.String("path", pgFile), zap.Error(err))
+			a.recordSkippedFile(pgFile, err)
+			atomic.AddInt64(&a.uploadCounts.unreadable, 1)
+			continue
 		}
+		if os.IsNotExist(err) {
+			// same as with stat, the file may have been legitimately removed in the meantime
+			a.logger.Info("Failed to open file. Might have been removed", zap.Error(err))
+			atomic.AddInt64(&a.uploadCounts.vanished, 1)
+			continue
+		}
+		if err != nil {
+			a.uploadFailed(pgFile, err)
+			continue
+		}
+		atomic.AddInt64(&a.uploadCounts.uploaded, 1)
+		a.recordFileSize(pgFile, st.Size())
+		a.recordChecksum(pgFile, checksum)
+		a.progress.FileDone(pgFile, st.Size())
+
+		// when resuming, a copy of the file uploaded by the interrupted run may have been stored with
+		// a different compression, in which case it must go, or the restore would pick either of them
+		if a.uploadedKeys != nil {
+			plain := util.TrimCompressionExtension(key)
+			for _, stale := range []string{plain, plain + lz4.Extension, plain + util.ZstdExtension} {
+				if stale == key || !a.uploadedKeys[stale] {
+					continue
+				}
+				if err := a.storage.Delete(a.ctx, stale); err != nil {
+					a.logger.Error("Failed to delete stale copy of file", zap.String("key", stale), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// return true iff the file is larger than the compression threshold, and it's not already compressed
+// (or otherwise incompressible)
+func (a *app) shouldCompress(path string, st os.FileInfo) bool {
+	if *a.noCompression || st.Size() <= int64(*a.compressThreshold) {
+		return false
+	}
+	compressible, err := util.IsCompressible(path)
+	if err != nil {
+		// let the upload deal with whatever went wrong (e.g., the file was removed)
+		a.logger.Debug("Failed to sample file for compression", zap.String("path", path), zap.Error(err))
+		return true
+	}
+	if !compressible {
+		a.logger.Debug("Skipping compression of incompressible file", zap.String("path", path))
+	}
 
+	return compressible
+}
+
+// upload the first metadata.Size bytes of the file path to key (see util.PaddedReader), compressing them on
+// the fly with the given options (if any), and return their checksum computed with algorithm as they're read, so that it
+// matches what's stored no matter if the file is written to meanwhile (as it is during an online backup);
+// the stream can't be rewound, so the file is read (and compressed) again from the start if the upload has
+// to be retried
+func (a *app) putFile(key string, path string, metadata storage.Metadata, compression *util.CompressOptions, algorithm string) (string, error) {
+	var checksum string
+	err := storage.Retry(a.ctx, a.storage, "put", key, func(ctx context.Context) error {
+		f, err := os.Open(path)
 		if err != nil {
-			a.logger.Fatal("Failed to upload file", zap.Error(err))
+			return err
+		}
+		defer f.Close()
+
+		var body io.Reader = util.PaddedReader(f, metadata.Size)
+		var h hash.Hash
+		if algorithm != util.ChecksumNone {
+			if h, err = util.NewHash(algorithm); err != nil {
+				return err
+			}
+			body = io.TeeReader(body, h)
+		}
+		if compression != nil {
+			release := a.acquireCompression()
+			defer release()
+			a.logger.Debug("Compressing file", zap.String("path", path), zap.Int64("size", metadata.Size))
+			compressed := util.CompressStream(body, metadata.Size, *compression)
+			// stops the compression, if the upload failed half way through
+			defer compressed.Close()
+			body = compressed
+		}
+
+		// only the bytes of the attempt that made it count
+		var stored int64
+		if err := a.storage.PutReader(ctx, key, &countingReader{r: body, n: &stored}, metadata); err != nil {
+			return err
+		}
+		atomic.AddInt64(&a.storedBytes, stored)
+		if h != nil {
+			checksum = util.FormatChecksum(algorithm, h)
+		}
+
+		return nil
+	})
+
+	return checksum, err
+}
+
+// countingReader atomically adds the number of bytes read from r to n
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+
+	return n, err
+}
+
+// return how many times smaller the stored files are than the originals (0 if unknown)
+func compressionRatio(size int64, stored int64) float64 {
+	if stored == 0 {
+		return 0
+	}
+
+	return float64(size) / float64(stored)
+}
+
+func validateLabel(args []string) error {
+	for _, arg := range args {
+		if i := strings.Index(arg, "="); i <= 0 {
+			return fmt.Errorf("label ('%s') must be of the form key=value", arg)
 		}
 	}
+
+	return nil
+}
+
+// return the key=value labels as a map; later labels override earlier ones with the same key
+func parseLabels(labels []string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	parsed := make(map[string]string, len(labels))
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		parsed[kv[0]] = kv[1]
+	}
+
+	return parsed
+}
+
+// return the metadata (mtime, size, mode, and ownership) of a local file to store alongside its object
+func fileMetadata(st os.FileInfo) storage.Metadata {
+	metadata := storage.Metadata{
+		ModifiedTime: st.ModTime().Unix(),
+		Mode:         st.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+	}
+	if !st.IsDir() {
+		metadata.Size = st.Size()
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		metadata.UID = int(sys.Uid)
+		metadata.GID = int(sys.Gid)
+	}
+
+	return metadata
 }
 
 func parseCreateBackupArgs(cfg *app, parser *argparse.Command) {
@@ -329,6 +1324,130 @@ func parseCreateBackupArgs(cfg *app, parser *argparse.Command) {
 			Required: false,
 			Default:  512 * 1024,
 			Help:     "compress files larger than"})
+	cfg.noCompression = boolFlag(
+		parser,
+		"",
+		"no-compression",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Don't compress any files (faster restores, at the expense of storage and transfer)"})
+	cfg.checksumAlgorithm = parser.Selector(
+		"",
+		"checksum",
+		util.ChecksumAlgorithms,
+		&argparse.Options{
+			Required: false,
+			Default:  util.ChecksumBLAKE3,
+			Help:     "Algorithm used to checksum each file as it is uploaded, recorded in the manifest (xxh3 is fastest, but not cryptographically secure)"})
+	cfg.resume = boolFlag(
+		parser,
+		"",
+		"resume",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Resume an interrupted backup, uploading only the files that changed since"})
+	cfg.unreadableFiles = parser.Selector(
+		"",
+		"unreadable-files",
+		[]string{unreadableFilesFail, unreadableFilesSkip},
+		&argparse.Options{
+			Required: false,
+			Default:  unreadableFilesFail,
+			Help:     "What to do about files that can't be read for lack of permissions (skipped files are listed in the manifest)"})
+	cfg.onError = parser.Selector(
+		"",
+		"on-error",
+		[]string{onErrorAbort, onErrorRetry, onErrorContinue},
+		&argparse.Options{
+			Required: false,
+			Default:  onErrorAbort,
+			Help: "What to do about files that fail to upload: abort the backup, retry a few times (then " +
+				"abort), or continue without them (and not mark the backup successful)"})
+	cfg.comment = parser.String(
+		"",
+		"comment",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Free form description of the backup (e.g., \"pre-upgrade snapshot\")"})
+	cfg.labels = stringListFlag(
+		parser,
+		"",
+		"label",
+		&argparse.Options{
+			Required: false,
+			Validate: validateLabel,
+			Help:     "Label the backup with key=value (repeatable)"})
+	cfg.excludes = stringListFlag(
+		parser,
+		"",
+		"exclude",
+		&argparse.Options{
+			Required: false,
+			Help:     "Glob pattern (relative to the data directory) of files and directories not to backup (repeatable)"})
+	cfg.excludeFile = parser.String(
+		"",
+		"exclude-file",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "File with exclude patterns, one per line"})
+	cfg.includeTransient = boolFlag(
+		parser,
+		"",
+		"include-transient",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Also backup transient files (pgsql_tmp, pg_internal.init, contents of pg_stat_tmp, etc.)"})
+	cfg.fileList = parser.String(
+		"",
+		"file-list",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Backup only the files listed (one per line, relative to the data directory) in this file (- for stdin)"})
+	cfg.preBackupCmd = parser.String(
+		"",
+		"pre-backup-cmd",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Shell command to run before starting the backup (which is not taken if the command fails), " +
+				"with the backup described in PGCARPENTER_* environment variables"})
+	cfg.postBackupCmd = parser.String(
+		"",
+		"post-backup-cmd",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Shell command to run once the backup is over (successfully or not), with the backup " +
+				"described (including PGCARPENTER_STATUS) in PGCARPENTER_* environment variables"})
+	cfg.forceUnlock = boolFlag(
+		parser,
+		"",
+		"force-unlock",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Ignore the lock left behind by a backup of the same cluster that's no longer running"})
+	cfg.logicalRoot = parser.String(
+		"",
+		"logical-root",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Where the root of the host's file system is mounted (e.g., a snapshot mounted at /snap), " +
+				"to find the targets of symlinks and tablespaces in it rather than on the live host"})
+	cfg.maxDuration = parser.Int(
+		"",
+		"max-duration",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Abort the backup (gracefully) if it takes more than the specified number of seconds (0 means no limit)"})
 	cfg.pgUser = parser.String(
 		"",
 		"user",
@@ -343,7 +1462,8 @@ func parseCreateBackupArgs(cfg *app, parser *argparse.Command) {
 			Required: false,
 			Default:  "",
 			Help:     "PostgreSQL password"})
-	cfg.backupCheckpoint = parser.Flag(
+	cfg.backupCheckpoint = boolFlag(
+		parser,
 		"",
 		"checkpoint",
 		&argparse.Options{
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/schedule"
+	"go.uber.org/zap"
+)
+
+// flags of daemon itself (all of which take a value), as opposed to the ones it passes on to the commands
+// it runs (which don't take them, and shouldn't see the token in their arguments either)
+var daemonFlags = []string{"listen-address", "api-token"}
+
+// run the commands scheduled in the configuration file, forever; each one runs in a process of its own
+// (this same binary), so that one failing (or crashing) doesn't take the others down
+func (a *app) daemon() int {
+	if len(a.config.Schedules) == 0 {
+		a.logger.Error("No schedules in the configuration file (see --config)")
+		return exitUsage
+	}
+	a.schedules = make([]*scheduleStatus, len(a.config.Schedules))
+	for i, job := range a.config.Schedules {
+		s, err := validateScheduledJob(job)
+		if err != nil {
+			a.logger.Error("Invalid schedule", zap.String("name", job.Name), zap.Error(err))
+			return exitUsage
+		}
+		a.schedules[i] = &scheduleStatus{job: job, schedule: s}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		a.logger.Error("Failed to find the path to pgCarpenter", zap.Error(err))
+		return exitFailure
+	}
+
+	if *a.listenAddress != "" {
+		go a.serveAPI(*a.listenAddress, executable)
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, st := range a.schedules {
+		wg.Add(1)
+		go func(st *scheduleStatus) {
+			defer wg.Done()
+			a.runSchedule(executable, st)
+		}(st)
+	}
+	wg.Wait()
+
+	return 0
+}
+
+func validateScheduledJob(job scheduledJob) (*schedule.Schedule, error) {
+	if len(job.Args) == 0 {
+		return nil, errors.New("no command to run")
+	}
+	if job.Args[0] == "daemon" {
+		return nil, errors.New("daemon can't schedule itself")
+	}
+
+	return schedule.Parse(job.Cron)
+}
+
+// run the job whenever it's scheduled to; it never runs concurrently with itself: if a run takes longer
+// than until the next one is due (or it was triggered through the API and is still running), that one is
+// skipped
+func (a *app) runSchedule(executable string, st *scheduleStatus) {
+	job := st.job
+	for {
+		next := st.schedule.Next(time.Now())
+		if next.IsZero() {
+			a.logger.Error("Schedule never runs", zap.String("name", job.Name), zap.String("cron", job.Cron))
+			return
+		}
+		st.setNextRun(next)
+		a.logger.Info("Next run scheduled", zap.String("name", job.Name), zap.Time("time", next))
+		if !a.sleep(time.Until(next)) {
+			return
+		}
+		if job.JitterSeconds > 0 {
+			if !a.sleep(time.Duration(rand.Int63n(int64(job.JitterSeconds)*int64(time.Second) + 1))) {
+				return
+			}
+		}
+
+		if !st.start() {
+			a.logger.Warn("Scheduled command is still running, skipping it", zap.String("name", job.Name))
+			continue
+		}
+		begin := time.Now()
+		a.runScheduledJob(executable, st)
+		if missed := st.schedule.Next(next); missed.Before(time.Now()) {
+			a.logger.Warn(
+				"Scheduled command took longer than until its next run, skipping it",
+				zap.String("name", job.Name),
+				zap.Duration("duration", time.Now().Sub(begin)))
+		}
+	}
+}
+
+// run the command of the job (which must have been started, see scheduleStatus.start), along with the
+// flags common to all commands given to daemon, trying again (up to the number of retries of the job) if
+// it fails
+func (a *app) runScheduledJob(executable string, st *scheduleStatus) {
+	job := st.job
+	args := append(append([]string{}, job.Args...), withoutFlags(os.Args[2:], daemonFlags)...)
+	var err error
+	for attempt := 0; attempt <= job.Retries; attempt++ {
+		err = a.runScheduledCommand(executable, st, args, attempt)
+		a.metrics.Add("pgcarpenter_scheduled_runs_total", "Scheduled commands run", 1, "schedule", job.Name)
+		if err == nil {
+			break
+		}
+		a.metrics.Add("pgcarpenter_scheduled_failures_total", "Scheduled commands that failed", 1, "schedule", job.Name)
+		// no point in trying again once the daemon is stopping
+		if a.ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("failed %d times: %w", job.Retries+1, err)
+		a.logger.Error("Scheduled command failed", zap.String("name", job.Name), zap.Error(err))
+	}
+	st.finish(err)
+}
+
+// run the command of the job once, collecting its metrics and following its progress
+func (a *app) runScheduledCommand(executable string, st *scheduleStatus, args []string, attempt int) error {
+	job := st.job
+	if attempt > 0 {
+		a.logger.Info("Retrying scheduled command", zap.String("name", job.Name), zap.Int("attempt", attempt))
+		if !a.sleep(time.Duration(job.RetryDelaySeconds) * time.Second) {
+			return a.ctx.Err()
+		}
+	}
+	a.logger.Info("Running scheduled command", zap.String("name", job.Name), zap.Strings("args", job.Args))
+	begin := time.Now()
+
+	scratch, err := ioutil.TempDir(*a.tmpDirectory, "pgCarpenter.daemon.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	metricsFile := filepath.Join(scratch, "metrics.json")
+	progressSocket := filepath.Join(scratch, "progress.sock")
+
+	// the command is stopped along with the daemon
+	cmd := a.commandContext(
+		executable,
+		append(args, "--metrics-file", metricsFile, "--progress-socket", progressSocket)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go st.followProgress(progressSocket, done)
+	err = cmd.Wait()
+	close(done)
+	if mergeErr := a.mergeMetrics(metricsFile); mergeErr != nil && !os.IsNotExist(mergeErr) {
+		a.logger.Warn("Failed to collect the metrics of the scheduled command", zap.Error(mergeErr))
+	}
+	if err != nil {
+		return err
+	}
+	a.logger.Info(
+		"Scheduled command completed",
+		zap.String("name", job.Name),
+		zap.Duration("duration", time.Now().Sub(begin)))
+
+	return nil
+}
+
+// return args without the given flags (and their values)
+func withoutFlags(args []string, flags []string) []string {
+	kept := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		skip := false
+		for _, f := range flags {
+			if args[i] == "--"+f {
+				// and its value
+				i++
+				skip = true
+			} else if strings.HasPrefix(args[i], "--"+f+"=") {
+				skip = true
+			}
+		}
+		if !skip {
+			kept = append(kept, args[i])
+		}
+	}
+
+	return kept
+}
+
+func parseDaemonArgs(cfg *app, parser *argparse.Command) {
+	// schedules are set in the configuration file (see --config)
+	cfg.listenAddress = parser.String(
+		"",
+		"listen-address",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Serve the HTTP API (status of the schedules, the latest backup and archiving, ad-hoc runs, " +
+				"and metrics on /metrics) at this address, e.g., 127.0.0.1:9187"})
+	cfg.apiToken = parser.String(
+		"",
+		"api-token",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Require ad-hoc runs through the HTTP API to send this token (as Authorization: Bearer <token>); " +
+				"without it, they're only allowed if the API listens on a loopback address"})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/progress"
+	"github.com/thumbtack/pgCarpenter/schedule"
+	"go.uber.org/zap"
+)
+
+// how long a scheduled command has to create its progress socket
+const progressSocketTimeout = 10 * time.Second
+
+// scheduleStatus is a schedule of the daemon, and how its runs are going. It's safe for concurrent use.
+type scheduleStatus struct {
+	job      scheduledJob
+	schedule *schedule.Schedule
+	mu       sync.Mutex
+	nextRun  time.Time
+	running  bool
+	started  time.Time
+	// the latest progress event of the running command (if it reports any, e.g., create-backup)
+	progress *progress.Event
+	lastRun  *runResult
+}
+
+// the outcome of a run of a scheduled command
+type runResult struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration_ns"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// mark the schedule as running; false if it already was
+func (st *scheduleStatus) start() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.running {
+		return false
+	}
+	st.running = true
+	st.started = time.Now()
+	st.progress = nil
+
+	return true
+}
+
+func (st *scheduleStatus) finish(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.running = false
+	st.lastRun = &runResult{Started: st.started, Duration: time.Now().Sub(st.started), Success: err == nil}
+	if err != nil {
+		st.lastRun.Error = err.Error()
+	}
+}
+
+func (st *scheduleStatus) setNextRun(t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nextRun = t
+}
+
+// keep the latest event sent to the progress socket (see --progress-socket) of the command, until done
+// is closed
+func (st *scheduleStatus) followProgress(socket string, done <-chan struct{}) {
+	// the command creates the socket once it's started
+	var conn net.Conn
+	deadline := time.Now().Add(progressSocketTimeout)
+	for {
+		var err error
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		// not every command reports progress
+		if time.Now().After(deadline) {
+			return
+		}
+	}
+	go func() {
+		<-done
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		e := progress.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		st.mu.Lock()
+		st.progress = &e
+		st.mu.Unlock()
+	}
+}
+
+// the status of a schedule, as reported by the API
+type scheduleReport struct {
+	Name     string          `json:"name"`
+	Cron     string          `json:"cron"`
+	Args     []string        `json:"args"`
+	NextRun  time.Time       `json:"next_run"`
+	Running  bool            `json:"running"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Progress *progress.Event `json:"progress,omitempty"`
+	LastRun  *runResult      `json:"last_run,omitempty"`
+}
+
+func (st *scheduleStatus) report() scheduleReport {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	r := scheduleReport{
+		Name:     st.job.Name,
+		Cron:     st.job.Cron,
+		Args:     st.job.Args,
+		NextRun:  st.nextRun,
+		Running:  st.running,
+		Progress: st.progress,
+		LastRun:  st.lastRun,
+	}
+	if st.running {
+		started := st.started
+		r.Started = &started
+	}
+
+	return r
+}
+
+// the status of the daemon, as reported by GET /status
+type daemonReport struct {
+	Schedules  []scheduleReport  `json:"schedules"`
+	LastBackup *lastBackupReport `json:"last_backup,omitempty"`
+	Archive    *archiveLagReport `json:"archive,omitempty"`
+	Errors     map[string]string `json:"errors,omitempty"`
+}
+
+type lastBackupReport struct {
+	Name       string    `json:"name"`
+	Completed  time.Time `json:"completed"`
+	AgeSeconds int64     `json:"age_seconds"`
+}
+
+type archiveLagReport struct {
+	// waiting to be archived; only known if the daemon was given --data-directory
+	ReadySegments *int   `json:"ready_segments,omitempty"`
+	OldestReady   string `json:"oldest_ready,omitempty"`
+	// how long the oldest one has been waiting
+	LagSeconds          *int64     `json:"lag_seconds,omitempty"`
+	LastArchived        string     `json:"last_archived,omitempty"`
+	LastArchivedTime    *time.Time `json:"last_archived_time,omitempty"`
+	LastArchivedSeconds int64      `json:"last_archived_age_seconds,omitempty"`
+}
+
+// serve the HTTP API of the daemon:
+//
+//	GET  /healthz                  200 as long as the daemon is up (e.g., for liveness probes)
+//	GET  /status                   the schedules (next run, progress of the running command, outcome of the
+//	                               last run), the latest successful backup, and how far behind archiving is
+//	POST /schedules/<name>/run     run the command of the schedule now (e.g., an ad-hoc backup); it takes
+//	                               --api-token, unless the API only listens on a loopback address
+//	GET  /metrics                  the metrics of the commands run so far, for Prometheus
+func (a *app) serveAPI(address string, executable string) {
+	// anyone who can reach the API could otherwise run any of the schedules (e.g., delete-backup)
+	allowRuns := *a.apiToken != "" || isLoopbackAddress(address)
+	if !allowRuns {
+		a.logger.Warn("Ad-hoc runs through the HTTP API are disabled, as it doesn't listen on a loopback address (see --api-token)",
+			zap.String("address", address))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/schedules/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowRuns {
+			http.Error(w, "ad-hoc runs need --api-token unless the API listens on a loopback address", http.StatusForbidden)
+			return
+		}
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		a.handleRun(w, r, executable)
+	})
+	mux.Handle("/metrics", a.metrics)
+	a.logger.Info("Serving the HTTP API", zap.String("address", address))
+	if err := http.ListenAndServe(address, mux); err != nil {
+		a.logger.Error("Failed to serve the HTTP API", zap.Error(err))
+	}
+}
+
+func (a *app) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := daemonReport{Errors: make(map[string]string)}
+	for _, st := range a.schedules {
+		report.Schedules = append(report.Schedules, st.report())
+	}
+
+	// failing to get any of the following is reported as part of the status
+	if latest, err := a.resolveLatest(); err != nil {
+		report.Errors["last_backup"] = err.Error()
+	} else if completed, err := a.storage.GetLastModifiedTime(a.ctx, a.getSuccessfulMarker(latest)); err != nil {
+		report.Errors["last_backup"] = err.Error()
+	} else {
+		t := time.Unix(completed, 0)
+		report.LastBackup = &lastBackupReport{
+			Name:       latest,
+			Completed:  t,
+			AgeSeconds: int64(time.Now().Sub(t).Seconds()),
+		}
+	}
+
+	archive := &archiveLagReport{}
+	if flagGiven("data-directory") {
+		if lag, err := a.getArchiveLag(); err != nil {
+			report.Errors["archive_lag"] = err.Error()
+		} else {
+			seconds := int64(lag.age.Seconds())
+			archive.ReadySegments = &lag.segments
+			archive.OldestReady = lag.oldest
+			archive.LagSeconds = &seconds
+		}
+	}
+	if last, err := a.getLastArchived(); err != nil {
+		report.Errors["last_archived"] = err.Error()
+	} else {
+		archive.LastArchived = last.Segment
+		archive.LastArchivedTime = &last.Time
+		archive.LastArchivedSeconds = int64(time.Now().Sub(last.Time).Seconds())
+	}
+	report.Archive = archive
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	// nothing to do if the client went away
+	_ = encoder.Encode(report)
+}
+
+// return true iff the address (host:port) to listen at is only reachable from this host, e.g., 127.0.0.1:9187
+// (but not :9187, which is every interface)
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// return true iff the request carries --api-token (if there's one)
+func (a *app) authorized(r *http.Request) bool {
+	if *a.apiToken == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(*a.apiToken)) == 1
+}
+
+// POST /schedules/<name>/run
+func (a *app) handleRun(w http.ResponseWriter, r *http.Request, executable string) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/schedules/"), "/")
+	if len(parts) != 2 || parts[1] != "run" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var st *scheduleStatus
+	for _, s := range a.schedules {
+		if s.job.Name == parts[0] {
+			st = s
+		}
+	}
+	if st == nil {
+		http.Error(w, "no such schedule", http.StatusNotFound)
+		return
+	}
+	if !st.start() {
+		http.Error(w, "already running", http.StatusConflict)
+		return
+	}
+
+	a.logger.Info("Running scheduled command on request", zap.String("name", st.job.Name), zap.String("from", r.RemoteAddr))
+	go a.runScheduledJob(executable, st)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("started\n"))
+}
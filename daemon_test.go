@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithoutFlags(t *testing.T) {
+	tests := []struct {
+		args     []string
+		flags    []string
+		expected []string
+	}{
+		{
+			args:     []string{"--config", "pgcarpenter.yaml", "--listen-address", ":9187", "--verbose"},
+			flags:    []string{"listen-address"},
+			expected: []string{"--config", "pgcarpenter.yaml", "--verbose"},
+		},
+		{
+			args:     []string{"--listen-address=:9187", "--config", "pgcarpenter.yaml"},
+			flags:    []string{"listen-address"},
+			expected: []string{"--config", "pgcarpenter.yaml"},
+		},
+		{
+			args:     []string{"--config", "pgcarpenter.yaml"},
+			flags:    []string{"listen-address"},
+			expected: []string{"--config", "pgcarpenter.yaml"},
+		},
+		// only the whole flag
+		{
+			args:     []string{"--listen-address-file", "f", "--listen"},
+			flags:    []string{"listen-address"},
+			expected: []string{"--listen-address-file", "f", "--listen"},
+		},
+		// all of the daemon's own, including the token of the API, which mustn't show up in the arguments of commands
+		{
+			args:     []string{"--listen-address", ":9187", "--api-token", "secret", "--config", "pgcarpenter.yaml"},
+			flags:    daemonFlags,
+			expected: []string{"--config", "pgcarpenter.yaml"},
+		},
+		{
+			args:     []string{"--api-token=secret", "--verbose"},
+			flags:    daemonFlags,
+			expected: []string{"--verbose"},
+		},
+		{
+			args:     []string{"--a", "1", "--b=2", "--c", "3"},
+			flags:    []string{"a", "b"},
+			expected: []string{"--c", "3"},
+		},
+		// without its value, at the end
+		{
+			args:     []string{"--verbose", "--listen-address"},
+			flags:    []string{"listen-address"},
+			expected: []string{"--verbose"},
+		},
+		{
+			args:     []string{},
+			flags:    []string{"listen-address"},
+			expected: []string{},
+		},
+	}
+	for _, tt := range tests {
+		if kept := withoutFlags(tt.args, tt.flags); !reflect.DeepEqual(kept, tt.expected) {
+			t.Errorf("withoutFlags(%v, %v) = %v, expected %v", tt.args, tt.flags, kept, tt.expected)
+		}
+	}
+}
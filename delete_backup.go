@@ -1,81 +1,300 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/storage"
 	"go.uber.org/zap"
 )
 
+// delete the backup given by --backup-name, or the ones matching --match and/or --older-than, and print
+// the names of the ones deleted along with the bytes freed
 func (a *app) DeleteBackup() int {
-	a.logger.Info("Starting to delete backup", zap.String("name", *a.backupName))
 	begin := time.Now()
+	names, err := a.backupsToDelete()
+	if err != nil {
+		a.logger.Error("Failed to find the backups to delete", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+	if len(names) == 0 {
+		a.logger.Error("No backups to delete")
+		return exitNotFound
+	}
+	if *a.deleteDryRun {
+		return a.dryRunDelete(names)
+	}
+	// there's no undoing it
+	if !*a.confirmDelete {
+		a.logger.Error("Not deleting backups without --yes", zap.Strings("names", names))
+		return exitUsage
+	}
 
-	// make sure the backup exists
-	_, err := a.storage.GetString(*a.backupName + "/")
+	freed := int64(0)
+	failed := 0
+	deleted := make([]string, 0, len(names))
+	partial := make([]string, 0)
+	for _, name := range names {
+		stored, err := a.deleteBackup(name)
+		if err != nil {
+			a.logger.Error("Failed to delete backup", zap.String("name", name), zap.Error(err))
+			failed++
+			partial = append(partial, name)
+			continue
+		}
+		freed += stored
+		deleted = append(deleted, name)
+		fmt.Printf("Deleted %s (%s)\n", name, formatFreed(stored))
+	}
+	fmt.Printf("Deleted %d backups, freed %s\n", len(names)-failed, formatFreed(freed))
+
+	// update the reference to LATEST, and the catalog
+	a.updateReferenceToLatest(names)
+	a.uncatalogBackups(deleted)
+	// the ones that failed may no longer be successful (or have all their files)
+	for _, name := range partial {
+		a.catalogBackup(name)
+	}
+
+	event := notify.Event{
+		Operation:  "delete-backup",
+		BackupName: strings.Join(names, ", "),
+		Host:       notify.Hostname(),
+		Success:    failed == 0,
+		Start:      begin,
+		Duration:   time.Now().Sub(begin),
+		Bytes:      freed,
+	}
+	if failed > 0 {
+		event.Error = fmt.Sprintf("failed to delete %d of %d backups, see the logs", failed, len(names))
+	}
+	a.notify(event)
+
+	if failed == len(names) {
+		return exitStorage
+	}
+	if failed > 0 {
+		return exitPartial
+	}
+
+	return 0
+}
+
+// print the backups that would be deleted, and the bytes that would be freed, without deleting anything
+func (a *app) dryRunDelete(names []string) int {
+	total := int64(0)
+	for _, name := range names {
+		stored := int64(0)
+		if m, err := a.getManifest(name); err == nil {
+			stored = m.StoredSize
+		}
+		total += stored
+		fmt.Printf("Would delete %s (%s)\n", name, formatFreed(stored))
+	}
+	fmt.Printf("Would delete %d backups, freeing %s\n", len(names), formatFreed(total))
+
+	return 0
+}
+
+// return the names of the backups to delete: the one given by --backup-name, or the ones matching any
+// --match pattern (if any) and older than --older-than (if given); the latest successful backup is never
+// deleted by pattern or age, only when named explicitly
+func (a *app) backupsToDelete() ([]string, error) {
+	bulk := len(*a.deleteMatch) > 0 || *a.deleteOlderThan != ""
+	if *a.backupName != "" {
+		if bulk {
+			return nil, errors.New("--backup-name can't be combined with --match or --older-than")
+		}
+		exists, err := a.storage.Exists(a.ctx, *a.backupName+"/")
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("backup not found: %s", *a.backupName)
+		}
+		return []string{*a.backupName}, nil
+	}
+	if !bulk {
+		return nil, errors.New("either --backup-name, --match, or --older-than is required")
+	}
+
+	var cutoff int64
+	if *a.deleteOlderThan != "" {
+		age, err := parseAge(*a.deleteOlderThan)
+		if err != nil {
+			return nil, err
+		}
+		cutoff = time.Now().Add(-age).Unix()
+	}
+	// there's no latest successful backup to keep if there's no reference to it, but if it can't be told
+	// which one it is, nothing is deleted
+	latest, err := a.resolveLatest()
+	if errors.Is(err, storage.ErrNotFound) {
+		a.logger.Debug("No reference to LATEST", zap.Error(err))
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to resolve the reference to LATEST: %w", err)
+	}
+
+	// from the catalog
+	entries, err := a.catalogEntries()
 	if err != nil {
-		a.logger.Error("Backup not found", zap.String("name", *a.backupName), zap.Error(err))
-		return 1
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name
+		if len(*a.deleteMatch) > 0 && !matchesAny(name, *a.deleteMatch) {
+			continue
+		}
+		// backups whose age can't be told are kept
+		if cutoff > 0 && (e.Created == 0 || e.Created >= cutoff) {
+			continue
+		}
+		if name == latest {
+			a.logger.Warn("Not deleting the latest successful backup", zap.String("name", name))
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// return true iff name matches any of the (path.Match) patterns
+func matchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if match, _ := path.Match(p, name); match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// delete the backup, along with its successful marker and manifest, and return the bytes it took in remote
+// storage (0 if unknown)
+func (a *app) deleteBackup(name string) (int64, error) {
+	a.logger.Info("Starting to delete backup", zap.String("name", name))
+	begin := time.Now()
+
+	stored := int64(0)
+	if m, err := a.getManifest(name); err == nil {
+		stored = m.StoredSize
+	}
+
+	// remove the successful marker (if one exists) first, so that a backup that's only partially deleted
+	// isn't taken for a successful one
+	if err := a.deleteSuccessfulMarker(name); err != nil {
+		return 0, fmt.Errorf("failed to delete the successful marker: %w", err)
 	}
 
 	// traverse the backup directory and delete all objects
-	if err := a.traverseAndDelete(); err != nil {
-		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
-		return 1
+	if err := a.traverseAndDelete(name); err != nil {
+		return 0, err
 	}
 
 	// remove the top level folder
-	if err := a.storage.Delete(*a.backupName + "/"); err != nil {
-		a.logger.Error("Failed to delete the top level folder", zap.Error(err))
-		return 1
+	if err := a.storage.Delete(a.ctx, name+"/"); err != nil {
+		return 0, fmt.Errorf("failed to delete the top level folder: %w", err)
 	}
 
-	// remove the successful marker, if one exists
-	if err := a.deleteSuccessfulMarker(*a.backupName); err != nil {
-		a.logger.Error("Failed to delete successful marker", zap.Error(err))
+	// remove the manifest, if one exists
+	if err := a.deleteManifest(name); err != nil {
+		a.logger.Error("Failed to delete manifest", zap.Error(err))
 	}
 
-	// update the reference to LATEST
-	a.updateReferenceToLatest()
-
 	a.logger.Info(
 		"Backup successfully deleted",
+		zap.String("name", name),
 		zap.Duration("seconds", time.Now().Sub(begin)),
 	)
 
-	return 0
+	return stored, nil
+}
+
+// bytes freed by deleting backups, unknown for backups taken by older versions of pgCarpenter
+func formatFreed(n int64) string {
+	if n == 0 {
+		return "unknown size"
+	}
+
+	return formatBytes(n)
+}
+
+// parse an age, either as a Go duration (e.g., 36h) or in days (e.g., 90d)
+func parseAge(age string) (time.Duration, error) {
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("age ('%s') must be a positive number of days (e.g., 90d) or a duration (e.g., 36h)", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("age ('%s') must be a positive number of days (e.g., 90d) or a duration (e.g., 36h)", age)
+	}
+
+	return d, nil
+}
+
+func validateAge(args []string) error {
+	_, err := parseAge(args[0])
+
+	return err
+}
+
+// delete all objects in the backup folder; return an error if any of them is left
+func (a *app) traverseAndDelete(name string) error {
+	// kick off the (recursive) listing of all objects and storing their path in the keysC channel
+	failed, err := a.deleteKeys(func(keysC chan<- string) error {
+		return a.storage.WalkFolder(a.ctx, name+"/", keysC)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to traverse backup folder: %w", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d files of the backup", failed)
+	}
+
+	return nil
 }
 
-func (a *app) traverseAndDelete() error {
-	// channel to keep the path of all files that need to compressed and uploaded
+// spawn a pool of workers to delete the keys fed to them; return how many failed to be deleted
+func (a *app) deleteKeys(feed func(keysC chan<- string) error) (int64, error) {
 	keysC := make(chan string)
+	failed := int64(0)
 
-	// spawn a pool of workers
 	a.logger.Info("Spawning workers", zap.Int("number", *a.nWorkers))
 	wg := &sync.WaitGroup{}
 	wg.Add(*a.nWorkers)
 	for i := 0; i < *a.nWorkers; i++ {
-		go a.deleteWorker(keysC, wg)
+		go a.deleteWorker(keysC, &failed, wg)
 	}
 
-	// kick off the (recursive) listing of all objects and storing their path in the keysC channel
-	if err := a.storage.WalkFolder(*a.backupName+"/", keysC); err != nil {
-		return err
-	}
+	err := feed(keysC)
 
-	// close the channel to signal there are no more items and wait for all workers to finish
+	// close the channel to signal there are no more items and wait for all workers to finish (even if
+	// feeding them failed, so that they don't wait for more forever)
 	a.logger.Info("Waiting for all workers to finish")
 	close(keysC)
 	wg.Wait()
 
-	return nil
+	return atomic.LoadInt64(&failed), err
 }
 
-func (a *app) deleteWorker(keysC <-chan string, wg *sync.WaitGroup) {
-	// continuously receive file paths (relative to the data directory)
-	// from the filesC channel, add them to tar files of up to ~1GB, and upload them
+// delete the keys received from keysC, counting the ones that fail to be deleted in failed (atomically)
+func (a *app) deleteWorker(keysC <-chan string, failed *int64, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for {
@@ -84,15 +303,20 @@ func (a *app) deleteWorker(keysC <-chan string, wg *sync.WaitGroup) {
 			a.logger.Debug("No more files to delete")
 			return
 		}
+		// once the command gives up, the files still queued are left alone
+		if a.ctx.Err() != nil {
+			continue
+		}
 
 		a.logger.Debug("Deleting file", zap.String("key", key))
-		if err := a.storage.Delete(key); err != nil {
-			a.logger.Error("Failed to delete file", zap.String("key", key))
+		if err := a.storage.Delete(a.ctx, key); err != nil {
+			a.logger.Error("Failed to delete file", zap.String("key", key), zap.Error(err))
+			atomic.AddInt64(failed, 1)
 		}
 	}
 }
 
-func (a *app) updateReferenceToLatest() {
+func (a *app) updateReferenceToLatest(deleted []string) {
 	latest, err := a.resolveLatest()
 	if err != nil {
 		// nothing we can do
@@ -101,13 +325,17 @@ func (a *app) updateReferenceToLatest() {
 	}
 	a.logger.Debug("Found LATEST", zap.String("key", latest))
 
-	// if the backup we just deleted is not LATEST, there's nothing for us to do here
-	if *a.backupName != latest {
+	// if none of the backups we just deleted is LATEST, there's nothing for us to do here
+	wasLatest := false
+	for _, name := range deleted {
+		wasLatest = wasLatest || name == latest
+	}
+	if !wasLatest {
 		return
 	}
 
 	// fetch all allBackups at the root of the bucket
-	allBackups, err := a.storage.ListFolder("")
+	allBackups, err := a.storage.ListFolder(a.ctx, "")
 	if err != nil {
 		a.logger.Error("Failed to get all backups", zap.Error(err))
 	}
@@ -116,10 +344,10 @@ func (a *app) updateReferenceToLatest() {
 	newLatestKey := ""
 	newLatestMTime := int64(0)
 	for _, bkp := range allBackups {
-		mtime, err := a.storage.GetLastModifiedTime(bkp)
+		mtime, err := a.storage.GetLastModifiedTime(a.ctx, bkp)
 		if err == nil {
-			_, err = a.storage.GetString(a.getSuccessfulMarker(bkp))
-			if err == nil {
+			successful, err := a.storage.Exists(a.ctx, a.getSuccessfulMarker(bkp))
+			if err == nil && successful {
 				if mtime > newLatestMTime {
 					a.logger.Debug(
 						"Found most recent backup",
@@ -142,6 +370,34 @@ func (a *app) updateReferenceToLatest() {
 }
 
 func parseDeleteBackupArgs(cfg *app, parser *argparse.Command) {
-	// there are no options as of now, we just keep this around for consistency
-	// (and easy maintenance/future-proof?)
+	cfg.confirmDelete = boolFlag(
+		parser,
+		"",
+		"yes",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Confirm the backups are to be deleted (there's no undoing it)"})
+	cfg.deleteDryRun = boolFlag(
+		parser,
+		"",
+		"dry-run",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Only print the backups that would be deleted (no need for --yes)"})
+	cfg.deleteMatch = stringListFlag(
+		parser,
+		"",
+		"match",
+		&argparse.Options{
+			Required: false,
+			Help:     "Delete the backups matching this name or glob pattern, e.g., nightly-* (can be repeated)"})
+	cfg.deleteOlderThan = parser.String(
+		"",
+		"older-than",
+		&argparse.Options{
+			Required: false,
+			Validate: validateAge,
+			Help:     "Delete the backups older than this, in days (e.g., 90d) or as a duration (e.g., 36h)"})
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// delete the archived WAL that comes before --before (a segment, a timestamp, or the name of a backup);
+// refuses to delete any WAL a successful backup still needs, i.e., from the segment it started in onwards
+func (a *app) deleteWAL() int {
+	horizon, err := a.resolveWALHorizon(*a.walHorizon)
+	if err != nil {
+		a.logger.Error("Failed to resolve the WAL horizon", zap.String("before", *a.walHorizon), zap.Error(err))
+		return exitCode(err, exitUsage)
+	}
+	if err := a.checkWALHorizon(horizon); err != nil {
+		a.logger.Error("Refusing to delete WAL", zap.String("horizon", horizon), zap.Error(err))
+		return exitCode(err, exitValidation)
+	}
+	a.logger.Info("Deleting archived WAL", zap.String("before", horizon), zap.Bool("dry-run", *a.walDeleteDryRun))
+	begin := time.Now()
+
+	keys, err := a.walBefore(horizon)
+	if err != nil {
+		a.logger.Error("Failed to list archived WAL", zap.Error(err))
+		return exitStorage
+	}
+	if *a.walDeleteDryRun {
+		for _, k := range keys {
+			fmt.Printf("delete %s\n", k)
+		}
+		fmt.Printf("%d WAL files would be deleted\n", len(keys))
+		return 0
+	}
+
+	failed, err := a.deleteKeys(func(keysC chan<- string) error { return a.sendKeys(keys, keysC) })
+	if err != nil {
+		a.logger.Error("Gave up deleting archived WAL", zap.Error(err))
+		return exitFailure
+	}
+	if failed > 0 {
+		a.logger.Error("Failed to delete archived WAL", zap.Int64("failed", failed), zap.Int("files", len(keys)))
+		if failed == int64(len(keys)) {
+			return exitStorage
+		}
+		return exitPartial
+	}
+
+	a.logger.Info(
+		"Archived WAL deleted",
+		zap.Int("files", len(keys)),
+		zap.Duration("seconds", time.Now().Sub(begin)))
+
+	return 0
+}
+
+// return the segment before which archived WAL can be deleted, given a segment (as is), a timestamp (the
+// segment the newest successful backup started at, or before, then started in, so that it's still possible
+// to recover up to any time after it), or the name of a backup (the segment it started in)
+func (a *app) resolveWALHorizon(before string) (string, error) {
+	if walSegmentRE.MatchString(before) {
+		return before, nil
+	}
+	if t, err := time.Parse(time.RFC3339, before); err == nil {
+		manifests, _, err := a.successfulBackupManifests()
+		if err != nil {
+			return "", withExitCode(exitStorage, err)
+		}
+		var newest *backupManifest
+		for _, m := range manifests {
+			if !m.StartTime.After(t) && (newest == nil || m.StartTime.After(newest.StartTime)) {
+				newest = m
+			}
+		}
+		if newest == nil {
+			return "", fmt.Errorf("no successful backup started before %s", before)
+		}
+		return newest.StartWALFile, nil
+	}
+
+	m, err := a.getManifest(before)
+	if err != nil {
+		return "", fmt.Errorf("not a WAL segment, nor a timestamp, nor a backup with a manifest: %w", err)
+	}
+	if m.StartWALFile == "" {
+		return "", fmt.Errorf("the manifest of backup %s doesn't record its first WAL segment", before)
+	}
+
+	return m.StartWALFile, nil
+}
+
+// return an error if deleting the WAL before horizon would break any successful backup, including the ones
+// that don't record the segment they started in (all their WAL could be needed)
+func (a *app) checkWALHorizon(horizon string) error {
+	manifests, unknown, err := a.successfulBackupManifests()
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("can't tell which WAL successful backups %s need", strings.Join(unknown, ", "))
+	}
+	for _, m := range manifests {
+		if walPosition(m.StartWALFile) < walPosition(horizon) {
+			return fmt.Errorf("backup %s needs WAL from %s onwards", m.Name, m.StartWALFile)
+		}
+	}
+
+	return nil
+}
+
+// return the keys of the archived segments (including partial segments, and backup history files) that
+// come before horizon, on any timeline; timeline history files are kept, they're tiny, and recovery needs
+// them to follow timeline switches
+func (a *app) walBefore(horizon string) ([]string, error) {
+	keysC := make(chan string)
+	keys := make([]string, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := range keysC {
+			name := strings.TrimSuffix(util.TrimCompressionExtension(filepath.Base(key)), util.GzipExtension)
+			switch walFileKind(name) {
+			case walSegmentFile, walPartialSegmentFile, walBackupHistoryFile:
+				if walPosition(name) < walPosition(horizon) {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}()
+	err := a.storage.WalkFolder(a.ctx, walFolder+"/", keysC)
+	close(keysC)
+	<-done
+	sort.Strings(keys)
+
+	return keys, err
+}
+
+// return the position of the segment (named name, or the file named after it) in the WAL, regardless of
+// the timeline, i.e., log and segment, which sort in the order they were written
+func walPosition(name string) string {
+	return name[8:24]
+}
+
+func parseDeleteWALArgs(cfg *app, parser *argparse.Command) {
+	cfg.walHorizon = parser.String(
+		"",
+		"before",
+		&argparse.Options{
+			Required: true,
+			Help: "Delete the WAL before this segment, the first segment of this backup, or the first segment " +
+				"of the newest backup started before this time (RFC 3339, e.g., 2020-01-02T15:04:05Z)"})
+	cfg.walDeleteDryRun = boolFlag(
+		parser,
+		"",
+		"dry-run",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Only print the WAL files that would be deleted"})
+}
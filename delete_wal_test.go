@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestWALPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"000000010000000000000003", "0000000000000003"},
+		{"000000010000000000000003.partial", "0000000000000003"},
+		{"000000010000000000000003.00000028.backup", "0000000000000003"},
+		// the timeline doesn't matter
+		{"0000000A00000002000000FE", "00000002000000FE"},
+	}
+	for _, tt := range tests {
+		if position := walPosition(tt.name); position != tt.expected {
+			t.Errorf("walPosition(%s) = %s, expected %s", tt.name, position, tt.expected)
+		}
+	}
+}
+
+func TestWALPositionBefore(t *testing.T) {
+	tests := []struct {
+		name     string
+		horizon  string
+		expected bool
+	}{
+		{"000000010000000000000002", "000000010000000000000003", true},
+		{"000000010000000000000003", "000000010000000000000003", false},
+		{"000000010000000000000004", "000000010000000000000003", false},
+		// a partial segment, or a backup history file, is kept along with the segment it's named after
+		{"000000010000000000000002.partial", "000000010000000000000003", true},
+		{"000000010000000000000003.partial", "000000010000000000000003", false},
+		{"000000010000000000000002.00000028.backup", "000000010000000000000003", true},
+		{"000000010000000000000003.00000028.backup", "000000010000000000000003", false},
+		// across a log boundary, for any segment size
+		{"0000000100000000000000FF", "000000010000000100000000", true},
+		{"000000010000000000000FFF", "000000010000000100000000", true},
+		{"000000010000000100000000", "0000000100000000000000FF", false},
+		// on any timeline, as segments are written in the same order regardless of it
+		{"000000020000000000000002", "000000010000000000000003", true},
+		{"000000010000000000000004", "000000020000000000000003", false},
+		{"000000010000000000000003.partial", "000000020000000000000003", false},
+	}
+	for _, tt := range tests {
+		if before := walPosition(tt.name) < walPosition(tt.horizon); before != tt.expected {
+			t.Errorf("%s before %s = %t, expected %t", tt.name, tt.horizon, before, tt.expected)
+		}
+	}
+}
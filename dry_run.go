@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// what restoring a file would do, as found out by --dry-run
+type dryRunFile struct {
+	file string
+	// why the file would be skipped; empty if it would be downloaded
+	skipReason string
+	size       int64
+	storedSize int64
+}
+
+// print what restoring the backup would do, file by file, and how much would be transferred; exit status
+// of restore-backup --dry-run
+func (a *app) dryRunRestore() int {
+	keys, err := a.listBackupKeys()
+	if err != nil {
+		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+
+	// the metadata of each object is needed, which takes a request per object
+	keysC := make(chan string)
+	files := make([]dryRunFile, 0, len(keys))
+	mu := sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	wg.Add(*a.nWorkers)
+	for i := 0; i < *a.nWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keysC {
+				// once the command gives up, the keys still queued are left alone
+				if a.ctx.Err() != nil {
+					continue
+				}
+				f, err := a.dryRunFile(key)
+				if err != nil {
+					a.logger.Error("Failed to get metadata", zap.String("key", key), zap.Error(err))
+					continue
+				}
+				mu.Lock()
+				files = append(files, f)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		if !util.IsObjectDirectory(key) && a.isIncludedPath(strings.TrimPrefix(key, *a.backupName+"/")) {
+			keysC <- key
+		}
+	}
+	close(keysC)
+	wg.Wait()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].file < files[j].file })
+	var download, skip int
+	var size, storedSize int64
+	for _, f := range files {
+		if f.skipReason != "" {
+			fmt.Printf("skip     %s (%s)\n", f.file, f.skipReason)
+			skip++
+			continue
+		}
+		fmt.Printf("download %s (%s)\n", f.file, formatBytes(f.storedSize))
+		download++
+		size += f.size
+		storedSize += f.storedSize
+	}
+	fmt.Printf(
+		"%d files to download (%s to transfer, %s restored), %d files to skip\n",
+		download, formatBytes(storedSize), formatBytes(size), skip)
+
+	return 0
+}
+
+// return what restoring the object would do
+func (a *app) dryRunFile(key string) (dryRunFile, error) {
+	file := strings.TrimPrefix(key, *a.backupName+"/")
+	metadata, err := a.storage.GetMetadata(a.ctx, key)
+	if err != nil {
+		return dryRunFile{}, err
+	}
+	local := util.TrimCompressionExtension(filepath.Join(*a.pgDataDirectory, file))
+
+	return dryRunFile{
+		file:       util.TrimCompressionExtension(file),
+		skipReason: a.skipReason(local, metadata),
+		size:       metadata.Size,
+		storedSize: metadata.StoredSize,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+// prefix of the environment variables flags default to, e.g., PGCARPENTER_S3_BUCKET for --s3-bucket
+const envPrefix = "PGCARPENTER_"
+
+// return the environment variable the flag defaults to
+func flagEnvName(lname string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(lname, "-", "_", -1))
+}
+
+// return args with the flags (of the parser, and of the command being run) that weren't given on the
+// command line, but are set in the environment, appended; lists (e.g., --label) are split on commas, and
+// flags that don't take a value are given unless the variable is empty, 0, or false
+func withEnvDefaults(parser *argparse.Parser, args []string) []string {
+	flags := parser.GetArgs()
+	for _, cmd := range parser.GetCommands() {
+		if len(args) > 1 && cmd.GetName() == args[1] {
+			flags = append(flags, cmd.GetArgs()...)
+		}
+	}
+
+	given := make(map[string]bool)
+	for _, arg := range args[1:] {
+		given[strings.SplitN(arg, "=", 2)[0]] = true
+	}
+	withEnv := append([]string{}, args...)
+	for _, f := range flags {
+		lname := f.GetLname()
+		if lname == "" || lname == "help" || given["--"+lname] || (f.GetSname() != "" && given["-"+f.GetSname()]) {
+			continue
+		}
+		value, ok := os.LookupEnv(flagEnvName(lname))
+		if !ok {
+			continue
+		}
+		switch {
+		case boolFlags[lname]:
+			if value != "" && value != "0" && strings.ToLower(value) != "false" {
+				withEnv = append(withEnv, "--"+lname)
+			}
+		case listFlags[lname]:
+			for _, v := range strings.Split(value, ",") {
+				withEnv = append(withEnv, "--"+lname, v)
+			}
+		default:
+			withEnv = append(withEnv, "--"+lname, value)
+		}
+	}
+
+	return withEnv
+}
+
+// the flags whose value isn't taken as is from the environment (see withEnvDefaults), by long name: the ones
+// that don't take a value, and lists; recorded as they're registered (see boolFlag and stringListFlag), as
+// argparse doesn't tell
+var (
+	boolFlags = make(map[string]bool)
+	listFlags = make(map[string]bool)
+)
+
+// flagParser is what flags are registered with: an argparse.Parser, or one of its commands
+type flagParser interface {
+	Flag(short string, long string, opts *argparse.Options) *bool
+	StringList(short string, long string, opts *argparse.Options) *[]string
+}
+
+// register a flag that doesn't take a value, like parser.Flag does
+func boolFlag(parser flagParser, short string, long string, opts *argparse.Options) *bool {
+	boolFlags[long] = true
+
+	return parser.Flag(short, long, opts)
+}
+
+// register a flag that can be given more than once, like parser.StringList does
+func stringListFlag(parser flagParser, short string, long string, opts *argparse.Options) *[]string {
+	listFlags[long] = true
+
+	return parser.StringList(short, long, opts)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+	"github.com/thumbtack/pgCarpenter/storage"
+)
+
+// exit statuses, so that wrapper scripts (and archive_command monitoring) can tell failures apart; they're
+// all below 126, as PostgreSQL takes higher ones from archive_command to mean it was killed. The exit
+// statuses of restore-wal are dictated by restore_command instead (see restore_wal.go), and the ones of
+// check-archive by Nagios (see check_archive.go)
+const (
+	// anything not covered below (e.g., failing to write a local file)
+	exitFailure = 1
+	// invalid flags or configuration (including combinations of them)
+	exitUsage = 2
+	// remote storage failed (e.g., bad credentials, or network issues after retrying)
+	exitStorage = 3
+	// connecting to, or querying, PostgreSQL failed
+	exitPostgreSQL = 4
+	// some of the work was done, but not all of it (e.g., a backup that's missing files, or deleting only
+	// some of the backups)
+	exitPartial = 5
+	// something failed a check (e.g., the checksums of restored files, or the WAL segments backups need)
+	exitValidation = 6
+	// the backup (or WAL segment, or database) doesn't exist
+	exitNotFound = 7
+)
+
+// an error to be reported with a given exit status (see withExitCode)
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// return err (unless it's nil) wrapped so that it's reported with the exit status code (see exitCode)
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &exitError{code: code, err: err}
+}
+
+// return the exit status to report err with: the one it was wrapped with (the outermost, see withExitCode),
+// or else the one its cause calls for (e.g., exitNotFound for storage.ErrNotFound), or else fallback
+func exitCode(err error, fallback int) int {
+	var wrapped *exitError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &wrapped):
+		return wrapped.code
+	case errors.Is(err, storage.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, errBackupAborted), errors.As(err, &pqErr):
+		return exitPostgreSQL
+	}
+
+	return fallback
+}
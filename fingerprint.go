@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/notify"
+	"go.uber.org/zap"
+)
+
+// folder with the fingerprint of the archive settings of each host archiving WAL segments to the bucket
+const archiversFolder = "archivers"
+
+// settings that must be the same on all hosts archiving to the same bucket; otherwise segments archived
+// by one host may not be restorable with the settings of another one
+type archiveSettings struct {
+	Bucket      string `json:"bucket"`
+	Prefix      string `json:"prefix"`
+	Compression string `json:"compression"`
+	// as WAL segments are compressed (see walCompressOptions)
+	CompressionLevel int   `json:"compression_level"`
+	LZ4BlockSize     int   `json:"lz4_block_size"`
+	LZ4BlockChecksum bool  `json:"lz4_block_checksum"`
+	ZstdThreshold    int64 `json:"zstd_threshold"`
+	ZstdWindow       int   `json:"zstd_window"`
+	// WAL segments are stored as they're compressed, encrypted (at rest) only as the bucket is configured
+	// to, which is the same for all hosts
+	Encryption string `json:"encryption"`
+}
+
+// archiveFingerprint is stored in archiversFolder/<host> by archive-wal
+type archiveFingerprint struct {
+	Host        string          `json:"host"`
+	Settings    archiveSettings `json:"settings"`
+	Fingerprint string          `json:"fingerprint"`
+	Version     string          `json:"version"`
+	UpdatedTime time.Time       `json:"updated_time"`
+}
+
+// return the fingerprint of the settings this host archives WAL segments with
+func (a *app) currentArchiveFingerprint() archiveFingerprint {
+	compression := a.walCompressOptions()
+	settings := archiveSettings{
+		Bucket:           *a.s3Bucket,
+		Prefix:           walFolder,
+		Compression:      strings.TrimPrefix(compression.Extension(0), "."),
+		CompressionLevel: compression.Level,
+		LZ4BlockSize:     compression.BlockSize,
+		LZ4BlockChecksum: compression.BlockChecksum,
+		ZstdThreshold:    compression.ZstdThreshold,
+		ZstdWindow:       compression.ZstdWindow,
+		Encryption:       "none",
+	}
+	// with --storage-url, the bucket is wherever the URL points to (without the backend settings)
+	if *a.storageURL != "" {
+		settings.Bucket = a.folderLocation("")
+	}
+	// marshaling a struct is deterministic, so is the hash
+	contents, _ := json.Marshal(settings)
+	sum := sha256.Sum256(contents)
+
+	return archiveFingerprint{
+		Host:        notify.Hostname(),
+		Settings:    settings,
+		Fingerprint: hex.EncodeToString(sum[:8]),
+		Version:     version,
+		UpdatedTime: time.Now(),
+	}
+}
+
+// store the fingerprint of this host's archive settings, if it changed since the last time it was stored
+// (so that, most of the time, this costs a single GET), and warn about other hosts archiving with conflicting
+// settings
+func (a *app) recordArchiveFingerprint() error {
+	current := a.currentArchiveFingerprint()
+	key := filepath.Join(archiversFolder, current.Host)
+
+	if previous, err := a.getArchiveFingerprint(key); err == nil && previous.Fingerprint == current.Fingerprint {
+		return nil
+	}
+
+	a.logger.Info(
+		"Recording archive settings fingerprint",
+		zap.String("host", current.Host),
+		zap.String("fingerprint", current.Fingerprint))
+	contents, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := a.storage.PutString(a.ctx, key, string(contents)); err != nil {
+		return err
+	}
+
+	fingerprints, err := a.listArchiveFingerprints()
+	if err != nil {
+		return err
+	}
+	for _, fp := range conflictingFingerprints(current, fingerprints) {
+		a.logger.Warn(
+			"Another host archives WAL segments to the same bucket with different settings",
+			zap.String("host", fp.Host),
+			zap.String("fingerprint", fp.Fingerprint),
+			zap.Any("settings", fp.Settings),
+			zap.Time("updated", fp.UpdatedTime),
+			zap.String("local_fingerprint", current.Fingerprint),
+			zap.Any("local_settings", current.Settings))
+	}
+
+	return nil
+}
+
+func (a *app) getArchiveFingerprint(key string) (archiveFingerprint, error) {
+	fp := archiveFingerprint{}
+	contents, err := a.storage.GetString(a.ctx, key)
+	if err != nil {
+		return fp, err
+	}
+	err = json.Unmarshal([]byte(contents), &fp)
+
+	return fp, err
+}
+
+// return the fingerprints of all hosts archiving to the bucket
+func (a *app) listArchiveFingerprints() ([]archiveFingerprint, error) {
+	keysC := make(chan string)
+	keys := make(chan []string)
+	go func() {
+		found := make([]string, 0)
+		for k := range keysC {
+			found = append(found, k)
+		}
+		keys <- found
+	}()
+	err := a.storage.WalkFolder(a.ctx, archiversFolder+"/", keysC)
+	close(keysC)
+	found := <-keys
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := make([]archiveFingerprint, 0, len(found))
+	for _, k := range found {
+		fp, err := a.getArchiveFingerprint(k)
+		if err != nil {
+			a.logger.Warn("Failed to read archive settings fingerprint", zap.String("key", k), zap.Error(err))
+			continue
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+
+	return fingerprints, nil
+}
+
+// return an error naming the hosts archiving to the bucket with different settings (as last recorded by
+// archive-wal on each of them), if there are any
+func (a *app) checkArchiveSettings() error {
+	fingerprints, err := a.listArchiveFingerprints()
+	if err != nil {
+		return err
+	}
+	hosts := make(map[string][]string)
+	for _, fp := range fingerprints {
+		hosts[fp.Fingerprint] = append(hosts[fp.Fingerprint], fp.Host)
+	}
+	if len(hosts) <= 1 {
+		return nil
+	}
+
+	conflicts := make([]string, 0, len(hosts))
+	for fingerprint, h := range hosts {
+		sort.Strings(h)
+		conflicts = append(conflicts, fmt.Sprintf("%s on %s", fingerprint, strings.Join(h, ", ")))
+	}
+	sort.Strings(conflicts)
+
+	return fmt.Errorf("hosts archive WAL to the bucket with different settings (fingerprints %s, see %s/)",
+		strings.Join(conflicts, "; "), archiversFolder)
+}
+
+// return the fingerprints (of other hosts) that don't match current
+func conflictingFingerprints(current archiveFingerprint, fingerprints []archiveFingerprint) []archiveFingerprint {
+	conflicts := make([]archiveFingerprint, 0)
+	for _, fp := range fingerprints {
+		if fp.Host != current.Host && fp.Fingerprint != current.Fingerprint {
+			conflicts = append(conflicts, fp)
+		}
+	}
+
+	return conflicts
+}
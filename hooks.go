@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// describes the backup to the commands run by hooks, in PGCARPENTER_* environment variables
+type hookEnv struct {
+	name     string
+	status   string // "started", "success", or "failure"
+	err      error
+	files    int64
+	bytes    int64
+	duration time.Duration
+}
+
+// run the (shell) command of the hook (e.g., --pre-backup-cmd), if any, with the environment variables
+// describing the backup; its output is logged
+func (a *app) runHook(hook string, command string, env hookEnv) error {
+	if command == "" {
+		return nil
+	}
+
+	a.logger.Info("Running hook", zap.String("hook", hook), zap.String("command", command))
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(
+		os.Environ(),
+		"PGCARPENTER_HOOK="+hook,
+		"PGCARPENTER_BACKUP_NAME="+env.name,
+		"PGCARPENTER_DATA_DIRECTORY="+strings.TrimSuffix(*a.pgDataDirectory, "/"),
+		"PGCARPENTER_STATUS="+env.status,
+		"PGCARPENTER_FILES="+strconv.FormatInt(env.files, 10),
+		"PGCARPENTER_BYTES="+strconv.FormatInt(env.bytes, 10),
+		"PGCARPENTER_DURATION="+strconv.FormatInt(int64(env.duration.Seconds()), 10))
+	if env.err != nil {
+		cmd.Env = append(cmd.Env, "PGCARPENTER_ERROR="+env.err.Error())
+	}
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		a.logger.Info("Hook output", zap.String("hook", hook), zap.String("output", string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("%s command failed: %w", hook, err)
+	}
+
+	return nil
+}
+
+// return the status of the operation that ended with err, for hooks
+func hookStatus(err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
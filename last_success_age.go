@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"go.uber.org/zap"
+)
+
+// exit status of last-success-age when the latest successful backup is older than --max-age, different
+// from the ones of errors so that monitoring can tell a stale backup from a failed check
+const staleBackupExitStatus = exitValidation
+
+// print the number of seconds since the latest successful backup was completed, for monitoring scripts
+func (a *app) lastSuccessAge() int {
+	latest, err := a.resolveLatest()
+	if err != nil {
+		a.logger.Error("Failed to get the name of the latest successful backup", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+	// the marker is created once the backup is completed
+	completed, err := a.storage.GetLastModifiedTime(a.ctx, a.getSuccessfulMarker(latest))
+	if err != nil {
+		a.logger.Error("Failed to get the time the latest backup was completed", zap.String("name", latest), zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+
+	age := int64(time.Now().Sub(time.Unix(completed, 0)).Seconds())
+	fmt.Println(age)
+
+	if *a.maxAge > 0 && age > int64(*a.maxAge) {
+		return staleBackupExitStatus
+	}
+
+	return 0
+}
+
+func parseLastSuccessAgeArgs(cfg *app, parser *argparse.Command) {
+	cfg.maxAge = parser.Int(
+		"",
+		"max-age",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help: fmt.Sprintf("Exit with %d if the latest successful backup is older than this many seconds "+
+				"(0 disables it)", staleBackupExitStatus)})
+}
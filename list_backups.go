@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/akamensky/argparse"
@@ -10,63 +11,45 @@ import (
 )
 
 func (a *app) listBackups() int {
-	type backupEntry struct {
-		name       string
-		timestamp  int64
-		successful bool
-	}
-
-	format := "%-34s%-28s%s"
-	backups := make([]backupEntry, 0)
+	format := "%-34s%-28s%-10s%-10s%s"
 
-	// fetch all keys at the root of the bucket
-	keys, err := a.storage.ListFolder("")
+	// from the catalog
+	backups, err := a.catalogEntries()
 	if err != nil {
 		a.logger.Error("Failed to list backups", zap.Error(err))
-	}
-
-	for _, k := range keys {
-		// remove the trailing slash from the backup's name
-		backupName := k[:len(k)-1]
-		// ignore the folder used to mark successful backups and the one we keep WAL segments in
-		if backupName == successfullyCompletedFolder || backupName == walFolder {
-			continue
-		}
-
-		bkp := backupEntry{name: backupName, timestamp: 0}
-		// try to get the object's last modified timestamp
-		mtime, err := a.storage.GetLastModifiedTime(k)
-		if err == nil {
-			bkp.timestamp = mtime
-		}
-
-		// was this backup successfully completed?
-		_, err = a.storage.GetString(a.getSuccessfulMarker(backupName))
-		bkp.successful = err == nil
-
-		backups = append(backups, bkp)
+		return exitStorage
 	}
 
 	// try to get the name of the latest backup
-	latest, err := a.storage.GetString(latestKey)
+	latest, err := a.storage.GetString(a.ctx, latestKey)
 	if err != nil {
 		latest = ""
 	}
 
 	// sort by timestamp asc
 	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].timestamp < backups[j].timestamp
+		return backups[i].Created < backups[j].Created
 	})
 
 	// formatted output
-	fmt.Printf(format, "Name", "Created", "\n")
+	if *a.listWAL {
+		format = "%-34s%-28s%-10s%-10s%-52s%s"
+		fmt.Printf(format, "Name", "Created", "Size", "Duration", "WAL", "\n")
+	} else {
+		fmt.Printf(format, "Name", "Created", "Size", "Duration", "\n")
+	}
 	for _, b := range backups {
-		fmt.Printf(format, b.name, formatTime(b.timestamp), formatStatus(b.successful))
+		columns := []interface{}{b.Name, formatTime(b.Created), formatSize(b.Size), formatDuration(b.Duration)}
+		if *a.listWAL {
+			columns = append(
+				columns, formatWALRange(&backupManifest{StartWALFile: b.StartWALFile, StopWALFile: b.StopWALFile}))
+		}
+		fmt.Printf(format, append(columns, formatStatus(b.Successful, b.Aborted))...)
 		endLine := ""
-		if b.name == latest {
-			endLine = "(LATEST)"
+		if b.Name == latest {
+			endLine = "(LATEST) "
 		}
-		fmt.Println(endLine)
+		fmt.Println(endLine + formatDescription(b.Comment, b.Labels))
 	}
 
 	return 0
@@ -78,7 +61,40 @@ func formatTime(mtime int64) string {
 	return t.Format(time.RFC3339)
 }
 
-func formatStatus(success bool) string {
+// unknown (i.e., empty) for backups taken by older versions of pgCarpenter
+func formatSize(size int64) string {
+	if size == 0 {
+		return ""
+	}
+
+	return formatBytes(size)
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+
+	return d.Round(time.Second).String()
+}
+
+// the segments needed to make the backup consistent, e.g., `000000010000000000000002 - 000000010000000000000004`;
+// unknown (i.e., empty) for backups taken by older versions of pgCarpenter
+func formatWALRange(m *backupManifest) string {
+	if m.StartWALFile == "" {
+		return ""
+	}
+	if m.StopWALFile == "" {
+		return m.StartWALFile + " - ?"
+	}
+
+	return m.StartWALFile + " - " + m.StopWALFile
+}
+
+func formatStatus(success bool, aborted bool) string {
+	if aborted {
+		return "(aborted!) "
+	}
 	if !success {
 		return "(incomplete!) "
 	}
@@ -86,7 +102,33 @@ func formatStatus(success bool) string {
 	return ""
 }
 
+// return the comment followed by the labels (sorted by key), e.g., `pre-upgrade snapshot [env=prod]`
+func formatDescription(comment string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+
+	description := comment
+	if len(pairs) > 0 {
+		description = strings.TrimSpace(description + " [" + strings.Join(pairs, ", ") + "]")
+	}
+
+	return description
+}
+
 func parseListBackupsArgs(cfg *app, parser *argparse.Command) {
-	// there are no options as of now, we just keep this around for consistency
-	// (and easy maintenance/future-proof?)
+	cfg.listWAL = boolFlag(
+		parser,
+		"",
+		"wal",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Show the WAL segments needed to make each backup consistent"})
 }
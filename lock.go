@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/storage"
+	"go.uber.org/zap"
+)
+
+// folder with a lock object, named after the system identifier of the cluster, for each backup in progress
+const locksFolder = "locks"
+
+// backupLock is stored as JSON in locksFolder/<system identifier> while a backup of the cluster is in progress
+type backupLock struct {
+	BackupName string    `json:"backup_name"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	DataDir    string    `json:"data_directory"`
+	Time       time.Time `json:"time"`
+}
+
+// make sure no other backup of the same cluster is in progress, neither on this host (with an flock on the
+// data directory) nor on any other (e.g., a standby) backing up to the same bucket (with a lock object in
+// remote storage); the returned function releases both locks. Remote storage has no way of creating objects
+// only if they don't exist, so the lock object doesn't protect against backups started at the very same
+// time, but it does against backups started while another one is running. With --force-unlock, a lock
+// object left behind by a backup that was killed is ignored (and replaced).
+func (a *app) lockBackup() (unlock func(), err error) {
+	dir, err := os.Open(*a.pgDataDirectory)
+	if err != nil {
+		return nil, err
+	}
+	// released by the kernel if we're killed, nothing is ever left behind
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		dir.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("another backup of %s is in progress on this host", *a.pgDataDirectory)
+		}
+		return nil, err
+	}
+	unlockLocal := func() {
+		syscall.Flock(int(dir.Fd()), syscall.LOCK_UN)
+		dir.Close()
+	}
+
+	id, err := systemIdentifier(*a.pgDataDirectory)
+	if err != nil {
+		unlockLocal()
+		return nil, fmt.Errorf("failed to read the system identifier of the cluster: %w", err)
+	}
+	key := filepath.Join(locksFolder, strconv.FormatUint(id, 10))
+
+	// only if there's certainly no lock, not if it can't be told (e.g., S3 throttling us)
+	lock, err := a.storage.GetString(a.ctx, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		unlockLocal()
+		return nil, fmt.Errorf("failed to check the backup lock: %w", err)
+	}
+	if err == nil {
+		held := backupLock{}
+		if err := json.Unmarshal([]byte(lock), &held); err != nil {
+			a.logger.Warn("Failed to decode backup lock", zap.String("key", key), zap.Error(err))
+		}
+		if !*a.forceUnlock {
+			unlockLocal()
+			return nil, fmt.Errorf(
+				"backup %s of the same cluster has been in progress on %s (pid %d) since %s; if it's no longer "+
+					"running, use --force-unlock",
+				held.BackupName, held.Host, held.PID, held.Time.Format(time.RFC3339))
+		}
+		a.logger.Warn(
+			"Ignoring the lock of another backup",
+			zap.String("name", held.BackupName),
+			zap.String("host", held.Host),
+			zap.Int("pid", held.PID))
+	}
+
+	contents, err := json.Marshal(backupLock{
+		BackupName: *a.backupName,
+		Host:       notify.Hostname(),
+		PID:        os.Getpid(),
+		DataDir:    *a.pgDataDirectory,
+		Time:       time.Now(),
+	})
+	if err != nil {
+		unlockLocal()
+		return nil, err
+	}
+	if err := a.storage.PutString(a.ctx, key, string(contents)); err != nil {
+		unlockLocal()
+		return nil, fmt.Errorf("failed to create the backup lock: %w", err)
+	}
+
+	return func() {
+		// even once the command gave up, or the next backup would have to --force-unlock
+		ctx, cancel := a.cleanupContext()
+		defer cancel()
+		if err := a.storage.Delete(ctx, key); err != nil {
+			a.logger.Error("Failed to remove the backup lock", zap.String("key", key), zap.Error(err))
+		}
+		unlockLocal()
+	}, nil
+}
+
+// return the database system identifier of the cluster in dataDirectory, i.e., the first field of pg_control
+// (which is written in the byte order of the server, i.e., little-endian on any platform we run on)
+func systemIdentifier(dataDirectory string) (uint64, error) {
+	f, err := os.Open(filepath.Join(dataDirectory, "global", "pg_control"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var id uint64
+	if err := binary.Read(f, binary.LittleEndian, &id); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
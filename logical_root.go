@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// when backing up a snapshot (e.g., mounted at /snap), absolute paths found in it (the targets of symlinks,
+// the locations of tablespaces) are the ones of the host it was taken on; with --logical-root, they're
+// looked up relative to the root of the snapshot instead (e.g., /var/lib/pg_tblspc/ts in /snap/var/lib/...)
+// rather than on the live file system, while they're still recorded as they are in the manifest
+
+// return where to find the absolute path of the snapshotted host (as is, without --logical-root)
+func (a *app) snapshotPath(path string) string {
+	if *a.logicalRoot == "" || !filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(*a.logicalRoot, path)
+}
+
+// return the local path to read the file at path (relative to the data directory) from; files symlinked
+// to absolute paths are read from the snapshot (rather than the live host) with --logical-root
+func (a *app) localPath(path string) string {
+	local := filepath.Join(*a.pgDataDirectory, path)
+	if *a.logicalRoot == "" {
+		return local
+	}
+	if target, err := os.Readlink(local); err == nil && filepath.IsAbs(target) {
+		return a.snapshotPath(target)
+	}
+
+	return local
+}
+
+// return the path of the data directory on the host the backup is taken from (i.e., relative to the
+// logical root, if any)
+func (a *app) logicalDataDirectory() (string, error) {
+	dataDirectory := strings.TrimSuffix(*a.pgDataDirectory, "/")
+	if *a.logicalRoot == "" {
+		return dataDirectory, nil
+	}
+
+	root, err := filepath.Abs(*a.logicalRoot)
+	if err != nil {
+		return "", err
+	}
+	relative, err := filepath.Rel(root, dataDirectory)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("data directory (%s) is not inside the logical root (%s)", dataDirectory, root)
+	}
+
+	return filepath.Join("/", relative), nil
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/metrics"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/progress"
+	"github.com/thumbtack/pgCarpenter/statsd"
 	"github.com/thumbtack/pgCarpenter/storage"
-	"github.com/thumbtack/pgCarpenter/storage/s3storage"
+	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -17,6 +27,7 @@ import (
 const (
 	walFolder                   = "WAL"
 	successfullyCompletedFolder = "successful"
+	manifestFolder              = "manifest"
 	latestKey                   = "LATEST"
 	backupNameRE                = "^[a-zA-Z0-9_-]+$"
 )
@@ -26,15 +37,52 @@ var gitCommit string
 
 type app struct {
 	// common
-	s3Region        *string
-	s3Bucket        *string
-	s3MaxRetries    *int
-	backupName      *string // only required by create, restore, and delete
-	pgDataDirectory *string // only required by create and restore
-	nWorkers        *int    // only create, restore, and delete can effectively use > 1
-	walPath         *string // only required by archive-wal and restore-wal
-	tmpDirectory    *string
-	verbose         *bool
+	storageURL          *string
+	s3Region            *string
+	s3Bucket            *string
+	s3MaxRetries        *int
+	s3PartSize          *int
+	s3Concurrency       *int
+	storageRetries      *int
+	storageRetryBackoff *int
+	storageOpTimeout    *int
+	s3UserAgent         *string
+	s3RequestPayer      *string
+	maxUploadRate       *int // only used by create-backup and archive-wal
+	maxDownloadRate     *int // only used by restore-backup and restore-wal
+	slowStart           *int
+	backupName          *string // only required by create, restore, report, and backup-info
+	pgDataDirectory     *string // only required by create, restore, and check-archive
+	workers             *string
+	compressionWorkers  *string
+	walPath             *string // only required by archive-wal and restore-wal
+	spoolDirectory      *string // only used by archive-wal and wal-uploader
+	tmpDirectory        *string
+	compressionLevel    *int    // only used by create-backup and archive-wal
+	lz4BlockSize        *string // ditto
+	lz4BlockChecksum    *bool   // ditto
+	zstdThreshold       *int    // ditto
+	zstdWindow          *string // ditto
+	verbose             *bool
+	configFile          *string
+	timeout             *int
+	smtpServer          *string
+	mailTo              *[]string
+	mailFrom            *string
+	smtpUser            *string
+	smtpPassword        *string
+	slackWebhook        *string
+	webhookURLs         *[]string
+	snsTopic            *string
+	healthcheckURL      *string
+	progressSocket      *string
+	progressInterval    *int
+	pushgateway         *string
+	metricsFile         *string
+	statsdAddress       *string
+	statsdNamespace     *string
+	statsdTags          *[]string
+	progressBar         *bool
 	// set on create_backup.go
 	pgUser            *string
 	pgPassword        *string
@@ -42,13 +90,131 @@ type app struct {
 	backupCheckpoint  *bool
 	statementTimeout  *int
 	compressThreshold *int
+	noCompression     *bool
+	checksumAlgorithm *string
+	resume            *bool
+	excludes          *[]string
+	excludeFile       *string
+	includeTransient  *bool
+	fileList          *string
+	logicalRoot       *string
+	forceUnlock       *bool
+	preBackupCmd      *string
+	postBackupCmd     *string
+	maxDuration       *int
+	comment           *string
+	unreadableFiles   *string
+	onError           *string
+	labels            *[]string
 	// set on restore_backup.go
-	modifiedOnly *bool
+	modifiedOnly        *bool
+	checksumDelta       *bool
+	restoreResume       *bool
+	verifyRestore       *bool
+	dryRun              *bool
+	includePaths        *[]string
+	materializeSymlinks *bool
+	preallocate         *bool
+	priorityDatabase    *string
+	postRestoreCmd      *string
+	forceRestore        *bool
+	tablespaceMap       *[]string
+	tablespaceRootDir   *string
+	recoveryMode        *string
+	targetTime          *string
+	targetXID           *string
+	targetLSN           *string
+	targetName          *string
+	targetAction        *string
+	targetTimeline      *string
+	// set on list_backups.go
+	listWAL *bool
+	// set on backup_info.go
+	infoJSON *bool
+	// set on daemon.go
+	listenAddress *string
+	apiToken      *string
+	// set on preflight.go
+	checkPGUser       *string
+	checkPGPassword   *string
+	checkSSLMode      *string
+	skipPostgresCheck *bool
+	minTmpSpace       *int
+	// set on delete_backup.go
+	confirmDelete   *bool
+	deleteMatch     *[]string
+	deleteOlderThan *string
+	deleteDryRun    *bool
+	// set on repair_markers.go
+	repairDryRun *bool
+	// set on report.go
+	signingKey   *string
+	reportOutput *string
+	// set on check_restore.go
+	checkEvery  *int
+	keepRestore *bool
+	// set on archive_agent.go
+	agentSocket *string
+	// set on last_success_age.go
+	maxAge *int
+	// set on archive_wal.go
+	archiveBatch  *int
+	checkWALPages *bool
+	// set on wal_spool.go
+	spoolPollInterval *int
+	// set on wal_show.go
+	walSegmentSize *int
+	// set on check_archive.go
+	warningSegments  *int
+	criticalSegments *int
+	warningSeconds   *int
+	criticalSeconds  *int
+	// set on receive_wal.go
+	receiveDirectory    *string
+	receiveCommand      *string
+	receiveHost         *string
+	receivePort         *string
+	receiveUser         *string
+	receivePassword     *string
+	receiveSlot         *string
+	receivePollInterval *int
+	// set on delete_wal.go
+	walHorizon      *string
+	walDeleteDryRun *bool
 	// set on restore_wal.go
-	walFileName *string
+	walFileName  *string
+	prefetch     *int
+	prefetchOnly *bool
 	// internal
-	storage storage.Storage
-	logger  *zap.Logger
+	storage          storage.Storage
+	logger           *zap.Logger
+	uploadedKeys     map[string]bool   // keys already uploaded by an interrupted backup (only set with --resume)
+	resumedChecksums map[string]string // checksums of the files uploaded by an interrupted backup (ditto)
+	uploadErr        error             // aborting the backup being created (guarded by manifestMu)
+	failedUploads    int               // files of the backup being created that failed to upload (guarded by manifestMu)
+	excludePatterns  []string          // user provided patterns of files not to backup
+	config           *config
+	notifiers        []notify.Notifier
+	manifest         *backupManifest   // of the backup being created
+	manifestMu       sync.Mutex        // guards manifest while the backup is being created
+	restoredSymlinks map[string]bool   // paths of the symlinks recreated by the restore
+	restoreState     *restoreState     // files restored so far (only set by restore-backup)
+	badFiles         []string          // restored files that are corrupted or failed --verify (guarded by manifestMu)
+	failedFiles      []string          // files that couldn't be restored (ditto)
+	failedDownloads  bool              // whether any of them because downloading failed (ditto)
+	restoreChecksums map[string]string // checksums of the files in the backup, from its manifest (if any)
+	tablespaceRoot   string            // if set, tablespaces are restored to <tablespaceRoot>/<oid> instead
+	deadline         time.Time         // by when the backup being created must be done (only set with --max-duration)
+	nWorkers         *int              // set by sizeWorkers; only create, restore, and delete can effectively use > 1
+	compressionSlots chan struct{}     // see acquireCompression
+	storedBytes      int64             // stored in remote storage by the backup being created (updated atomically)
+	uploadCounts     uploadCounts      // of the backup being created
+	progressSink     *progress.Socket
+	progress         *progress.Reporter // of the backup being created or restored
+	metrics          *metrics.Registry
+	statsd           *statsd.Client    // nil unless --statsd-address is set
+	schedules        []*scheduleStatus // only set by daemon
+	ctx              context.Context   // done once the command must give up (on --timeout, or a signal)
 }
 
 func initLogging() (*zap.Logger, *zap.AtomicLevel) {
@@ -73,19 +239,27 @@ func parseArgs(a *app) func() int {
 		"PostgreSQL Continuous Archiving and Point-in-Time Recovery")
 
 	// flags common to all sub-commands
+	a.storageURL = parser.String(
+		"",
+		"storage-url",
+		&argparse.Options{
+			Required: false,
+			Help:     "URL of the storage where to push/fetch backups to/from (e.g., s3://bucket?region=us-west-2); overrides --s3-bucket, --s3-region, --s3-part-size, --s3-concurrency, and --request-payer"})
 	a.s3Region = parser.String(
 		"",
 		"s3-region",
 		&argparse.Options{
 			Required: false,
 			Default:  "us-east-1",
-			Help:     "AWS region where the S3 bucket lives in"})
+			Help: "AWS region where the S3 bucket lives in; if not given, the bucket's region is looked up " +
+				"(which takes s3:GetBucketLocation) every time pgCarpenter runs"})
 	a.s3Bucket = parser.String(
 		"",
 		"s3-bucket",
 		&argparse.Options{
-			Required: len(os.Args) > 1 && os.Args[1] != "version",
-			Help:     "S3 bucket where to push/fetch backups to/from"})
+			Required: len(os.Args) > 1 && os.Args[1] != "version" &&
+				!flagGiven("storage-url") && os.Getenv(flagEnvName("storage-url")) == "",
+			Help: "S3 bucket where to push/fetch backups to/from (required unless --storage-url is given)"})
 	a.s3MaxRetries = parser.Int(
 		"",
 		"s3-max-retries",
@@ -93,42 +267,311 @@ func parseArgs(a *app) func() int {
 			Required: false,
 			Default:  3,
 			Help:     "Maximum number of attempts at connecting to S3"})
+	a.s3PartSize = parser.Int(
+		"",
+		"s3-part-size",
+		&argparse.Options{
+			Required: false,
+			Default:  32,
+			Validate: validateS3PartSize,
+			Help:     "Size, in MB, of the parts of multipart uploads and downloads (5 to 5120); objects can have at most 10000 parts"})
+	a.s3Concurrency = parser.Int(
+		"",
+		"s3-concurrency",
+		&argparse.Options{
+			Required: false,
+			Default:  32,
+			Validate: validateS3Concurrency,
+			Help:     "Number of parts of each file uploaded or downloaded at a time (on top of --workers files at a time)"})
+	a.storageRetries = parser.Int(
+		"",
+		"storage-retries",
+		&argparse.Options{
+			Required: false,
+			Default:  5,
+			Validate: validateStorageRetries,
+			Help:     "Number of times storage operations that fail with a transient error (e.g., throttling, timeouts) are tried again, on top of --s3-max-retries; 0 disables them"})
+	a.storageRetryBackoff = parser.Int(
+		"",
+		"storage-retry-backoff",
+		&argparse.Options{
+			Required: false,
+			Default:  500,
+			Validate: validateStorageRetryBackoff,
+			Help:     "Milliseconds to wait before retrying a storage operation, doubling with every retry (up to 30s) and jittered"})
+	a.storageOpTimeout = parser.Int(
+		"",
+		"storage-op-timeout",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Validate: validateStorageOpTimeout,
+			Help:     "Seconds each attempt at a storage operation can take, transfer included, before it's retried (see --storage-retries) or failed, e.g., so that a hung connection in restore-wal can't stall recovery; mind the largest files; 0 means no limit"})
+	a.s3UserAgent = parser.String(
+		"",
+		"s3-user-agent",
+		&argparse.Options{
+			Required: false,
+			Help:     "Added to the user-agent of S3 requests, for attribution in access logs (default pgCarpenter/<version>)"})
+	a.s3RequestPayer = parser.Selector(
+		"",
+		"request-payer",
+		[]string{"requester"},
+		&argparse.Options{
+			Required: false,
+			Help:     "Confirm the requester pays for S3 requests; needed for buckets owned by another account that require it"})
+	a.maxUploadRate = parser.Int(
+		"",
+		"max-upload-rate",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Maximum upload rate in bytes per second, shared by all workers (0 means unlimited)"})
+	a.maxDownloadRate = parser.Int(
+		"",
+		"max-download-rate",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Maximum download rate in bytes per second, shared by all workers (0 means unlimited)"})
+	a.slowStart = parser.Int(
+		"",
+		"slow-start",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help: "Start with up to this many concurrent S3 requests, ramping up as long as S3 keeps up and " +
+				"backing off when it throttles (0 means no limit)"})
 	a.backupName = parser.String(
 		"",
 		"backup-name",
 		&argparse.Options{
 			Required: len(os.Args) > 1 &&
-				(os.Args[1] == "create-backup" || os.Args[1] == "restore-backup" || os.Args[1] == "delete-backup"),
+				(os.Args[1] == "create-backup" || os.Args[1] == "restore-backup" || os.Args[1] == "report" ||
+					os.Args[1] == "backup-info"),
 			Validate: validateBackupName,
-			Help:     "Name of the backup"})
+			Help: "Name of the backup; when creating one, either " + backupNameAuto + " (for a timestamp) or a " +
+				"template, e.g., nightly-{{.Timestamp}} (or {{.Date}}, {{.Host}})"})
 	a.pgDataDirectory = parser.String(
 		"",
 		"data-directory",
 		&argparse.Options{
-			Required: len(os.Args) > 1 && (os.Args[1] == "create-backup" || os.Args[1] == "restore-backup"),
+			Required: len(os.Args) > 1 &&
+				(os.Args[1] == "create-backup" || os.Args[1] == "restore-backup" || os.Args[1] == "check-archive"),
 			Validate: validateDataDirectory,
 			Help:     "Full path to the data directory of the PostgreSQL cluster to backup"})
-	a.nWorkers = parser.Int(
+	a.workers = parser.String(
 		"",
 		"workers",
 		&argparse.Options{
 			Required: false,
-			Default:  1,
-			Help:     "Number of concurrent jobs"})
+			Default:  "1",
+			Validate: validateWorkers,
+			Help: "Number of concurrent jobs, or " + workersAuto + " to size it according to the number of CPUs " +
+				"(and ramp up S3 requests according to how well S3 keeps up, see --slow-start)"})
+	a.compressionWorkers = parser.String(
+		"",
+		"compression-workers",
+		&argparse.Options{
+			Required: false,
+			Default:  workersAuto,
+			Validate: validateWorkers,
+			Help: "Number of files compressed or decompressed concurrently, or " + workersAuto +
+				" for the number of CPUs; when backing up, files are compressed as they're uploaded, so this " +
+				"also caps compressed uploads"})
 	a.tmpDirectory = parser.String(
 		"",
 		"tmp",
 		&argparse.Options{
 			Required: false,
 			Default:  "/tmp",
-			Help:     "Directory to use for creating temporary files"})
-	a.verbose = parser.Flag(
+			Help:     "Directory to use for creating temporary files (only used by restore-wal and check-restore)"})
+	a.compressionLevel = parser.Int(
+		"",
+		"compression-level",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Validate: validateCompressionLevel,
+			Help:     "LZ4 compression level; 0 is the fastest, higher levels compress better but are slower"})
+	a.lz4BlockSize = parser.Selector(
+		"",
+		"lz4-block-size",
+		[]string{"64KB", "256KB", "1MB", "4MB"},
+		&argparse.Options{
+			Required: false,
+			Default:  "4MB",
+			Help:     "Size of the blocks of the LZ4 frames"})
+	a.lz4BlockChecksum = boolFlag(
+		parser,
+		"",
+		"lz4-block-checksum",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Add a checksum to each LZ4 block, on top of the checksum of the whole frame"})
+	a.zstdThreshold = parser.Int(
+		"",
+		"zstd-threshold",
+		&argparse.Options{
+			Required: false,
+			Default:  1 << 30,
+			Help: "Compress files of at least this many bytes (e.g., full 1GB segments of relations) with zstd " +
+				"instead of LZ4, for a better ratio at about half the speed (0 disables it); WAL is always " +
+				"compressed with LZ4"})
+	a.zstdWindow = parser.Selector(
+		"",
+		"zstd-window",
+		[]string{"8MB", "32MB", "128MB", "512MB"},
+		&argparse.Options{
+			Required: false,
+			Default:  "128MB",
+			Help: "How far back zstd looks for matches; larger windows only help with long runs repeated exactly " +
+				"that far apart (this is not zstd --long), and take as much memory per file being compressed"})
+	a.verbose = boolFlag(
+		parser,
 		"",
 		"verbose",
 		&argparse.Options{
 			Required: false,
 			Default:  false,
 			Help:     "Verbose output"})
+	a.configFile = parser.String(
+		"",
+		"config",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Path to a JSON configuration file"})
+	a.timeout = parser.Int(
+		"",
+		"timeout",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help:     "Give up on the command (and any storage requests in flight) after this many seconds; 0 means never (daemon passes it on to the commands it runs)"})
+	// notifications
+	a.smtpServer = parser.String(
+		"",
+		"smtp-server",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "SMTP server (host:port) used to email a summary when create-backup, restore-backup, or delete-backup finishes"})
+	a.mailTo = stringListFlag(
+		parser,
+		"",
+		"mail-to",
+		&argparse.Options{
+			Required: false,
+			Help:     "Recipient of the summary email (repeatable)"})
+	a.mailFrom = parser.String(
+		"",
+		"mail-from",
+		&argparse.Options{
+			Required: false,
+			Default:  "pgcarpenter@" + notify.Hostname(),
+			Help:     "Sender of the summary email"})
+	a.smtpUser = parser.String(
+		"",
+		"smtp-user",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "User to authenticate with the SMTP server (no authentication if empty)"})
+	a.smtpPassword = parser.String(
+		"",
+		"smtp-password",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Password to authenticate with the SMTP server"})
+	a.slackWebhook = parser.String(
+		"",
+		"slack-webhook",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "URL of a Slack incoming webhook to post a summary to"})
+	a.webhookURLs = stringListFlag(
+		parser,
+		"",
+		"webhook-url",
+		&argparse.Options{
+			Required: false,
+			Help:     "URL to POST the outcome (as JSON) to (repeatable)"})
+	a.snsTopic = parser.String(
+		"",
+		"sns-topic",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "ARN of an SNS topic to publish the outcome (as JSON) to"})
+	a.healthcheckURL = parser.String(
+		"",
+		"healthcheck-url",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "URL of a dead man's switch (e.g., healthchecks.io) to ping when create-backup, restore-backup, " +
+				"or delete-backup succeeds (<url>/fail when it fails)"})
+	a.progressSocket = parser.String(
+		"",
+		"progress-socket",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Path to a Unix socket on which to serve progress events (newline delimited JSON)"})
+	a.pushgateway = parser.String(
+		"",
+		"pushgateway",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "URL of a Prometheus Pushgateway to push metrics to once done, e.g., http://pushgateway:9091"})
+	a.metricsFile = parser.String(
+		"",
+		"metrics-file",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Write metrics (as JSON) to this file once done (daemon uses it to collect the metrics of commands)"})
+	a.statsdAddress = parser.String(
+		"",
+		"statsd-address",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Send metrics over UDP to this statsd (or DogStatsD) server, e.g., localhost:8125"})
+	a.statsdNamespace = parser.String(
+		"",
+		"statsd-namespace",
+		&argparse.Options{
+			Required: false,
+			Default:  "pgcarpenter.",
+			Help:     "Prefix of the names of the metrics sent to statsd"})
+	a.statsdTags = stringListFlag(
+		parser,
+		"",
+		"statsd-tag",
+		&argparse.Options{
+			Required: false,
+			Help:     "Tag (DogStatsD only) of the metrics sent to statsd, e.g., env:prod; can be given multiple times"})
+	a.progressInterval = parser.Int(
+		"",
+		"progress-interval",
+		&argparse.Options{
+			Required: false,
+			Default:  60,
+			Help:     "Log the progress (percentage, throughput, and ETA) of backups and restores every this many seconds (0 disables it)"})
+	a.progressBar = boolFlag(
+		parser,
+		"",
+		"progress-bar",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Draw a progress bar on stderr, if it's a terminal"})
 	// archive WAL + restore WAL
 	a.walPath = parser.String(
 		"",
@@ -136,6 +579,14 @@ func parseArgs(a *app) func() int {
 		&argparse.Options{
 			Required: len(os.Args) > 1 && (os.Args[1] == "archive-wal" || os.Args[1] == "restore-wal"),
 			Help:     "Path to the WAL segment"})
+	a.spoolDirectory = parser.String(
+		"",
+		"spool-directory",
+		&argparse.Options{
+			Required: len(os.Args) > 1 && os.Args[1] == "wal-uploader",
+			Default:  "",
+			Help: "Have archive-wal copy WAL segments to this directory (on the same host) and return right " +
+				"away, for wal-uploader to archive them in the background"})
 
 	// subcommands
 	listBackupsCmd := parser.NewCommand("list-backups", "List all available backups")
@@ -146,24 +597,60 @@ func parseArgs(a *app) func() int {
 	parseRestoreBackupArgs(a, restoreBackupCmd)
 	archiveWALCmd := parser.NewCommand("archive-wal", "Archive a WAL segment (use with archive_command)")
 	parseArchiveWALArgs(a, archiveWALCmd)
+	archiveAgentCmd := parser.NewCommand(
+		"archive-agent", "Serve archive requests on a Unix socket (use with the archive module in contrib/)")
+	parseArchiveAgentArgs(a, archiveAgentCmd)
 	restoreWALCmd := parser.NewCommand("restore-wal", "Restore a WAL segment (use with restore_command)")
 	parseRestoreWALArgs(a, restoreWALCmd)
 	deleteBackupCmd := parser.NewCommand("delete-backup", "Delete a base backup")
 	parseDeleteBackupArgs(a, deleteBackupCmd)
+	checkRestoreCmd := parser.NewCommand(
+		"check-restore", "Test restoring a backup (LATEST by default) to a scratch directory, and record the result")
+	parseCheckRestoreArgs(a, checkRestoreCmd)
+	reportCmd := parser.NewCommand("report", "Generate a (signed) chain-of-custody report of a backup")
+	parseReportArgs(a, reportCmd)
+	walStatusCmd := parser.NewCommand("wal-status", "Show the last archived WAL segment")
+	parseWALStatusArgs(a, walStatusCmd)
+	walUploaderCmd := parser.NewCommand("wal-uploader", "Archive the WAL segments spooled by archive-wal")
+	parseWALUploaderArgs(a, walUploaderCmd)
+	walShowCmd := parser.NewCommand("wal-show", "List the archived WAL segments, by timeline, and the gaps in between")
+	parseWALShowArgs(a, walShowCmd)
+	checkArchiveCmd := parser.NewCommand(
+		"check-archive", "Check how far behind WAL archiving is (exit status as expected by Nagios)")
+	parseCheckArchiveArgs(a, checkArchiveCmd)
+	receiveWALCmd := parser.NewCommand(
+		"receive-wal", "Stream WAL over the replication protocol (with pg_receivewal) and archive it")
+	parseReceiveWALArgs(a, receiveWALCmd)
+	daemonCmd := parser.NewCommand("daemon", "Run the commands scheduled in the configuration file")
+	parseDaemonArgs(a, daemonCmd)
+	preflightCmd := parser.NewCommand("check", "Check that everything backups need is in place")
+	parsePreflightArgs(a, preflightCmd)
+	backupInfoCmd := parser.NewCommand("backup-info", "Show the details of a backup, including the WAL it needs")
+	parseBackupInfoArgs(a, backupInfoCmd)
+	deleteWALCmd := parser.NewCommand("delete-wal", "Delete the archived WAL no backup needs anymore")
+	parseDeleteWALArgs(a, deleteWALCmd)
+	lastSuccessAgeCmd := parser.NewCommand(
+		"last-success-age", "Print the number of seconds since the latest successful backup was completed")
+	parseLastSuccessAgeArgs(a, lastSuccessAgeCmd)
+	repairMarkersCmd := parser.NewCommand(
+		"repair-markers", "Fix the markers of successful backups, LATEST, and the catalog to agree with the backups in storage")
+	parseRepairMarkersArgs(a, repairMarkersCmd)
 	versionCmd := parser.NewCommand("version", "Print the version of pgCarpenter")
 
 	// parse input
-	err := parser.Parse(os.Args)
+	// flags not given on the command line default to environment variables (see withEnvDefaults)
+	err := parser.Parse(withEnvDefaults(parser, os.Args))
 	if err != nil {
 		// print the error message and usage information
 		// (just like with the -h or --help flags)
 		fmt.Print(parser.Usage(err))
 		// essentially a no-op
-		return func() int { return 1 }
+		return func() int { return exitUsage }
 	}
 
 	if versionCmd.Happened() {
 		fmt.Printf("pgCarpenter version %s (git: %s)\n", version, gitCommit)
+		fmt.Printf("storage backends: %s\n", strings.Join(storage.Schemes(), ", "))
 		return func() int { return 0 }
 	}
 	if listBackupsCmd.Happened() {
@@ -175,6 +662,15 @@ func parseArgs(a *app) func() int {
 	if restoreBackupCmd.Happened() {
 		return a.restoreBackup
 	}
+	if archiveAgentCmd.Happened() {
+		return a.archiveAgent
+	}
+	if checkRestoreCmd.Happened() {
+		return a.checkRestore
+	}
+	if reportCmd.Happened() {
+		return a.report
+	}
 	if archiveWALCmd.Happened() {
 		return a.archiveWAL
 	}
@@ -184,9 +680,42 @@ func parseArgs(a *app) func() int {
 	if deleteBackupCmd.Happened() {
 		return a.DeleteBackup
 	}
+	if walStatusCmd.Happened() {
+		return a.walStatus
+	}
+	if walUploaderCmd.Happened() {
+		return a.walUploader
+	}
+	if walShowCmd.Happened() {
+		return a.walShow
+	}
+	if checkArchiveCmd.Happened() {
+		return a.checkArchive
+	}
+	if receiveWALCmd.Happened() {
+		return a.receiveWAL
+	}
+	if daemonCmd.Happened() {
+		return a.daemon
+	}
+	if preflightCmd.Happened() {
+		return a.preflight
+	}
+	if backupInfoCmd.Happened() {
+		return a.backupInfo
+	}
+	if deleteWALCmd.Happened() {
+		return a.deleteWAL
+	}
+	if lastSuccessAgeCmd.Happened() {
+		return a.lastSuccessAge
+	}
+	if repairMarkersCmd.Happened() {
+		return a.repairMarkers
+	}
 
 	// we should never reach this point, but the compiler needs it
-	return func() int { return 1 }
+	return func() int { return exitFailure }
 }
 
 func validateDataDirectory(args []string) error {
@@ -206,6 +735,15 @@ func validateDataDirectory(args []string) error {
 func validateBackupName(args []string) error {
 	// make sure the backup name is valid
 	errorMsg := fmt.Sprintf("backup name ('%s') does not match '%s'", args[0], backupNameRE)
+	// templates are only expanded when creating backups (see expandBackupName)
+	if len(os.Args) > 1 && os.Args[1] == "create-backup" && isBackupNameTemplate(args[0]) {
+		_, err := expandBackupName(args[0], time.Now())
+		return err
+	}
+	// LATEST moves on as backups are taken, deleting it by mistake is too easy
+	if len(os.Args) > 1 && os.Args[1] == "delete-backup" && args[0] == latestKey {
+		return errors.New("backup name can't be " + latestKey + " when deleting a backup")
+	}
 	if args[0] != latestKey {
 		match, err := regexp.MatchString(backupNameRE, args[0])
 		if err != nil || !match {
@@ -216,6 +754,37 @@ func validateBackupName(args []string) error {
 	return nil
 }
 
+func validateCompressionLevel(args []string) error {
+	level, err := strconv.Atoi(args[0])
+	if err != nil || level < 0 {
+		return fmt.Errorf("compression level ('%s') must be a non-negative integer", args[0])
+	}
+
+	return nil
+}
+
+// return the options to compress files with
+func (a *app) compressOptions() util.CompressOptions {
+	return util.CompressOptions{
+		Level:         *a.compressionLevel,
+		BlockSize:     util.LZ4BlockSizes[*a.lz4BlockSize],
+		BlockChecksum: *a.lz4BlockChecksum,
+		// only worth it for files large enough
+		ZstdThreshold: int64(*a.zstdThreshold),
+		ZstdWindow:    util.ZstdWindowSizes[*a.zstdWindow],
+	}
+}
+
+// return the options to compress WAL with: always LZ4, as WAL is archived (and looked up by restore-wal) as
+// <name>.lz4 regardless of its size, which would otherwise be compressed with zstd past --zstd-threshold
+// (e.g., segments of a cluster with wal_segment_size=1GB)
+func (a *app) walCompressOptions() util.CompressOptions {
+	options := a.compressOptions()
+	options.ZstdThreshold = 0
+
+	return options
+}
+
 // make sure we have the absolute path to the data directory
 func (a *app) normalizeDataDirectoryPath() error {
 	// get the absolute path
@@ -237,6 +806,86 @@ func (a *app) normalizeDataDirectoryPath() error {
 	return nil
 }
 
+// return the user-agent to tag S3 requests with
+func (a *app) userAgent() string {
+	if *a.s3UserAgent != "" {
+		return *a.s3UserAgent
+	}
+	if version == "" {
+		return "pgCarpenter"
+	}
+
+	return "pgCarpenter/" + version
+}
+
+// read the major version of PostgreSQL (e.g., 9 for 9.6, 12 for 12) from the PG_VERSION
+// file at the root of dataDirectory
+func pgMajorVersion(dataDirectory string) (int, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dataDirectory, "PG_VERSION"))
+	if err != nil {
+		return 0, err
+	}
+
+	major := strings.SplitN(strings.TrimSpace(string(contents)), ".", 2)[0]
+
+	return strconv.Atoi(major)
+}
+
+// return the name of the directory (relative to the data directory) where WAL is kept, which was
+// renamed from pg_xlog to pg_wal in PG 10
+func walDirectory(pgMajorVersion int) string {
+	if pgMajorVersion >= 10 {
+		return "pg_wal"
+	}
+
+	return "pg_xlog"
+}
+
+// set by notify_sns.go, unless built without AWS support
+var newSNSNotifier func(topicARN string) (notify.Notifier, error)
+
+// create the notifiers that were configured on the command line
+func (a *app) setupNotifiers() error {
+	if *a.smtpServer != "" {
+		if len(*a.mailTo) == 0 {
+			return errors.New("--smtp-server requires at least one --mail-to")
+		}
+		a.notifiers = append(
+			a.notifiers,
+			notify.NewSMTP(*a.smtpServer, *a.mailFrom, *a.mailTo, *a.smtpUser, *a.smtpPassword))
+	}
+	if *a.slackWebhook != "" {
+		a.notifiers = append(a.notifiers, notify.NewSlack(*a.slackWebhook))
+	}
+	for _, url := range *a.webhookURLs {
+		a.notifiers = append(a.notifiers, notify.NewWebhook(url))
+	}
+	if *a.healthcheckURL != "" {
+		a.notifiers = append(a.notifiers, notify.NewHealthcheck(*a.healthcheckURL))
+	}
+	if *a.snsTopic != "" {
+		if newSNSNotifier == nil {
+			return errors.New("pgCarpenter was built without support for SNS (see the build tags in the Makefile)")
+		}
+		n, err := newSNSNotifier(*a.snsTopic)
+		if err != nil {
+			return err
+		}
+		a.notifiers = append(a.notifiers, n)
+	}
+
+	return nil
+}
+
+// send event to all configured notifiers; failing to notify is logged, but otherwise ignored
+func (a *app) notify(event notify.Event) {
+	for _, n := range a.notifiers {
+		if err := n.Notify(event); err != nil {
+			a.logger.Error("Failed to send notification", zap.String("operation", event.Operation), zap.Error(err))
+		}
+	}
+}
+
 func main() {
 	// logging
 	logger, atom := initLogging()
@@ -244,7 +893,8 @@ func main() {
 	defer logger.Sync()
 
 	cfg := &app{
-		logger: logger,
+		logger:  logger,
+		metrics: metrics.New(),
 	}
 
 	// parse the command line arguments and get a callback to the subcommand we should execute
@@ -255,14 +905,60 @@ func main() {
 		atom.SetLevel(zap.DebugLevel)
 	}
 
-	// as of now the only supported storage backend is S3
-	cfg.storage = s3storage.New(*cfg.s3Bucket, *cfg.s3Region, *cfg.s3MaxRetries, cfg.logger)
+	if err := cfg.loadConfig(); err != nil {
+		cfg.logger.Error("Failed to load the configuration file", zap.Error(err))
+		os.Exit(exitUsage)
+	}
+
+	if err := cfg.setupNotifiers(); err != nil {
+		cfg.logger.Error("Failed to set up notifications", zap.Error(err))
+		os.Exit(exitUsage)
+	}
+
+	if err := cfg.setupStatsd(); err != nil {
+		cfg.logger.Error("Failed to set up statsd", zap.Error(err))
+		os.Exit(exitUsage)
+	}
+
+	// may enable --slow-start, so it must come before setting up storage
+	cfg.sizeWorkers()
+
+	// version doesn't need storage (and must work in binaries built without any)
+	if len(os.Args) > 1 && os.Args[1] != "version" {
+		if err := cfg.setupStorage(); err != nil {
+			cfg.logger.Error("Failed to set up storage", zap.Error(err))
+			os.Exit(exitUsage)
+		}
+	}
 
 	// make sure we're using the absolute path to the data directory before starting
 	if err := cfg.normalizeDataDirectoryPath(); err != nil {
 		cfg.logger.Error("Failed to normalize the path to the data directory", zap.Error(err))
-		os.Exit(1)
+		os.Exit(exitFailure)
+	}
+
+	if *cfg.progressSocket != "" {
+		sink, err := progress.Listen(*cfg.progressSocket)
+		if err != nil {
+			cfg.logger.Error("Failed to create the progress socket", zap.Error(err))
+			os.Exit(exitFailure)
+		}
+		cfg.progressSink = sink
+	}
+
+	cancel := cfg.setupContext()
+	rc := callback()
+	cancel()
+	cfg.exportMetrics()
+	cfg.statsd.Close()
+
+	if cfg.progressSink != nil {
+		if err := cfg.progressSink.Close(); err != nil {
+			cfg.logger.Error("Failed to close the progress socket", zap.Error(err))
+		}
 	}
 
-	os.Exit(callback())
+	// os.Exit doesn't run deferred functions
+	logger.Sync()
+	os.Exit(rc)
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// backupManifest describes a backup, as opposed to its contents; it's stored as JSON in
+// manifestFolder/<backup name> so that it's not restored along with the backup
+type backupManifest struct {
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"start_time"`
+	StopTime  time.Time `json:"stop_time"`
+	// set by the operator (--comment and --label) to tell routine and ad-hoc backups apart
+	Comment string            `json:"comment,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// total size (in bytes, uncompressed) of the files in the backup
+	Size int64 `json:"size,omitempty"`
+	// number of files (not including directories) in the backup
+	Files int64 `json:"files,omitempty"`
+	// bytes actually stored (i.e., compressed) in remote storage; if the backup was resumed, only counting
+	// what was uploaded by the last run
+	StoredSize int64 `json:"stored_size,omitempty"`
+	// how long it took to take the backup, and with how many workers
+	Duration time.Duration `json:"duration_ns,omitempty"`
+	Workers  int           `json:"workers,omitempty"`
+	// size (in bytes, uncompressed) of every file in the backup, by path relative to the data directory;
+	// restores use it to start with the largest files
+	FileSizes map[string]int64 `json:"file_sizes,omitempty"`
+	// checksum (see --checksum) of every file in the backup, by path relative to the data directory, computed
+	// from the contents as they were read to be uploaded; restores verify the files against it
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// who took the backup: host, local and PostgreSQL users, and storage credentials (if known)
+	Host               string `json:"host,omitempty"`
+	OSUser             string `json:"os_user,omitempty"`
+	PGUser             string `json:"pg_user,omitempty"`
+	Identity           string `json:"identity,omitempty"`
+	PGCarpenterVersion string `json:"pgcarpenter_version,omitempty"`
+	// WAL needed to make the backup consistent: from the start LSN (in StartWALFile) up to the stop LSN (in
+	// StopWALFile), given the size of the segments (wal_segment_size, in bytes)
+	StartLSN       string `json:"start_lsn,omitempty"`
+	StopLSN        string `json:"stop_lsn,omitempty"`
+	StartWALFile   string `json:"start_wal_file,omitempty"`
+	StopWALFile    string `json:"stop_wal_file,omitempty"`
+	WALSegmentSize int64  `json:"wal_segment_size,omitempty"`
+	// server_version_num of the cluster
+	PGVersion int `json:"pg_version"`
+	// true iff the backup was taken from a standby (i.e., pg_is_in_recovery())
+	FromStandby    bool   `json:"from_standby"`
+	FullPageWrites string `json:"full_page_writes,omitempty"`
+	// where the data directory was on the host it was backed up from (i.e., relative to --logical-root)
+	DataDirectory string `json:"data_directory,omitempty"`
+	// oid of every database, by name
+	Databases map[string]uint32 `json:"databases,omitempty"`
+	// contents are stored under pg_tblspc/<oid>/ in the backup
+	Tablespaces []tablespace `json:"tablespaces,omitempty"`
+	// symlinks other than the ones to tablespaces; files symlinks point to are backed up as regular files
+	Symlinks []symlink `json:"symlinks,omitempty"`
+	// set if the backup was stopped before all files were uploaded (e.g., due to --max-duration)
+	Aborted     bool   `json:"aborted,omitempty"`
+	AbortReason string `json:"abort_reason,omitempty"`
+	// files that were not backed up because they couldn't be read (with --unreadable-files=skip-with-warning)
+	SkippedFiles []skippedFile `json:"skipped_files,omitempty"`
+	// anything an operator restoring the backup should be aware of
+	Notes []string `json:"notes,omitempty"`
+	// history of checks that the backup can be restored, oldest first
+	Verifications []verification `json:"verifications,omitempty"`
+}
+
+type skippedFile struct {
+	// relative to the data directory
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// verification records a check (e.g., a test restore) of a backup
+type verification struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Method  string    `json:"method"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	// how long the check took
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// average bytes (uncompressed) backed up per second
+func (m *backupManifest) throughput() float64 {
+	if m.Duration <= 0 {
+		return 0
+	}
+
+	return float64(m.Size) / m.Duration.Seconds()
+}
+
+func (a *app) getManifestKey(backupName string) string {
+	return filepath.Join(manifestFolder, backupName)
+}
+
+func (a *app) putManifest(m *backupManifest) error {
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// even once the command gave up, so that the manifest tells how it ended
+	ctx, cancel := a.cleanupContext()
+	defer cancel()
+
+	return a.storage.PutString(ctx, a.getManifestKey(m.Name), string(contents))
+}
+
+// get the manifest of the backup; backups taken by older versions of pgCarpenter don't have one
+func (a *app) getManifest(backupName string) (*backupManifest, error) {
+	contents, err := a.storage.GetString(a.ctx, a.getManifestKey(backupName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &backupManifest{}
+	if err := json.Unmarshal([]byte(contents), m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (a *app) deleteManifest(backupName string) error {
+	key := a.getManifestKey(backupName)
+	exists, err := a.storage.Exists(a.ctx, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		a.logger.Debug("Deleting manifest", zap.String("key", key))
+		if err := a.storage.Delete(a.ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
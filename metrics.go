@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/metrics"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/statsd"
+	"go.uber.org/zap"
+)
+
+// job the metrics are pushed to the Pushgateway as (along with the host, as the instance)
+const pushgatewayJob = "pgcarpenter"
+
+// send metrics to statsd too, with --statsd-address
+func (a *app) setupStatsd() error {
+	if *a.statsdAddress == "" {
+		return nil
+	}
+	for _, tag := range *a.statsdTags {
+		if strings.ContainsAny(tag, "|,#") {
+			return fmt.Errorf("invalid statsd tag: %s", tag)
+		}
+	}
+	var err error
+	a.statsd, err = statsd.New(*a.statsdAddress, *a.statsdNamespace, *a.statsdTags)
+
+	return err
+}
+
+// record the outcome of create-backup
+func (a *app) recordBackupMetrics(err error, duration time.Duration) {
+	a.metrics.Add("pgcarpenter_backups_total", "Backups attempted", 1)
+	if err != nil {
+		a.metrics.Add("pgcarpenter_backup_failures_total", "Backups that failed", 1)
+		a.statsd.Count("backup.failed", 1)
+		return
+	}
+	a.statsd.Count("backup.succeeded", 1)
+	a.statsd.Timing("backup.duration", duration)
+	a.statsd.Gauge("backup.size_bytes", float64(a.manifest.Size))
+	a.statsd.Gauge("backup.stored_bytes", float64(a.manifest.StoredSize))
+	a.metrics.Observe(
+		"pgcarpenter_backup_duration_seconds", "Time taken by successful backups", metrics.DurationBuckets,
+		duration.Seconds())
+	a.metrics.Add(
+		"pgcarpenter_backup_uploaded_bytes_total", "Bytes (compressed) uploaded by successful backups",
+		float64(a.manifest.StoredSize))
+	a.metrics.Add(
+		"pgcarpenter_backup_skipped_files_total", "Files left out of successful backups because they couldn't be read",
+		float64(len(a.manifest.SkippedFiles)))
+	a.metrics.Set(
+		"pgcarpenter_backup_last_success_timestamp_seconds", "When the last successful backup was completed",
+		float64(time.Now().Unix()))
+}
+
+// record the outcome of archiving a WAL segment (by archive-wal, archive-agent, wal-uploader, or receive-wal)
+func (a *app) recordWALArchiveMetrics(err error, duration time.Duration) {
+	if err != nil {
+		a.metrics.Add("pgcarpenter_wal_archive_failures_total", "WAL segments that failed to be archived", 1)
+		a.statsd.Count("wal.archive_failed", 1)
+		return
+	}
+	a.statsd.Count("wal.archived", 1)
+	a.statsd.Timing("wal.archive_duration", duration)
+	a.metrics.Add("pgcarpenter_wal_archived_total", "WAL segments archived", 1)
+	a.metrics.Observe(
+		"pgcarpenter_wal_archive_duration_seconds", "Time taken to archive a WAL segment", metrics.DurationBuckets,
+		duration.Seconds())
+	a.metrics.Set(
+		"pgcarpenter_wal_last_archived_timestamp_seconds", "When the last WAL segment was archived",
+		float64(time.Now().Unix()))
+}
+
+// record the outcome of restore-backup (only sent to statsd)
+func (a *app) recordRestoreMetrics(rc int, duration time.Duration, bytes int64) {
+	if rc != 0 {
+		a.statsd.Count("restore.failed", 1)
+		return
+	}
+	a.statsd.Count("restore.succeeded", 1)
+	a.statsd.Timing("restore.duration", duration)
+	a.statsd.Gauge("restore.bytes", float64(bytes))
+	if duration > 0 {
+		a.statsd.Gauge("restore.throughput_bytes_per_second", float64(bytes)/duration.Seconds())
+	}
+}
+
+// push the metrics to the Pushgateway (with --pushgateway), and write them to --metrics-file (e.g., for
+// daemon to pick up); failing to is logged, but otherwise ignored
+func (a *app) exportMetrics() {
+	if *a.pushgateway != "" {
+		if err := a.metrics.Push(*a.pushgateway, pushgatewayJob, notify.Hostname()); err != nil {
+			a.logger.Error("Failed to push metrics", zap.String("pushgateway", *a.pushgateway), zap.Error(err))
+		}
+	}
+	if *a.metricsFile != "" {
+		contents, err := json.Marshal(a.metrics.Snapshot())
+		if err == nil {
+			err = ioutil.WriteFile(*a.metricsFile, contents, 0600)
+		}
+		if err != nil {
+			a.logger.Error("Failed to write metrics", zap.String("path", *a.metricsFile), zap.Error(err))
+		}
+	}
+}
+
+// merge the metrics written to path (with --metrics-file) by another pgCarpenter process
+func (a *app) mergeMetrics(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	families := make([]metrics.Family, 0)
+	if err := json.Unmarshal(contents, &families); err != nil {
+		return err
+	}
+	a.metrics.Merge(families)
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kinds of metrics
+const (
+	KindCounter   = "counter"
+	KindGauge     = "gauge"
+	KindHistogram = "histogram"
+)
+
+// DurationBuckets are the upper bounds (in seconds) of the buckets of histograms of durations, from
+// archiving a WAL segment (sub-second) to taking a large backup (hours).
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600, 7200, 14400, 28800}
+
+// Family is all the samples of a metric, one for each combination of labels.
+type Family struct {
+	Name    string    `json:"name"`
+	Help    string    `json:"help"`
+	Kind    string    `json:"kind"`
+	Samples []*Sample `json:"samples"`
+}
+
+// Sample is the value of a metric for a combination of labels.
+type Sample struct {
+	// rendered, e.g., {operation="create-backup"}
+	Labels string  `json:"labels"`
+	Value  float64 `json:"value"`
+	// only histograms: upper bounds of the buckets, and the (non cumulative) number of observations in each
+	Buckets []float64 `json:"buckets,omitempty"`
+	Counts  []uint64  `json:"counts,omitempty"`
+	Count   uint64    `json:"count,omitempty"`
+}
+
+// Registry keeps the metrics of a process. It's safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*Family
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{families: make(map[string]*Family)}
+}
+
+// Add adds v to the counter.
+func (r *Registry) Add(name string, help string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sample(name, help, KindCounter, labels).Value += v
+}
+
+// Set sets the gauge to v.
+func (r *Registry) Set(name string, help string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sample(name, help, KindGauge, labels).Value = v
+}
+
+// Observe records v in the histogram, which has buckets with the given upper bounds (sorted).
+func (r *Registry) Observe(name string, help string, buckets []float64, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.sample(name, help, KindHistogram, labels)
+	if s.Buckets == nil {
+		s.Buckets = buckets
+		s.Counts = make([]uint64, len(buckets))
+	}
+	for i, upper := range s.Buckets {
+		if v <= upper {
+			s.Counts[i]++
+			break
+		}
+	}
+	// the sum of the observations
+	s.Value += v
+	s.Count++
+}
+
+// return the sample of the metric with the labels (pairs of names and values), creating it if needed; the
+// registry must be locked
+func (r *Registry) sample(name string, help string, kind string, labels []string) *Sample {
+	return r.renderedSample(name, help, kind, renderLabels(labels))
+}
+
+// like sample, given the rendered labels
+func (r *Registry) renderedSample(name string, help string, kind string, labels string) *Sample {
+	f, ok := r.families[name]
+	if !ok {
+		f = &Family{Name: name, Help: help, Kind: kind}
+		r.families[name] = f
+	}
+	for _, s := range f.Samples {
+		if s.Labels == labels {
+			return s
+		}
+	}
+	s := &Sample{Labels: labels}
+	f.Samples = append(f.Samples, s)
+
+	return s
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Snapshot returns a copy of all the metrics, sorted by name.
+func (r *Registry) Snapshot() []Family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	families := make([]Family, 0, len(r.families))
+	for _, f := range r.families {
+		c := Family{Name: f.Name, Help: f.Help, Kind: f.Kind}
+		for _, s := range f.Samples {
+			copied := *s
+			copied.Counts = append([]uint64(nil), s.Counts...)
+			c.Samples = append(c.Samples, &copied)
+		}
+		sort.Slice(c.Samples, func(i, j int) bool { return c.Samples[i].Labels < c.Samples[j].Labels })
+		families = append(families, c)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+
+	return families
+}
+
+// Merge merges a snapshot (e.g., of another process) into the registry: counters and histograms are
+// added up, gauges are replaced.
+func (r *Registry) Merge(families []Family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range families {
+		for _, in := range f.Samples {
+			s := r.renderedSample(f.Name, f.Help, f.Kind, in.Labels)
+			switch f.Kind {
+			case KindGauge:
+				s.Value = in.Value
+			case KindHistogram:
+				if s.Buckets == nil {
+					s.Buckets = in.Buckets
+					s.Counts = make([]uint64, len(in.Buckets))
+				}
+				for i := range s.Counts {
+					if i < len(in.Counts) {
+						s.Counts[i] += in.Counts[i]
+					}
+				}
+				s.Value += in.Value
+				s.Count += in.Count
+			default:
+				s.Value += in.Value
+			}
+		}
+	}
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	buf := bytes.Buffer{}
+	for _, f := range r.Snapshot() {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.Name, f.Help, f.Name, f.Kind)
+		for _, s := range f.Samples {
+			if f.Kind != KindHistogram {
+				fmt.Fprintf(&buf, "%s%s %g\n", f.Name, s.Labels, s.Value)
+				continue
+			}
+			cumulative := uint64(0)
+			for i, upper := range s.Buckets {
+				cumulative += s.Counts[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", f.Name, withLabel(s.Labels, "le", fmt.Sprintf("%g", upper)),
+					cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", f.Name, withLabel(s.Labels, "le", "+Inf"), s.Count)
+			fmt.Fprintf(&buf, "%s_sum%s %g\n", f.Name, s.Labels, s.Value)
+			fmt.Fprintf(&buf, "%s_count%s %d\n", f.Name, s.Labels, s.Count)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// return the rendered labels with one more
+func withLabel(labels string, name string, value string) string {
+	extra := fmt.Sprintf(`%s="%s"`, name, value)
+	if labels == "" {
+		return "{" + extra + "}"
+	}
+
+	return strings.TrimSuffix(labels, "}") + "," + extra + "}"
+}
+
+// ServeHTTP serves the metrics, e.g., on /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	// nothing to do if the scraper went away
+	_ = r.WriteText(w)
+}
+
+// Push replaces the metrics of the job (and instance) in the Prometheus Pushgateway at gateway (e.g.,
+// http://pushgateway:9091) with the ones in the registry.
+func (r *Registry) Push(gateway string, job string, instance string) error {
+	body := bytes.Buffer{}
+	if err := r.WriteText(&body); err != nil {
+		return err
+	}
+	target := fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimSuffix(gateway, "/"),
+		url.PathEscape(job), url.PathEscape(instance))
+	req, err := http.NewRequest(http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	// nothing to read from the response
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway replied with %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type healthcheckNotifier struct {
+	url string
+}
+
+// NewHealthcheck returns a Notifier that pings a dead man's switch (e.g., https://hc-ping.com/<uuid> on
+// healthchecks.io): url on success, and url/fail on failure, with a summary of the event as the body (which
+// these services usually keep as the log of the ping).
+func NewHealthcheck(url string) Notifier {
+	return &healthcheckNotifier{url: strings.TrimSuffix(url, "/")}
+}
+
+func (n *healthcheckNotifier) Notify(event Event) error {
+	url := n.url
+	if !event.Success {
+		url += "/fail"
+	}
+	body := event.Summary() + "\n" + strings.Join(event.Details(), "\n") + "\n"
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// nothing to read from the response
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("healthcheck replied with %s", resp.Status)
+	}
+
+	return nil
+}
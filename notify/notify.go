@@ -0,0 +1,67 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Event describes the outcome of an operation (e.g., create-backup).
+type Event struct {
+	Operation  string        `json:"operation"`
+	BackupName string        `json:"backup_name,omitempty"`
+	Host       string        `json:"host"`
+	Success    bool          `json:"success"`
+	Error      string        `json:"error,omitempty"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration_ns"`
+	Files      int           `json:"files"`
+	// backed up, restored, or freed (by delete-backup)
+	Bytes int64 `json:"bytes"`
+}
+
+type Notifier interface {
+	// Notify sends the event to whoever should hear about it.
+	Notify(event Event) error
+}
+
+// Summary returns a one-line, human readable summary of the event.
+func (e Event) Summary() string {
+	status := "succeeded"
+	if !e.Success {
+		status = "FAILED"
+	}
+
+	return fmt.Sprintf("pgCarpenter %s %s on %s (backup: %s)", e.Operation, status, e.Host, e.BackupName)
+}
+
+// Details returns the lines (without line breaks) describing the event, other than its summary.
+func (e Event) Details() []string {
+	details := []string{
+		fmt.Sprintf("Started:  %s", e.Start.Format(time.RFC3339)),
+		fmt.Sprintf("Duration: %s", e.Duration),
+		fmt.Sprintf("Files:    %d", e.Files),
+		fmt.Sprintf("Bytes:    %d", e.Bytes),
+	}
+	if e.Error != "" {
+		details = append(details, fmt.Sprintf("Error:    %s", e.Error))
+	}
+
+	return details
+}
+
+// JSON returns the event serialized as indented JSON.
+func (e Event) JSON() ([]byte, error) {
+	return json.MarshalIndent(e, "", "  ")
+}
+
+// Hostname returns the name of the host we're running on, or "unknown".
+func Hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return host
+}
@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+type smtpNotifier struct {
+	server   string // host:port
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+// NewSMTP returns a Notifier that emails a summary of each event, with the event itself attached as JSON,
+// through the SMTP server (host:port). Authentication (PLAIN) is only attempted if username is not empty.
+func NewSMTP(server string, from string, to []string, username string, password string) Notifier {
+	return &smtpNotifier{server: server, from: from, to: to, username: username, password: password}
+}
+
+func (n *smtpNotifier) Notify(event Event) error {
+	msg, err := n.message(event)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, err := net.SplitHostPort(n.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+
+	return smtp.SendMail(n.server, auth, n.from, n.to, msg)
+}
+
+// build a multipart message with the summary as the body and the JSON event as an attachment
+func (n *smtpNotifier) message(event Event) ([]byte, error) {
+	attachment, err := event.JSON()
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "%s\r\n\r\n", event.Summary())
+	for _, line := range event.Details() {
+		fmt.Fprintf(part, "%s\r\n", line)
+	}
+
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/json"},
+		"Content-Disposition": {`attachment; filename="stats.json"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(attachment); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", event.Summary())
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+package snsnotify
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/thumbtack/pgCarpenter/notify"
+)
+
+type snsNotifier struct {
+	client *sns.SNS
+	topic  string
+}
+
+// New returns a Notifier that publishes each event, as JSON (with the summary as the subject), to the SNS
+// topic with the given ARN, in the topic's region.
+func New(topicARN string) (notify.Notifier, error) {
+	parsed, err := arn.Parse(topicARN)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(
+		session.Options{
+			Config:            aws.Config{Region: aws.String(parsed.Region)},
+			SharedConfigState: session.SharedConfigEnable,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return &snsNotifier{client: sns.New(sess), topic: topicARN}, nil
+}
+
+func (n *snsNotifier) Notify(event notify.Event) error {
+	message, err := event.JSON()
+	if err != nil {
+		return err
+	}
+	// subjects are limited to 100 characters
+	subject := event.Summary()
+	if len(subject) > 100 {
+		subject = subject[:100]
+	}
+	_, err = n.client.Publish(&sns.PublishInput{
+		TopicArn: aws.String(n.topic),
+		Subject:  aws.String(subject),
+		Message:  aws.String(string(message)),
+	})
+
+	return err
+}
@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how long to wait for a webhook to reply
+const webhookTimeout = 30 * time.Second
+
+type webhookNotifier struct {
+	url string
+	// builds the body (JSON) of the request from the event
+	payload func(event Event) ([]byte, error)
+}
+
+// NewWebhook returns a Notifier that POSTs each event, as JSON, to url.
+func NewWebhook(url string) Notifier {
+	return &webhookNotifier{url: url, payload: func(event Event) ([]byte, error) { return json.Marshal(event) }}
+}
+
+// NewSlack returns a Notifier that posts a summary of each event to a Slack channel, through an incoming
+// webhook (url).
+func NewSlack(url string) Notifier {
+	return &webhookNotifier{url: url, payload: slackMessage}
+}
+
+func (n *webhookNotifier) Notify(event Event) error {
+	body, err := n.payload(event)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// nothing to read from the response
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook replied with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func slackMessage(event Event) ([]byte, error) {
+	icon := ":white_check_mark:"
+	if !event.Success {
+		icon = ":rotating_light:"
+	}
+	text := fmt.Sprintf("%s %s\n```%s```", icon, event.Summary(), strings.Join(event.Details(), "\n"))
+
+	return json.Marshal(map[string]string{"text": text})
+}
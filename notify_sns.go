@@ -0,0 +1,13 @@
+//go:build !nos3
+// +build !nos3
+
+package main
+
+import (
+	"github.com/thumbtack/pgCarpenter/notify/snsnotify"
+)
+
+// SNS comes with the AWS SDK, so it's left out along with S3 (-tags nos3)
+func init() {
+	newSNSNotifier = snsnotify.New
+}
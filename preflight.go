@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/util"
+)
+
+const (
+	// folder the probe objects written by check go in
+	probeFolder = "pgcarpenter-check"
+	// unreadable files listed by check, at most
+	maxReportedFiles = 10
+)
+
+// preflightCheck is one of the checks run by check
+type preflightCheck struct {
+	name string
+	run  func() error
+}
+
+// check that everything a backup needs is in place (storage, PostgreSQL, the data directory, and the
+// temporary directory), and print whether each check passed, so that problems are found out about before
+// the nightly backup runs into them
+func (a *app) preflight() int {
+	checks := []preflightCheck{
+		{"storage (write, read, and delete a probe object)", a.checkStorageAccess},
+		{"temporary directory space (" + *a.tmpDirectory + ")", a.checkTmpSpace},
+		{"archive settings (the same on all hosts archiving WAL to the bucket)", a.checkArchiveSettings},
+	}
+	if !*a.skipPostgresCheck {
+		checks = append(checks, preflightCheck{"PostgreSQL connection and backup privileges", a.checkPostgresAccess})
+	}
+	// --data-directory defaults to the working directory once normalized, which isn't worth checking
+	if flagGiven("data-directory") {
+		checks = append(checks, preflightCheck{"data directory readability", a.checkDataDirectoryReadable})
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			fmt.Printf("FAIL  %s: %s\n", c.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS  %s\n", c.name)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		return exitValidation
+	}
+	fmt.Printf("All %d checks passed\n", len(checks))
+
+	return 0
+}
+
+// return true iff the (long) flag was given on the command line, with or without =
+func flagGiven(name string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "--"+name || strings.HasPrefix(arg, "--"+name+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write a probe object, read it back, and delete it
+func (a *app) checkStorageAccess() error {
+	key := filepath.Join(probeFolder, fmt.Sprintf("%s-%d", notify.Hostname(), time.Now().UnixNano()))
+	body := "pgCarpenter check " + time.Now().Format(time.RFC3339)
+	if err := a.storage.PutString(a.ctx, key, body); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	contents, err := a.storage.GetString(a.ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if contents != body {
+		return fmt.Errorf("read back different contents from %s", key)
+	}
+	if err := a.storage.Delete(a.ctx, key); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// make sure there's at least --min-tmp-space MB available in the temporary directory
+func (a *app) checkTmpSpace() error {
+	if _, err := os.Stat(*a.tmpDirectory); err != nil {
+		return err
+	}
+	free, err := util.FreeSpace(*a.tmpDirectory)
+	if err != nil {
+		return err
+	}
+	if min := int64(*a.minTmpSpace) << 20; free < min {
+		return fmt.Errorf("only %s available, need %s", formatBytes(free), formatBytes(min))
+	}
+
+	return nil
+}
+
+// connect to PostgreSQL the way create-backup does, and make sure the user can start and stop backups,
+// and that WAL is being archived
+func (a *app) checkPostgresAccess() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	connStr := fmt.Sprintf("user=%s password='%s' sslmode=%s", *a.checkPGUser, *a.checkPGPassword, *a.checkSSLMode)
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	// nothing was written, there's no need to throw an error if closing it fails
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRowContext(ctx, "SHOW server_version_num").Scan(&version); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	// pg_start_backup and pg_stop_backup were renamed in PG 15
+	functions := []string{"pg_start_backup(text, boolean, boolean)", "pg_stop_backup(boolean, boolean)"}
+	if version >= 150000 {
+		functions = []string{"pg_backup_start(text, boolean)", "pg_backup_stop(boolean)"}
+	} else if version < 100000 {
+		functions[1] = "pg_stop_backup(boolean)"
+	}
+	for _, f := range functions {
+		var allowed bool
+		err := db.QueryRowContext(ctx, "SELECT has_function_privilege($1, 'EXECUTE')", f).Scan(&allowed)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return fmt.Errorf("user %s can't execute %s", *a.checkPGUser, f)
+		}
+	}
+
+	var archiveMode, walLevel string
+	err = db.QueryRowContext(ctx, "SELECT current_setting('archive_mode'), current_setting('wal_level')").Scan(
+		&archiveMode, &walLevel)
+	if err != nil {
+		return err
+	}
+	if archiveMode == "off" {
+		return errors.New("archive_mode is off, so the WAL backups need isn't archived")
+	}
+	if walLevel == "minimal" {
+		return errors.New("wal_level is minimal, backups can't be taken")
+	}
+
+	return nil
+}
+
+// make sure every file that would be backed up can be read
+func (a *app) checkDataDirectoryReadable() error {
+	unreadable := make([]string, 0)
+	root := *a.pgDataDirectory
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		relative, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		if relative != "." && a.ignoreFile(relative) {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// files might change during the traversal, as PostgreSQL is running
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			unreadable = append(unreadable, relative)
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			if err := checkReadable(path); err != nil && !os.IsNotExist(err) {
+				unreadable = append(unreadable, relative)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unreadable) > maxReportedFiles {
+		return fmt.Errorf("%d files can't be read: %s, ...", len(unreadable),
+			strings.Join(unreadable[:maxReportedFiles], ", "))
+	}
+	if len(unreadable) > 0 {
+		return fmt.Errorf("%d files can't be read: %s", len(unreadable), strings.Join(unreadable, ", "))
+	}
+
+	return nil
+}
+
+func parsePreflightArgs(cfg *app, parser *argparse.Command) {
+	cfg.checkPGUser = parser.String(
+		"",
+		"user",
+		&argparse.Options{
+			Required: false,
+			Default:  "postgres",
+			Help:     "PostgreSQL user"})
+	cfg.checkPGPassword = parser.String(
+		"",
+		"password",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "PostgreSQL password"})
+	cfg.checkSSLMode = parser.Selector(
+		"",
+		"sslmode",
+		[]string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"},
+		&argparse.Options{
+			Required: false,
+			Default:  "disable",
+			Help:     "SSL certificate verification mode"})
+	cfg.skipPostgresCheck = boolFlag(
+		parser,
+		"",
+		"no-postgres",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Don't check PostgreSQL (e.g., on hosts that only restore backups)"})
+	cfg.minTmpSpace = parser.Int(
+		"",
+		"min-tmp-space",
+		&argparse.Options{
+			Required: false,
+			Default:  256,
+			Help:     "Fail if less than this many MB are available in the temporary directory (see --tmp)"})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/thumbtack/pgCarpenter/progress"
+	"go.uber.org/zap"
+)
+
+// width (in characters) of the bar drawn with --progress-bar
+const progressBarWidth = 30
+
+// start tracking the progress of operation on the backup being created or restored, logging it every
+// --progress-interval seconds and drawing a progress bar with --progress-bar; the returned function stops it
+func (a *app) startProgress(operation string) (stop func()) {
+	a.progress = progress.NewReporter(operation, *a.backupName, a.progressSink)
+	a.progress.Started()
+
+	interval := time.Duration(*a.progressInterval) * time.Second
+	bar := *a.progressBar && isTerminal(os.Stderr)
+	if bar {
+		// a bar updated once a minute would look stuck
+		interval = time.Second
+	}
+	if interval <= 0 {
+		return func() {}
+	}
+
+	lastLog := time.Now()
+	stopReporting := a.progress.Every(interval, func(s progress.Snapshot) {
+		if bar {
+			fmt.Fprint(os.Stderr, "\r"+formatProgressBar(s))
+		}
+		if *a.progressInterval > 0 && time.Since(lastLog) >= time.Duration(*a.progressInterval)*time.Second {
+			lastLog = time.Now()
+			a.logProgress(operation, s)
+		}
+	})
+
+	return func() {
+		stopReporting()
+		if bar {
+			fmt.Fprintln(os.Stderr, "\r"+formatProgressBar(a.progress.Snapshot()))
+		}
+	}
+}
+
+func (a *app) logProgress(operation string, s progress.Snapshot) {
+	fields := []zap.Field{
+		zap.String("operation", operation),
+		zap.String("name", *a.backupName),
+		zap.Int64("files", s.Files),
+		zap.Int64("bytes", s.Bytes),
+		zap.Int64("total_files", s.TotalFiles),
+		zap.Int64("total_bytes", s.TotalBytes),
+		zap.Float64("bytes_per_second", s.Throughput),
+	}
+	// until the totals are final, there's no telling how far along we are
+	if s.Final {
+		fields = append(fields, zap.Float64("percent", s.Percent), zap.Duration("eta", s.ETA))
+	}
+	a.logger.Info("Progress", fields...)
+}
+
+// e.g., [#########---------------------]  31.2%  1.2GiB/3.9GiB  45.3MiB/s  ETA 12m3s
+func formatProgressBar(s progress.Snapshot) string {
+	filled := int(s.Percent / 100 * progressBarWidth)
+	total := "?"
+	eta := "?"
+	if s.Final {
+		total = formatBytes(s.TotalBytes)
+		eta = s.ETA.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf(
+		"[%s%s] %5.1f%%  %s/%s  %s/s  ETA %s   ",
+		strings.Repeat("#", filled),
+		strings.Repeat("-", progressBarWidth-filled),
+		s.Percent,
+		formatBytes(s.Bytes),
+		total,
+		formatBytes(int64(s.Throughput)),
+		eta)
+}
+
+// e.g., 1.2GiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// return true iff f is a terminal (rather than, e.g., a file or a pipe)
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
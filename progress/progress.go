@@ -0,0 +1,193 @@
+package progress
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// types of events
+const (
+	EventStarted  = "started"
+	EventFile     = "file"
+	EventFinished = "finished"
+	// sent periodically, see Reporter.Every
+	EventProgress = "progress"
+)
+
+// Event is a progress update, as sent to the clients of a Socket.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Operation string    `json:"operation"`
+	Backup    string    `json:"backup,omitempty"`
+	// set on EventFile: the file that was just processed
+	File string `json:"file,omitempty"`
+	// files and bytes processed so far
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// set on EventProgress: totals (so far, unless final), percentage of bytes processed, and estimated
+	// time to completion (only once totals are final)
+	TotalFiles int64         `json:"total_files,omitempty"`
+	TotalBytes int64         `json:"total_bytes,omitempty"`
+	Percent    float64       `json:"percent,omitempty"`
+	ETA        time.Duration `json:"eta_ns,omitempty"`
+	// set on EventFinished
+	Success bool   `json:"success,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Reporter keeps track of the progress of an operation and sends events to a Socket. It's safe for
+// concurrent use; a nil Socket means progress is only tracked.
+type Reporter struct {
+	operation  string
+	backup     string
+	socket     *Socket
+	started    time.Time
+	files      int64
+	bytes      int64
+	totalFiles int64
+	totalBytes int64
+	final      int32 // 1 once the totals are final
+}
+
+// Snapshot is the progress of an operation at some point in time.
+type Snapshot struct {
+	Files      int64
+	Bytes      int64
+	TotalFiles int64
+	TotalBytes int64
+	// true iff the totals are final, rather than what's been found so far
+	Final   bool
+	Elapsed time.Duration
+	// bytes per second, on average since the operation started
+	Throughput float64
+	// of bytes processed, and estimated time to completion; only known once totals are final
+	Percent float64
+	ETA     time.Duration
+}
+
+// NewReporter returns a Reporter for operation (e.g., create-backup) on backup.
+func NewReporter(operation string, backup string, socket *Socket) *Reporter {
+	return &Reporter{operation: operation, backup: backup, socket: socket}
+}
+
+// Started reports the operation has started.
+func (r *Reporter) Started() {
+	r.started = time.Now()
+	r.send(Event{Type: EventStarted})
+}
+
+// AddTotal adds files, of size bytes, to the total amount of work, as it's found.
+func (r *Reporter) AddTotal(files int64, bytes int64) {
+	atomic.AddInt64(&r.totalFiles, files)
+	atomic.AddInt64(&r.totalBytes, bytes)
+}
+
+// SetTotal sets the total amount of work, when it's known in advance; the totals are final.
+func (r *Reporter) SetTotal(files int64, bytes int64) {
+	atomic.StoreInt64(&r.totalFiles, files)
+	atomic.StoreInt64(&r.totalBytes, bytes)
+	r.TotalsFinal()
+}
+
+// TotalsFinal signals that all of the work has been found (e.g., with AddTotal).
+func (r *Reporter) TotalsFinal() {
+	atomic.StoreInt32(&r.final, 1)
+}
+
+// Snapshot returns the progress so far.
+func (r *Reporter) Snapshot() Snapshot {
+	s := Snapshot{
+		Files:      r.Files(),
+		Bytes:      r.Bytes(),
+		TotalFiles: atomic.LoadInt64(&r.totalFiles),
+		TotalBytes: atomic.LoadInt64(&r.totalBytes),
+		Final:      atomic.LoadInt32(&r.final) == 1,
+		Elapsed:    time.Since(r.started),
+	}
+	if s.Elapsed > 0 {
+		s.Throughput = float64(s.Bytes) / s.Elapsed.Seconds()
+	}
+	if s.Final && s.TotalBytes > 0 {
+		s.Percent = 100 * float64(s.Bytes) / float64(s.TotalBytes)
+		if s.Percent > 100 {
+			s.Percent = 100
+		}
+		if s.Throughput > 0 && s.Bytes < s.TotalBytes {
+			s.ETA = time.Duration(float64(s.TotalBytes-s.Bytes) / s.Throughput * float64(time.Second))
+		}
+	}
+
+	return s
+}
+
+// Every calls fn with a snapshot of the progress, and sends it to the Socket, every interval until the
+// returned function is called.
+func (r *Reporter) Every(interval time.Duration, fn func(Snapshot)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s := r.Snapshot()
+				fn(s)
+				r.send(Event{
+					Type:       EventProgress,
+					TotalFiles: s.TotalFiles,
+					TotalBytes: s.TotalBytes,
+					Percent:    s.Percent,
+					ETA:        s.ETA,
+				})
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// FileDone reports file, of size bytes, has been processed.
+func (r *Reporter) FileDone(file string, size int64) {
+	atomic.AddInt64(&r.files, 1)
+	atomic.AddInt64(&r.bytes, size)
+	r.send(Event{Type: EventFile, File: file})
+}
+
+// Finished reports the operation has finished; err is nil on success.
+func (r *Reporter) Finished(err error) {
+	e := Event{Type: EventFinished, Success: err == nil}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.send(e)
+}
+
+// Files returns the number of files processed so far.
+func (r *Reporter) Files() int64 {
+	return atomic.LoadInt64(&r.files)
+}
+
+// Bytes returns the number of bytes processed so far.
+func (r *Reporter) Bytes() int64 {
+	return atomic.LoadInt64(&r.bytes)
+}
+
+func (r *Reporter) send(e Event) {
+	if r.socket == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Operation = r.operation
+	e.Backup = r.backup
+	e.Files = r.Files()
+	e.Bytes = r.Bytes()
+	r.socket.Send(e)
+}
@@ -0,0 +1,84 @@
+package progress
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// how long to wait on a slow client before giving up on it
+const writeTimeout = time.Second
+
+// Socket serves progress events, as newline delimited JSON, to all clients connected to a Unix socket.
+// Clients only get the events sent after they connect.
+type Socket struct {
+	listener net.Listener
+	mu       sync.Mutex
+	clients  map[net.Conn]struct{}
+}
+
+// Listen creates a Unix socket at path (replacing any stale one) and starts accepting clients.
+func Listen(path string) (*Socket, error) {
+	// a previous run may have been killed before it had a chance to clean up
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Socket{listener: listener, clients: make(map[net.Conn]struct{})}
+	go s.accept()
+
+	return s, nil
+}
+
+func (s *Socket) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// the listener was closed
+			return
+		}
+		s.mu.Lock()
+		s.clients[conn] = struct{}{}
+		s.mu.Unlock()
+	}
+}
+
+// Send writes the event to all connected clients, dropping the ones that fail to keep up.
+func (s *Socket) Send(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.clients {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(line); err != nil {
+			conn.Close()
+			delete(s.clients, conn)
+		}
+	}
+}
+
+// Close disconnects all clients and removes the socket.
+func (s *Socket) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.clients {
+		conn.Close()
+		delete(s.clients, conn)
+	}
+
+	return err
+}
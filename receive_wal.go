@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"go.uber.org/zap"
+)
+
+// directory (in the receive directory) where the partial segment is copied to before being uploaded, as
+// pg_receivewal keeps writing to it
+const partialSnapshotDirectory = ".pgcarpenter-partial"
+
+// stream WAL over the replication protocol, by running pg_receivewal (which takes care of reconnecting,
+// and of syncing each segment as it's completed), and upload the segments it receives; unlike
+// archive_command, the segment being written is uploaded too (as a partial segment), every
+// --poll-interval seconds, so that failing over only loses what was written since
+func (a *app) receiveWAL() int {
+	if err := os.MkdirAll(*a.receiveDirectory, 0700); err != nil {
+		a.logger.Error("Failed to create the receive directory", zap.Error(err))
+		return exitFailure
+	}
+	if *a.receiveSlot != "" {
+		if err := a.runReceiveWAL("--create-slot", "--if-not-exists").Run(); err != nil {
+			a.logger.Error("Failed to create the replication slot", zap.String("slot", *a.receiveSlot), zap.Error(err))
+			return exitPostgreSQL
+		}
+	}
+
+	cmd := a.runReceiveWAL("--directory", *a.receiveDirectory)
+	a.logger.Info("Receiving WAL", zap.String("directory", *a.receiveDirectory), zap.Strings("command", cmd.Args))
+	if err := cmd.Start(); err != nil {
+		a.logger.Error("Failed to start pg_receivewal", zap.Error(err))
+		return exitFailure
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// modification time of the partial segment when it was last uploaded
+	uploaded := make(map[string]time.Time)
+	interval := time.Duration(*a.receivePollInterval) * time.Second
+	for {
+		select {
+		case err := <-exited:
+			// upload whatever was received before pg_receivewal exited
+			if err := a.uploadReceived(uploaded); err != nil {
+				a.logger.Error("Failed to archive received WAL", zap.Error(err))
+			}
+			a.logger.Error("pg_receivewal exited", zap.Error(err))
+			return exitFailure
+		case <-a.ctx.Done():
+			// pg_receivewal is sent SIGTERM, what it received is archived once it's started again
+			a.logger.Info("Stopping pg_receivewal")
+			<-exited
+			return 0
+		case <-time.After(interval):
+			if err := a.uploadReceived(uploaded); err != nil {
+				a.logger.Error("Failed to archive received WAL, trying again later", zap.Error(err))
+			}
+		}
+	}
+}
+
+// return the pg_receivewal command, with the connection options and the given arguments
+func (a *app) runReceiveWAL(args ...string) *exec.Cmd {
+	args = append(args, "--no-password", "--username", *a.receiveUser)
+	if *a.receiveHost != "" {
+		args = append(args, "--host", *a.receiveHost)
+	}
+	if *a.receivePort != "" {
+		args = append(args, "--port", *a.receivePort)
+	}
+	if *a.receiveSlot != "" {
+		args = append(args, "--slot", *a.receiveSlot)
+	}
+	cmd := a.commandContext(*a.receiveCommand, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if *a.receivePassword != "" {
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+*a.receivePassword)
+	}
+
+	return cmd
+}
+
+// upload the segments completed by pg_receivewal, oldest first, removing each one once archived, along with
+// the partial segment, unless it hasn't changed since it was last uploaded
+func (a *app) uploadReceived(uploaded map[string]time.Time) error {
+	entries, err := ioutil.ReadDir(*a.receiveDirectory)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, e := range entries {
+		path := filepath.Join(*a.receiveDirectory, e.Name())
+		switch walFileKind(e.Name()) {
+		case walSegmentFile, walTimelineHistoryFile:
+			if err := a.archiveSegment(path); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			delete(uploaded, e.Name()+".partial")
+			a.logger.Debug("Archived received WAL segment", zap.String("WAL", e.Name()))
+		case walPartialSegmentFile:
+			if !e.ModTime().After(uploaded[e.Name()]) {
+				continue
+			}
+			if err := a.uploadPartial(path); err != nil {
+				return err
+			}
+			uploaded[e.Name()] = e.ModTime()
+		}
+	}
+
+	return nil
+}
+
+// upload a snapshot of the partial segment pg_receivewal is writing to, so that what's uploaded matches
+// its checksum
+func (a *app) uploadPartial(path string) error {
+	dir := filepath.Join(*a.receiveDirectory, partialSnapshotDirectory)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	snapshot := filepath.Join(dir, filepath.Base(path))
+	if err := copyFileSync(path, snapshot); err != nil {
+		return err
+	}
+	defer os.Remove(snapshot)
+
+	return a.archiveSegment(snapshot)
+}
+
+func validateReceiveDirectory(args []string) error {
+	if !filepath.IsAbs(args[0]) {
+		return fmt.Errorf("receive directory ('%s') must be an absolute path", args[0])
+	}
+
+	return nil
+}
+
+func parseReceiveWALArgs(cfg *app, parser *argparse.Command) {
+	cfg.receiveDirectory = parser.String(
+		"",
+		"receive-directory",
+		&argparse.Options{
+			Required: true,
+			Validate: validateReceiveDirectory,
+			Help:     "Full path to the directory pg_receivewal writes WAL to before it's uploaded"})
+	cfg.receiveCommand = parser.String(
+		"",
+		"pg-receivewal",
+		&argparse.Options{
+			Required: false,
+			Default:  "pg_receivewal",
+			Help:     "Path to pg_receivewal (if not in the PATH)"})
+	cfg.receiveHost = parser.String(
+		"",
+		"host",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "PostgreSQL host (or directory of its Unix-domain socket)"})
+	cfg.receivePort = parser.String(
+		"",
+		"port",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "PostgreSQL port"})
+	cfg.receiveUser = parser.String(
+		"",
+		"user",
+		&argparse.Options{
+			Required: false,
+			Default:  "postgres",
+			Help:     "PostgreSQL user (with the REPLICATION attribute)"})
+	cfg.receivePassword = parser.String(
+		"",
+		"password",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "PostgreSQL password"})
+	cfg.receiveSlot = parser.String(
+		"",
+		"slot",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Replication slot to stream from (created if it doesn't exist), so that the primary keeps " +
+				"WAL around until it's received"})
+	cfg.receivePollInterval = parser.Int(
+		"",
+		"poll-interval",
+		&argparse.Options{
+			Required: false,
+			Default:  10,
+			Help:     "Upload received WAL (including the partial segment) every this many seconds"})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// PG 12 replaced recovery.conf with settings in postgresql.conf (or postgresql.auto.conf) and an empty
+	// recovery.signal file to request recovery
+	recoverySignalVersion = 12
+	recoveryConfFile      = "recovery.conf"
+	recoverySignalFile    = "recovery.signal"
+	standbySignalFile     = "standby.signal"
+	autoConfFile          = "postgresql.auto.conf"
+	// what the restored cluster does once started: recover (up to the recovery target, or the end of the
+	// archived WAL) and promote, or keep following the archived WAL as a standby
+	recoveryModeRecovery = "recovery"
+	recoveryModeStandby  = "standby"
+)
+
+var recoveryTargetActions = []string{"pause", "promote", "shutdown"}
+var recoveryModes = []string{recoveryModeRecovery, recoveryModeStandby}
+
+// recoverySetting is a single name = 'value' line of recovery.conf (or postgresql.auto.conf)
+type recoverySetting struct {
+	name  string
+	value string
+}
+
+func validateTargetXID(args []string) error {
+	if _, err := strconv.ParseUint(args[0], 10, 64); err != nil {
+		return fmt.Errorf("transaction id ('%s') must be a non-negative integer", args[0])
+	}
+
+	return nil
+}
+
+func validateTargetLSN(args []string) error {
+	if match, _ := regexp.MatchString(`^[0-9A-Fa-f]{1,8}/[0-9A-Fa-f]{1,8}$`, args[0]); !match {
+		return fmt.Errorf("LSN ('%s') must look like 0/16B3748", args[0])
+	}
+
+	return nil
+}
+
+// return the recovery target (e.g., recovery_target_time) requested on the command line, if any; at most
+// one of them can be given
+func (a *app) recoveryTarget() (*recoverySetting, error) {
+	targets := []recoverySetting{
+		{"recovery_target_time", *a.targetTime},
+		{"recovery_target_xid", *a.targetXID},
+		{"recovery_target_lsn", *a.targetLSN},
+		{"recovery_target_name", *a.targetName},
+	}
+	var target *recoverySetting
+	for i := range targets {
+		if targets[i].value == "" {
+			continue
+		}
+		if target != nil {
+			return nil, errors.New("only one of --target-time, --target-xid, --target-lsn, and --target-name " +
+				"can be given")
+		}
+		target = &targets[i]
+	}
+	if target == nil && *a.targetAction != "" {
+		return nil, errors.New("--target-action requires a recovery target")
+	}
+
+	return target, nil
+}
+
+// return true iff the restored cluster must be configured to start recovery (see writeRecoveryConfig)
+func (a *app) needsRecoveryConfig(target *recoverySetting) bool {
+	return target != nil || *a.recoveryMode != "" || *a.targetTimeline != ""
+}
+
+func validateTargetTimeline(args []string) error {
+	if args[0] == "latest" || args[0] == "current" {
+		return nil
+	}
+	if tli, err := strconv.ParseUint(args[0], 10, 32); err != nil || tli == 0 {
+		return fmt.Errorf("timeline ('%s') must be latest, current, or a timeline id", args[0])
+	}
+
+	return nil
+}
+
+// return the restore_command that fetches WAL segments with this very binary
+func (a *app) restoreCommand() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the path to pgCarpenter: %w", err)
+	}
+	args := []string{
+		executable, "restore-wal",
+	}
+	if *a.storageURL != "" {
+		args = append(args, "--storage-url", "'"+*a.storageURL+"'")
+	} else {
+		args = append(args, "--s3-bucket", *a.s3Bucket)
+		if a.s3RegionGiven() {
+			args = append(args, "--s3-region", *a.s3Region)
+		}
+	}
+	// so that a hung connection can't stall recovery
+	if *a.storageOpTimeout > 0 {
+		args = append(args, "--storage-op-timeout", strconv.Itoa(*a.storageOpTimeout))
+	}
+	if *a.configFile != "" {
+		args = append(args, "--config", *a.configFile)
+	}
+	args = append(args, "--wal-path", "%p", "--wal-filename", "%f")
+
+	return strings.Join(args, " "), nil
+}
+
+// configure the restored cluster to start recovery (up to target, if not nil) fetching WAL with restore-wal
+// from the same bucket, the way its version of PostgreSQL expects it: before PG 12, in recovery.conf; since,
+// appended to postgresql.auto.conf along with an empty recovery.signal (or standby.signal)
+func (a *app) writeRecoveryConfig(target *recoverySetting) error {
+	version, err := pgMajorVersion(*a.pgDataDirectory)
+	if err != nil {
+		return fmt.Errorf("failed to determine the version of PostgreSQL: %w", err)
+	}
+	restoreCommand, err := a.restoreCommand()
+	if err != nil {
+		return err
+	}
+	standby := *a.recoveryMode == recoveryModeStandby
+
+	settings := []recoverySetting{{"restore_command", restoreCommand}}
+	if standby && version < recoverySignalVersion {
+		settings = append(settings, recoverySetting{"standby_mode", "on"})
+	}
+	if target != nil {
+		settings = append(settings, *target)
+	}
+	if *a.targetAction != "" {
+		settings = append(settings, recoverySetting{"recovery_target_action", *a.targetAction})
+	}
+	if *a.targetTimeline != "" {
+		settings = append(settings, recoverySetting{"recovery_target_timeline", *a.targetTimeline})
+	}
+
+	lines := []string{"# added by pgCarpenter restore-backup"}
+	for _, s := range settings {
+		lines = append(lines, fmt.Sprintf("%s = '%s'", s.name, strings.ReplaceAll(s.value, "'", "''")))
+	}
+	contents := strings.Join(lines, "\n") + "\n"
+
+	if version < recoverySignalVersion {
+		path := filepath.Join(*a.pgDataDirectory, recoveryConfFile)
+		a.logger.Info("Writing recovery settings", zap.String("path", path))
+		return ioutil.WriteFile(path, []byte(contents), 0600)
+	}
+
+	// settings appended to postgresql.auto.conf override the ones restored with it
+	path := filepath.Join(*a.pgDataDirectory, autoConfFile)
+	a.logger.Info("Writing recovery settings", zap.String("path", path))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	signal := recoverySignalFile
+	if standby {
+		signal = standbySignalFile
+	}
+
+	return ioutil.WriteFile(filepath.Join(*a.pgDataDirectory, signal), nil, 0600)
+}
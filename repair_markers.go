@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// fix the markers of successful backups, and LATEST, so that they agree with the backups actually in
+// storage: markers of backups whose data is gone are removed, missing markers of backups whose manifest
+// says they were completed (and whose files are all there) are recreated, and LATEST is pointed at the
+// newest successful backup if it points at one that isn't (anymore); the catalog is rebuilt as well
+func (a *app) repairMarkers() int {
+	verb := ""
+	if *a.repairDryRun {
+		verb = "would "
+	}
+
+	backups, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		a.logger.Error("Failed to list backups", zap.Error(err))
+		return exitStorage
+	}
+	exists := make(map[string]bool)
+	for _, k := range backups {
+		name := strings.TrimSuffix(k, "/")
+		if !isBackupFolder(name) {
+			continue
+		}
+		exists[name] = true
+	}
+	markers, err := a.listKeys(successfullyCompletedFolder + "/")
+	if err != nil {
+		a.logger.Error("Failed to list the markers of successful backups", zap.Error(err))
+		return exitStorage
+	}
+	successful := make(map[string]bool)
+	for _, k := range markers {
+		successful[strings.TrimPrefix(k, successfullyCompletedFolder+"/")] = true
+	}
+
+	repaired := 0
+	failed := 0
+	for _, name := range sortedKeys(successful) {
+		if exists[name] {
+			continue
+		}
+		fmt.Printf("%sremove the marker of %s: its data is gone\n", verb, name)
+		delete(successful, name)
+		repaired++
+		if *a.repairDryRun {
+			continue
+		}
+		if err := a.storage.Delete(a.ctx, a.getSuccessfulMarker(name)); err != nil {
+			a.logger.Error("Failed to remove the marker", zap.String("name", name), zap.Error(err))
+			failed++
+		}
+	}
+
+	for _, name := range sortedKeys(exists) {
+		if successful[name] {
+			continue
+		}
+		if err := a.verifyCompleteBackup(name); err != nil {
+			a.logger.Debug("Not marking the backup as successful", zap.String("name", name), zap.Error(err))
+			continue
+		}
+		fmt.Printf("%screate the missing marker of %s: its manifest is complete, and all its files are there\n",
+			verb, name)
+		successful[name] = true
+		repaired++
+		if *a.repairDryRun {
+			continue
+		}
+		if err := a.putSuccessfulMarker(name); err != nil {
+			a.logger.Error("Failed to create the marker", zap.String("name", name), zap.Error(err))
+			failed++
+		}
+	}
+
+	// LATEST may be missing too
+	latest := ""
+	latestExists, err := a.storage.Exists(a.ctx, latestKey)
+	if err == nil && latestExists {
+		latest, err = a.resolveLatest()
+	}
+	if err != nil {
+		a.logger.Error("Failed to resolve the reference to LATEST", zap.Error(err))
+		return exitStorage
+	}
+	if !successful[latest] {
+		newest, err := a.newestBackup(successful)
+		if err != nil {
+			a.logger.Error("Failed to find the newest successful backup", zap.Error(err))
+			return exitStorage
+		}
+		if newest != "" && newest != latest {
+			fmt.Printf("%spoint %s to %s: it pointed to '%s', which isn't a successful backup\n",
+				verb, latestKey, newest, latest)
+			repaired++
+			if !*a.repairDryRun {
+				if err := a.updateLatest(newest); err != nil {
+					a.logger.Error("Failed to update the reference to LATEST", zap.Error(err))
+					failed++
+				}
+			}
+		}
+	}
+
+	if *a.repairDryRun {
+		fmt.Printf("%d markers would be repaired\n", repaired)
+		return 0
+	}
+	fmt.Printf("%d markers repaired\n", repaired)
+
+	// the catalog may be just as wrong
+	if err := a.rebuildCatalog(); err != nil {
+		a.logger.Error("Failed to rebuild the catalog", zap.Error(err))
+		failed++
+	}
+	if failed > 0 {
+		return exitStorage
+	}
+
+	return 0
+}
+
+// return nil iff the backup verifiably completed: its manifest says so, and every file it lists (along
+// with the backup label) is in storage
+func (a *app) verifyCompleteBackup(name string) error {
+	m, err := a.getManifest(name)
+	if err != nil {
+		return fmt.Errorf("no manifest: %w", err)
+	}
+	switch {
+	case m.Aborted:
+		return errors.New("the backup was aborted: " + m.AbortReason)
+	case m.StopTime.IsZero():
+		return errors.New("the backup wasn't stopped")
+	case len(m.FileSizes) == 0:
+		// taken by an older version of pgCarpenter
+		return errors.New("the manifest doesn't list the files in the backup")
+	}
+	for _, f := range m.SkippedFiles {
+		if strings.HasPrefix(f.Reason, "failed to upload") {
+			return fmt.Errorf("%s failed to upload", f.Path)
+		}
+	}
+
+	keys, err := a.listKeys(name + "/")
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]bool)
+	for _, k := range keys {
+		stored[util.TrimCompressionExtension(strings.TrimPrefix(k, name+"/"))] = true
+	}
+	if !stored["backup_label"] {
+		return errors.New("backup_label is missing")
+	}
+	for path := range m.FileSizes {
+		if !stored[path] {
+			return fmt.Errorf("%s is missing", path)
+		}
+	}
+
+	return nil
+}
+
+// return the newest of the backups, by the time their folder was created, or "" if there are none
+func (a *app) newestBackup(names map[string]bool) (string, error) {
+	newest := ""
+	newestMTime := int64(0)
+	for name := range names {
+		mtime, err := a.storage.GetLastModifiedTime(a.ctx, name+"/")
+		if err != nil {
+			return "", err
+		}
+		if mtime > newestMTime {
+			newest = name
+			newestMTime = mtime
+		}
+	}
+
+	return newest, nil
+}
+
+// return the keys of all objects under prefix
+func (a *app) listKeys(prefix string) ([]string, error) {
+	keysC := make(chan string)
+	keys := make([]string, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := range keysC {
+			keys = append(keys, key)
+		}
+	}()
+	err := a.storage.WalkFolder(a.ctx, prefix, keysC)
+	close(keysC)
+	<-done
+
+	return keys, err
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func parseRepairMarkersArgs(cfg *app, parser *argparse.Command) {
+	cfg.repairDryRun = boolFlag(
+		parser,
+		"",
+		"dry-run",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Only print what would be repaired"})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/storage"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// chain-of-custody report of a backup, for audits
+type custodyReport struct {
+	Backup        string    `json:"backup"`
+	GeneratedTime time.Time `json:"generated_time"`
+	GeneratedBy   string    `json:"generated_by"`
+	Successful    bool      `json:"successful"`
+	// when, where, and by whom the backup was taken, as well as its verification history; only
+	// missing for backups taken by older versions of pgCarpenter
+	Manifest *backupManifest `json:"manifest,omitempty"`
+	Files    []reportFile    `json:"files"`
+}
+
+type reportFile struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	ModifiedTime int64  `json:"modified_time"`
+	Checksum     string `json:"checksum,omitempty"`
+}
+
+// the report, as is, along with its signature (if a signing key was given); verifiers check the signature
+// against the exact bytes of Report
+type signedReport struct {
+	Report    json.RawMessage `json:"report"`
+	Algorithm string          `json:"algorithm,omitempty"`
+	PublicKey string          `json:"public_key,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+func (a *app) report() int {
+	a.logger.Info("Generating report", zap.String("name", *a.backupName))
+	begin := time.Now()
+
+	if *a.backupName == latestKey {
+		latest, err := a.resolveLatest()
+		if err != nil {
+			a.logger.Error("Failed to resolve the reference to LATEST", zap.Error(err))
+			return exitCode(err, exitStorage)
+		}
+		*a.backupName = latest
+	}
+
+	// make sure the backup exists
+	exists, err := a.storage.Exists(a.ctx, *a.backupName+"/")
+	if err != nil {
+		a.logger.Error("Failed to check whether the backup exists", zap.String("name", *a.backupName), zap.Error(err))
+		return exitStorage
+	}
+	if !exists {
+		a.logger.Error("Backup not found", zap.String("name", *a.backupName))
+		return exitNotFound
+	}
+
+	r := custodyReport{
+		Backup:        *a.backupName,
+		GeneratedTime: time.Now(),
+		GeneratedBy:   notify.Hostname(),
+	}
+	if identifier, ok := a.storage.(storage.Identifier); ok {
+		if identity, err := identifier.Identity(a.ctx); err == nil {
+			r.GeneratedBy += " (" + identity + ")"
+		}
+	}
+	r.Successful, err = a.storage.Exists(a.ctx, a.getSuccessfulMarker(*a.backupName))
+	if err != nil {
+		a.logger.Error("Failed to check whether the backup was successful", zap.Error(err))
+		return exitStorage
+	}
+	if manifest, err := a.getManifest(*a.backupName); err == nil {
+		r.Manifest = manifest
+	} else {
+		a.logger.Warn("Failed to get the backup's manifest", zap.Error(err))
+	}
+
+	r.Files, err = a.reportFiles()
+	if err != nil {
+		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+
+	signed, err := a.signReport(r)
+	if err != nil {
+		a.logger.Error("Failed to sign report", zap.Error(err))
+		return exitFailure
+	}
+	contents, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		a.logger.Error("Failed to encode report", zap.Error(err))
+		return exitFailure
+	}
+	contents = append(contents, '\n')
+
+	if *a.reportOutput == "" {
+		_, err = os.Stdout.Write(contents)
+	} else {
+		err = ioutil.WriteFile(*a.reportOutput, contents, 0600)
+	}
+	if err != nil {
+		a.logger.Error("Failed to write report", zap.Error(err))
+		return exitFailure
+	}
+
+	a.logger.Info(
+		"Report successfully generated",
+		zap.Int("files", len(r.Files)),
+		zap.Duration("seconds", time.Now().Sub(begin)))
+
+	return 0
+}
+
+// return the size, mtime, and checksum of every object in the backup, sorted by key
+func (a *app) reportFiles() ([]reportFile, error) {
+	keysC := make(chan string)
+	files := make([]reportFile, 0)
+	mu := sync.Mutex{}
+
+	// the checksums of the files are in the manifest; backups taken by older versions of pgCarpenter have
+	// them in the metadata of the objects instead
+	var checksums map[string]string
+	if m, err := a.getManifest(*a.backupName); err == nil {
+		checksums = m.Checksums
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(*a.nWorkers)
+	for i := 0; i < *a.nWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keysC {
+				// once the command gives up, the keys still queued are left alone
+				if a.ctx.Err() != nil {
+					continue
+				}
+				f := reportFile{Key: strings.TrimPrefix(key, *a.backupName+"/")}
+				metadata, err := a.storage.GetMetadata(a.ctx, key)
+				if err != nil {
+					a.logger.Error("Failed to get metadata", zap.Error(err), zap.String("key", key))
+				} else {
+					f.Size = metadata.Size
+					f.ModifiedTime = metadata.ModifiedTime
+					f.Checksum = metadata.Checksum
+				}
+				if checksum, ok := checksums[util.TrimCompressionExtension(f.Key)]; ok {
+					f.Checksum = checksum
+				}
+				mu.Lock()
+				files = append(files, f)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := a.storage.WalkFolder(a.ctx, *a.backupName+"/", keysC)
+	close(keysC)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Key < files[j].Key })
+
+	return files, nil
+}
+
+// sign the report with the Ed25519 private key in --signing-key (PKCS #8, PEM encoded, e.g., as
+// generated by `openssl genpkey -algorithm ed25519`), if one was given
+func (a *app) signReport(r custodyReport) (signedReport, error) {
+	contents, err := json.Marshal(r)
+	if err != nil {
+		return signedReport{}, err
+	}
+	signed := signedReport{Report: contents}
+	if *a.signingKey == "" {
+		return signed, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(*a.signingKey)
+	if err != nil {
+		return signed, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return signed, errors.New("no PEM data found in " + *a.signingKey)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return signed, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return signed, errors.New("signing key is not an Ed25519 private key")
+	}
+
+	signed.Algorithm = "ed25519"
+	signed.PublicKey = base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	signed.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, contents))
+
+	return signed, nil
+}
+
+func parseReportArgs(cfg *app, parser *argparse.Command) {
+	cfg.signingKey = parser.String(
+		"",
+		"signing-key",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Ed25519 private key (PKCS #8, PEM encoded) to sign the report with"})
+	cfg.reportOutput = parser.String(
+		"",
+		"output",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "File to write the report to (default stdout)"})
+}
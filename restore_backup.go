@@ -1,22 +1,70 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/akamensky/argparse"
-	"github.com/pierrec/lz4"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"github.com/thumbtack/pgCarpenter/storage"
 	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 )
 
 // we don't backup up empty directories, but the ones below must exist in order for PG to start
-var directoriesThatMustExist = []string{"pg_tblspc", "pg_replslot", "pg_stat", "pg_snapshots", "pg_xlog"}
+// (along with the WAL directory, whose name depends on the version of PG; see walDirectory)
+var directoriesThatMustExist = []string{"pg_tblspc", "pg_replslot", "pg_stat", "pg_snapshots"}
 
 func (a *app) restoreBackup() int {
+	begin := time.Now()
+	rc := a.runRestore()
+	// nothing was restored
+	if *a.dryRun {
+		return rc
+	}
+
+	env := hookEnv{name: *a.backupName, status: "success", duration: time.Now().Sub(begin)}
+	if rc != 0 {
+		env.status = "failure"
+	}
+	if a.progress != nil {
+		env.files = a.progress.Files()
+		env.bytes = a.progress.Bytes()
+	}
+	a.recordRestoreMetrics(rc, env.duration, env.bytes)
+	event := notify.Event{
+		Operation:  "restore-backup",
+		BackupName: *a.backupName,
+		Host:       notify.Hostname(),
+		Success:    rc == 0,
+		Start:      begin,
+		Duration:   env.duration,
+		Files:      int(env.files),
+		Bytes:      env.bytes,
+	}
+	// the error itself was logged
+	if rc != 0 {
+		event.Error = "restore failed, see the logs"
+	}
+	a.notify(event)
+	if err := a.runHook("post-restore", *a.postRestoreCmd, env); err != nil {
+		a.logger.Error("Failed to run post-restore hook", zap.Error(err))
+	}
+
+	return rc
+}
+
+// restore the backup; return the exit status of restore-backup
+func (a *app) runRestore() int {
 	// create a channel for distributing work
 	// spawn nWorkers
 	// list all files in backupName, and for each file:
@@ -34,19 +82,179 @@ func (a *app) restoreBackup() int {
 		latest, err := a.resolveLatest()
 		if err != nil {
 			a.logger.Error("Failed to resolve the name of the backup for "+latestKey, zap.Error(err))
-			return 1
+			return exitCode(err, exitStorage)
 		}
 		// update the field with the backup name we'll be using everywhere
 		*a.backupName = latest
 	}
 
+	if err := a.checkRestoreTarget(); err != nil {
+		// nothing is written with --dry-run
+		if !*a.dryRun {
+			a.logger.Error("Refusing to restore to the data directory (--force to do it anyway)", zap.Error(err))
+			return exitValidation
+		}
+		a.logger.Warn("The restore would be refused (--force to do it anyway)", zap.Error(err))
+	}
+
+	// a clone restored alongside the original cluster (e.g., on the same host) must not write to the
+	// original's tablespaces, nor wherever its other symlinks point to
+	if *a.tablespaceRootDir != "" {
+		a.tablespaceRoot = *a.tablespaceRootDir
+		*a.materializeSymlinks = true
+	}
+
+	// bad combinations of recovery target flags are better found out before restoring anything
+	target, err := a.recoveryTarget()
+	if err != nil {
+		a.logger.Error("Invalid recovery target", zap.Error(err))
+		return exitUsage
+	}
+
 	a.logger.Info("Starting to restore backup", zap.String("name", *a.backupName))
 	begin := time.Now()
 
-	// channel to keep the path of all files that need to compressed and uploaded
-	restoreFilesC := make(chan string)
+	// backups taken by older versions of pgCarpenter don't have a manifest
+	manifest, err := a.getManifest(*a.backupName)
+	if err != nil {
+		a.logger.Debug("Failed to get the backup's manifest", zap.Error(err))
+	} else {
+		for _, note := range manifest.Notes {
+			a.logger.Warn(note, zap.String("name", *a.backupName))
+		}
+		a.restoreChecksums = manifest.Checksums
+	}
+	// older versions of pgCarpenter checksummed files apart from uploading them, so those checksums don't
+	// match the files that were written to while they were being backed up (i.e., most of a busy cluster)
+	if *a.verifyRestore && len(a.restoreChecksums) == 0 {
+		a.logger.Warn("The backup has no checksums of the files it stored, they can't be verified", zap.String("name", *a.backupName))
+	}
+	if *a.dryRun {
+		return a.dryRunRestore()
+	}
+
+	// keep track of the files restored, so that the restore can be resumed if it's interrupted
+	if err := os.MkdirAll(*a.pgDataDirectory, 0700); err != nil {
+		a.logger.Error("Failed to create the data directory", zap.Error(err))
+		return exitFailure
+	}
+	a.restoreState, err = openRestoreState(*a.pgDataDirectory, *a.backupName, *a.restoreResume)
+	if err != nil {
+		a.logger.Error("Failed to open the state of the restore", zap.Error(err))
+		return exitFailure
+	}
+	if n := len(a.restoreState.done); n > 0 {
+		a.logger.Info("Resuming interrupted restore", zap.Int("restored_files", n))
+	}
+	complete := false
+	defer func() {
+		if err := a.restoreState.close(complete); err != nil {
+			a.logger.Error("Failed to close the state of the restore", zap.Error(err))
+		}
+	}()
+	var tablespaceLocations map[string]string
+	if manifest != nil {
+		if *a.preallocate {
+			if err := a.checkFreeSpace(manifest.Size); err != nil {
+				a.logger.Error("Not enough space to restore the backup", zap.Error(err))
+				return exitValidation
+			}
+		}
+		// the symlinks to the tablespaces must exist before restoring their contents
+		if tablespaceLocations, err = a.restoreTablespaces(manifest.Tablespaces); err != nil {
+			a.logger.Error("Failed to restore tablespaces", zap.Error(err))
+			return exitFailure
+		}
+		if err := a.restoreSymlinks(manifest.Symlinks); err != nil {
+			a.logger.Error("Failed to restore symlinks", zap.Error(err))
+			return exitFailure
+		}
+	}
+
+	priorityOID := ""
+	if *a.priorityDatabase != "" {
+		priorityOID, err = a.resolvePriorityDatabase(manifest)
+		if err != nil {
+			a.logger.Error("Failed to find the priority database", zap.Error(err))
+			return exitNotFound
+		}
+	}
+
+	stopProgress := a.startProgress("restore-backup")
+	defer stopProgress()
+	// the totals are of the whole backup
+	if manifest != nil && manifest.Size > 0 && len(*a.includePaths) == 0 {
+		a.progress.SetTotal(manifest.Files, manifest.Size)
+	}
+
+	// kick off the (recursive) listing of all objects so that the workers can restore the files; if we know
+	// how large the files are, largest first
+	switch {
+	case priorityOID != "":
+		err = a.restorePriorityFirst(manifest, priorityOID)
+	case manifest != nil && len(manifest.FileSizes) > 0:
+		err = a.restoreKeys(func(keysC chan<- string) error { return a.walkBySize(manifest.FileSizes, keysC) })
+	default:
+		err = a.restoreKeys(func(keysC chan<- string) error {
+			return a.storage.WalkFolder(a.ctx, *a.backupName+"/", keysC)
+		})
+	}
+	if err != nil {
+		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
+		a.progress.Finished(err)
+		return exitCode(err, exitStorage)
+	}
+
+	if len(a.failedFiles) > 0 {
+		sort.Strings(a.failedFiles)
+		a.logger.Error("Failed to restore files", zap.Strings("files", a.failedFiles))
+		a.progress.Finished(fmt.Errorf("failed to restore %d files", len(a.failedFiles)))
+		if a.failedDownloads {
+			return exitStorage
+		}
+		return exitFailure
+	}
+	if len(a.badFiles) > 0 {
+		sort.Strings(a.badFiles)
+		a.logger.Error("Restored files are corrupted or failed verification", zap.Strings("files", a.badFiles))
+		a.progress.Finished(errors.New("restored files are corrupted or failed verification"))
+		return exitValidation
+	}
+
+	// the symlinks to the tablespaces are recreated from the tablespace map when recovery starts
+	if len(tablespaceLocations) > 0 {
+		if err := relocateTablespaceMap(*a.pgDataDirectory, tablespaceLocations); err != nil {
+			a.logger.Error("Failed to rewrite the tablespace map", zap.Error(err))
+			a.progress.Finished(err)
+			return exitFailure
+		}
+	}
+	a.logger.Debug("Creating missing required directories")
+	a.createRequiredDirs()
+	complete = true
+	if a.needsRecoveryConfig(target) {
+		if err := a.writeRecoveryConfig(target); err != nil {
+			a.logger.Error("Failed to write recovery settings", zap.Error(err))
+			a.progress.Finished(err)
+			return exitFailure
+		}
+	}
+	a.progress.Finished(nil)
+
+	a.logger.Info(
+		"Backup successfully restored",
+		zap.Duration("seconds", time.Now().Sub(begin)),
+	)
+
+	return 0
+}
+
+// spawn a pool of workers to restore the objects (full path to the remote storage object) fed to them
+func (a *app) restoreKeys(feed func(keysC chan<- string) error) error {
+	// channel to keep the path of all files that need to be downloaded and decompressed; buffered so that
+	// workers don't wait on the listing between files
+	restoreFilesC := make(chan string, *a.nWorkers)
 
-	// spawn a pool of workers
 	a.logger.Info("Spawning workers", zap.Int("number", *a.nWorkers))
 	wg := &sync.WaitGroup{}
 	wg.Add(*a.nWorkers)
@@ -54,36 +262,159 @@ func (a *app) restoreBackup() int {
 		go a.restoreWorker(restoreFilesC, wg)
 	}
 
-	// kick off the (recursive) listing of all objects and put them in the restoreFilesC channel
-	// so that the workers can restore the files
-	if err := a.storage.WalkFolder(*a.backupName+"/", restoreFilesC); err != nil {
-		a.logger.Error("Failed to traverse backup folder", zap.Error(err))
-		return 1
-	}
+	err := feed(restoreFilesC)
 
 	// close the channel to signal there are no more items and wait for all workers to finish
 	a.logger.Info("Waiting for all workers to finish")
 	close(restoreFilesC)
 	wg.Wait()
 
-	a.logger.Debug("Creating missing required directories")
-	a.createRequiredDirs()
+	return err
+}
+
+// list all objects in the backup
+func (a *app) listBackupKeys() ([]string, error) {
+	listC := make(chan string)
+	keys := make([]string, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := range listC {
+			keys = append(keys, key)
+		}
+	}()
+	err := a.storage.WalkFolder(a.ctx, *a.backupName+"/", listC)
+	close(listC)
+	<-done
+
+	return keys, err
+}
+
+// list all objects in the backup and put them in keysC ordered by size (as in orderBySize)
+func (a *app) walkBySize(sizes map[string]int64, keysC chan<- string) error {
+	keys, err := a.listBackupKeys()
+	if err != nil {
+		return err
+	}
+
+	return a.sendKeys(orderBySize(keys, *a.backupName+"/", sizes), keysC)
+}
+
+// restore the files of the database with the given oid (along with the cluster-wide ones) before
+// everything else, so that recovery of the database can start as soon as possible
+func (a *app) restorePriorityFirst(manifest *backupManifest, oid string) error {
+	keys, err := a.listBackupKeys()
+	if err != nil {
+		return err
+	}
+	if manifest != nil && len(manifest.FileSizes) > 0 {
+		keys = orderBySize(keys, *a.backupName+"/", manifest.FileSizes)
+	}
+
+	priority := make([]string, 0)
+	rest := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if isPriorityFile(strings.TrimPrefix(key, *a.backupName+"/"), oid) {
+			priority = append(priority, key)
+		} else {
+			rest = append(rest, key)
+		}
+	}
 
 	a.logger.Info(
-		"Backup successfully restored",
-		zap.Duration("seconds", time.Now().Sub(begin)),
-	)
+		"Restoring priority database first",
+		zap.String("database", *a.priorityDatabase),
+		zap.String("oid", oid),
+		zap.Int("files", len(priority)))
+	send := func(keys []string) func(chan<- string) error {
+		return func(keysC chan<- string) error { return a.sendKeys(keys, keysC) }
+	}
+	if err := a.restoreKeys(send(priority)); err != nil {
+		return err
+	}
+	a.logger.Info(
+		"Priority database restored, restoring the remaining databases",
+		zap.String("database", *a.priorityDatabase),
+		zap.Int("files", len(rest)))
 
-	return 0
+	return a.restoreKeys(send(rest))
+}
+
+// return true iff the file (relative to the data directory) is needed to recover the database with the
+// given oid: its own files (in the default tablespace or any other), cluster-wide files, directories,
+// and anything else that's not specific to one of the other databases
+func isPriorityFile(file string, oid string) bool {
+	parts := strings.Split(file, "/")
+	switch {
+	case util.IsObjectDirectory(file):
+		return true
+	// base/<oid>/...
+	case parts[0] == "base":
+		return len(parts) > 1 && parts[1] == oid
+	// pg_tblspc/<tablespace oid>/<version directory>/<oid>/...
+	case parts[0] == "pg_tblspc" && len(parts) > 3:
+		return parts[3] == oid
+	}
+
+	return true
+}
+
+// return the oid of the database given with --priority-database, which is either a name (looked up in the
+// manifest) or an oid
+func (a *app) resolvePriorityDatabase(manifest *backupManifest) (string, error) {
+	if _, err := strconv.ParseUint(*a.priorityDatabase, 10, 32); err == nil {
+		return *a.priorityDatabase, nil
+	}
+	if manifest == nil {
+		return "", errors.New("backups taken by older versions of pgCarpenter don't list their databases, " +
+			"use the database's oid instead")
+	}
+	oid, ok := manifest.Databases[*a.priorityDatabase]
+	if !ok {
+		return "", fmt.Errorf("database not found in the backup: %s", *a.priorityDatabase)
+	}
+
+	return strconv.FormatUint(uint64(oid), 10), nil
+}
+
+// objects are listed in lexicographic order, which clusters the (1GB) segments of large relations together
+// under base/; sort keys by descending size so that the largest files don't end up being restored last,
+// while the workers aren't otherwise busy, then interleave them with the smallest ones (directories, and
+// files the sizes of which are unknown, are taken as empty) so that workers aren't all stuck on
+// large files at once
+func orderBySize(keys []string, prefix string, sizes map[string]int64) []string {
+	sizeOf := func(key string) int64 {
+		return sizes[util.TrimCompressionExtension(strings.TrimPrefix(key, prefix))]
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return sizeOf(keys[i]) > sizeOf(keys[j]) })
+
+	ordered := make([]string, 0, len(keys))
+	for i, j := 0, len(keys)-1; i <= j; i, j = i+1, j-1 {
+		ordered = append(ordered, keys[i])
+		if i != j {
+			ordered = append(ordered, keys[j])
+		}
+	}
+
+	return ordered
 }
 
 func (a *app) createRequiredDirs() {
-	for _, d := range directoriesThatMustExist {
+	required := append(directoriesThatMustExist, a.config.RequiredDirectories...)
+	// the restored PG_VERSION tells us how the WAL directory is named
+	version, err := pgMajorVersion(*a.pgDataDirectory)
+	if err != nil {
+		a.logger.Error("Failed to determine the version of PostgreSQL, not creating the WAL directory", zap.Error(err))
+	} else {
+		required = append(required, walDirectory(version))
+	}
+
+	for _, d := range required {
 		path := filepath.Join(*a.pgDataDirectory, d)
 		// only try to create the directory if one does not already exist
 		_, err := os.Stat(path)
 		if os.IsNotExist(err) {
-			if err := os.Mkdir(path, 0700); err != nil {
+			if err := os.MkdirAll(path, 0700); err != nil {
 				// there's no benefit on interrupting the loop and returning an error
 				// might as well just log it and move on to the next directory
 				a.logger.Error("Failed to create directory", zap.Error(err))
@@ -94,7 +425,7 @@ func (a *app) createRequiredDirs() {
 
 // get the name of the last successful backup and update the configuration flag
 func (a *app) resolveLatest() (string, error) {
-	latest, err := a.storage.GetString(latestKey)
+	latest, err := a.storage.GetString(a.ctx, latestKey)
 	if err != nil {
 		return "", err
 	}
@@ -113,12 +444,29 @@ func (a *app) restoreWorker(restoreFilesC <-chan string, wg *sync.WaitGroup) {
 			a.logger.Debug("No more files to process")
 			return
 		}
+		// once the command gives up, the files still queued are left alone
+		if a.ctx.Err() != nil {
+			continue
+		}
 
 		a.logger.Debug("Processing file", zap.String("remote", key))
 
 		// drop the backup name from the key to get the path relative to the data directory
 		file := strings.TrimPrefix(key, *a.backupName+"/")
 		dst := filepath.Join(*a.pgDataDirectory, file)
+		if !a.isIncludedPath(file) {
+			continue
+		}
+		if a.restoreState.isDone(file) {
+			a.logger.Debug("Skipping file restored by the interrupted restore", zap.String("remote", key))
+			a.progress.FileDone(file, 0)
+			continue
+		}
+		// files are not restored through the symlinks pointing to them
+		if a.restoredSymlinks[util.TrimCompressionExtension(file)] {
+			a.logger.Debug("Skipping symlinked file", zap.String("path", file))
+			continue
+		}
 		// if the object is a directory all we need to make sure is that it exists (any eventual
 		// content will be added at some point)
 		if util.IsObjectDirectory(dst) {
@@ -126,29 +474,43 @@ func (a *app) restoreWorker(restoreFilesC <-chan string, wg *sync.WaitGroup) {
 			// create the directory iff it does not already exist
 			_, err := os.Stat(local)
 			if os.IsNotExist(err) {
-				if err := os.MkdirAll(local, os.ModePerm); err != nil {
+				if err := os.MkdirAll(local, 0700); err != nil {
 					a.logger.Error("Failed to create directory", zap.Error(err))
 				}
 			}
+			if metadata, err := a.storage.GetMetadata(a.ctx, key); err != nil {
+				a.logger.Error("Failed to get metadata", zap.Error(err), zap.String("key", key))
+			} else {
+				a.restorePermissions(local, metadata)
+			}
 			// regardless of whether or not the directory was successfully created, there's
 			// nothing else to do here
 			continue
 		}
 
-		// get the modify time stored in the object's metadata
-		mtime, err := a.storage.GetLastModifiedTime(key)
-		// skip this file if the modify timestamp stored in the key's metadata matches the local version
-		if *a.modifiedOnly {
-			if err != nil {
-				a.logger.Error("Failed to get mtime", zap.Error(err), zap.String("key", key))
-			} else {
-				// the key may be of a compressed file in which case it'll include
-				// an extension that the local file does not have
-				local := strings.TrimSuffix(dst, lz4.Extension)
-				if a.fileHasNotChanged(local, mtime) {
-					a.logger.Debug("Skipping unmodified file", zap.String("remote", key))
-					continue
+		// get the modify time (and size) stored in the object's metadata
+		metadata, err := a.storage.GetMetadata(a.ctx, key)
+		mtime := metadata.ModifiedTime
+		if err != nil && (*a.modifiedOnly || *a.checksumDelta) {
+			a.logger.Error("Failed to get metadata", zap.Error(err), zap.String("key", key))
+		}
+		// skip this file if the local version is the same (as told by its mtime, or checksum)
+		if err == nil {
+			// the key may be of a compressed file in which case it'll include
+			// an extension that the local file does not have
+			local := util.TrimCompressionExtension(dst)
+			if reason := a.skipReason(local, metadata); reason != "" {
+				a.logger.Debug("Skipping file", zap.String("remote", key), zap.String("reason", reason))
+				// the checksum may match even if the mtime doesn't
+				if mtime != 0 {
+					if err := os.Chtimes(local, time.Now(), time.Unix(mtime, 0)); err != nil {
+						a.logger.Error("Failed to update mtime", zap.Error(err))
+					}
 				}
+				a.restorePermissions(local, metadata)
+				a.progress.FileDone(file, metadata.Size)
+				a.markRestored(file)
+				continue
 			}
 		}
 
@@ -157,7 +519,7 @@ func (a *app) restoreWorker(restoreFilesC <-chan string, wg *sync.WaitGroup) {
 
 		// make sure the directory path exists
 		dir := filepath.Dir(dst)
-		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		if err := os.MkdirAll(dir, 0700); err != nil {
 			a.logger.Error("Failed to create the directory structure", zap.Error(err))
 		}
 
@@ -165,33 +527,67 @@ func (a *app) restoreWorker(restoreFilesC <-chan string, wg *sync.WaitGroup) {
 		out, err := os.Create(dst)
 		if err != nil {
 			a.logger.Error("Failed to create file", zap.Error(err))
-			// no point on trying to continue
-			return
+			a.restoreFailed(file, false)
+			continue
+		}
+		// the size of compressed objects is only known after downloading them; it's preallocated when
+		// decompressing them instead
+		compressed := util.IsObjectCompressed(key) || isForeignGzip(key, metadata)
+		if *a.preallocate && !compressed {
+			if err := util.Preallocate(out, metadata.Size); err != nil {
+				a.logger.Error("Failed to preallocate file", zap.Error(err), zap.String("path", dst))
+			}
 		}
 		// download contents
-		err = a.storage.Get(key, out)
+		err = a.storage.Get(a.ctx, key, out)
 		if err != nil {
-			a.logger.Error("Failed to download file", zap.Error(err))
+			a.logger.Error("Failed to download file", zap.Error(err), zap.String("key", key))
 		}
 		// close the file
-		if err := out.Close(); err != nil {
-			a.logger.Error("Failed to close file", zap.Error(err))
+		if closeErr := out.Close(); closeErr != nil {
+			a.logger.Error("Failed to close file", zap.Error(closeErr))
+			if err == nil {
+				a.restoreFailed(file, false)
+				util.MustRemoveFile(dst, a.logger)
+				continue
+			}
+		}
+		// a partially downloaded file is not left behind (and it's restored again if the restore is resumed)
+		if err != nil {
+			// unless it's because the command gave up, which is reported as such
+			if a.ctx.Err() == nil {
+				a.restoreFailed(file, true)
+			}
+			util.MustRemoveFile(dst, a.logger)
+			continue
 		}
 
 		// if the object we got is a compressed file, decompress it and remove the compressed one
 		localFile := out.Name()
-		if util.IsObjectCompressed(key) {
+		if compressed {
 			compressed := out.Name()
-			decompressed := strings.TrimSuffix(compressed, lz4.Extension)
+			decompressed := strings.TrimSuffix(util.TrimCompressionExtension(compressed), util.GzipExtension)
 			localFile = decompressed
 			a.logger.Debug(
 				"Decompressing file",
 				zap.String("compressed", compressed),
 				zap.String("decompressed", decompressed))
-			if err := util.Decompress(compressed, decompressed); err != nil {
-				a.logger.Error("Failed to decompress file", zap.Error(err))
+			size := int64(0)
+			if *a.preallocate {
+				size = metadata.Size
 			}
+			release := a.acquireCompression()
+			err := util.DecompressPreallocated(compressed, decompressed, size)
+			release()
 			util.MustRemoveFile(compressed, a.logger)
+			// a corrupted file is not restored at all
+			if err != nil {
+				a.logger.Error("Failed to decompress file", zap.Error(err), zap.String("key", key))
+				a.manifestMu.Lock()
+				a.badFiles = append(a.badFiles, util.TrimCompressionExtension(file))
+				a.manifestMu.Unlock()
+				continue
+			}
 		}
 
 		// update the last modified time to match the one we just restored
@@ -201,6 +597,80 @@ func (a *app) restoreWorker(restoreFilesC <-chan string, wg *sync.WaitGroup) {
 				a.logger.Error("Failed to update mtime", zap.Error(err))
 			}
 		}
+		a.restorePermissions(localFile, metadata)
+		a.progress.FileDone(file, metadata.Size)
+		if *a.verifyRestore && !a.verifyRestoredFile(localFile, a.restoreChecksums[util.TrimCompressionExtension(file)]) {
+			a.manifestMu.Lock()
+			a.badFiles = append(a.badFiles, util.TrimCompressionExtension(file))
+			a.manifestMu.Unlock()
+			continue
+		}
+		a.markRestored(file)
+	}
+}
+
+// record that the file (relative to the data directory) couldn't be restored, because downloading it failed
+// or otherwise (e.g., creating it)
+func (a *app) restoreFailed(file string, download bool) {
+	a.manifestMu.Lock()
+	defer a.manifestMu.Unlock()
+
+	a.failedFiles = append(a.failedFiles, util.TrimCompressionExtension(file))
+	a.failedDownloads = a.failedDownloads || download
+}
+
+// return false iff the checksum of the restored file doesn't match the one of the contents that were stored
+// when it was backed up (as recorded in the manifest); files backed up without one can't be verified
+func (a *app) verifyRestoredFile(localFile string, checksum string) bool {
+	if checksum == "" {
+		return true
+	}
+	restored, err := util.Checksum(localFile, util.ChecksumAlgorithmOf(checksum))
+	if err != nil {
+		a.logger.Error("Failed to checksum restored file", zap.String("path", localFile), zap.Error(err))
+		return false
+	}
+	if restored != checksum {
+		a.logger.Error(
+			"Checksum mismatch",
+			zap.String("path", localFile),
+			zap.String("expected", checksum),
+			zap.String("restored", restored))
+		return false
+	}
+
+	return true
+}
+
+// record that the file (relative to the data directory) has been restored, so that it's not restored again
+// if the restore is resumed; failing to do so only costs restoring it again
+func (a *app) markRestored(file string) {
+	if err := a.restoreState.markDone(file); err != nil {
+		a.logger.Warn("Failed to record restored file", zap.String("path", file), zap.Error(err))
+	}
+}
+
+// return true iff the object was compressed with gzip by another tool; pgCarpenter never gzips files, and
+// always records the mtime of the ones it uploads (including files named *.gz, which it uploads as they are)
+func isForeignGzip(key string, metadata storage.Metadata) bool {
+	return strings.HasSuffix(key, util.GzipExtension) && metadata.ModifiedTime == 0
+}
+
+// apply the mode and ownership stored in the object's metadata to the restored file (or directory);
+// ownership can only be changed when running as root, otherwise files belong to whoever restored them
+func (a *app) restorePermissions(path string, metadata storage.Metadata) {
+	// backups taken by older versions of pgCarpenter don't have this information
+	if metadata.Mode == 0 {
+		return
+	}
+
+	if err := os.Chmod(path, metadata.Mode); err != nil {
+		a.logger.Error("Failed to update mode", zap.String("path", path), zap.Error(err))
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Chown(path, metadata.UID, metadata.GID); err != nil {
+			a.logger.Error("Failed to update ownership", zap.String("path", path), zap.Error(err))
+		}
 	}
 }
 
@@ -217,12 +687,315 @@ func (a *app) fileHasNotChanged(localFile string, mtime int64) bool {
 	return mtime == st.ModTime().Unix()
 }
 
+// return true iff the file (relative to the data directory, as stored in the backup) is to be restored, i.e.,
+// there's no --include-path, or it's under one of them
+func (a *app) isIncludedPath(file string) bool {
+	if len(*a.includePaths) == 0 {
+		return true
+	}
+	file = strings.TrimSuffix(util.TrimCompressionExtension(file), util.DirectoryExtension)
+	for _, p := range *a.includePaths {
+		p = strings.TrimSuffix(filepath.Clean(p), "/")
+		if file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// return why the local file doesn't need to be restored (i.e., it's the same as the one in the backup, with
+// --modified-only or --checksum-delta), or an empty string if it does
+func (a *app) skipReason(localFile string, metadata storage.Metadata) string {
+	if *a.modifiedOnly && a.fileHasNotChanged(localFile, metadata.ModifiedTime) {
+		return "unmodified"
+	}
+	if *a.checksumDelta && a.fileMatchesChecksum(localFile, a.storedChecksum(localFile, metadata)) {
+		return "matching checksum"
+	}
+
+	return ""
+}
+
+// return the checksum of the contents stored for the local file (in the data directory), as recorded in the
+// manifest; backups taken by older versions of pgCarpenter have it in the object's metadata instead (which is
+// good enough to tell a file doesn't need to be restored, as a mismatch only costs restoring it)
+func (a *app) storedChecksum(localFile string, metadata storage.Metadata) string {
+	if rel, err := filepath.Rel(*a.pgDataDirectory, localFile); err == nil {
+		if checksum, ok := a.restoreChecksums[rel]; ok {
+			return checksum
+		}
+	}
+
+	return metadata.Checksum
+}
+
+// return true iff the local file exists and its checksum matches the given one; files without a checksum
+// (e.g., backed up with --checksum none) never match
+func (a *app) fileMatchesChecksum(localFile string, checksum string) bool {
+	if checksum == "" {
+		return false
+	}
+	if _, err := os.Stat(localFile); os.IsNotExist(err) {
+		return false
+	}
+	local, err := util.Checksum(localFile, util.ChecksumAlgorithmOf(checksum))
+	if err != nil {
+		a.logger.Error("Failed to checksum file", zap.String("path", localFile), zap.Error(err))
+		return false
+	}
+
+	return local == checksum
+}
+
+// return an error if restoring to the data directory would (most likely) be a mistake: PostgreSQL is
+// running on it, or it's not empty (unless restoring only modified files to what looks like a data directory)
+func (a *app) checkRestoreTarget() error {
+	if *a.forceRestore {
+		return nil
+	}
+
+	pidFile := filepath.Join(*a.pgDataDirectory, "postmaster.pid")
+	if pid, err := readPostmasterPID(pidFile); err == nil && processExists(pid) {
+		return fmt.Errorf("PostgreSQL is running on it (pid %d, see %s)", pid, pidFile)
+	}
+
+	entries, err := ioutil.ReadDir(*a.pgDataDirectory)
+	// e.g., check-restore's scratch directory, created by the restore
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// the data directory may be the root of a file system
+		if e.Name() == "lost+found" {
+			continue
+		}
+		// whatever was restored by the interrupted restore is to be kept
+		if *a.restoreResume && hasRestoreState(*a.pgDataDirectory) {
+			break
+		}
+		if !*a.modifiedOnly && !*a.checksumDelta {
+			return errors.New("data directory is not empty (use --modified-only or --checksum-delta to " +
+				"restore only the files that changed)")
+		}
+		if _, err := os.Stat(filepath.Join(*a.pgDataDirectory, "PG_VERSION")); err != nil {
+			return errors.New("data directory is not empty, but doesn't look like a PostgreSQL data directory " +
+				"(there's no PG_VERSION)")
+		}
+		break
+	}
+
+	return nil
+}
+
+// return the pid of the postmaster, from the first line of postmaster.pid
+func readPostmasterPID(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(strings.SplitN(string(contents), "\n", 2)[0]))
+}
+
+// return true iff there's a process with the given pid; a process we're not allowed to signal exists too
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || err == syscall.EPERM
+}
+
+// return an error if the file system of the data directory doesn't have room for size bytes (e.g., the size
+// of the backup); tablespaces on other file systems are not accounted for
+func (a *app) checkFreeSpace(size int64) error {
+	if size == 0 {
+		a.logger.Warn("Backup size is unknown, free space can't be checked")
+		return nil
+	}
+	free, err := util.FreeSpace(*a.pgDataDirectory)
+	if err != nil {
+		return err
+	}
+	a.logger.Info("Checking free space", zap.Int64("backup_size", size), zap.Int64("free", free))
+	if free < size {
+		return fmt.Errorf("backup needs %d bytes but only %d are available in %s", size, free, *a.pgDataDirectory)
+	}
+
+	return nil
+}
+
 func parseRestoreBackupArgs(cfg *app, parser *argparse.Command) {
-	cfg.modifiedOnly = parser.Flag(
+	cfg.modifiedOnly = boolFlag(
+		parser,
 		"",
 		"modified-only",
 		&argparse.Options{
 			Required: false,
 			Default:  false,
 			Help:     "Use the last modified timestamp to transfer only files that have changed)"})
+	cfg.verifyRestore = boolFlag(
+		parser,
+		"",
+		"verify",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help: "Check the checksum of every restored file against the one of the contents stored when it was " +
+				"backed up (as recorded in the manifest), and fail if any doesn't match"})
+	cfg.restoreResume = boolFlag(
+		parser,
+		"",
+		"resume",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help: "Resume an interrupted restore of the same backup, skipping the files it already restored " +
+				"(as recorded in " + restoreStateFile + ")"})
+	cfg.checksumDelta = boolFlag(
+		parser,
+		"",
+		"checksum-delta",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help: "Compare the checksums of local files with the ones stored in the backup to transfer only " +
+				"files that have changed (slower than --modified-only, but doesn't trust mtimes)"})
+	cfg.includePaths = stringListFlag(
+		parser,
+		"",
+		"include-path",
+		&argparse.Options{
+			Required: false,
+			Help: "Only restore files under this path, relative to the data directory (e.g., base/16384/ for " +
+				"a single database; repeatable)"})
+	cfg.dryRun = boolFlag(
+		parser,
+		"",
+		"dry-run",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help: "List the files that would be downloaded (or skipped, with --modified-only or --checksum-delta) " +
+				"and how many bytes would be transferred, without restoring anything"})
+	cfg.materializeSymlinks = boolFlag(
+		parser,
+		"",
+		"materialize-symlinks",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Restore symlinks as regular directories and files instead of recreating them"})
+	cfg.preallocate = boolFlag(
+		parser,
+		"",
+		"preallocate",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Check there's enough free space for the whole backup and preallocate files before writing them"})
+	cfg.postRestoreCmd = parser.String(
+		"",
+		"post-restore-cmd",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Shell command to run once the restore is over (successfully or not), with the backup " +
+				"described in PGCARPENTER_* environment variables"})
+	cfg.forceRestore = boolFlag(
+		parser,
+		"",
+		"force",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help: "Restore even if the data directory is not empty, or PostgreSQL seems to be running on it " +
+				"(e.g., a stale postmaster.pid)"})
+	cfg.tablespaceRootDir = parser.String(
+		"",
+		"tablespace-root",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Validate: validateTablespaceRoot,
+			Help: "Restore every tablespace to a subdirectory (named after its oid) of this directory, and " +
+				"other symlinks as regular directories and files, so that nothing is written outside of it " +
+				"and the data directory (e.g., for a clone of a cluster running on the same host)"})
+	cfg.tablespaceMap = stringListFlag(
+		parser,
+		"",
+		"tablespace-map",
+		&argparse.Options{
+			Required: false,
+			Validate: validateTablespaceMap,
+			Help: "Restore the tablespace at olddir (on the host the backup was taken from) to newdir, " +
+				"pointing both its symlink in pg_tblspc and its line in tablespace_map to it (repeatable)"})
+	cfg.recoveryMode = parser.Selector(
+		"",
+		"recovery-mode",
+		recoveryModes,
+		&argparse.Options{
+			Required: false,
+			Help: "Configure the restored cluster to start recovery (or as a standby) fetching WAL with " +
+				"restore-wal from the same bucket; implied (as recovery) by the --target-* flags"})
+	cfg.targetTime = parser.String(
+		"",
+		"target-time",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Recover up to this time (e.g., '2019-06-01 12:00:00 UTC'), replaying WAL archived with " +
+				"archive-wal"})
+	cfg.targetXID = parser.String(
+		"",
+		"target-xid",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Validate: validateTargetXID,
+			Help:     "Recover up to this transaction id"})
+	cfg.targetLSN = parser.String(
+		"",
+		"target-lsn",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Validate: validateTargetLSN,
+			Help:     "Recover up to this LSN (e.g., 0/16B3748; PG 10+)"})
+	cfg.targetName = parser.String(
+		"",
+		"target-name",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help:     "Recover up to this restore point (created with pg_create_restore_point())"})
+	cfg.targetTimeline = parser.String(
+		"",
+		"target-timeline",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Validate: validateTargetTimeline,
+			Help: "Recover along this timeline: latest, current (the backup's), or a timeline id; PostgreSQL's " +
+				"default is latest since PG 12, current before"})
+	cfg.targetAction = parser.Selector(
+		"",
+		"target-action",
+		recoveryTargetActions,
+		&argparse.Options{
+			Required: false,
+			Help:     "What to do once the recovery target is reached (PostgreSQL's default is pause)"})
+	cfg.priorityDatabase = parser.String(
+		"",
+		"priority-database",
+		&argparse.Options{
+			Required: false,
+			Default:  "",
+			Help: "Name (or oid) of a database to restore first, along with the cluster-wide files, before " +
+				"the remaining databases"})
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// file (in the data directory) where restore-backup keeps track of the files it's done with, so that
+// --resume can pick up where an interrupted restore left off; removed once the restore is over
+const restoreStateFile = "pgcarpenter_restore.state"
+
+// restoreState is the list of files of a backup already restored to the data directory, the first line
+// being the name of the backup, followed by one restored file (relative to the data directory) per line
+type restoreState struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// open (or create) the state of the restore of the backup to dataDirectory; the state left by an
+// interrupted restore is only picked up if resume is true
+func openRestoreState(dataDirectory string, backupName string, resume bool) (*restoreState, error) {
+	path := filepath.Join(dataDirectory, restoreStateFile)
+	s := &restoreState{done: make(map[string]bool)}
+
+	if resume {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			lines := strings.Split(string(contents), "\n")
+			if lines[0] != backupName {
+				return nil, fmt.Errorf("the interrupted restore was of a different backup: %s", lines[0])
+			}
+			for _, l := range lines[1:] {
+				if l != "" {
+					s.done[l] = true
+				}
+			}
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			s.f = f
+			// the last line may have been cut short by the interruption
+			if !strings.HasSuffix(string(contents), "\n") {
+				if _, err := f.WriteString("\n"); err != nil {
+					f.Close()
+					return nil, err
+				}
+			}
+			return s, nil
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(backupName + "\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.f = f
+
+	return s, nil
+}
+
+// return true iff the file (relative to the data directory) was restored by the interrupted restore
+func (s *restoreState) isDone(file string) bool {
+	if s == nil {
+		return false
+	}
+
+	return s.done[file]
+}
+
+// record that the file (relative to the data directory) has been restored; the record is not synced,
+// which is fine for the restore process dying, but not the host
+func (s *restoreState) markDone(file string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.f.WriteString(file + "\n")
+
+	return err
+}
+
+// close the state, and remove it iff the restore is complete
+func (s *restoreState) close(complete bool) error {
+	if s == nil {
+		return nil
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if !complete {
+		return nil
+	}
+
+	return os.Remove(s.f.Name())
+}
+
+// return true iff there's the state of an interrupted restore in the data directory
+func hasRestoreState(dataDirectory string) bool {
+	_, err := os.Stat(filepath.Join(dataDirectory, restoreStateFile))
+
+	return err == nil
+}
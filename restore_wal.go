@@ -1,15 +1,25 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
-	"regexp"
+	"path/filepath"
 	"time"
 
 	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/storage"
 	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 )
 
+// PostgreSQL takes any non-zero exit status of restore_command up to 125 to mean the segment is not (yet)
+// archived, e.g., the end of the archive has been reached and recovery is over; higher ones, like the shell's
+// when the command is killed by a signal, abort recovery instead
+const (
+	walNotFoundExitStatus = 1
+	walFatalExitStatus    = 126
+)
+
 func (a *app) restoreWAL() int {
 	begin := time.Now()
 	a.logger.Debug(
@@ -22,47 +32,65 @@ func (a *app) restoreWAL() int {
 	walFullPath, err := a.getWALFullPath(*a.walPath)
 	if err != nil {
 		a.logger.Error("Failed to get the full path to the WAL segment", zap.Error(err))
-		return 1
+		return walFatalExitStatus
 	}
 
-	// ignore history files (matching [0-9].history):
-	// https://www.postgresql.org/docs/8.3/continuous-archiving.html (24.3.3)
-	match, err := regexp.MatchString(`[0-9]+\.history`, *a.walFileName)
-	if err == nil && match {
-		a.logger.Debug("Ignoring history file", zap.String("filename", *a.walFileName))
+	// timeline history files (e.g., 00000002.history) are archived by archive-wal like any other file, and
+	// restored the same way: recovery asks for them to follow timeline switches (e.g., onto the timeline of a
+	// promoted standby), and to find the latest timeline; the ones that don't exist are simply not found
+
+	if *a.prefetchOnly {
+		return a.prefetchWAL(walFullPath)
+	}
+	if *a.prefetch > 0 && a.restorePrefetched(walFullPath) {
+		a.startPrefetch(walFullPath)
 		return 0
 	}
 
 	// object key (based on the file name, without the path, including the LZ4 extension)
 	key := a.getWALObjectKey(*a.walFileName)
-	// download to a temporary file
-	outTmp, err := ioutil.TempFile(*a.tmpDirectory, "")
-	// don't exit without trying to remove the temporary file
-	defer util.MustRemoveFile(outTmp.Name(), a.logger)
-	// get the contents of the (compressed) WAL segment to the temporary file
-	err = a.storage.Get(key, outTmp)
-	if err != nil {
-		// this may not be an error. it's possible (especially on low traffic environments) that it
+	tmpPath, err := a.downloadWAL(key)
+	// WAL archived (gzipped) by the tool used before pgCarpenter may still be needed; only looked for when
+	// the segment wasn't archived by pgCarpenter, so it doesn't cost anything otherwise
+	if errors.Is(err, storage.ErrNotFound) {
+		gzKey := filepath.Join(walFolder, *a.walFileName+util.GzipExtension)
+		if exists, gzErr := a.storage.Exists(a.ctx, gzKey); gzErr == nil && exists {
+			key = gzKey
+			tmpPath, err = a.downloadWAL(key)
+		}
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		// this is not an error. it's possible (especially on low traffic environments) that it
 		// takes a while to gather the 16MB a full WAL segment contains and a file is requested a few
-		// times before it's ready
-		// there amy also be network slowdowns, etc.
+		// times before it's ready, and recovery keeps asking for segments until there are no more
 		a.logger.Debug(
-			"Failed to download WAL segment. This may not be an error (e.g., WAL has not yet been archived)",
-			zap.Error(err),
+			"WAL segment not found (e.g., it has not yet been archived)",
 			zap.String("key", key),
 			zap.String("filename", *a.walFileName))
-		return 1
+		// the end of the archive has been reached (for now), and the segments after it can't have been
+		// prefetched, so whatever is left over would otherwise be left behind once recovery is over
+		a.removePrefetches(walFullPath)
+		return walNotFoundExitStatus
 	}
-	// close the file
-	if err := outTmp.Close(); err != nil {
-		a.logger.Error("Failed to close temporary WAL segment", zap.Error(err))
-		// it's not safe to report that the file is available and in a good state
-		return 1
+	if err != nil {
+		// e.g., bad credentials, or network issues (after retrying); telling PostgreSQL the segment doesn't
+		// exist would end recovery early
+		a.logger.Error(
+			"Failed to download WAL segment",
+			zap.Error(err),
+			zap.String("key", key),
+			zap.String("filename", *a.walFileName))
+		return walFatalExitStatus
 	}
+	// don't exit without trying to remove the temporary file
+	defer util.MustRemoveFile(tmpPath, a.logger)
 	// decompress the temporary file to the requested WAL segment
-	if err := util.Decompress(outTmp.Name(), walFullPath); err != nil {
+	if err := util.Decompress(tmpPath, walFullPath); err != nil {
 		a.logger.Error("Failed to decompress temporary WAL segment", zap.Error(err))
-		return 1
+		return walFatalExitStatus
+	}
+	if *a.prefetch > 0 {
+		a.startPrefetch(walFullPath)
 	}
 
 	a.logger.Debug(
@@ -73,6 +101,44 @@ func (a *app) restoreWAL() int {
 	return 0
 }
 
+// restore the requested segment from the prefetch directory, if it's there; return true iff it was
+func (a *app) restorePrefetched(walFullPath string) bool {
+	path := prefetchedSegment(prefetchDir(walFullPath), *a.walFileName)
+	if path == "" {
+		return false
+	}
+	// prefetched segments are only used once
+	defer util.MustRemoveFile(path, a.logger)
+	if err := util.Decompress(path, walFullPath); err != nil {
+		a.logger.Warn("Failed to decompress prefetched WAL segment, downloading it again", zap.Error(err))
+		return false
+	}
+	a.logger.Debug("Restored prefetched WAL segment", zap.String("filename", *a.walFileName))
+
+	return true
+}
+
+// download the object to a temporary file, named with the extension of the object so that it's decompressed
+// accordingly, and return its path; on error, the temporary file is removed
+func (a *app) downloadWAL(key string) (string, error) {
+	outTmp, err := ioutil.TempFile(*a.tmpDirectory, "*"+filepath.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	// get the contents of the (compressed) WAL segment to the temporary file
+	err = a.storage.Get(a.ctx, key, outTmp)
+	// it's not safe to report that the file is available and in a good state if it can't be closed
+	if closeErr := outTmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		util.MustRemoveFile(outTmp.Name(), a.logger)
+		return "", err
+	}
+
+	return outTmp.Name(), nil
+}
+
 func parseRestoreWALArgs(cfg *app, parser *argparse.Command) {
 	cfg.walFileName = parser.String(
 		"",
@@ -81,4 +147,20 @@ func parseRestoreWALArgs(cfg *app, parser *argparse.Command) {
 			// Required: len(os.Args) > 1 && (os.Args[1] == "archive-wal" || os.Args[1] == "restore-wal"),
 			Required: true,
 			Help:     "File name of the desired WAL segment"})
+	cfg.prefetch = parser.Int(
+		"",
+		"prefetch",
+		&argparse.Options{
+			Required: false,
+			Default:  0,
+			Help: "Download this many of the following WAL segments in the background, to restore them " +
+				"from " + prefetchDirectory + " (in the WAL directory) when they're requested"})
+	cfg.prefetchOnly = boolFlag(
+		parser,
+		"",
+		"prefetch-only",
+		&argparse.Options{
+			Required: false,
+			Default:  false,
+			Help:     "Only prefetch the WAL segments following the given one (used internally by --prefetch)"})
 }
@@ -0,0 +1,143 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the fields of a cron expression, in order, and the values each one takes
+var fields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	// allowed values of each field, indexed by value
+	allowed [5][]bool
+	// true iff the day of month (or the day of week) field is restricted, i.e., not *; as in cron, if both
+	// are, a day matches if either one does
+	domRestricted bool
+	dowRestricted bool
+}
+
+// Parse parses a standard (five field) cron expression, e.g., `30 2 * * 1-5`. Each field is either *, a
+// value, a range (1-5), or a list of them (1,3,5), optionally with a step (*/15, 0-30/10). Day of week
+// goes from 0 (Sunday) to 6, and 7 is Sunday too.
+func Parse(expr string) (*Schedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression ('%s') must have %d fields", expr, len(fields))
+	}
+
+	s := &Schedule{}
+	for i, part := range parts {
+		max := fields[i].max
+		// Sunday is both 0 and 7
+		if i == 4 {
+			max = 7
+		}
+		allowed, err := parseField(part, fields[i].min, max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in cron expression ('%s'): %w", fields[i].name, expr, err)
+		}
+		if i == 4 && allowed[7] {
+			allowed[0] = true
+		}
+		s.allowed[i] = allowed
+	}
+	s.domRestricted = parts[2] != "*"
+	s.dowRestricted = parts[4] != "*"
+
+	return s, nil
+}
+
+func parseField(field string, min int, max int) ([]bool, error) {
+	allowed := make([]bool, max+1)
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step: %s", item)
+			}
+			step = n
+			item = item[:i]
+		}
+
+		from, to := min, max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid range: %s", item)
+			}
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid range: %s", item)
+			}
+		default:
+			n, err := strconv.Atoi(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value: %s", item)
+			}
+			from, to = n, n
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("out of range (%d-%d): %s", min, max, item)
+		}
+
+		for v := from; v <= to; v += step {
+			allowed[v] = true
+		}
+	}
+
+	return allowed, nil
+}
+
+// Next returns the first time after t (truncated to the minute) that matches the schedule, or the zero
+// time if there's none within the next 5 years (e.g., 30 February).
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if !s.allowed[3][int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.allowed[1][t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.allowed[0][t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.allowed[2][t.Day()]
+	dow := s.allowed[4][int(t.Weekday())]
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+
+	return dom && dow
+}
@@ -0,0 +1,83 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"30 2 * * 1-5", false},
+		{"*/15 0-6,22,23 1,15 */2 0", false},
+		{"0-30/10 * * * 7", false},
+		{"  0   3 * * *  ", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * 32 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"*/-1 * * * *", true},
+		{"a * * * *", true},
+		{"1- * * * *", true},
+		{"1,,2 * * * *", true},
+		{"* * * JAN *", true},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse('%s'): unexpected error: %v", tt.expr, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2021, time.March, 17, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"* * * * *", now, time.Date(2021, time.March, 17, 10, 21, 0, 0, time.UTC)},
+		{"*/15 * * * *", now, time.Date(2021, time.March, 17, 10, 30, 0, 0, time.UTC)},
+		// the time itself never matches, even if on the minute
+		{"20 10 * * *", now.Truncate(time.Minute), time.Date(2021, time.March, 18, 10, 20, 0, 0, time.UTC)},
+		{"30 2 * * *", now, time.Date(2021, time.March, 18, 2, 30, 0, 0, time.UTC)},
+		// weekdays only, from a Friday
+		{"30 2 * * 1-5", time.Date(2021, time.March, 19, 3, 0, 0, 0, time.UTC), time.Date(2021, time.March, 22, 2, 30, 0, 0, time.UTC)},
+		// Sunday is both 0 and 7
+		{"0 0 * * 0", now, time.Date(2021, time.March, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", now, time.Date(2021, time.March, 21, 0, 0, 0, 0, time.UTC)},
+		// either the day of month or the day of week, if both are restricted
+		{"0 0 1 * 5", now, time.Date(2021, time.March, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 18 * 0", now, time.Date(2021, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		// both, if only one of them is
+		{"0 0 1 * *", now, time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		// across the end of the year
+		{"0 0 1 1 *", now, time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// leap years only
+		{"0 0 29 2 *", now, time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// never
+		{"0 0 30 2 *", now, time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse('%s'): unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if next := s.Next(tt.from); !next.Equal(tt.expected) {
+			t.Errorf("Next('%s', %s) = %s, expected %s", tt.expr, tt.from, next, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client sends metrics over UDP to a statsd server, with the DogStatsD extension for tags (which plain
+// statsd servers ignore, or reject, so don't set any for those). A nil Client sends nothing, so that
+// callers don't have to check whether statsd was configured. Metrics are best effort: failing to send
+// them is ignored.
+type Client struct {
+	conn      net.Conn
+	namespace string
+	// rendered, e.g., |#env:prod,service:db
+	tags string
+}
+
+// New returns a Client sending to address (host:port), prefixing the names of the metrics with namespace
+// (e.g., "pgcarpenter.") and tagging them with tags (e.g., "env:prod").
+func New(address string, namespace string, tags []string) (*Client, error) {
+	// UDP, so this doesn't fail if there's no one listening
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, namespace: namespace}
+	if len(tags) > 0 {
+		c.tags = "|#" + strings.Join(tags, ",")
+	}
+
+	return c, nil
+}
+
+// Timing sends the duration of an operation, in milliseconds.
+func (c *Client) Timing(name string, d time.Duration, tags ...string) {
+	c.send(name, fmt.Sprintf("%g", float64(d)/float64(time.Millisecond)), "ms", tags)
+}
+
+// Gauge sends the current value of something.
+func (c *Client) Gauge(name string, v float64, tags ...string) {
+	c.send(name, fmt.Sprintf("%g", v), "g", tags)
+}
+
+// Count adds n to a counter.
+func (c *Client) Count(name string, n int64, tags ...string) {
+	c.send(name, fmt.Sprintf("%d", n), "c", tags)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+// send a metric, with the tags of the client, and the given ones
+func (c *Client) send(name string, value string, kind string, tags []string) {
+	if c == nil {
+		return
+	}
+	allTags := c.tags
+	if len(tags) > 0 {
+		if allTags == "" {
+			allTags = "|#"
+		} else {
+			allTags += ","
+		}
+		allTags += strings.Join(tags, ",")
+	}
+	// nothing to do if it fails
+	_, _ = fmt.Fprintf(c.conn, "%s%s:%s|%s%s", c.namespace, name, value, kind, allTags)
+}
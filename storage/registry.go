@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Options holds the settings common to all storage backends; anything specific to a backend (e.g., the
+// region of an S3 bucket) goes in the URL of the storage instead.
+type Options struct {
+	Logger *zap.Logger
+	// UserAgent identifies pgCarpenter in requests (e.g., pgCarpenter/1.2.3), for backends that care
+	UserAgent  string
+	MaxRetries int
+	// MaxUploadRate caps the aggregate upload throughput (bytes per second); 0 means unlimited
+	MaxUploadRate int64
+	// MaxDownloadRate caps the aggregate download throughput (bytes per second); 0 means unlimited
+	MaxDownloadRate int64
+	// SlowStart is the number of concurrent requests to start with, ramping up from there; 0 means no limit
+	SlowStart int
+}
+
+// Factory returns the storage at location, whose scheme is the one the factory was registered for.
+type Factory func(location *url.URL, opts Options) (Storage, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a storage backend available to Open for URLs with the given scheme (e.g., s3). It's
+// meant to be called from the init function of the package implementing the backend, so that compiling
+// the backend in is a matter of importing that package (e.g., import _ ".../storage/s3storage"). Like
+// database/sql.Register, it panics if the factory is nil or the scheme is already taken.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := factories[scheme]; dup {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// Open returns the storage at location (e.g., s3://bucket?region=us-west-2) using the backend registered
+// for its scheme.
+func Open(location string, opts Options) (Storage, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL %q: %w", location, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("invalid storage URL %q: missing scheme (e.g., s3://)", location)
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[u.Scheme]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q (forgotten import or build tag?)", u.Scheme)
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	return factory(u, opts)
+}
+
+// Schemes returns the schemes of the registered storage backends, sorted.
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetryPolicy is how WithRetries tries operations again, and how long it gives each attempt.
+type RetryPolicy struct {
+	// Retries is the number of times a failed operation is tried again; 0 disables retries
+	Retries int
+	// Backoff is how long to wait before the first retry; it doubles with every retry, up to MaxBackoff,
+	// and each wait is jittered (between half of it and all of it)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout is how long each attempt at an operation (transfer included) can take before it's given up
+	// on, and retried if there are retries left; 0 means no limit
+	Timeout time.Duration
+}
+
+// RetryClassifier is implemented by backends that can tell errors worth trying again (e.g., throttling,
+// timeouts) from the ones that aren't (e.g., access denied); without it, anything but ErrNotFound is.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+type retryingStorage struct {
+	Storage
+	policy    RetryPolicy
+	retryable func(err error) bool
+	logger    *zap.Logger
+}
+
+// WithRetries returns s with its operations tried again, according to policy, when they fail with an error
+// worth trying again (see RetryClassifier), or time out. That's on top of whatever retries the backend does on its own
+// (e.g., the SDK's for S3), which don't cover every failure, and give up quickly under throttling.
+//
+// WalkFolder isn't retried (nor timed out), as it may have sent objects already, and neither is PutReader
+// unless its body can be rewound (i.e., it's an io.Seeker), although it's still timed out.
+func WithRetries(s Storage, policy RetryPolicy, logger *zap.Logger) Storage {
+	if policy.Retries <= 0 && policy.Timeout <= 0 {
+		return s
+	}
+
+	retryable := func(err error) bool { return !errors.Is(err, ErrNotFound) }
+	if c, ok := s.(RetryClassifier); ok {
+		retryable = c.IsRetryable
+	}
+
+	return &retryingStorage{Storage: s, policy: policy, retryable: retryable, logger: logger}
+}
+
+// Retry runs op, which does something with s that s can't retry on its own (e.g., uploading a stream that
+// has to be produced again), according to the policy s was given by WithRetries, if any.
+func Retry(ctx context.Context, s Storage, operation string, key string, op func(ctx context.Context) error) error {
+	if r, ok := s.(*retryingStorage); ok {
+		return r.retry(ctx, operation, key, op)
+	}
+
+	return op(ctx)
+}
+
+// run op with a context that's done once the timeout of the policy (if any) is up; timedOut is true iff
+// that's why op failed
+func (s *retryingStorage) attempt(ctx context.Context, op func(ctx context.Context) error) (timedOut bool, err error) {
+	if s.policy.Timeout <= 0 {
+		return false, op(ctx)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, s.policy.Timeout)
+	defer cancel()
+	err = op(attemptCtx)
+	if err != nil && attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return true, fmt.Errorf("storage operation timed out after %s: %w", s.policy.Timeout, err)
+	}
+
+	return false, err
+}
+
+// run op until it succeeds, fails with an error not worth trying again, runs out of retries, or ctx is done
+func (s *retryingStorage) retry(ctx context.Context, operation string, key string, op func(ctx context.Context) error) error {
+	backoff := s.policy.Backoff
+	timedOut, err := s.attempt(ctx, op)
+	for retry := 1; err != nil && retry <= s.policy.Retries; retry++ {
+		// the backend can't tell a timed out attempt from one that was canceled
+		if ctx.Err() != nil || !timedOut && !s.retryable(err) {
+			return err
+		}
+		// somewhere between half of the backoff and all of it, so that workers throttled at the same time
+		// don't all come back at the same time
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		s.logger.Warn(
+			"Storage operation failed, retrying",
+			zap.String("operation", operation),
+			zap.String("key", key),
+			zap.Int("retry", retry),
+			zap.Duration("backoff", wait),
+			zap.Error(err))
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		backoff *= 2
+		if backoff > s.policy.MaxBackoff {
+			backoff = s.policy.MaxBackoff
+		}
+		timedOut, err = s.attempt(ctx, op)
+	}
+
+	return err
+}
+
+func (s *retryingStorage) Put(ctx context.Context, key string, localPath string, metadata Metadata) error {
+	return s.retry(ctx, "put", key, func(ctx context.Context) error { return s.Storage.Put(ctx, key, localPath, metadata) })
+}
+
+func (s *retryingStorage) PutReader(ctx context.Context, key string, body io.Reader, metadata Metadata) error {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		_, err := s.attempt(ctx, func(ctx context.Context) error { return s.Storage.PutReader(ctx, key, body, metadata) })
+		return err
+	}
+
+	return s.retry(ctx, "put", key, func(ctx context.Context) error {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return s.Storage.PutReader(ctx, key, body, metadata)
+	})
+}
+
+func (s *retryingStorage) PutString(ctx context.Context, key string, body string) error {
+	return s.retry(ctx, "put", key, func(ctx context.Context) error { return s.Storage.PutString(ctx, key, body) })
+}
+
+func (s *retryingStorage) PutStringWithMetadata(ctx context.Context, key string, body string, metadata Metadata) error {
+	return s.retry(ctx, "put", key, func(ctx context.Context) error { return s.Storage.PutStringWithMetadata(ctx, key, body, metadata) })
+}
+
+func (s *retryingStorage) Get(ctx context.Context, key string, out io.WriterAt) error {
+	// a retry writes the whole object again, from the start
+	return s.retry(ctx, "get", key, func(ctx context.Context) error { return s.Storage.Get(ctx, key, out) })
+}
+
+func (s *retryingStorage) GetString(ctx context.Context, key string) (string, error) {
+	var contents string
+	err := s.retry(ctx, "get", key, func(ctx context.Context) error {
+		var err error
+		contents, err = s.Storage.GetString(ctx, key)
+		return err
+	})
+
+	return contents, err
+}
+
+func (s *retryingStorage) GetLastModifiedTime(ctx context.Context, key string) (int64, error) {
+	var mtime int64
+	err := s.retry(ctx, "head", key, func(ctx context.Context) error {
+		var err error
+		mtime, err = s.Storage.GetLastModifiedTime(ctx, key)
+		return err
+	})
+
+	return mtime, err
+}
+
+func (s *retryingStorage) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := s.retry(ctx, "head", key, func(ctx context.Context) error {
+		var err error
+		exists, err = s.Storage.Exists(ctx, key)
+		return err
+	})
+
+	return exists, err
+}
+
+func (s *retryingStorage) GetMetadata(ctx context.Context, key string) (Metadata, error) {
+	var metadata Metadata
+	err := s.retry(ctx, "head", key, func(ctx context.Context) error {
+		var err error
+		metadata, err = s.Storage.GetMetadata(ctx, key)
+		return err
+	})
+
+	return metadata, err
+}
+
+func (s *retryingStorage) ListFolder(ctx context.Context, path string) ([]string, error) {
+	var keys []string
+	err := s.retry(ctx, "list", path, func(ctx context.Context) error {
+		var err error
+		keys, err = s.Storage.ListFolder(ctx, path)
+		return err
+	})
+
+	return keys, err
+}
+
+func (s *retryingStorage) Delete(ctx context.Context, key string) error {
+	return s.retry(ctx, "delete", key, func(ctx context.Context) error { return s.Storage.Delete(ctx, key) })
+}
+
+// Identity is passed through to the backend, if it's an Identifier.
+func (s *retryingStorage) Identity(ctx context.Context) (string, error) {
+	identifier, ok := s.Storage.(Identifier)
+	if !ok {
+		return "", errors.New("the storage backend can't tell the identity it's accessed with")
+	}
+
+	var identity string
+	err := s.retry(ctx, "identity", "", func(ctx context.Context) error {
+		var err error
+		identity, err = identifier.Identity(ctx)
+		return err
+	})
+
+	return identity, err
+}
@@ -0,0 +1,108 @@
+package s3storage
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// header S3 tells the region of the bucket in, when requests go to another region than the bucket's
+const bucketRegionHeader = "X-Amz-Bucket-Region"
+
+// regionRedirect sends requests to the region the bucket lives in, once it's found out to be another
+// one than the client was configured with: S3 doesn't follow buckets across regions, requests to the
+// wrong one fail with (confusing) redirects
+type regionRedirect struct {
+	bucket string
+	// requests don't go to the default endpoint of the region (e.g., a custom endpoint was configured),
+	// so only the region they're signed for changes
+	customEndpoint bool
+	logger         *zap.Logger
+
+	mu     sync.RWMutex
+	region string
+}
+
+// install the handlers that send requests to the bucket's region (if it's known) and find it out from
+// the responses of the ones that went to the wrong one
+func (rr *regionRedirect) install(client *s3.S3) {
+	// before the bucket is moved to the host of the endpoint
+	client.Handlers.Build.PushFront(rr.build)
+	client.Handlers.Complete.PushBack(rr.complete)
+}
+
+func (rr *regionRedirect) get() string {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	return rr.region
+}
+
+// send requests to region from now on
+func (rr *regionRedirect) set(region string) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.region = region
+}
+
+func (rr *regionRedirect) build(r *request.Request) {
+	region := rr.get()
+	if region == "" || region == aws.StringValue(r.Config.Region) {
+		return
+	}
+	r.Config.Region = aws.String(region)
+	r.ClientInfo.SigningRegion = region
+	if rr.customEndpoint {
+		return
+	}
+	resolved, err := endpoints.DefaultResolver().EndpointFor(endpoints.S3ServiceID, region)
+	if err != nil {
+		rr.logger.Debug("Failed to resolve the endpoint of the bucket's region", zap.String("region", region), zap.Error(err))
+		return
+	}
+	u, err := url.Parse(resolved.URL)
+	if err != nil {
+		return
+	}
+	r.HTTPRequest.URL.Scheme = u.Scheme
+	r.HTTPRequest.URL.Host = u.Host
+	if resolved.SigningRegion != "" {
+		r.ClientInfo.SigningRegion = resolved.SigningRegion
+	}
+}
+
+func (rr *regionRedirect) complete(r *request.Request) {
+	if r.Error == nil || r.HTTPResponse == nil {
+		return
+	}
+	region := r.HTTPResponse.Header.Get(bucketRegionHeader)
+	if region == "" || region == aws.StringValue(r.Config.Region) || region == rr.get() {
+		return
+	}
+	rr.logger.Warn(
+		"Bucket is in a different region than --s3-region, using the bucket's",
+		zap.String("bucket", rr.bucket),
+		zap.String("s3_region", aws.StringValue(r.Config.Region)),
+		zap.String("bucket_region", region))
+	rr.set(region)
+}
+
+// return true iff err is the response to a request sent to another region than the bucket's, which is
+// worth trying again once the bucket's region is known (see complete)
+func (rr *regionRedirect) redirected(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok || rr == nil || rr.get() == "" {
+		return false
+	}
+
+	return reqErr.StatusCode() == http.StatusMovedPermanently || reqErr.Code() == "PermanentRedirect" ||
+		reqErr.Code() == "AuthorizationHeaderMalformed"
+}
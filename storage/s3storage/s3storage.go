@@ -2,18 +2,28 @@ package s3storage
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/thumbtack/pgCarpenter/storage"
+	"github.com/thumbtack/pgCarpenter/util"
 	"go.uber.org/zap"
 )
 
@@ -22,74 +32,229 @@ const (
 	// deserialize it and the inconsistency would probably throw us off at some point
 	metadataUploadTime   = "Upload_time"
 	metadataModifiedTime = "Modified_time"
+	metadataChecksum     = "Checksum"
+	metadataSize         = "Size"
+	metadataMode         = "Mode"
+	metadataUID          = "Uid"
+	metadataGID          = "Gid"
 )
 
+// with --slow-start, never allow more concurrent requests than this
+const maxConcurrentRequests = 1024
+
+// defaults of Options.PartSize and Options.Concurrency
+const (
+	defaultPartSize    = 32 * 1024 * 1024
+	defaultConcurrency = 32
+)
+
+// how many prefixes WalkFolder lists at a time
+const walkConcurrency = 16
+
+// Options configures the S3 storage backend.
+type Options struct {
+	Bucket string
+	Region string
+	// DetectRegion looks up the region of the bucket when the storage is opened, rather than sending
+	// requests to Region until one of them is redirected (i.e., Region wasn't given explicitly)
+	DetectRegion bool
+	MaxRetries   int
+	// MaxUploadRate caps the aggregate upload throughput (bytes per second) of all requests; 0 means unlimited
+	MaxUploadRate int64
+	// MaxDownloadRate caps the aggregate download throughput (bytes per second) of all requests; 0 means unlimited
+	MaxDownloadRate int64
+	// UserAgent is appended to the SDK's user-agent of every request (e.g., pgCarpenter/1.2.3), for
+	// attribution in S3 access logs
+	UserAgent string
+	// SlowStart is the number of concurrent requests to start with, ramping up from there as long as S3
+	// keeps up and backing off when it throttles us (e.g., on a cold prefix); 0 means no limit
+	SlowStart int
+	// RequestPayer is sent with every request when set (i.e., "requester" for buckets where the requester pays)
+	RequestPayer string
+	// PartSize is the size (in bytes) of the parts of multipart uploads and downloads; 0 means 32MB
+	PartSize int64
+	// Concurrency is the number of parts of a single object uploaded or downloaded at a time; 0 means 32
+	Concurrency int
+}
+
 type s3Storage struct {
 	client     *s3.S3
 	uploader   *s3manager.Uploader
 	downloader *s3manager.Downloader
+	redirect   *regionRedirect
 	bucket     string
 	logger     *zap.Logger
 }
 
-func New(bucket string, region string, maxRetries int, logger *zap.Logger) storage.Storage {
-	backend := &s3Storage{bucket: bucket, logger: logger}
+func init() {
+	storage.Register("s3", open)
+}
 
-	// generic S3 client
-	backend.client = s3.New(session.Must(
+// open the bucket at s3://<bucket>[/][?region=<region>][&request_payer=requester][&part_size_mb=<MB>]
+// [&concurrency=<parts>]; without a region, the bucket's is looked up
+func open(location *url.URL, opts storage.Options) (storage.Storage, error) {
+	if location.Host == "" {
+		return nil, fmt.Errorf("missing bucket in storage URL %q (e.g., s3://bucket)", location.String())
+	}
+	if location.Path != "" && location.Path != "/" {
+		return nil, fmt.Errorf("storing under a prefix of the bucket is not supported (%q)", location.Path)
+	}
+	query := location.Query()
+	region, detectRegion := query.Get("region"), false
+	if region == "" {
+		region, detectRegion = "us-east-1", true
+	}
+	partSize, concurrency := int64(0), 0
+	if v := query.Get("part_size_mb"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb < 5 || mb > 5*1024 {
+			return nil, fmt.Errorf("part_size_mb (%q) must be between 5 and 5120", v)
+		}
+		partSize = mb * 1024 * 1024
+	}
+	if v := query.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("concurrency (%q) must be a positive integer", v)
+		}
+		concurrency = n
+	}
+
+	return New(
+		Options{
+			Bucket:          location.Host,
+			Region:          region,
+			DetectRegion:    detectRegion,
+			MaxRetries:      opts.MaxRetries,
+			MaxUploadRate:   opts.MaxUploadRate,
+			MaxDownloadRate: opts.MaxDownloadRate,
+			UserAgent:       opts.UserAgent,
+			RequestPayer:    query.Get("request_payer"),
+			SlowStart:       opts.SlowStart,
+			PartSize:        partSize,
+			Concurrency:     concurrency,
+		},
+		opts.Logger), nil
+}
+
+func New(opts Options, logger *zap.Logger) storage.Storage {
+	backend := &s3Storage{bucket: opts.Bucket, logger: logger}
+
+	sess := session.Must(
 		session.NewSessionWithOptions(
 			session.Options{
 				Config: aws.Config{
-					Region:                        aws.String(region),
-					MaxRetries:                    aws.Int(maxRetries),
+					Region:                        aws.String(opts.Region),
+					MaxRetries:                    aws.Int(opts.MaxRetries),
 					CredentialsChainVerboseErrors: aws.Bool(true)},
 				SharedConfigState:       session.SharedConfigEnable,
 				AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
-			})))
+			}))
+
+	// all requests go through a transport that enforces the (optional) bandwidth and concurrency limits;
+	// it wraps the session's own transport, rather than being passed to the session, as the session can
+	// only load a custom CA bundle (AWS_CA_BUNDLE) into an *http.Transport
+	transport := http.DefaultTransport
+	if sess.Config.HTTPClient != nil && sess.Config.HTTPClient.Transport != nil {
+		transport = sess.Config.HTTPClient.Transport
+	}
+	sess.Config.HTTPClient = &http.Client{
+		Transport: &throttledTransport{
+			transport:   transport,
+			upload:      util.NewRateLimiter(opts.MaxUploadRate),
+			download:    util.NewRateLimiter(opts.MaxDownloadRate),
+			concurrency: util.NewConcurrencyLimiter(opts.SlowStart, maxConcurrentRequests),
+		},
+	}
+
+	// generic S3 client
+	backend.client = s3.New(sess)
+
+	if opts.UserAgent != "" {
+		backend.client.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(opts.UserAgent))
+	}
+	// rather than setting RequestPayer on the input of each and every request (including the ones made
+	// by the upload and download managers), add the header as the requests are built; before they're signed
+	if opts.RequestPayer != "" {
+		backend.client.Handlers.Build.PushBack(func(r *request.Request) {
+			r.HTTPRequest.Header.Set("X-Amz-Request-Payer", opts.RequestPayer)
+		})
+	}
+
+	// requests to a bucket in another region fail with (confusing) redirects; unless the region was given,
+	// it's looked up (along with the handlers above, e.g., for buckets where the requester pays), rather
+	// than waiting for a request to be redirected
+	backend.redirect = &regionRedirect{
+		bucket:         opts.Bucket,
+		customEndpoint: aws.StringValue(sess.Config.Endpoint) != "",
+		logger:         logger,
+	}
+	backend.redirect.install(backend.client)
+	if opts.DetectRegion {
+		if region := detectBucketRegion(backend.client, opts.Bucket, logger); region != "" && region != opts.Region {
+			logger.Debug("Using the region of the bucket", zap.String("bucket", opts.Bucket), zap.String("region", region))
+			backend.redirect.set(region)
+		}
+	}
+
+	if opts.PartSize == 0 {
+		opts.PartSize = defaultPartSize
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = defaultConcurrency
+	}
 
 	// the s3 manager is helpful with large file uploads; also thread-safe
 	backend.uploader = s3manager.NewUploaderWithClient(backend.client, func(u *s3manager.Uploader) {
-		u.PartSize = 32 * 1024 * 1024
-		u.Concurrency = 32
+		u.PartSize = opts.PartSize
+		u.Concurrency = opts.Concurrency
 		u.LeavePartsOnError = false
 	})
 
 	// similarly, this is helpful with large downloads
 	backend.downloader = s3manager.NewDownloaderWithClient(backend.client, func(u *s3manager.Downloader) {
-		u.PartSize = 32 * 1024 * 1024
-		u.Concurrency = 32
+		u.PartSize = opts.PartSize
+		u.Concurrency = opts.Concurrency
 	})
 
 	return backend
 }
 
-func (s s3Storage) Put(objectKey string, localPath string, mtime int64) error {
+// return the region the bucket lives in, or an empty string if it can't be found out (e.g., we're not
+// allowed to s3:GetBucketLocation), in which case requests go to the configured region as they always did
+func detectBucketRegion(client *s3.S3, bucket string, logger *zap.Logger) string {
+	out, err := client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		logger.Debug("Failed to get the region of the bucket", zap.String("bucket", bucket), zap.Error(err))
+		return ""
+	}
+
+	// buckets in us-east-1 have no location constraint, and the ones in eu-west-1 may have a legacy one (EU)
+	return s3.NormalizeBucketLocation(aws.StringValue(out.LocationConstraint))
+}
+
+func (s s3Storage) Put(ctx context.Context, objectKey string, localPath string, metadata storage.Metadata) error {
 	// open the compressed file to upload
 	file, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
-	// read the compressed file into a buffer
+	defer file.Close()
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
+	// the file is read as it's uploaded (the upload manager reads one part at a time), rather than
+	// buffered in memory, as the size it had when we started, no matter if it grows or shrinks meanwhile
 	size := fileInfo.Size()
-	buffer := make([]byte, size)
-	_, err = file.Read(buffer)
-	if err != nil {
-		return err
-	}
-
-	// prepare the body of the upload
-	body := bytes.NewReader(buffer)
+	body := util.PaddedReader(file, size)
 
 	s.logger.Debug("Uploading file", zap.String("objectKey", objectKey), zap.String("localPath", localPath))
 	if size > 5*1024*1024 {
-		_, err = s.uploader.Upload(getUploadInput(&s.bucket, &objectKey, body, mtime))
+		_, err = s.uploader.UploadWithContext(ctx, getUploadInput(&s.bucket, &objectKey, body, metadata))
 	} else {
-		_, err = s.client.PutObject(getPutObjectInput(&s.bucket, &objectKey, body, mtime))
+		_, err = s.client.PutObjectWithContext(ctx, getPutObjectInput(&s.bucket, &objectKey, body, metadata))
 	}
 	if err != nil {
 		return err
@@ -98,10 +263,23 @@ func (s s3Storage) Put(objectKey string, localPath string, mtime int64) error {
 	return nil
 }
 
-func (s s3Storage) PutString(key string, body string) error {
+func (s s3Storage) PutReader(ctx context.Context, key string, body io.Reader, metadata storage.Metadata) error {
+	s.logger.Debug("Uploading stream", zap.String("objectKey", key))
+	// the upload manager reads the body one part at a time, uploading it in a single request if it turns
+	// out to fit in one part
+	_, err := s.uploader.UploadWithContext(ctx, getUploadInput(&s.bucket, &key, body, metadata))
+
+	return err
+}
+
+func (s s3Storage) PutString(ctx context.Context, key string, body string) error {
+	return s.PutStringWithMetadata(ctx, key, body, storage.Metadata{ModifiedTime: time.Now().Unix()})
+}
+
+func (s s3Storage) PutStringWithMetadata(ctx context.Context, key string, body string, metadata storage.Metadata) error {
 	s.logger.Debug("Creating object", zap.String("key", key))
 
-	_, err := s.client.PutObject(getPutObjectInput(&s.bucket, &key, strings.NewReader(body), time.Now().Unix()))
+	_, err := s.client.PutObjectWithContext(ctx, getPutObjectInput(&s.bucket, &key, strings.NewReader(body), metadata))
 	if err != nil {
 		return err
 	}
@@ -109,13 +287,17 @@ func (s s3Storage) PutString(key string, body string) error {
 	return nil
 }
 
-func (s s3Storage) Get(key string, out io.WriterAt) error {
-	_, err := s.downloader.Download(
+func (s s3Storage) Get(ctx context.Context, key string, out io.WriterAt) error {
+	_, err := s.downloader.DownloadWithContext(
+		ctx,
 		out,
 		&s3.GetObjectInput{
 			Bucket: aws.String(s.bucket),
 			Key:    aws.String(key),
 		})
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+	}
 	if err != nil {
 		return err
 	}
@@ -123,11 +305,14 @@ func (s s3Storage) Get(key string, out io.WriterAt) error {
 	return nil
 }
 
-func (s s3Storage) GetString(key string) (string, error) {
-	result, err := s.client.GetObject(&s3.GetObjectInput{
+func (s s3Storage) GetString(ctx context.Context, key string) (string, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
+	if isNotFound(err) {
+		return "", fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -143,29 +328,121 @@ func (s s3Storage) GetString(key string) (string, error) {
 	return buf.String(), nil
 }
 
-func (s s3Storage) GetLastModifiedTime(key string) (int64, error) {
-	result, err := s.client.HeadObject(&s3.HeadObjectInput{
+func (s s3Storage) GetLastModifiedTime(ctx context.Context, key string) (int64, error) {
+	metadata, err := s.GetMetadata(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return metadata.ModifiedTime, nil
+}
+
+// Identity returns the provider and access key ID of the AWS credentials in use.
+func (s s3Storage) Identity(ctx context.Context) (string, error) {
+	creds, err := s.client.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return creds.ProviderName + ":" + creds.AccessKeyID, nil
+}
+
+func (s s3Storage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
+	if isNotFound(err) {
+		return false, nil
+	}
 	if err != nil {
-		return 0, err
+		return false, err
 	}
 
-	mtime, ok := result.Metadata[metadataModifiedTime]
-	if ok {
-		mtime, err := strconv.Atoi(*mtime)
-		if err != nil {
-			return 0, err
+	return true, nil
+}
+
+// return true iff err is the response to a request for an object that doesn't exist; going by the status
+// rather than the error code (NoSuchKey), as HEAD responses have no body to tell it
+func isNotFound(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+
+	return ok && reqErr.StatusCode() == http.StatusNotFound
+}
+
+// IsRetryable returns true iff err is worth trying again: throttling, 5xx, timeouts, and connections that
+// dropped, unlike, e.g., access denied or a missing bucket, which are there to stay.
+func (s s3Storage) IsRetryable(err error) bool {
+	for err != nil {
+		if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) || s.redirect.redirected(err) {
+			return true
 		}
+		if reqErr, ok := err.(awserr.RequestFailure); ok &&
+			(reqErr.StatusCode() >= http.StatusInternalServerError || reqErr.StatusCode() == http.StatusTooManyRequests) {
+			return true
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			var netErr net.Error
+			return errors.As(err, &netErr)
+		}
+		if aerr.Code() == request.CanceledErrorCode {
+			return false
+		}
+		// the upload manager wraps the error that failed the upload (e.g., of one of its parts)
+		err = aerr.OrigErr()
+	}
 
-		return int64(mtime), nil
+	return false
+}
+
+func (s s3Storage) GetMetadata(ctx context.Context, key string) (storage.Metadata, error) {
+	metadata := storage.Metadata{}
+	result, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return metadata, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+	}
+	if err != nil {
+		return metadata, err
+	}
+
+	metadata.StoredSize = aws.Int64Value(result.ContentLength)
+	if mtime, ok := result.Metadata[metadataModifiedTime]; ok {
+		metadata.ModifiedTime, err = strconv.ParseInt(*mtime, 10, 64)
+		if err != nil {
+			return metadata, err
+		}
+	}
+	if size, ok := result.Metadata[metadataSize]; ok {
+		metadata.Size, err = strconv.ParseInt(*size, 10, 64)
+		if err != nil {
+			return metadata, err
+		}
+	}
+	if checksum, ok := result.Metadata[metadataChecksum]; ok {
+		metadata.Checksum = *checksum
+	}
+	if mode, ok := result.Metadata[metadataMode]; ok {
+		m, err := strconv.ParseUint(*mode, 8, 32)
+		if err != nil {
+			return metadata, err
+		}
+		metadata.Mode = fromUnixMode(uint32(m))
+		if metadata.UID, err = getIntMetadata(result.Metadata, metadataUID); err != nil {
+			return metadata, err
+		}
+		if metadata.GID, err = getIntMetadata(result.Metadata, metadataGID); err != nil {
+			return metadata, err
+		}
 	}
 
-	return 0, nil
+	return metadata, nil
 }
 
-func (s s3Storage) ListFolder(path string) ([]string, error) {
+func (s s3Storage) ListFolder(ctx context.Context, path string) ([]string, error) {
 	keys := make([]string, 0)
 
 	var next *string = nil
@@ -180,7 +457,7 @@ func (s s3Storage) ListFolder(path string) ([]string, error) {
 		if next != nil {
 			input.ContinuationToken = next
 		}
-		result, err := s.client.ListObjectsV2(input)
+		result, err := s.client.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
 			return nil, err
 		}
@@ -199,95 +476,269 @@ func (s s3Storage) ListFolder(path string) ([]string, error) {
 	}
 }
 
-func (s s3Storage) WalkFolder(path string, keysC chan<- string) error {
+// WalkFolder lists the folder and its subfolders concurrently, up to walkConcurrency prefixes at a time,
+// putting objects in keysC as the listings come in (i.e., in no particular order), rather than one
+// subfolder after another, which takes forever on data directories with thousands of them
+func (s s3Storage) WalkFolder(ctx context.Context, path string, keysC chan<- string) error {
+	// stop everyone else at the first error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		pending = []string{path} // prefixes yet to be listed
+		active  = 0              // prefixes being listed, whose subfolders may yet be added to pending
+		walkErr error
+	)
+	cond := sync.NewCond(&mu)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(walkConcurrency)
+	for i := 0; i < walkConcurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(pending) == 0 && active > 0 && walkErr == nil {
+					cond.Wait()
+				}
+				// done once there's nothing left to list, and nothing being listed that may add more
+				if walkErr != nil || len(pending) == 0 {
+					mu.Unlock()
+					return
+				}
+				// depth first, so that there are never that many pending prefixes
+				prefix := pending[len(pending)-1]
+				pending = pending[:len(pending)-1]
+				active++
+				mu.Unlock()
+
+				children, err := s.listPrefix(ctx, prefix, keysC)
+
+				mu.Lock()
+				active--
+				if err != nil && walkErr == nil {
+					walkErr = err
+					cancel()
+				}
+				pending = append(pending, children...)
+				mu.Unlock()
+				cond.Broadcast()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if walkErr == nil {
+		s.logger.Debug("Done traversing folder", zap.String("prefix", path))
+	}
+
+	return walkErr
+}
+
+// put the objects right under prefix in keysC, and return its subfolders
+func (s s3Storage) listPrefix(ctx context.Context, prefix string, keysC chan<- string) ([]string, error) {
+	children := make([]string, 0)
+
 	var next *string = nil
 	for {
 		input := &s3.ListObjectsV2Input{
 			Bucket:    aws.String(s.bucket),
 			Delimiter: aws.String("/"),
-			Prefix:    aws.String(path),
+			Prefix:    aws.String(prefix),
 		}
 		// include the continuation token, if there's one
 		if next != nil {
 			input.ContinuationToken = next
 		}
-		result, err := s.client.ListObjectsV2(input)
+		result, err := s.client.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// objects to restore
 		for _, obj := range result.Contents {
 			s.logger.Debug("Found object while traversing folder", zap.String("key", *obj.Key))
-			if *obj.Key == path {
+			if *obj.Key == prefix {
 				s.logger.Debug("Skipping parent folder", zap.String("path", *obj.Key))
 				continue
 			}
-			keysC <- *obj.Key
+			// whoever is receiving may have given up
+			select {
+			case keysC <- *obj.Key:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
 
 		// child folders to process
 		for _, p := range result.CommonPrefixes {
-			s.logger.Debug("Processing child folder", zap.String("prefix", *p.Prefix))
-			if err := s.WalkFolder(*p.Prefix, keysC); err != nil {
-				return err
-			}
+			s.logger.Debug("Found child folder", zap.String("prefix", *p.Prefix))
+			children = append(children, *p.Prefix)
 		}
 
-		if *result.IsTruncated {
-			next = result.NextContinuationToken
-		} else {
-			s.logger.Debug("Done traversing folder", zap.String("prefix", path))
-			return nil
+		if !*result.IsTruncated {
+			return children, nil
 		}
+		next = result.NextContinuationToken
 	}
 }
 
-func (s s3Storage) Delete(key string) error {
+func (s s3Storage) Delete(ctx context.Context, key string) error {
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	}
 
-	_, err := s.client.DeleteObject(input)
+	_, err := s.client.DeleteObjectWithContext(ctx, input)
+
+	return err
+}
+
+// throttledTransport is an http.RoundTripper that limits the rate at which request bodies are sent (and
+// response bodies are received), and the number of concurrent requests
+type throttledTransport struct {
+	transport   http.RoundTripper
+	upload      *util.RateLimiter
+	download    *util.RateLimiter
+	concurrency *util.ConcurrencyLimiter
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.upload != nil && req.Body != nil && req.Body != http.NoBody {
+		// a RoundTripper must not modify the original request
+		req = req.Clone(req.Context())
+		req.Body = t.upload.ReadCloser(req.Body)
+	}
+
+	if t.concurrency == nil {
+		resp, err := t.transport.RoundTrip(req)
+		if err == nil {
+			resp.Body = t.download.ReadCloser(resp.Body)
+		}
+		return resp, err
+	}
+
+	// don't wait for a turn of a request that's been given up on
+	token, err := t.concurrency.AcquireContext(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		var netErr net.Error
+		t.concurrency.Release(token, errors.As(err, &netErr) && netErr.Timeout())
+		return resp, err
+	}
+	// S3 replies with 503 SlowDown when we're sending requests faster than the prefix can take them
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		t.concurrency.Release(token, true)
+		return resp, nil
+	}
+	// the request is only done once its response (e.g., the contents of an object) has been read
+	resp.Body = &releasingReadCloser{
+		ReadCloser: t.download.ReadCloser(resp.Body),
+		release:    func() { t.concurrency.Release(token, false) },
+	}
+
+	return resp, nil
+}
+
+// releasingReadCloser calls release (once) when closed
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
 
 	return err
 }
 
 // return a map with generally useful metadata for Put/Upload operations
-func generateS3ObjectMetadata(mtime int64) map[string]*string {
+func generateS3ObjectMetadata(metadata storage.Metadata) map[string]*string {
 	now := strconv.FormatInt(time.Now().Unix(), 10)
 
-	metadata := map[string]*string{
+	s3Metadata := map[string]*string{
 		metadataUploadTime: aws.String(now),
 	}
 
-	// add file size and modified timestamp, if provided
-	if mtime != 0 {
-		metadata[metadataModifiedTime] = aws.String(strconv.FormatInt(mtime, 10))
+	// add modified timestamp, size, and checksum, if provided
+	if metadata.ModifiedTime != 0 {
+		s3Metadata[metadataModifiedTime] = aws.String(strconv.FormatInt(metadata.ModifiedTime, 10))
+	}
+	if metadata.Size != 0 {
+		s3Metadata[metadataSize] = aws.String(strconv.FormatInt(metadata.Size, 10))
+	}
+	if metadata.Checksum != "" {
+		s3Metadata[metadataChecksum] = aws.String(metadata.Checksum)
+	}
+	// add mode (in octal, as one would expect) and ownership, if provided
+	if metadata.Mode != 0 {
+		s3Metadata[metadataMode] = aws.String(strconv.FormatUint(uint64(toUnixMode(metadata.Mode)), 8))
+		s3Metadata[metadataUID] = aws.String(strconv.Itoa(metadata.UID))
+		s3Metadata[metadataGID] = aws.String(strconv.Itoa(metadata.GID))
+	}
+
+	return s3Metadata
+}
+
+// os.FileMode uses its own bits for setuid, setgid, and sticky; store the traditional unix ones instead
+var unixModeBits = map[os.FileMode]uint32{os.ModeSetuid: 04000, os.ModeSetgid: 02000, os.ModeSticky: 01000}
+
+func toUnixMode(mode os.FileMode) uint32 {
+	unixMode := uint32(mode.Perm())
+	for bit, unixBit := range unixModeBits {
+		if mode&bit != 0 {
+			unixMode |= unixBit
+		}
+	}
+
+	return unixMode
+}
+
+func fromUnixMode(unixMode uint32) os.FileMode {
+	mode := os.FileMode(unixMode) & os.ModePerm
+	for bit, unixBit := range unixModeBits {
+		if unixMode&unixBit != 0 {
+			mode |= bit
+		}
+	}
+
+	return mode
+}
+
+// return the integer value of the metadata key, or 0 if there's no such key
+func getIntMetadata(metadata map[string]*string, key string) (int, error) {
+	value, ok := metadata[key]
+	if !ok {
+		return 0, nil
 	}
 
-	return metadata
+	return strconv.Atoi(*value)
 }
 
 // getPutObjectInput creates and returns a pointer to an instance of s3.PutObjectInput that includes
 // the object's metadata as required and used by pgCarpenter.
-func getPutObjectInput(bucket *string, key *string, body io.ReadSeeker, mtime int64) *s3.PutObjectInput {
+func getPutObjectInput(bucket *string, key *string, body io.ReadSeeker, metadata storage.Metadata) *s3.PutObjectInput {
 	return &s3.PutObjectInput{
 		Bucket:   bucket,
 		Key:      key,
 		Body:     body,
-		Metadata: generateS3ObjectMetadata(mtime),
+		Metadata: generateS3ObjectMetadata(metadata),
 	}
 }
 
 // getUploadInput creates and returns a pointer to an instance of s3manager.UploadInput that includes
 // the object's metadata as required and used by pgCarpenter
-func getUploadInput(bucket *string, key *string, body io.Reader, mtime int64) *s3manager.UploadInput {
+func getUploadInput(bucket *string, key *string, body io.Reader, metadata storage.Metadata) *s3manager.UploadInput {
 	return &s3manager.UploadInput{
 		Bucket:   bucket,
 		Key:      key,
 		Body:     body,
-		Metadata: generateS3ObjectMetadata(mtime),
+		Metadata: generateS3ObjectMetadata(metadata),
 	}
 }
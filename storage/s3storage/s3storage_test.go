@@ -0,0 +1,122 @@
+package s3storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/thumbtack/pgCarpenter/storage"
+	"go.uber.org/zap"
+)
+
+// return a backend for the bucket "bucket" served by handler
+func newTestStorage(t *testing.T, handler http.HandlerFunc) s3Storage {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := s3.New(sess)
+	redirect := &regionRedirect{bucket: "bucket", customEndpoint: true, logger: zap.NewNop()}
+	redirect.install(client)
+
+	return s3Storage{client: client, redirect: redirect, bucket: "bucket", logger: zap.NewNop()}
+}
+
+func TestGetString(t *testing.T) {
+	s := newTestStorage(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/LATEST":
+			w.Write([]byte("20210317T102030"))
+		case "/bucket/missing":
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+				`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		case "/bucket/denied":
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+				`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	tests := []struct {
+		key      string
+		expected string
+		notFound bool
+		wantErr  bool
+	}{
+		{key: "LATEST", expected: "20210317T102030"},
+		{key: "missing", notFound: true, wantErr: true},
+		{key: "denied", wantErr: true},
+		{key: "failing", wantErr: true},
+	}
+	for _, tt := range tests {
+		contents, err := s.GetString(context.Background(), tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("GetString(%s): unexpected error: %v", tt.key, err)
+			continue
+		}
+		if notFound := errors.Is(err, storage.ErrNotFound); notFound != tt.notFound {
+			t.Errorf("GetString(%s): error %v wraps ErrNotFound = %t, expected %t", tt.key, err, notFound, tt.notFound)
+		}
+		if contents != tt.expected {
+			t.Errorf("GetString(%s) = %q, expected %q", tt.key, contents, tt.expected)
+		}
+	}
+}
+
+func TestRegionRedirect(t *testing.T) {
+	s := newTestStorage(t, func(w http.ResponseWriter, r *http.Request) {
+		// requests are signed for the region they're sent to
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/") {
+			w.Header().Set(bucketRegionHeader, "eu-west-1")
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusMovedPermanently)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+				`<Error><Code>PermanentRedirect</Code><Message>The bucket you are attempting to access must be ` +
+				`addressed using the specified endpoint.</Message></Error>`))
+			return
+		}
+		w.Write([]byte("20210317T102030"))
+	})
+
+	// the request that finds out the bucket is elsewhere fails, but it's worth trying again
+	_, err := s.GetString(context.Background(), "LATEST")
+	if err == nil {
+		t.Fatal("GetString sent to the wrong region: expected an error")
+	}
+	if !s.IsRetryable(err) {
+		t.Errorf("GetString sent to the wrong region: error %v is not retryable", err)
+	}
+	if region := s.redirect.get(); region != "eu-west-1" {
+		t.Errorf("region after the redirect is %q, expected eu-west-1", region)
+	}
+
+	contents, err := s.GetString(context.Background(), "LATEST")
+	if err != nil {
+		t.Fatalf("GetString after the redirect: unexpected error: %v", err)
+	}
+	if contents != "20210317T102030" {
+		t.Errorf("GetString after the redirect = %q, expected %q", contents, "20210317T102030")
+	}
+}
@@ -1,26 +1,70 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"io"
+	"os"
 )
 
+// ErrNotFound is returned (wrapped) by Get, GetString, and GetMetadata when the object doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// Metadata holds the attributes of a local file that are stored alongside the object.
+type Metadata struct {
+	// ModifiedTime is the last modified timestamp (mtime) of the local file; 0 if unknown.
+	ModifiedTime int64
+	// Size of the local (uncompressed) file in bytes; 0 if unknown.
+	Size int64
+	// Checksum of the local file as returned by util.Checksum; empty if unknown.
+	Checksum string
+	// Mode (permission bits, along with setuid, setgid, and sticky) of the local file; 0 if unknown,
+	// in which case UID and GID are meaningless.
+	Mode os.FileMode
+	UID  int
+	GID  int
+	// StoredSize is the size of the object itself (e.g., compressed) in bytes; only set by GetMetadata.
+	StoredSize int64
+}
+
+// Storage is implemented by storage backends. All methods take a context, and give up (returning its
+// error) once it's done, so that no operation outlives the command that started it (e.g., on a timeout
+// or a signal).
 type Storage interface {
 	// Put stores the contents of the local file path in the object identified by key. It also
-	// stores the last modified timestamp (mtime) in the object's metadata.
-	Put(key string, localPath string, mtime int64) error
+	// stores metadata (e.g., mtime, checksum) in the object's metadata.
+	Put(ctx context.Context, key string, localPath string, metadata Metadata) error
+	// PutReader stores everything read from body, until EOF, in the object identified by key. Unlike Put,
+	// the size of the contents doesn't need to be known in advance (e.g., to stream compressed contents).
+	PutReader(ctx context.Context, key string, body io.Reader, metadata Metadata) error
 	// PutString stores the value of body as the content of the object identified by key.
-	PutString(key string, body string) error
-	// Get writes the contents of the object identified by key into out.
-	Get(key string, out io.WriterAt) error
-	// GetString returns the contents of the object as a string.
-	GetString(key string) (string, error)
+	PutString(ctx context.Context, key string, body string) error
+	// PutStringWithMetadata is like PutString, but it also stores metadata in the object's metadata.
+	PutStringWithMetadata(ctx context.Context, key string, body string, metadata Metadata) error
+	// Get writes the contents of the object identified by key into out, or returns an error wrapping
+	// ErrNotFound if there's no such object.
+	Get(ctx context.Context, key string, out io.WriterAt) error
+	// GetString returns the contents of the object as a string, or an error wrapping ErrNotFound if there's
+	// no such object.
+	GetString(ctx context.Context, key string) (string, error)
 	// GetLastModifiedTime returns the modified time as stored in the objects metadata.
-	GetLastModifiedTime(key string) (int64, error)
+	GetLastModifiedTime(ctx context.Context, key string) (int64, error)
+	// Exists returns true iff there's an object identified by key, without downloading its contents.
+	Exists(ctx context.Context, key string) (bool, error)
+	// GetMetadata returns the metadata stored alongside the object identified by key, or an error wrapping
+	// ErrNotFound if there's no such object.
+	GetMetadata(ctx context.Context, key string) (Metadata, error)
 	// ListFolder returns the contents (list of strings) of the folder rooted at path.
-	ListFolder(path string) ([]string, error)
+	ListFolder(ctx context.Context, path string) ([]string, error)
 	// WalkFolder traverses the folder rooted at path, putting each object it finds in the channel keysC.
-	// If an error occurs the traversal is interrupted and the error returned.
-	WalkFolder(path string, keysC chan<- string) error
+	// If an error occurs (or ctx is done) the traversal is interrupted and the error returned.
+	WalkFolder(ctx context.Context, path string, keysC chan<- string) error
 	// Delete removes the folder path and all its contents.
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Identifier is implemented by backends that can tell who requests are made as (e.g., for audits).
+type Identifier interface {
+	// Identity returns a description of the credentials used to access the storage.
+	Identity(ctx context.Context) (string, error)
 }
@@ -0,0 +1,7 @@
+//go:build !nos3
+// +build !nos3
+
+package main
+
+// the S3 storage backend registers itself (for s3:// URLs) when imported
+import _ "github.com/thumbtack/pgCarpenter/storage/s3storage"
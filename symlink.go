@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// symlink inside the data directory (other than the ones to tablespaces), as recorded in the manifest
+type symlink struct {
+	// relative to the data directory
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	// true iff the symlink points to a directory
+	IsDir bool `json:"is_dir"`
+}
+
+// return the symlink at path (relative to the data directory); resolve maps absolute targets to where
+// they can be found locally (see snapshotPath)
+func readSymlink(dataDirectory string, path string, resolve func(string) string) (symlink, error) {
+	link := symlink{Path: path}
+	target, err := os.Readlink(filepath.Join(dataDirectory, path))
+	if err != nil {
+		return link, err
+	}
+	link.Target = target
+
+	local := filepath.Join(dataDirectory, path)
+	if filepath.IsAbs(target) {
+		local = resolve(target)
+	}
+	// a dangling symlink is recorded as a symlink to a file
+	if st, err := os.Stat(local); err == nil {
+		link.IsDir = st.IsDir()
+	}
+
+	return link, nil
+}
+
+// recreate the symlinks of the backup in the data directory before restoring any files; with
+// --materialize-symlinks, directories are created instead, and files are restored as regular files
+func (a *app) restoreSymlinks(links []symlink) error {
+	a.restoredSymlinks = make(map[string]bool)
+	for _, l := range links {
+		path := filepath.Join(*a.pgDataDirectory, l.Path)
+		if *a.materializeSymlinks {
+			if l.IsDir {
+				a.logger.Info("Materializing symlink as directory", zap.String("path", l.Path))
+				if err := os.MkdirAll(path, 0700); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		a.logger.Info("Restoring symlink", zap.String("path", l.Path), zap.String("target", l.Target))
+		if l.IsDir {
+			// relative targets are relative to the directory the symlink is in
+			target := l.Target
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		}
+		if err := ensureSymlink(l.Target, path); err != nil {
+			return err
+		}
+		// whatever the symlink points to is not ours to overwrite
+		a.restoredSymlinks[l.Path] = true
+	}
+
+	return nil
+}
+
+// make sure link is a symlink to target, replacing an existing symlink pointing elsewhere
+func ensureSymlink(target string, link string) error {
+	if err := os.MkdirAll(filepath.Dir(link), 0700); err != nil {
+		return err
+	}
+
+	// leave existing symlinks alone if they point to the right place (e.g., with --modified-only)
+	if current, err := os.Readlink(link); err == nil {
+		if current == target {
+			return nil
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	} else if _, err := os.Lstat(link); err == nil {
+		return fmt.Errorf("%s exists and is not a symlink", link)
+	}
+
+	return os.Symlink(target, link)
+}
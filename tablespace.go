@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// directory (relative to the data directory) with a symlink, named after the tablespace's OID,
+// to the location of each tablespace
+const tablespaceDirectory = "pg_tblspc"
+
+// file (in the data directory) pg_stop_backup gives the location of each tablespace in, one `<oid> <location>`
+// per line; PostgreSQL (re)creates the symlinks in pg_tblspc from it when recovery starts
+const tablespaceMapFile = "tablespace_map"
+
+// tablespace, as recorded in the manifest
+type tablespace struct {
+	OID      string `json:"oid"`
+	Location string `json:"location"`
+}
+
+// return all tablespaces of the cluster in dataDirectory, i.e., the symlinks in pg_tblspc; the
+// contents of the tablespaces are backed up as if they were in pg_tblspc/<oid>/
+func findTablespaces(dataDirectory string) ([]tablespace, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dataDirectory, tablespaceDirectory))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tablespaces := make([]tablespace, 0)
+	for _, e := range entries {
+		// in-place tablespaces (PG 15+) are regular directories and are backed up like any other
+		if e.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		location, err := os.Readlink(filepath.Join(dataDirectory, tablespaceDirectory, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tablespaces = append(tablespaces, tablespace{OID: e.Name(), Location: location})
+	}
+
+	return tablespaces, nil
+}
+
+// return true iff path (relative to the data directory) is the symlink to a tablespace
+func isTablespaceLink(path string, info os.FileInfo) bool {
+	return filepath.Dir(path) == tablespaceDirectory && info.Mode()&os.ModeSymlink != 0
+}
+
+// create the location of each tablespace, and the symlink to it in pg_tblspc, so that files
+// restored to pg_tblspc/<oid>/ end up in the tablespace; return the location of each tablespace by oid
+func (a *app) restoreTablespaces(tablespaces []tablespace) (map[string]string, error) {
+	mapping := parseTablespaceMap(*a.tablespaceMap)
+	locations := make(map[string]string, len(tablespaces))
+	for _, ts := range tablespaces {
+		link := filepath.Join(*a.pgDataDirectory, tablespaceDirectory, ts.OID)
+		location := ts.Location
+		if newLocation, ok := mapping[filepath.Clean(ts.Location)]; ok {
+			location = newLocation
+			delete(mapping, filepath.Clean(ts.Location))
+		}
+		if a.tablespaceRoot != "" {
+			location = filepath.Join(a.tablespaceRoot, ts.OID)
+		}
+		a.logger.Info("Restoring tablespace", zap.String("oid", ts.OID), zap.String("location", location))
+
+		if err := os.MkdirAll(location, 0700); err != nil {
+			return nil, err
+		}
+		if err := ensureSymlink(location, link); err != nil {
+			return nil, err
+		}
+		locations[ts.OID] = location
+	}
+	// most likely a typo, the tablespace would otherwise be restored where it was
+	for old := range mapping {
+		a.logger.Warn("No tablespace found in the backup for --tablespace-map", zap.String("location", old))
+	}
+
+	return locations, nil
+}
+
+// rewrite the tablespace map restored to the data directory with the locations the tablespaces were restored
+// to (by oid), as PostgreSQL would otherwise point the symlinks back to where the tablespaces were on the
+// host the backup was taken from (e.g., the original cluster's, for a clone restored alongside it)
+func relocateTablespaceMap(dataDirectory string, locations map[string]string) error {
+	path := filepath.Join(dataDirectory, tablespaceMapFile)
+	contents, err := ioutil.ReadFile(path)
+	// backups of clusters without tablespaces don't have one
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tablespaces := parseTablespaceMapFile(string(contents))
+	for i, ts := range tablespaces {
+		if location, ok := locations[ts.OID]; ok {
+			tablespaces[i].Location = location
+		}
+	}
+	relocated := formatTablespaceMapFile(tablespaces)
+	if relocated == string(contents) {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte(relocated), 0600)
+}
+
+// return the tablespaces in the contents of a tablespace map; as in PostgreSQL, a backslash escapes the
+// character following it (i.e., line breaks and backslashes in locations)
+func parseTablespaceMapFile(contents string) []tablespace {
+	tablespaces := make([]tablespace, 0)
+	line := strings.Builder{}
+	escaped := false
+	for _, c := range contents + "\n" {
+		switch {
+		case escaped:
+			line.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '\n' || c == '\r':
+			if kv := strings.SplitN(line.String(), " ", 2); len(kv) == 2 {
+				tablespaces = append(tablespaces, tablespace{OID: kv[0], Location: kv[1]})
+			}
+			line.Reset()
+		default:
+			line.WriteRune(c)
+		}
+	}
+
+	return tablespaces
+}
+
+// return the contents of the tablespace map of the tablespaces, as PostgreSQL writes it
+func formatTablespaceMapFile(tablespaces []tablespace) string {
+	b := strings.Builder{}
+	for _, ts := range tablespaces {
+		b.WriteString(ts.OID + " ")
+		for _, c := range ts.Location {
+			if c == '\n' || c == '\r' || c == '\\' {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(c)
+		}
+		b.WriteRune('\n')
+	}
+
+	return b.String()
+}
+
+func validateTablespaceRoot(args []string) error {
+	if !filepath.IsAbs(args[0]) {
+		return fmt.Errorf("tablespace root ('%s') must be an absolute path", args[0])
+	}
+
+	return nil
+}
+
+func validateTablespaceMap(args []string) error {
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || !filepath.IsAbs(kv[0]) || !filepath.IsAbs(kv[1]) {
+			return fmt.Errorf("tablespace mapping ('%s') must be of the form olddir=newdir, with absolute paths", arg)
+		}
+	}
+
+	return nil
+}
+
+// return the olddir=newdir mappings as a map of (clean) old to new locations; later mappings override
+// earlier ones of the same location
+func parseTablespaceMap(mappings []string) map[string]string {
+	parsed := make(map[string]string, len(mappings))
+	for _, m := range mappings {
+		kv := strings.SplitN(m, "=", 2)
+		parsed[filepath.Clean(kv[0])] = filepath.Clean(kv[1])
+	}
+
+	return parsed
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestParseTablespaceMapFile(t *testing.T) {
+	tests := []struct {
+		contents string
+		expected []tablespace
+	}{
+		{"", []tablespace{}},
+		{
+			"16385 /mnt/ts1\n16386 /mnt/ts2\n",
+			[]tablespace{{"16385", "/mnt/ts1"}, {"16386", "/mnt/ts2"}},
+		},
+		// without a trailing line break
+		{"16385 /mnt/ts1", []tablespace{{"16385", "/mnt/ts1"}}},
+		// locations may have spaces, and escaped line breaks and backslashes
+		{
+			"16385 /mnt/table space\n16386 /mnt/ts\\\n2\n16387 /mnt/ts\\\\3\n",
+			[]tablespace{{"16385", "/mnt/table space"}, {"16386", "/mnt/ts\n2"}, {"16387", "/mnt/ts\\3"}},
+		},
+		{"16385 /mnt/ts1\r\n", []tablespace{{"16385", "/mnt/ts1"}}},
+	}
+	for _, tt := range tests {
+		if tablespaces := parseTablespaceMapFile(tt.contents); !reflect.DeepEqual(tablespaces, tt.expected) {
+			t.Errorf("parseTablespaceMapFile(%q) = %v, expected %v", tt.contents, tablespaces, tt.expected)
+		}
+	}
+}
+
+func TestFormatTablespaceMapFile(t *testing.T) {
+	tablespaces := []tablespace{{"16385", "/mnt/table space"}, {"16386", "/mnt/ts\n2"}, {"16387", "/mnt/ts\\3"}}
+	expected := "16385 /mnt/table space\n16386 /mnt/ts\\\n2\n16387 /mnt/ts\\\\3\n"
+	contents := formatTablespaceMapFile(tablespaces)
+	if contents != expected {
+		t.Errorf("formatTablespaceMapFile(%v) = %q, expected %q", tablespaces, contents, expected)
+	}
+	if parsed := parseTablespaceMapFile(contents); !reflect.DeepEqual(parsed, tablespaces) {
+		t.Errorf("parseTablespaceMapFile(%q) = %v, expected %v", contents, parsed, tablespaces)
+	}
+}
+
+func TestRelocateTablespaceMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		contents  string
+		locations map[string]string
+		expected  string
+	}{
+		{
+			name:      "relocated",
+			contents:  "16385 /mnt/ts1\n16386 /mnt/ts2\n",
+			locations: map[string]string{"16385": "/clone/16385", "16386": "/clone/16386"},
+			expected:  "16385 /clone/16385\n16386 /clone/16386\n",
+		},
+		{
+			name:      "some relocated",
+			contents:  "16385 /mnt/ts1\n16386 /mnt/ts2\n",
+			locations: map[string]string{"16386": "/mnt/new ts2"},
+			expected:  "16385 /mnt/ts1\n16386 /mnt/new ts2\n",
+		},
+		{
+			name:      "restored where they were",
+			contents:  "16385 /mnt/ts1\n",
+			locations: map[string]string{"16385": "/mnt/ts1"},
+			expected:  "16385 /mnt/ts1\n",
+		},
+	}
+	for _, tt := range tests {
+		dataDirectory := t.TempDir()
+		path := filepath.Join(dataDirectory, tablespaceMapFile)
+		if err := ioutil.WriteFile(path, []byte(tt.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := relocateTablespaceMap(dataDirectory, tt.locations); err != nil {
+			t.Errorf("%s: relocateTablespaceMap: unexpected error: %v", tt.name, err)
+			continue
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != tt.expected {
+			t.Errorf("%s: tablespace map is %q, expected %q", tt.name, contents, tt.expected)
+		}
+	}
+
+	// nothing to rewrite
+	dataDirectory := t.TempDir()
+	if err := relocateTablespaceMap(dataDirectory, map[string]string{"16385": "/clone/16385"}); err != nil {
+		t.Errorf("relocateTablespaceMap without a tablespace map: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDirectory, tablespaceMapFile)); !os.IsNotExist(err) {
+		t.Errorf("relocateTablespaceMap created a tablespace map: %v", err)
+	}
+}
+
+func TestRestoreTablespacesMapping(t *testing.T) {
+	dataDirectory := t.TempDir()
+	newLocation := filepath.Join(t.TempDir(), "ts1")
+	tablespaceMap := []string{"/mnt/ts1/=" + newLocation}
+	a := &app{logger: zap.NewNop(), pgDataDirectory: &dataDirectory, tablespaceMap: &tablespaceMap}
+	if err := ioutil.WriteFile(filepath.Join(dataDirectory, tablespaceMapFile), []byte("16385 /mnt/ts1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	locations, err := a.restoreTablespaces([]tablespace{{"16385", "/mnt/ts1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relocateTablespaceMap(dataDirectory, locations); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.Readlink(filepath.Join(dataDirectory, tablespaceDirectory, "16385"))
+	if err != nil || target != newLocation {
+		t.Errorf("symlink to the tablespace points to %s (%v), expected %s", target, err, newLocation)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dataDirectory, tablespaceMapFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "16385 " + newLocation + "\n"; string(contents) != expected {
+		t.Errorf("tablespace map is %q, expected %q", contents, expected)
+	}
+}
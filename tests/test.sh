@@ -238,7 +238,7 @@ create_backup() {
 delete_backup(){
     log "Deleting backup"
     docker exec ${CONTAINER_NAME} /${PGCARPENTER_BIN} delete-backup \
-        --s3-bucket ${S3_BUCKET} --backup-name ${BACKUP_NAME} --verbose > delete_backup.log
+        --s3-bucket ${S3_BUCKET} --backup-name ${BACKUP_NAME} --yes --verbose > delete_backup.log
     if ! grep 'Backup successfully deleted' delete_backup.log > /dev/null
     then
         log 'delete-backup failed'
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// uploadQueue hands the files found by create-backup to the workers largest first, so that the largest
+// ones (e.g., 1GB segments of relations) start uploading right away, rather than whenever the walk gets to
+// them, which would leave a single worker grinding through the last of them at the end of the backup while
+// the rest sit idle. It's unbounded, but it only holds paths and their stat
+type uploadQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	files  largestFirst
+	closed bool
+}
+
+func newUploadQueue() *uploadQueue {
+	q := &uploadQueue{}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// add a file to upload
+func (q *uploadQueue) push(f backupFile) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	heap.Push(&q.files, f)
+	q.cond.Signal()
+}
+
+// signal that no more files are coming
+func (q *uploadQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// return the largest file queued, blocking until there's one; false once the queue is closed and empty
+func (q *uploadQueue) pop() (backupFile, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.files.Len() == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.files.Len() == 0 {
+		return backupFile{}, false
+	}
+
+	return heap.Pop(&q.files).(backupFile), true
+}
+
+// largestFirst is a heap.Interface of files, the largest on top; directories count as empty
+type largestFirst []backupFile
+
+func (h largestFirst) Len() int { return len(h) }
+
+func (h largestFirst) Less(i, j int) bool {
+	si, sj := fileSize(h[i]), fileSize(h[j])
+	if si != sj {
+		return si > sj
+	}
+	return h[i].path < h[j].path
+}
+
+func (h largestFirst) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *largestFirst) Push(x interface{}) { *h = append(*h, x.(backupFile)) }
+
+func (h *largestFirst) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return f
+}
+
+func fileSize(f backupFile) int64 {
+	if f.info.IsDir() {
+		return 0
+	}
+
+	return f.info.Size()
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	// ChecksumNone disables checksumming altogether
+	ChecksumNone = "none"
+	// ChecksumSHA256 uses crypto/sha256 (SHA-NI/AVX2 accelerated where available)
+	ChecksumSHA256 = "sha256"
+	// ChecksumBLAKE3 uses a SIMD (AVX2/AVX-512) implementation of BLAKE3
+	ChecksumBLAKE3 = "blake3"
+	// ChecksumXXH3 is by far the fastest option, but it is not a cryptographic hash and
+	// only protects against accidental corruption
+	ChecksumXXH3 = "xxh3"
+)
+
+// ChecksumAlgorithms lists all supported checksum algorithms.
+var ChecksumAlgorithms = []string{ChecksumNone, ChecksumSHA256, ChecksumBLAKE3, ChecksumXXH3}
+
+// NewHash returns a new hash.Hash computing the checksum algorithm.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(), nil
+	case ChecksumXXH3:
+		return xxh3.New(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+}
+
+// ChecksumAlgorithmOf returns the algorithm a checksum (as returned by Checksum) was computed with.
+func ChecksumAlgorithmOf(checksum string) string {
+	return strings.SplitN(checksum, ":", 2)[0]
+}
+
+// Checksum computes the checksum of the contents of the file path using algorithm. The result is
+// formatted as <algorithm>:<hex digest>, so that it's self-describing when stored alongside the data.
+// It returns an empty string if algorithm is ChecksumNone.
+func Checksum(path string, algorithm string) (string, error) {
+	if algorithm == ChecksumNone {
+		return "", nil
+	}
+
+	h, err := NewHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	// read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	// large reads keep the vectorized implementations busy
+	if _, err := io.Copy(h, bufio.NewReaderSize(f, 1024*1024)); err != nil {
+		return "", err
+	}
+
+	return FormatChecksum(algorithm, h), nil
+}
+
+// FormatChecksum returns the checksum computed by h (a hash.Hash returned by NewHash for algorithm) the
+// way Checksum does.
+func FormatChecksum(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
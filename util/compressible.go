@@ -0,0 +1,70 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pierrec/lz4"
+)
+
+const (
+	// how much of the beginning of a file to sample when deciding whether it's worth compressing
+	compressibleSampleSize = 64 * 1024
+	// minimum fraction of the sample compressing it must save
+	compressibleMinSavings = 0.1
+)
+
+// extensions of files that are already compressed, compressing them again is a waste of time
+var compressedExtensions = map[string]bool{
+	".7z":   true,
+	".br":   true,
+	".bz2":  true,
+	".gz":   true,
+	".jpeg": true,
+	".jpg":  true,
+	".lz4":  true,
+	".lzma": true,
+	".png":  true,
+	".xz":   true,
+	".zip":  true,
+	".zst":  true,
+}
+
+// IsCompressible returns false iff the file path isn't worth compressing with LZ4: either its extension
+// is of an already compressed format, or compressing a sample of its contents barely reduces its size.
+func IsCompressible(path string) (bool, error) {
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sample := make([]byte, compressibleSampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	sample = sample[:n]
+
+	compressed := make([]byte, lz4.CompressBlockBound(n))
+	hashTable := make([]int, 1<<16)
+	size, err := lz4.CompressBlock(sample, compressed, hashTable)
+	if err != nil {
+		return false, err
+	}
+	// 0 means the sample is incompressible
+	if size == 0 {
+		return false, nil
+	}
+
+	return float64(size) <= float64(n)*(1-compressibleMinSavings), nil
+}
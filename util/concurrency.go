@@ -0,0 +1,126 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// ConcurrencyLimiter caps the number of concurrent operations (e.g., requests to S3), adapting the cap with
+// AIMD: starting low, it doubles the cap every time as many operations as the cap succeed (slow start) until
+// the first sign of congestion, after which it grows the cap by one at a time; on congestion (e.g., S3 asking
+// us to slow down), it halves the cap. A nil *ConcurrencyLimiter imposes no limit.
+type ConcurrencyLimiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	max       int
+	threshold int // slow start until the limit reaches it
+	inFlight  int
+	successes int // since the limit last changed
+	// incremented whenever the limit is decreased, so that all of the operations that were already in flight
+	// failing (they most likely will) don't decrease it over and over again
+	generation int
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter allowing initial concurrent operations at first, and
+// never more than max. It returns nil (i.e., unlimited) if initial is not positive.
+func NewConcurrencyLimiter(initial int, max int) *ConcurrencyLimiter {
+	if initial <= 0 {
+		return nil
+	}
+	if max < initial {
+		max = initial
+	}
+
+	l := &ConcurrencyLimiter{limit: initial, max: max, threshold: max}
+	l.cond = sync.NewCond(&l.mu)
+
+	return l
+}
+
+// Acquire blocks until another operation can start. It returns a token to pass to Release.
+func (l *ConcurrencyLimiter) Acquire() int {
+	token, _ := l.AcquireContext(context.Background())
+
+	return token
+}
+
+// AcquireContext is like Acquire, but it gives up (returning the error of ctx, and no token to release)
+// once ctx is done.
+func (l *ConcurrencyLimiter) AcquireContext(ctx context.Context) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	// wake up the waiters when ctx is done, so that they can give up
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.inFlight >= l.limit {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		l.cond.Wait()
+	}
+	l.inFlight++
+
+	return l.generation, nil
+}
+
+// Release signals the end of the operation started when token was returned by Acquire; congested is true
+// iff the operation failed (or was slow) because of congestion.
+func (l *ConcurrencyLimiter) Release(token int, congested bool) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// only grow the limit if it's actually limiting anything
+	saturated := l.inFlight >= l.limit
+	l.inFlight--
+
+	switch {
+	case congested && token == l.generation:
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		l.threshold = l.limit
+		l.successes = 0
+		l.generation++
+	case !congested && saturated:
+		l.successes++
+		if l.successes >= l.limit {
+			if l.limit < l.threshold {
+				l.limit *= 2
+			} else {
+				l.limit++
+			}
+			if l.limit > l.max {
+				l.limit = l.max
+			}
+			l.successes = 0
+		}
+	}
+
+	l.cond.Broadcast()
+}
+
+// Limit returns the current limit on concurrent operations.
+func (l *ConcurrencyLimiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE, from linux/falloc.h (the syscall package doesn't define it)
+const fallocKeepSize = 0x01
+
+// Preallocate reserves size bytes of disk space for f, so that running out of space surfaces right away
+// rather than half way through writing the file. The size of f is left alone (i.e., it's only as large as
+// what's written to it), and so is f on file systems that don't support fallocate(2).
+func Preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+
+	return err
+}
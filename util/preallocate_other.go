@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import "os"
+
+// Preallocate is a no-op on platforms without fallocate(2).
+func Preallocate(f *os.File, size int64) error {
+	return nil
+}
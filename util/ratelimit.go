@@ -0,0 +1,75 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that can be shared by multiple goroutines to cap their aggregate throughput.
+// A nil *RateLimiter imposes no limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens (bytes) per second
+	tokens float64 // may become negative, in which case callers sleep until it's paid back
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing up to bytesPerSecond bytes per second, with a burst of
+// up to one second worth of bytes. It returns nil (i.e., unlimited) if bytesPerSecond is not positive.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// Wait blocks until n bytes can be transferred without exceeding the rate limit.
+func (r *RateLimiter) Wait(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	// refill the bucket, but never allow more than one second worth of burst
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	// take what we need, even if that leaves us in debt
+	r.tokens -= float64(n)
+	deficit := -r.tokens
+	r.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / r.rate * float64(time.Second)))
+	}
+}
+
+// ReadCloser wraps rc so that reading from it is subject to the rate limit.
+func (r *RateLimiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return rc
+	}
+
+	return &throttledReadCloser{ReadCloser: rc, limiter: r}
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	limiter *RateLimiter
+}
+
+func (t *throttledReadCloser) Read(p []byte) (int, error) {
+	// read in small chunks so that the throughput is smooth rather than bursty
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := t.ReadCloser.Read(p)
+	t.limiter.Wait(n)
+
+	return n, err
+}
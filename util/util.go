@@ -2,9 +2,11 @@ package util
 
 import (
 	"bufio"
+	"compress/gzip"
 	"io"
-	"io/ioutil"
 	"os"
+	"strings"
+	"syscall"
 
 	"github.com/pierrec/lz4"
 	"go.uber.org/zap"
@@ -12,6 +14,40 @@ import (
 
 const DirectoryExtension = ".dir"
 
+// LZ4BlockSizes maps the names of the block sizes supported by LZ4 frames to their size in bytes.
+var LZ4BlockSizes = map[string]int{
+	"64KB":  64 << 10,
+	"256KB": 256 << 10,
+	"1MB":   1 << 20,
+	"4MB":   4 << 20,
+}
+
+// CompressOptions configures the LZ4 frames written by Compress. The zero value uses the fastest
+// compression and the default (4MB) block size.
+type CompressOptions struct {
+	// Level of compression: 0 is the fastest, higher levels trade speed for a better ratio.
+	Level int
+	// BlockSize is one of LZ4BlockSizes; 0 for the default.
+	BlockSize int
+	// BlockChecksum adds a checksum to each block, on top of the checksum of the whole frame
+	// (which is always written).
+	BlockChecksum bool
+	// ZstdThreshold is the size (in bytes) from which files are compressed with zstd, with a large window
+	// (see ZstdWindow), instead of LZ4, for a better ratio at the cost of speed; 0 disables it.
+	ZstdThreshold int64
+	// ZstdWindow is one of ZstdWindowSizes; 0 for the default (128MB).
+	ZstdWindow int
+}
+
+// Extension returns the extension of the compressed objects of files of size bytes.
+func (o CompressOptions) Extension(size int64) string {
+	if o.ZstdThreshold > 0 && size >= o.ZstdThreshold {
+		return ZstdExtension
+	}
+
+	return lz4.Extension
+}
+
 // MustRemoveFile tries to delete the file path from the local file system. On error a message is logged.
 func MustRemoveFile(path string, logger *zap.Logger) {
 	logger.Debug("Removing file", zap.String("path", path))
@@ -21,9 +57,19 @@ func MustRemoveFile(path string, logger *zap.Logger) {
 	}
 }
 
-// IsObjectCompressed returns true iff path is of a compressed, i.e., contains a .lz4 extension
+// IsObjectCompressed returns true iff path is of a compressed, i.e., contains a .lz4 (or .zst) extension
 func IsObjectCompressed(path string) bool {
-	return path[len(path)-len(lz4.Extension):] == lz4.Extension
+	return strings.HasSuffix(path, lz4.Extension) || strings.HasSuffix(path, ZstdExtension)
+}
+
+// GzipExtension is the extension of files compressed with gzip by other tools (e.g., WAL archived before
+// switching to pgCarpenter), which Decompress can decompress too. Unlike .lz4 and .zst, it doesn't mark
+// objects as compressed by pgCarpenter (see IsObjectCompressed): plenty of files are named *.gz.
+const GzipExtension = ".gz"
+
+// TrimCompressionExtension returns path without its compression extension (if any).
+func TrimCompressionExtension(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, lz4.Extension), ZstdExtension)
 }
 
 // IsObjectDirectory returns true iff path is of a directory, i.e., contains a .dir extension
@@ -31,64 +77,79 @@ func IsObjectDirectory(path string) bool {
 	return path[len(path)-len(DirectoryExtension):] == DirectoryExtension
 }
 
-// Compress compresses the file inPath using tmpDir fo storing the compressed output file and
-// any intermediate temporary files it might need to create. It returns the full path to the
-// compressed file, or an error.
-func Compress(inPath string, tmpDir string) (string, error) {
-	// create a temporary file with a unique name compress it -- multiple files
-	// are named 000: pg_notify/0000, pg_subtrans/0000
-	outFile, err := ioutil.TempFile(tmpDir, "pgCarpenter.")
-	if err != nil {
-		return "", err
+// FreeSpace returns the number of bytes available to unprivileged users on the file system of path.
+func FreeSpace(path string) (int64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
 	}
 
-	// open input file
-	inFile, err := os.Open(inPath)
-	if err != nil {
-		return "", err
-	}
-	// we open this for read only, and this process exists after a finite (short)
-	// period of time; there's no need to throw an error if closing it fails
-	defer inFile.Close()
-
-	// buffer read from the input file and lz4 writer
-	r := bufio.NewReader(inFile)
-	w := lz4.NewWriter(outFile)
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
 
-	// read 4k at a time
-	buf := make([]byte, 4096)
-	for {
-		n, err := r.Read(buf)
-		if err != nil && err != io.EOF {
-			return "", err
+// CompressStream returns a reader of the LZ4 (or zstd, see CompressOptions.Extension) compressed contents
+// of r, of size bytes. The contents are compressed by a separate goroutine as they're read, without any
+// intermediate files. Errors reading or compressing r are returned by Read. The reader must be closed, even
+// if it's not read until EOF.
+func CompressStream(r io.Reader, size int64, opts CompressOptions) io.ReadCloser {
+	pr, pw := io.Pipe()
+	if opts.Extension(size) == ZstdExtension {
+		go compressStreamZstd(r, opts, pw)
+		return pr
+	}
+	go func() {
+		w := lz4.NewWriter(pw)
+		w.Header = lz4.Header{
+			CompressionLevel: opts.Level,
+			BlockMaxSize:     opts.BlockSize,
+			BlockChecksum:    opts.BlockChecksum,
 		}
-
-		// we're done
-		if n == 0 {
-			break
+		_, err := io.Copy(w, r)
+		// end the frame (with its checksum)
+		if err == nil {
+			err = w.Close()
 		}
+		pw.CloseWithError(err)
+	}()
 
-		// write the 4k chunk
-		if _, err := w.Write(buf[:n]); err != nil {
-			return "", err
-		}
-	}
+	return pr
+}
 
-	// flush any pending compressed data
-	if err = w.Flush(); err != nil {
-		return "", err
-	}
+// PaddedReader returns a reader of the first size bytes of f, read as zeros past the end of the file, so
+// that a file truncated while it's being read (e.g., a relation truncated by vacuum during an online backup)
+// is read with the size it had when we started, like pg_basebackup does; replaying WAL makes up for the
+// difference. Bytes appended meanwhile aren't read either.
+func PaddedReader(f *os.File, size int64) *io.SectionReader {
+	return io.NewSectionReader(zeroPaddedFile{f}, 0, size)
+}
 
-	// make sure we successfully close the compressed file
-	if err := outFile.Close(); err != nil {
-		return "", err
+type zeroPaddedFile struct {
+	*os.File
+}
+
+func (f zeroPaddedFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	if err == io.EOF {
+		for i := n; i < len(b); i++ {
+			b[i] = 0
+		}
+		return len(b), nil
 	}
 
-	return outFile.Name(), nil
+	return n, err
 }
 
-// Decompress decompresses the file inPath to outPath.
+// Decompress decompresses the file inPath to outPath, verifying the checksums of the frame (and its blocks,
+// if any) along the way. On error, outPath is removed rather than left behind with corrupted contents.
+// Frames written by older versions of Compress don't have an end mark, and can't be verified.
 func Decompress(inPath string, outPath string) error {
+	return DecompressPreallocated(inPath, outPath, 0)
+}
+
+// DecompressPreallocated is like Decompress, but it first preallocates size bytes (i.e., the size of the
+// decompressed file, if known) for outPath. The decompressed file is as large as what was decompressed,
+// even if that's less than size (the space reserved past it is released).
+func DecompressPreallocated(inPath string, outPath string, size int64) (err error) {
 	// open the input, compressed file
 	inFile, err := os.Open(inPath)
 	if err != nil {
@@ -103,14 +164,41 @@ func Decompress(inPath string, outPath string) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			outFile.Close()
+			os.Remove(outPath)
+		}
+	}()
+	if err := Preallocate(outFile, size); err != nil {
+		return err
+	}
 
-	// lz4 read buffer
-	r := lz4.NewReader(inFile)
+	// lz4 (or zstd, or gzip) read buffer
+	var r io.Reader = lz4.NewReader(inFile)
+	switch {
+	case strings.HasSuffix(inPath, ZstdExtension):
+		zr, err := newZstdReader(inFile)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(inPath, GzipExtension):
+		// the CRC of the contents is verified once they're read until EOF
+		gr, err := gzip.NewReader(inFile)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
 	// write buffer
 	w := bufio.NewWriter(outFile)
 
 	// 4kb chunks
 	buf := make([]byte, 4096)
+	written := int64(0)
 	for {
 		// read a chunk
 		n, err := r.Read(buf)
@@ -125,11 +213,17 @@ func Decompress(inPath string, outPath string) error {
 		if _, err := w.Write(buf[:n]); err != nil {
 			return err
 		}
+		written += int64(n)
 	}
 
 	// flush and pending data
 	if err = w.Flush(); err != nil {
-		panic(err)
+		return err
+	}
+	if size > written {
+		if err = outFile.Truncate(written); err != nil {
+			return err
+		}
 	}
 
 	// make sure we successfully close the compressed file
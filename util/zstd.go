@@ -0,0 +1,68 @@
+package util
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdExtension marks objects compressed with zstd (see CompressOptions.ZstdThreshold).
+const ZstdExtension = ".zst"
+
+// ZstdWindowSizes maps the names of the supported zstd window sizes to their size in bytes.
+var ZstdWindowSizes = map[string]int{
+	"8MB":   8 << 20,
+	"32MB":  32 << 20,
+	"128MB": 128 << 20,
+	"512MB": 512 << 20,
+}
+
+// files are read in chunks this large to be compressed by the zstd encoder
+const zstdReadSize = 1 << 20
+
+func compressStreamZstd(r io.Reader, opts CompressOptions, pw *io.PipeWriter) {
+	window := opts.ZstdWindow
+	if window == 0 {
+		window = ZstdWindowSizes["128MB"]
+	}
+	// this is not the long-distance matching of the reference implementation (zstd --long), which the
+	// pure Go encoder doesn't have: a larger window only lets it refer back further to long runs repeated
+	// exactly (e.g., 2x on a file made of 48MB of random bytes twice, with a 128MB window, vs. nothing with
+	// 32MB), while short matches far back are still not found (no gain from 8MB to 128MB on 4 copies of
+	// 48MB of text, with 1% of the bytes changed in each, where zstd is 2.69x vs. 1.74x for LZ4, at half
+	// the speed); a single goroutine compresses the whole window, keeping memory at (roughly) the size of
+	// the window per file
+	w, err := zstd.NewWriter(
+		pw,
+		zstd.WithWindowSize(window),
+		zstd.WithEncoderLevel(zstd.SpeedDefault),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(true))
+	if err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+
+	_, err = io.CopyBuffer(w, r, make([]byte, zstdReadSize))
+	// end the frame (with its checksum)
+	if err == nil {
+		err = w.Close()
+	} else {
+		w.Close()
+	}
+	pw.CloseWithError(err)
+}
+
+// the decompressed contents of r, which was compressed with compressStreamZstd; the checksum of the
+// frame is verified once it's read until EOF
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(
+		r,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxWindow(uint64(ZstdWindowSizes["512MB"])))
+	if err != nil {
+		return nil, err
+	}
+
+	return d.IOReadCloser(), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pierrec/lz4"
+	"go.uber.org/zap"
+)
+
+const (
+	// directory (next to the WAL segment being restored, i.e., in pg_wal) where prefetched segments are
+	// kept, compressed, until they're requested
+	prefetchDirectory = ".pgcarpenter-prefetch"
+	// extension of the segments being prefetched; they're renamed once complete
+	prefetchPartExtension = ".part"
+	// a prefetch that's been going on for longer than this is assumed to have been interrupted
+	stalePrefetch = 10 * time.Minute
+	// environment variable to tell the prefetching process the size of the WAL segments
+	segmentSizeEnv = "PGCARPENTER_WAL_SEGMENT_SIZE"
+)
+
+// return the directory where the segments restored to the directory of walFullPath are prefetched to
+func prefetchDir(walFullPath string) string {
+	return filepath.Join(filepath.Dir(walFullPath), prefetchDirectory)
+}
+
+// return the path to the (compressed) segment in the prefetch directory
+func prefetchPath(dir string, segment string) string {
+	return filepath.Join(dir, segment+lz4.Extension)
+}
+
+// return the path to the prefetched segment, or an empty string if it hasn't been prefetched
+func prefetchedSegment(dir string, segment string) string {
+	path := prefetchPath(dir, segment)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// return the names of the n segments following segment (on the same timeline), given the size of the
+// segments (i.e., wal_segment_size)
+func nextSegments(segment string, segmentSize int64, n int) ([]string, error) {
+	m := walSegmentRE.FindStringSubmatch(segment)
+	if m == nil || segmentSize <= 0 {
+		return nil, fmt.Errorf("not a WAL segment: %s", segment)
+	}
+	log, err := strconv.ParseUint(m[2], 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := strconv.ParseUint(m[3], 16, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// there are 4GB / segment size segments per log
+	segmentsPerLog := uint64(1<<32) / uint64(segmentSize)
+	next := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		seg++
+		if seg >= segmentsPerLog {
+			log++
+			seg = 0
+		}
+		next = append(next, fmt.Sprintf("%s%08X%08X", m[1], log, seg))
+	}
+
+	return next, nil
+}
+
+// start prefetching the segments following the one just restored to walFullPath, in the background (the
+// startup process is waiting for restore-wal to exit before it can replay the segment)
+func (a *app) startPrefetch(walFullPath string) {
+	// e.g., history files
+	if !walSegmentRE.MatchString(*a.walFileName) {
+		return
+	}
+	st, err := os.Stat(walFullPath)
+	if err != nil {
+		a.logger.Warn("Failed to get the size of the WAL segment, not prefetching", zap.Error(err))
+		return
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		a.logger.Warn("Failed to find the path to pgCarpenter, not prefetching", zap.Error(err))
+		return
+	}
+
+	cmd := exec.Command(executable, append(os.Args[1:], "--prefetch-only")...)
+	cmd.Env = append(os.Environ(), segmentSizeEnv+"="+strconv.FormatInt(st.Size(), 10))
+	// in a session of its own, so that it's not interrupted along with restore_command
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		a.logger.Warn("Failed to start prefetching WAL segments", zap.Error(err))
+		return
+	}
+	if err := cmd.Process.Release(); err != nil {
+		a.logger.Debug("Failed to release the prefetching process", zap.Error(err))
+	}
+}
+
+// download the --prefetch segments following the one requested to the prefetch directory; exit status of
+// restore-wal --prefetch-only
+func (a *app) prefetchWAL(walFullPath string) int {
+	segmentSize, err := strconv.ParseInt(os.Getenv(segmentSizeEnv), 10, 64)
+	if err != nil {
+		a.logger.Error("Failed to get the size of the WAL segments", zap.Error(err))
+		return exitFailure
+	}
+	segments, err := nextSegments(*a.walFileName, segmentSize, *a.prefetch)
+	if err != nil {
+		a.logger.Debug("Not prefetching", zap.Error(err))
+		return 0
+	}
+	dir := prefetchDir(walFullPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		a.logger.Error("Failed to create the prefetch directory", zap.Error(err))
+		return exitFailure
+	}
+	a.removeStalePrefetches(dir, *a.walFileName)
+
+	wg := &sync.WaitGroup{}
+	for _, segment := range segments {
+		wg.Add(1)
+		go func(segment string) {
+			defer wg.Done()
+			if err := a.prefetchSegment(dir, segment); err != nil {
+				// most likely, the segment hasn't been archived yet
+				a.logger.Debug("Failed to prefetch WAL segment", zap.String("segment", segment), zap.Error(err))
+			}
+		}(segment)
+	}
+	wg.Wait()
+
+	return 0
+}
+
+// download the segment to the prefetch directory, unless it's already there (or on its way)
+func (a *app) prefetchSegment(dir string, segment string) error {
+	path := prefetchPath(dir, segment)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	// the partial file doubles as a lock, so that concurrent prefetches don't download the same segment
+	part, err := os.OpenFile(path+prefetchPartExtension, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = a.storage.Get(a.ctx, a.getWALObjectKey(segment), part)
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(part.Name())
+		return err
+	}
+
+	return os.Rename(part.Name(), path)
+}
+
+// remove the prefetch directory of the segments restored to the directory of walFullPath, along with whatever
+// is in it (including segments being prefetched, which fail to be renamed into place)
+func (a *app) removePrefetches(walFullPath string) {
+	if err := os.RemoveAll(prefetchDir(walFullPath)); err != nil {
+		a.logger.Warn("Failed to remove prefetched WAL segments", zap.Error(err))
+	}
+}
+
+// remove the prefetched segments that come before segment (they won't be requested again, unless recovery
+// is restarted, in which case they're downloaded again), along with interrupted prefetches
+func (a *app) removeStalePrefetches(dir string, segment string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		a.logger.Debug("Failed to list prefetched WAL segments", zap.Error(err))
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		stale := strings.HasSuffix(name, prefetchPartExtension) && time.Now().Sub(e.ModTime()) > stalePrefetch
+		if stale || (!strings.HasSuffix(name, prefetchPartExtension) && name < segment) {
+			a.logger.Debug("Removing prefetched WAL segment", zap.String("name", name))
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNextSegments(t *testing.T) {
+	tests := []struct {
+		segment     string
+		segmentSize int64
+		n           int
+		expected    []string
+		wantErr     bool
+	}{
+		{
+			segment:     "000000010000000000000003",
+			segmentSize: 16 << 20,
+			n:           2,
+			expected:    []string{"000000010000000000000004", "000000010000000000000005"},
+		},
+		{
+			segment:     "000000010000000000000003",
+			segmentSize: 16 << 20,
+			n:           0,
+			expected:    []string{},
+		},
+		// 256 segments of 16MB per log
+		{
+			segment:     "0000000100000000000000FE",
+			segmentSize: 16 << 20,
+			n:           3,
+			expected:    []string{"0000000100000000000000FF", "000000010000000100000000", "000000010000000100000001"},
+		},
+		// the timeline is kept
+		{
+			segment:     "0000000A000000FF000000FF",
+			segmentSize: 16 << 20,
+			n:           1,
+			expected:    []string{"0000000A0000010000000000"},
+		},
+		// 4096 segments of 1MB per log
+		{
+			segment:     "0000000100000000000000FF",
+			segmentSize: 1 << 20,
+			n:           1,
+			expected:    []string{"000000010000000000000100"},
+		},
+		{
+			segment:     "000000010000000000000FFF",
+			segmentSize: 1 << 20,
+			n:           2,
+			expected:    []string{"000000010000000100000000", "000000010000000100000001"},
+		},
+		// 4 segments of 1GB per log
+		{
+			segment:     "000000010000000200000002",
+			segmentSize: 1 << 30,
+			n:           3,
+			expected:    []string{"000000010000000200000003", "000000010000000300000000", "000000010000000300000001"},
+		},
+		{
+			segment:     "000000010000000000000003.partial",
+			segmentSize: 16 << 20,
+			n:           1,
+			wantErr:     true,
+		},
+		{
+			segment:     "00000002.history",
+			segmentSize: 16 << 20,
+			n:           1,
+			wantErr:     true,
+		},
+		{
+			segment:     "000000010000000000000003",
+			segmentSize: 0,
+			n:           1,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		next, err := nextSegments(tt.segment, tt.segmentSize, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("nextSegments(%s, %d, %d): unexpected error: %v", tt.segment, tt.segmentSize, tt.n, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(next, tt.expected) {
+			t.Errorf("nextSegments(%s, %d, %d) = %v, expected %v", tt.segment, tt.segmentSize, tt.n, next, tt.expected)
+		}
+	}
+}
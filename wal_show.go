@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/util"
+	"go.uber.org/zap"
+)
+
+// walRange is a run of consecutive segments, by number (see parseSegmentName), on a timeline
+type walRange struct {
+	first uint64
+	last  uint64
+}
+
+// list the archived WAL by timeline, as ranges of consecutive segments, and the gaps in between; gaps in
+// the WAL needed to restore the oldest successful backup (or any later one) make the exit status 1
+func (a *app) walShow() int {
+	segmentSize := int64(*a.walSegmentSize) << 20
+	timelines, history, err := a.listArchivedWAL(segmentSize)
+	if err != nil {
+		a.logger.Error("Failed to list archived WAL", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+	oldest, err := a.oldestBackupManifest()
+	if err != nil {
+		a.logger.Error("Failed to list backups", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+
+	// segments needed since the oldest backup started
+	var startTimeline, startSegment uint64
+	if oldest != nil {
+		startTimeline, startSegment, err = parseSegmentName(oldest.StartWALFile, segmentSize)
+		if err != nil {
+			a.logger.Error("Failed to parse the first WAL segment of the oldest backup", zap.Error(err))
+			return exitFailure
+		}
+	}
+
+	tlis := make([]uint64, 0, len(timelines)+1)
+	for tli := range timelines {
+		tlis = append(tlis, tli)
+	}
+	// even if none of its segments were archived
+	if _, ok := timelines[startTimeline]; oldest != nil && !ok {
+		tlis = append(tlis, startTimeline)
+	}
+	sort.Slice(tlis, func(i, j int) bool { return tlis[i] < tlis[j] })
+
+	missing := uint64(0)
+	for _, tli := range tlis {
+		ranges := segmentRanges(timelines[tli])
+		fmt.Printf("Timeline %d", tli)
+		if history[tli] {
+			fmt.Print(" (history file archived)")
+		}
+		fmt.Println()
+
+		// the segment the oldest backup starts in must be there too
+		if oldest != nil && tli == startTimeline && (len(ranges) == 0 || ranges[len(ranges)-1].last < startSegment) {
+			// how many of the segments after it are missing too can't be told
+			missing++
+			fmt.Printf(
+				"  missing %s onwards (needed by the oldest backup)\n",
+				segmentName(tli, startSegment, segmentSize))
+		} else if oldest != nil && tli == startTimeline && ranges[0].first > startSegment {
+			n := ranges[0].first - startSegment
+			missing += n
+			fmt.Printf(
+				"  missing %s - %s (%d segments, needed by the oldest backup)\n",
+				segmentName(tli, startSegment, segmentSize),
+				segmentName(tli, ranges[0].first-1, segmentSize),
+				n)
+		}
+		for i, r := range ranges {
+			if i > 0 {
+				gap := walRange{ranges[i-1].last + 1, r.first - 1}
+				n := gap.last - gap.first + 1
+				needed := oldest != nil && tli >= startTimeline && gap.last >= startSegment
+				note := "not needed by any backup"
+				if needed {
+					missing += n
+					note = "needed"
+				}
+				fmt.Printf(
+					"  missing %s - %s (%d segments, %s)\n",
+					segmentName(tli, gap.first, segmentSize),
+					segmentName(tli, gap.last, segmentSize),
+					n,
+					note)
+			}
+			fmt.Printf(
+				"  %s - %s (%d segments)\n",
+				segmentName(tli, r.first, segmentSize),
+				segmentName(tli, r.last, segmentSize),
+				r.last-r.first+1)
+		}
+	}
+
+	if oldest == nil {
+		fmt.Println("No successful backup with a manifest recording its first WAL segment")
+		return 0
+	}
+	fmt.Printf("Oldest backup %s starts in %s\n", oldest.Name, oldest.StartWALFile)
+	if missing > 0 {
+		fmt.Printf("%d segments needed to restore it (or later backups) are missing\n", missing)
+		return exitValidation
+	}
+	fmt.Println("No segments needed to restore it (or later backups) are missing")
+
+	return 0
+}
+
+// return the numbers of the archived segments by timeline, and the timelines with a history file
+func (a *app) listArchivedWAL(segmentSize int64) (map[uint64][]uint64, map[uint64]bool, error) {
+	keysC := make(chan string)
+	timelines := make(map[uint64][]uint64)
+	history := make(map[uint64]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := range keysC {
+			name := strings.TrimSuffix(util.TrimCompressionExtension(filepath.Base(key)), util.GzipExtension)
+			switch walFileKind(name) {
+			case walSegmentFile:
+				tli, segment, err := parseSegmentName(name, segmentSize)
+				if err == nil {
+					timelines[tli] = append(timelines[tli], segment)
+				}
+			case walTimelineHistoryFile:
+				if tli, err := strconv.ParseUint(name[:8], 16, 32); err == nil {
+					history[tli] = true
+				}
+			}
+		}
+	}()
+	err := a.storage.WalkFolder(a.ctx, walFolder+"/", keysC)
+	close(keysC)
+	<-done
+
+	return timelines, history, err
+}
+
+// return the manifest of the oldest successful backup that records its first WAL segment, if any
+func (a *app) oldestBackupManifest() (*backupManifest, error) {
+	manifests, _, err := a.successfulBackupManifests()
+	if err != nil {
+		return nil, err
+	}
+	var oldest *backupManifest
+	for _, m := range manifests {
+		if oldest == nil || m.StartTime.Before(oldest.StartTime) {
+			oldest = m
+		}
+	}
+
+	return oldest, nil
+}
+
+// return the manifests of the successful backups that record their first WAL segment, along with the names
+// of the ones that don't (e.g., taken by older versions of pgCarpenter), i.e., whose WAL can't be told apart
+func (a *app) successfulBackupManifests() ([]*backupManifest, []string, error) {
+	keys, err := a.storage.ListFolder(a.ctx, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests := make([]*backupManifest, 0)
+	unknown := make([]string, 0)
+	for _, k := range keys {
+		name := strings.TrimSuffix(k, "/")
+		if !isBackupFolder(name) {
+			continue
+		}
+		successful, err := a.storage.Exists(a.ctx, a.getSuccessfulMarker(name))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !successful {
+			continue
+		}
+		m, err := a.getManifest(name)
+		if err != nil || m.StartWALFile == "" {
+			unknown = append(unknown, name)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+
+	return manifests, unknown, nil
+}
+
+// return the timeline of the segment, and its number counting from the very first segment (i.e., log *
+// segments per log + segment)
+func parseSegmentName(name string, segmentSize int64) (uint64, uint64, error) {
+	m := walSegmentRE.FindStringSubmatch(name)
+	if m == nil {
+		return 0, 0, fmt.Errorf("not a WAL segment: %s", name)
+	}
+	tli, _ := strconv.ParseUint(m[1], 16, 32)
+	log, _ := strconv.ParseUint(m[2], 16, 32)
+	seg, _ := strconv.ParseUint(m[3], 16, 32)
+
+	return tli, log*segmentsPerLog(segmentSize) + seg, nil
+}
+
+// return the name of the segment, given its timeline and number (as returned by parseSegmentName)
+func segmentName(tli uint64, segment uint64, segmentSize int64) string {
+	perLog := segmentsPerLog(segmentSize)
+
+	return fmt.Sprintf("%08X%08X%08X", tli, segment/perLog, segment%perLog)
+}
+
+// there are 4GB / segment size segments per log
+func segmentsPerLog(segmentSize int64) uint64 {
+	return uint64(1<<32) / uint64(segmentSize)
+}
+
+// return the runs of consecutive segments
+func segmentRanges(segments []uint64) []walRange {
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	ranges := make([]walRange, 0)
+	for _, s := range segments {
+		if n := len(ranges); n > 0 && s <= ranges[n-1].last+1 {
+			if s > ranges[n-1].last {
+				ranges[n-1].last = s
+			}
+			continue
+		}
+		ranges = append(ranges, walRange{s, s})
+	}
+
+	return ranges
+}
+
+func validateWALSegmentSize(args []string) error {
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 1 || size > 1024 || size&(size-1) != 0 {
+		return fmt.Errorf("WAL segment size ('%s') must be a power of 2 between 1 and 1024", args[0])
+	}
+
+	return nil
+}
+
+func parseWALShowArgs(cfg *app, parser *argparse.Command) {
+	cfg.walSegmentSize = parser.Int(
+		"",
+		"segment-size",
+		&argparse.Options{
+			Required: false,
+			Default:  16,
+			Validate: validateWALSegmentSize,
+			Help:     "Size of the WAL segments (wal_segment_size) in MB"})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"go.uber.org/zap"
+)
+
+// extension of the segments being copied to the spool; they're renamed once safely on disk
+const spoolTmpExtension = ".tmp"
+
+// copy the WAL segment to the spool directory, where wal-uploader picks it up from; it's only safe for
+// PostgreSQL to recycle the segment once the copy is on disk, so both the copy and its directory are synced
+func (a *app) spoolSegment(walFullPath string) error {
+	if err := validateWALFile(walFullPath, filepath.Base(walFullPath), *a.checkWALPages); err != nil {
+		return fmt.Errorf("invalid WAL segment: %w", err)
+	}
+	if err := os.MkdirAll(*a.spoolDirectory, 0700); err != nil {
+		return err
+	}
+	dst := filepath.Join(*a.spoolDirectory, filepath.Base(walFullPath))
+	// archive_command may be called again for a segment that was already spooled (e.g., after a crash),
+	// in which case the copy is simply replaced
+	if err := copyFileSync(walFullPath, dst+spoolTmpExtension); err != nil {
+		return err
+	}
+	if err := os.Rename(dst+spoolTmpExtension, dst); err != nil {
+		return err
+	}
+
+	return syncDirectory(*a.spoolDirectory)
+}
+
+// copy src to dst, syncing dst before returning
+func copyFileSync(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	// read only; there's no need to throw an error if closing it fails
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// sync the directory, so that files created in (or renamed into) it survive a crash
+func syncDirectory(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
+
+// drain the spool directory to remote storage, forever; segments are only removed from the spool once
+// they're archived, and the ones that fail to upload are tried again on the next pass
+func (a *app) walUploader() int {
+	a.logger.Info("Uploading spooled WAL segments", zap.String("spool", *a.spoolDirectory))
+	interval := time.Duration(*a.spoolPollInterval) * time.Second
+	for {
+		if err := a.drainSpool(); err != nil {
+			a.logger.Error("Failed to archive spooled WAL segment, trying again later", zap.Error(err))
+		}
+		// segments still in the spool are archived once it's started again
+		if !a.sleep(interval) {
+			a.logger.Info("Stopped uploading spooled WAL segments")
+			return 0
+		}
+	}
+}
+
+// archive every segment in the spool directory, oldest first, and stop at the first one that fails so that
+// segments are archived in order
+func (a *app) drainSpool() error {
+	entries, err := ioutil.ReadDir(*a.spoolDirectory)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// still being copied by archive-wal
+		if e.IsDir() || strings.HasSuffix(e.Name(), spoolTmpExtension) {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(*a.spoolDirectory, name)
+		begin := time.Now()
+		if err := a.archiveSegment(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		a.logger.Debug(
+			"Archived spooled WAL segment",
+			zap.String("WAL", name),
+			zap.Duration("duration", time.Now().Sub(begin)))
+	}
+
+	return nil
+}
+
+func parseWALUploaderArgs(cfg *app, parser *argparse.Command) {
+	cfg.spoolPollInterval = parser.Int(
+		"",
+		"poll-interval",
+		&argparse.Options{
+			Required: false,
+			Default:  1,
+			Help:     "Look for new WAL segments in the spool directory every this many seconds"})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/thumbtack/pgCarpenter/notify"
+	"go.uber.org/zap"
+)
+
+// pointer to the last segment archived, updated by archive-wal, so that finding out when we last archived
+// doesn't take listing the whole WAL folder
+var walLatestKey = filepath.Join(walFolder, latestKey)
+
+// names of WAL segments (as opposed to, e.g., history and backup history files, or partial segments):
+// timeline, log, and segment, in hex
+var walSegmentRE = regexp.MustCompile(`^([0-9A-F]{8})([0-9A-F]{8})([0-9A-F]{8})$`)
+
+// lastArchived is stored as JSON in walLatestKey
+type lastArchived struct {
+	Segment string `json:"segment"`
+	// the LSN up to which WAL has been archived, i.e., the end of the segment
+	LSN  string    `json:"lsn"`
+	Host string    `json:"host"`
+	Time time.Time `json:"time"`
+}
+
+// show the last WAL segment archived, and how long ago
+func (a *app) walStatus() int {
+	last, err := a.getLastArchived()
+	if err != nil {
+		a.logger.Error("Failed to get the last archived WAL segment", zap.Error(err))
+		return exitCode(err, exitStorage)
+	}
+
+	fmt.Printf("Last archived segment: %s\n", last.Segment)
+	fmt.Printf("Archived up to LSN:    %s\n", last.LSN)
+	fmt.Printf("Archived by:           %s\n", last.Host)
+	fmt.Printf(
+		"Archived at:           %s (%s ago)\n",
+		last.Time.Format(time.RFC3339),
+		time.Now().Sub(last.Time).Round(time.Second))
+
+	return 0
+}
+
+func (a *app) getLastArchived() (lastArchived, error) {
+	last := lastArchived{}
+	contents, err := a.storage.GetString(a.ctx, walLatestKey)
+	if err != nil {
+		return last, err
+	}
+	err = json.Unmarshal([]byte(contents), &last)
+
+	return last, err
+}
+
+// update the pointer to the last archived segment, unless segment (e.g., archived again, or by another
+// archiver running concurrently) is older than the one it points to already
+func (a *app) recordLastArchived(walFullPath string) error {
+	segment := filepath.Base(walFullPath)
+	// only full segments tell how far we've archived
+	if walFileKind(segment) != walSegmentFile {
+		return nil
+	}
+	if previous, err := a.getLastArchived(); err == nil && previous.Segment >= segment {
+		return nil
+	}
+
+	st, err := os.Stat(walFullPath)
+	if err != nil {
+		return err
+	}
+	lsn, err := segmentEndLSN(segment, st.Size())
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(lastArchived{
+		Segment: segment,
+		LSN:     lsn,
+		Host:    notify.Hostname(),
+		Time:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return a.storage.PutString(a.ctx, walLatestKey, string(contents))
+}
+
+// return the LSN (formatted like PostgreSQL does, e.g., 16/B374D848) at the end of the segment, given its
+// name and size (i.e., wal_segment_size)
+func segmentEndLSN(segment string, segmentSize int64) (string, error) {
+	m := walSegmentRE.FindStringSubmatch(segment)
+	if m == nil || segmentSize <= 0 {
+		return "", fmt.Errorf("not a WAL segment: %s", segment)
+	}
+	log, err := strconv.ParseUint(m[2], 16, 32)
+	if err != nil {
+		return "", err
+	}
+	seg, err := strconv.ParseUint(m[3], 16, 32)
+	if err != nil {
+		return "", err
+	}
+
+	// the log number is the high 32 bits of the LSN, and there are 4GB / segment size segments per log
+	lsn := log<<32 + (seg+1)*uint64(segmentSize)
+
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn)), nil
+}
+
+// return the LSN formatted like PostgreSQL does (e.g., 16/B374D848) as a number
+func parseLSN(lsn string) (uint64, error) {
+	parts := strings.SplitN(lsn, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("not an LSN: %s", lsn)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return hi<<32 | lo, nil
+}
+
+// return the name of the last segment needed to reach the stop LSN of a backup, on the timeline of the
+// segment it started in; if the stop LSN is right at the beginning of a segment, that's the previous one
+func stopWALFile(startWALFile string, stopLSN string, segmentSize int64) (string, error) {
+	m := walSegmentRE.FindStringSubmatch(startWALFile)
+	if m == nil || segmentSize <= 0 {
+		return "", fmt.Errorf("not a WAL segment: %s", startWALFile)
+	}
+	lsn, err := parseLSN(stopLSN)
+	if err != nil || lsn == 0 {
+		return "", fmt.Errorf("not an LSN: %s", stopLSN)
+	}
+
+	// the log number is the high 32 bits of the LSN, and there are 4GB / segment size segments per log
+	segment := (lsn - 1) / uint64(segmentSize)
+	segmentsPerLog := uint64(1<<32) / uint64(segmentSize)
+
+	return fmt.Sprintf("%s%08X%08X", m[1], segment/segmentsPerLog, segment%segmentsPerLog), nil
+}
+
+func parseWALStatusArgs(cfg *app, parser *argparse.Command) {
+	// there are no options as of now, we just keep this around for consistency
+}
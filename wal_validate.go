@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	// size of WAL pages (XLOG_BLCKSZ), which PostgreSQL only allows changing at compile time
+	walPageSize = 8192
+	// valid sizes of WAL segments (wal_segment_size) are powers of 2 in between
+	minWALSegmentSize = 1 << 20
+	maxWALSegmentSize = 1 << 30
+	// xlp_info bits: XLP_FIRST_IS_CONTRECORD, XLP_LONG_HEADER, and XLP_BKP_REMOVABLE
+	walPageLongHeader = 0x0002
+	walPageAllFlags   = 0x0007
+)
+
+// walPageHeader is the beginning of XLogPageHeaderData (all pages) and XLogLongPageHeaderData (the first
+// page of each segment)
+type walPageHeader struct {
+	magic    uint16
+	info     uint16
+	pageAddr uint64
+	// only in long headers
+	segmentSize uint32
+	blockSize   uint32
+}
+
+func parseWALPageHeader(page []byte) walPageHeader {
+	h := walPageHeader{
+		magic:    binary.LittleEndian.Uint16(page[0:2]),
+		info:     binary.LittleEndian.Uint16(page[2:4]),
+		pageAddr: binary.LittleEndian.Uint64(page[8:16]),
+	}
+	if h.info&walPageLongHeader != 0 {
+		h.segmentSize = binary.LittleEndian.Uint32(page[32:36])
+		h.blockSize = binary.LittleEndian.Uint32(page[36:40])
+	}
+
+	return h
+}
+
+// return an error if the file PostgreSQL asked us to archive doesn't look right: its name is not one
+// PostgreSQL gives the files it archives, or it's a segment of a size PostgreSQL doesn't allow (e.g.,
+// truncated); with checkPages, the page headers of segments are checked too
+func validateWALFile(path string, name string, checkPages bool) error {
+	kind := walFileKind(name)
+	if kind == walUnknownFile {
+		return fmt.Errorf("not a WAL segment, nor a history file: %s", name)
+	}
+	if kind != walSegmentFile && kind != walPartialSegmentFile {
+		return nil
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	if size < minWALSegmentSize || size > maxWALSegmentSize || size&(size-1) != 0 {
+		return fmt.Errorf("WAL segment of unexpected size (%d bytes, truncated?): %s", size, name)
+	}
+	if !checkPages {
+		return nil
+	}
+
+	return checkWALPages(path, name[:24], size)
+}
+
+// check the header of each page of the segment: the first one must be a long header describing the
+// segment, and each page after it must be at the right address, up to the end of the WAL written to it;
+// the rest of a segment switched early (e.g., pg_switch_wal()) is either zeroed or left over from the
+// (older) segment it was recycled from
+func checkWALPages(path string, segment string, segmentSize int64) error {
+	start, err := segmentStartLSN(segment, segmentSize)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// read only; there's no need to throw an error if closing it fails
+	defer f.Close()
+
+	page := make([]byte, walPageSize)
+	if _, err := io.ReadFull(f, page); err != nil {
+		return err
+	}
+	first := parseWALPageHeader(page)
+	switch {
+	case first.info&walPageLongHeader == 0:
+		return fmt.Errorf("first page of WAL segment %s has no long header", segment)
+	case first.info&^walPageAllFlags != 0:
+		return fmt.Errorf("first page of WAL segment %s has invalid flags %04X", segment, first.info)
+	case first.pageAddr != start:
+		return fmt.Errorf("first page of WAL segment %s is at address %X, expected %X", segment, first.pageAddr, start)
+	case int64(first.segmentSize) != segmentSize:
+		return fmt.Errorf("WAL segment %s is %d bytes, its header says %d", segment, segmentSize, first.segmentSize)
+	case first.blockSize != walPageSize:
+		return fmt.Errorf("WAL segment %s has pages of %d bytes, expected %d", segment, first.blockSize, walPageSize)
+	}
+
+	for offset := int64(walPageSize); offset < segmentSize; offset += walPageSize {
+		if _, err := io.ReadFull(f, page); err != nil {
+			return err
+		}
+		h := parseWALPageHeader(page)
+		expected := start + uint64(offset)
+		// the end of the WAL written to the segment
+		if h.pageAddr < expected {
+			return nil
+		}
+		if h.pageAddr > expected {
+			return fmt.Errorf("page %d of WAL segment %s is at address %X, expected %X", offset/walPageSize, segment,
+				h.pageAddr, expected)
+		}
+		if h.magic != first.magic || h.info&^walPageAllFlags != 0 || h.info&walPageLongHeader != 0 {
+			return fmt.Errorf("page %d of WAL segment %s has an invalid header", offset/walPageSize, segment)
+		}
+	}
+
+	return nil
+}
+
+// return the LSN at the beginning of the segment, given its name and size
+func segmentStartLSN(segment string, segmentSize int64) (uint64, error) {
+	m := walSegmentRE.FindStringSubmatch(segment)
+	if m == nil {
+		return 0, errors.New("not a WAL segment: " + segment)
+	}
+	log, err := strconv.ParseUint(m[2], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	seg, err := strconv.ParseUint(m[3], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return log<<32 + seg*uint64(segmentSize), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testWALMagic = 0xD10D
+
+// return the contents of a segment of the given size starting at start, with the first written pages
+// having valid headers and the rest zeroed
+func testWALSegment(start uint64, segmentSize int64, written int64) []byte {
+	contents := make([]byte, segmentSize)
+	for offset := int64(0); offset < written; offset += walPageSize {
+		page := contents[offset : offset+walPageSize]
+		binary.LittleEndian.PutUint16(page[0:2], testWALMagic)
+		binary.LittleEndian.PutUint64(page[8:16], start+uint64(offset))
+		if offset == 0 {
+			binary.LittleEndian.PutUint16(page[2:4], walPageLongHeader)
+			binary.LittleEndian.PutUint32(page[32:36], uint32(segmentSize))
+			binary.LittleEndian.PutUint32(page[36:40], walPageSize)
+		}
+	}
+
+	return contents
+}
+
+func writeTestFile(t *testing.T, name string, contents []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestSegmentStartLSN(t *testing.T) {
+	tests := []struct {
+		segment     string
+		segmentSize int64
+		expected    uint64
+		wantErr     bool
+	}{
+		{"000000010000000000000000", 16 << 20, 0, false},
+		{"000000010000000000000003", 16 << 20, 0x3000000, false},
+		// the last segment of a log, and the first one of the next
+		{"0000000100000000000000FF", 16 << 20, 0xFF000000, false},
+		{"000000010000000100000000", 16 << 20, 0x100000000, false},
+		// the timeline doesn't matter
+		{"0000000A00000002000000FE", 16 << 20, 0x2FE000000, false},
+		{"000000010000000000000003", 1 << 20, 0x300000, false},
+		{"000000010000000000000FFF", 1 << 20, 0xFFF00000, false},
+		{"000000010000000500000003", 1 << 30, 0x5C0000000, false},
+		{"000000010000000000000003.partial", 16 << 20, 0, true},
+		{"00000002.history", 16 << 20, 0, true},
+		{"00000001000000000000000g", 16 << 20, 0, true},
+	}
+	for _, tt := range tests {
+		lsn, err := segmentStartLSN(tt.segment, tt.segmentSize)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("segmentStartLSN(%s, %d): unexpected error: %v", tt.segment, tt.segmentSize, err)
+			continue
+		}
+		if lsn != tt.expected {
+			t.Errorf("segmentStartLSN(%s, %d) = %X, expected %X", tt.segment, tt.segmentSize, lsn, tt.expected)
+		}
+	}
+}
+
+func TestCheckWALPages(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name        string
+		segment     string
+		segmentSize int64
+		contents    func() []byte
+		wantErr     bool
+	}{
+		{
+			name:        "complete segment",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(3*mb, mb, mb) },
+		},
+		{
+			name:        "segment switched early",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(3*mb, mb, 10*walPageSize) },
+		},
+		{
+			name:        "segment recycled from an older one",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents: func() []byte {
+				contents := testWALSegment(3*mb, mb, 10*walPageSize)
+				old := testWALSegment(1*mb, mb, mb)
+				copy(contents[10*walPageSize:], old[10*walPageSize:])
+				return contents
+			},
+		},
+		{
+			name:        "first segment of a log",
+			segment:     "000000010000000100000000",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(1<<32, mb, mb) },
+		},
+		{
+			name:        "last segment of a log",
+			segment:     "000000010000000000000FFF",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(0xFFF*mb, mb, mb) },
+		},
+		{
+			name:        "segment of another address",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(4*mb, mb, mb) },
+			wantErr:     true,
+		},
+		{
+			name:        "segment of another log",
+			segment:     "000000010000000100000003",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(3*mb, mb, mb) },
+			wantErr:     true,
+		},
+		{
+			name:        "segment of another size",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents: func() []byte {
+				contents := testWALSegment(3*mb, mb, mb)
+				binary.LittleEndian.PutUint32(contents[32:36], 16*mb)
+				return contents
+			},
+			wantErr: true,
+		},
+		{
+			name:        "no long header",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents: func() []byte {
+				contents := testWALSegment(3*mb, mb, mb)
+				binary.LittleEndian.PutUint16(contents[2:4], 0)
+				return contents
+			},
+			wantErr: true,
+		},
+		{
+			name:        "invalid flags",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents: func() []byte {
+				contents := testWALSegment(3*mb, mb, mb)
+				binary.LittleEndian.PutUint16(contents[2:4], walPageLongHeader|0x0100)
+				return contents
+			},
+			wantErr: true,
+		},
+		{
+			name:        "page ahead of its address",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents: func() []byte {
+				contents := testWALSegment(3*mb, mb, mb)
+				binary.LittleEndian.PutUint64(contents[5*walPageSize+8:], 3*mb+6*walPageSize)
+				return contents
+			},
+			wantErr: true,
+		},
+		{
+			name:        "page of another magic",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents: func() []byte {
+				contents := testWALSegment(3*mb, mb, mb)
+				binary.LittleEndian.PutUint16(contents[5*walPageSize:], testWALMagic+1)
+				return contents
+			},
+			wantErr: true,
+		},
+		{
+			name:        "truncated segment",
+			segment:     "000000010000000000000003",
+			segmentSize: mb,
+			contents:    func() []byte { return testWALSegment(3*mb, mb, mb)[:mb/2] },
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		path := writeTestFile(t, tt.segment, tt.contents())
+		err := checkWALPages(path, tt.segment, tt.segmentSize)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkWALPages(%s, %d): unexpected error: %v", tt.name, tt.segment, tt.segmentSize, err)
+		}
+	}
+}
+
+func TestValidateWALFile(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name     string
+		contents []byte
+		wantErr  bool
+	}{
+		{"000000010000000000000003", testWALSegment(3*mb, mb, mb), false},
+		{"000000010000000000000003.partial", testWALSegment(3*mb, mb, 10*walPageSize), false},
+		{"000000010000000000000003.00000028.backup", []byte("START WAL LOCATION: 0/3000028\n"), false},
+		{"00000002.history", []byte("1\t0/3000000\tno recovery target specified\n"), false},
+		// truncated, or not a power of 2
+		{"000000010000000000000003", testWALSegment(3*mb, mb, mb)[:mb/2], true},
+		{"000000010000000000000003.partial", testWALSegment(3*mb, mb, mb)[:mb-1], true},
+		{"000000010000000000000003", append(testWALSegment(3*mb, mb, mb), make([]byte, walPageSize)...), true},
+		// written at the wrong address
+		{"000000010000000000000004", testWALSegment(3*mb, mb, mb), true},
+		{"000000010000000000000004.partial", testWALSegment(3*mb, mb, mb), true},
+		{"000000010000000000000003.tmp", testWALSegment(3*mb, mb, mb), true},
+		{"RECOVERYHISTORY", []byte{}, true},
+	}
+	for _, tt := range tests {
+		path := writeTestFile(t, tt.name, tt.contents)
+		err := validateWALFile(path, tt.name, true)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateWALFile(%s): unexpected error: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package walker
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WalkFunc is called for each file (or directory) found, with its path relative to the root of the
+// walk. Returning filepath.SkipDir for a directory skips its contents, any other error stops the walk.
+type WalkFunc func(path string, info os.FileInfo) error
+
+// ErrorFunc is called with the path (relative to the root of the walk) of each file (or directory) that
+// can't be read, e.g., for lack of permissions. Returning nil skips it (along with its contents, for a
+// directory), any other error stops the walk.
+type ErrorFunc func(path string, err error) error
+
+// Walker enumerates the files to back up.
+type Walker interface {
+	// Walk calls fn for each file, stopping at the first error.
+	Walk(fn WalkFunc) error
+}
+
+type directoryWalker struct {
+	root    string
+	onError ErrorFunc
+}
+
+// NewDirectory returns a Walker that traverses the directory root (which must end with a trailing
+// slash if it's a symlink). Files that vanish during the traversal are skipped; for any other error,
+// onError (if not nil) decides whether to stop the walk.
+func NewDirectory(root string, onError ErrorFunc) Walker {
+	return &directoryWalker{root: root, onError: onError}
+}
+
+func (w *directoryWalker) Walk(fn WalkFunc) error {
+	return filepath.Walk(
+		w.root,
+		func(path string, info os.FileInfo, err error) error {
+			// the root itself is ""
+			relative, relErr := filepath.Rel(w.root, path)
+			if relErr != nil {
+				return relErr
+			}
+			if relative == "." {
+				relative = ""
+			}
+			if err != nil {
+				// files might change during the traversal; it's normal during an online backup
+				if os.IsNotExist(err) {
+					return nil
+				}
+				// anything other than the file not existing, on the other hand, is a problem
+				if w.onError == nil {
+					return err
+				}
+				// the directory itself is fine, even if its contents can't be listed
+				if info != nil && info.IsDir() {
+					if err := fn(relative, info); err != nil {
+						return err
+					}
+				}
+				return w.onError(relative, err)
+			}
+
+			return fn(relative, info)
+		},
+	)
+}
+
+type fileListWalker struct {
+	root    string
+	list    io.Reader
+	onError ErrorFunc
+}
+
+// NewFileList returns a Walker that reads the paths (relative to root) of the files to walk from list,
+// one per line, e.g., as generated by find(1) on a snapshot. Files that don't exist are skipped; for any
+// other error, onError (if not nil) decides whether to stop the walk.
+func NewFileList(root string, list io.Reader, onError ErrorFunc) Walker {
+	return &fileListWalker{root: root, list: list, onError: onError}
+}
+
+func (w *fileListWalker) Walk(fn WalkFunc) error {
+	scanner := bufio.NewScanner(w.list)
+	for scanner.Scan() {
+		path := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "./")
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(w.root, path))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			if w.onError == nil {
+				return err
+			}
+			if err := w.onError(path, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// there's no traversal to skip, directories are only listed if they were explicitly included
+		if err := fn(path, info); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+type prefixWalker struct {
+	prefix string
+	w      Walker
+}
+
+// NewPrefix returns a Walker that walks w, prepending prefix to the paths it reports; e.g., to report
+// the contents of a tablespace as if they were inside the data directory.
+func NewPrefix(prefix string, w Walker) Walker {
+	return &prefixWalker{prefix: prefix, w: w}
+}
+
+func (w *prefixWalker) Walk(fn WalkFunc) error {
+	return w.w.Walk(func(path string, info os.FileInfo) error {
+		return fn(filepath.Join(w.prefix, path), info)
+	})
+}
+
+type multiWalker []Walker
+
+// NewMulti returns a Walker that walks each of walkers, in order.
+func NewMulti(walkers ...Walker) Walker {
+	return multiWalker(walkers)
+}
+
+func (ws multiWalker) Walk(fn WalkFunc) error {
+	for _, w := range ws {
+		if err := w.Walk(fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
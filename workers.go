@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// value of --workers and --compression-workers that sizes the pool according to the host
+const workersAuto = "auto"
+
+// with --workers auto, the pool is sized for network (rather than CPU) bound work, within these bounds,
+// and S3 requests are ramped up from slowStartPerCPU per CPU as long as S3 keeps up
+const (
+	minAutoWorkers  = 8
+	maxAutoWorkers  = 64
+	workersPerCPU   = 4
+	slowStartPerCPU = 2
+)
+
+func validateWorkers(args []string) error {
+	if args[0] == workersAuto {
+		return nil
+	}
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 1 {
+		return fmt.Errorf("number of workers ('%s') must be a positive integer or %s", args[0], workersAuto)
+	}
+
+	return nil
+}
+
+// set the number of workers (i.e., concurrent uploads and downloads) and the number of files compressed or
+// decompressed concurrently according to --workers and --compression-workers. Workers mostly wait on the
+// network, so with auto there are many more of them than CPUs, and the actual number of concurrent requests
+// is left to --slow-start (unless set explicitly) to adapt to the throughput S3 gives us; compression, on
+// the other hand, is CPU bound and is capped by the number of CPUs
+func (a *app) sizeWorkers() {
+	cpus := runtime.NumCPU()
+
+	workers := cpus * workersPerCPU
+	if workers < minAutoWorkers {
+		workers = minAutoWorkers
+	}
+	if workers > maxAutoWorkers {
+		workers = maxAutoWorkers
+	}
+	if *a.workers == workersAuto {
+		if *a.slowStart == 0 {
+			*a.slowStart = cpus * slowStartPerCPU
+		}
+	} else {
+		// validated when parsing the arguments
+		workers, _ = strconv.Atoi(*a.workers)
+	}
+	a.nWorkers = &workers
+
+	compressionWorkers := cpus
+	if *a.compressionWorkers != workersAuto {
+		compressionWorkers, _ = strconv.Atoi(*a.compressionWorkers)
+	}
+	a.compressionSlots = make(chan struct{}, compressionWorkers)
+
+	a.logger.Debug(
+		"Sized worker pools",
+		zap.Int("workers", workers),
+		zap.Int("compression_workers", compressionWorkers),
+		zap.Int("slow_start", *a.slowStart))
+}
+
+// block until another file can be compressed or decompressed; the returned function must be called when done
+func (a *app) acquireCompression() (release func()) {
+	a.compressionSlots <- struct{}{}
+
+	return func() { <-a.compressionSlots }
+}